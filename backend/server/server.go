@@ -188,6 +188,15 @@ func apiQueryHandler(w http.ResponseWriter, r *http.Request) {
 	userId := getRequiredQueryParam(r, "user_id")
 	deviceId := getRequiredQueryParam(r, "device_id")
 	updateUsageData(r, userId, deviceId, 0, true)
+
+	// Reject queries from devices that aren't registered, so that the client can tell the user to re-register
+	var devices []*shared.Device
+	checkGormResult(GLOBAL_DB.Where("user_id = ? AND device_id = ?", userId, deviceId).Find(&devices))
+	if len(devices) == 0 {
+		http.Error(w, "device is not registered", http.StatusUnauthorized)
+		return
+	}
+
 	// Increment the count
 	checkGormResult(GLOBAL_DB.Exec("UPDATE enc_history_entries SET read_count = read_count + 1 WHERE device_id = ?", deviceId))
 
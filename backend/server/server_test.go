@@ -487,3 +487,30 @@ func TestDeletionRequests(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestQueryFromUnregisteredDevice(t *testing.T) {
+	// Set up
+	InitDB()
+
+	// Register a device
+	userId := data.UserId("key")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	deviceReq := httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil)
+	apiRegisterHandler(nil, deviceReq)
+
+	// Querying from the registered device succeeds
+	w := httptest.NewRecorder()
+	searchReq := httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil)
+	apiQueryHandler(w, searchReq)
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("expected query from a registered device to succeed, status_code=%d", w.Result().StatusCode)
+	}
+
+	// But querying from an unregistered device is rejected
+	w = httptest.NewRecorder()
+	searchReq = httptest.NewRequest(http.MethodGet, "/?device_id="+uuid.Must(uuid.NewRandom()).String()+"&user_id="+userId, nil)
+	apiQueryHandler(w, searchReq)
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected query from an unregistered device to be rejected, status_code=%d", w.Result().StatusCode)
+	}
+}
@@ -395,7 +395,7 @@ echo thisisrecorded`)
 	tableDividerMatcher := `\s+`
 	pathMatcher := `~?/[a-zA-Z_0-9/-]+`
 	datetimeMatcher := `[a-zA-Z]{3}\s\d{1,2}\s\d{4}\s[0-9:]+\s([A-Z]{3}|[+-]\d{4})`
-	runtimeMatcher := `[0-9.ms]+`
+	runtimeMatcher := `<?[0-9.hms]+`
 	exitCodeMatcher := `0`
 	pipefailMatcher := `set -em?o pipefail`
 	line1Matcher := `Hostname` + tableDividerMatcher + `CWD` + tableDividerMatcher + `Timestamp` + tableDividerMatcher + `Runtime` + tableDividerMatcher + `Exit Code` + tableDividerMatcher + `Command\s*\n`
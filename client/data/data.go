@@ -23,6 +23,8 @@ const (
 	CONFIG_PATH      = ".hishtory.config"
 	HISHTORY_PATH    = ".hishtory"
 	DB_PATH          = ".hishtory.db"
+	// Where entries that failed to upload are queued when there is no local DB to retry them from (see RemoteOnly)
+	PENDING_UPLOADS_PATH = "pending_uploads.jsonl"
 )
 
 type HistoryEntry struct {
@@ -36,6 +38,11 @@ type HistoryEntry struct {
 	EndTime                 time.Time     `json:"end_time" gorm:"uniqueIndex:compositeindex"`
 	DeviceId                string        `json:"device_id" gorm:"uniqueIndex:compositeindex"`
 	CustomColumns           CustomColumns `json:"custom_columns"`
+	TerminalPane            string        `json:"terminal_pane"`
+	IsSensitive             bool          `json:"is_sensitive"`
+	NormalizedPaths         string        `json:"normalized_paths"`
+	ExpandedCommand         string        `json:"expanded_command"`
+	SessionId               string        `json:"session_id"`
 }
 
 type CustomColumns []CustomColumn
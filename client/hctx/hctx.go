@@ -2,12 +2,14 @@ package hctx
 
 import (
 	"context"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 	"sync"
 	"time"
 
@@ -18,9 +20,42 @@ import (
 	"gorm.io/gorm/logger"
 
 	// Needed to use sqlite without CGO
+	sqlitedriver "github.com/glebarez/go-sqlite"
 	"github.com/glebarez/sqlite"
 )
 
+// Compiled regexes for the REGEXP operator, by pattern
+var compiledRegexes sync.Map
+
+func init() {
+	// Implements the REGEXP operator (used by the re: search atom) since sqlite doesn't include one by default.
+	// `X REGEXP Y` calls regexp(Y, X).
+	sqlitedriver.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlitedriver.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("regexp pattern must be a string, got %T", args[0])
+		}
+		var s string
+		switch v := args[1].(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		default:
+			return false, nil
+		}
+		re, ok := compiledRegexes.Load(pattern)
+		if !ok {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %#v: %v", pattern, err)
+			}
+			re, _ = compiledRegexes.LoadOrStore(pattern, compiled)
+		}
+		return re.(*regexp.Regexp).MatchString(s), nil
+	})
+}
+
 var (
 	hishtoryLogger *logrus.Logger
 	getLoggerOnce  sync.Once
@@ -77,6 +112,27 @@ func OpenLocalSqliteDb() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	dbFilePath := path.Join(homedir, data.HISHTORY_PATH, data.DB_PATH)
+	dsn := fmt.Sprintf("file:%s?cache=shared&mode=rwc&_journal_mode=WAL", dbFilePath)
+	db, err := openSqliteDb(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.Exec("PRAGMA journal_mode = WAL")
+	return db, nil
+}
+
+// Opens a DB that is only stored in memory, so that no history is persisted on disk. Used for the remote-only mode.
+func OpenInMemorySqliteDb() (*gorm.DB, error) {
+	return openSqliteDb("file:hishtory?mode=memory&cache=shared")
+}
+
+// The version of the local DB's schema. This must be incremented whenever the schema changes in a way that older
+// versions of hishtory can't safely handle (e.g. adding a column to HistoryEntry), so that older binaries refuse
+// to use a DB that was written by a newer binary.
+const SCHEMA_VERSION = 6
+
+func openSqliteDb(dsn string) (*gorm.DB, error) {
 	newLogger := logger.New(
 		GetLogger(),
 		logger.Config{
@@ -86,8 +142,6 @@ func OpenLocalSqliteDb() (*gorm.DB, error) {
 			Colorful:                  false,
 		},
 	)
-	dbFilePath := path.Join(homedir, data.HISHTORY_PATH, data.DB_PATH)
-	dsn := fmt.Sprintf("file:%s?cache=shared&mode=rwc&_journal_mode=WAL", dbFilePath)
 	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{SkipDefaultTransaction: true, Logger: newLogger})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to the DB: %v", err)
@@ -100,8 +154,21 @@ func OpenLocalSqliteDb() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	var dbSchemaVersion int
+	err = db.Raw("PRAGMA user_version").Scan(&dbSchemaVersion).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the DB's schema version: %v", err)
+	}
+	if dbSchemaVersion > SCHEMA_VERSION {
+		return nil, fmt.Errorf("the local DB was written by a newer version of hishtory (DB schema version %d, but this binary only supports up to version %d), please run `hishtory update`", dbSchemaVersion, SCHEMA_VERSION)
+	}
 	db.AutoMigrate(&data.HistoryEntry{})
-	db.Exec("PRAGMA journal_mode = WAL")
+	if dbSchemaVersion < SCHEMA_VERSION {
+		err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SCHEMA_VERSION)).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to set the DB's schema version: %v", err)
+		}
+	}
 	return db, nil
 }
 
@@ -114,7 +181,12 @@ func MakeContext() *context.Context {
 		panic(fmt.Errorf("failed to retrieve config: %v", err))
 	}
 	ctx = context.WithValue(ctx, hishtoryContextKey("config"), config)
-	db, err := OpenLocalSqliteDb()
+	var db *gorm.DB
+	if config.RemoteOnly {
+		db, err = OpenInMemorySqliteDb()
+	} else {
+		db, err = OpenLocalSqliteDb()
+	}
 	if err != nil {
 		panic(fmt.Errorf("failed to open local DB: %v", err))
 	}
@@ -127,6 +199,12 @@ func MakeContext() *context.Context {
 	return &ctx
 }
 
+// Returns a copy of the given context that uses the given config. Note that this does not persist the config to disk.
+func WithConfig(ctx *context.Context, config ClientConfig) *context.Context {
+	newCtx := context.WithValue(*ctx, hishtoryContextKey("config"), config)
+	return &newCtx
+}
+
 func GetConf(ctx *context.Context) ClientConfig {
 	v := (*ctx).Value(hishtoryContextKey("config"))
 	if v != nil {
@@ -173,10 +251,121 @@ type ClientConfig struct {
 	CustomColumns []CustomColumnDefinition `json:"custom_columns"`
 	// Whether this is an offline instance of hishtory with no syncing
 	IsOffline bool `json:"is_offline"`
+	// Whether this device has ever successfully retrieved entries from the backend, so that a device that is
+	// temporarily offline can be distinguished from one that has never been able to sync
+	HaveSyncedWithBackend bool `json:"have_synced_with_backend"`
 	// Whether duplicate commands should be displayed
 	FilterDuplicateCommands bool `json:"filter_duplicate_commands"`
+	// How duplicate commands are detected when FilterDuplicateCommands is enabled (either exact or normalized)
+	DedupMode string `json:"dedup_mode"`
+	// Whether duplicate filtering also filters out non-consecutive duplicates, so only the most recent occurrence of each command is shown
+	FilterAllDuplicateCommands bool `json:"filter_all_duplicate_commands"`
 	// A format string for the timestamp
 	TimestampFormat string `json:"timestamp_format"`
+	// The timezone (e.g. UTC or an IANA name like America/New_York) that timestamps are displayed in. Empty means the
+	// local timezone.
+	DisplayTimezone string `json:"display_timezone"`
+	// Commands run by these programs (e.g. wrappers like direnv) are never recorded
+	NeverRecordPrograms []string `json:"never_record_programs"`
+	// Commands run by these programs are recorded, but hidden from results unless explicitly searched for via the program: atom
+	HiddenPrograms []string `json:"hidden_programs"`
+	// Whether the TUI should hide non-critical warnings (e.g. about being offline or banners from the backend)
+	Quiet bool `json:"quiet"`
+	// What the TUI outputs when it is exited without selecting an entry (one of restore, leave, clear, or echo)
+	TuiQuitBehavior string `json:"tui_quit_behavior"`
+	// What the TUI does when enter is pressed while there are no results (one of quit, ignore, or query)
+	TuiEmptyEnterBehavior string `json:"tui_empty_enter_behavior"`
+	// A query that is implicitly added to every search that is displayed to the user (e.g. "-program:ls")
+	DefaultFilter string `json:"default_filter"`
+	// Directories whose .hishtory.toml files are trusted and thus will be used to override this config
+	TrustedDirectories []string `json:"trusted_directories"`
+	// Whether history should only be stored on the backend, with nothing persisted in a local DB. Searches download
+	// and decrypt the history from the backend into an in-memory DB.
+	RemoteOnly bool `json:"remote_only"`
+	// Whether paths referenced in commands are recorded in a canonical form (absolute, with symlinks resolved) so
+	// that searching for a path also matches commands that referred to it via a relative path or a symlink
+	NormalizePaths bool `json:"normalize_paths"`
+	// Fixed widths for columns in the TUI, by column name. Columns without a fixed width are sized automatically.
+	ColumnWidths map[string]int `json:"column_widths"`
+	// How the TUI shrinks columns to fit in a narrow terminal (either widest or proportional)
+	ColumnShrinkMode string `json:"column_shrink_mode"`
+	// How the cwd: atom matches directories (one of substring, exact, prefix, or fuzzy)
+	CwdMatchMode string `json:"cwd_match_mode"`
+	// Whether search terms match commands that contain their characters in order but not necessarily next to each
+	// other, with the results ranked by how closely they match
+	FuzzySearch bool `json:"fuzzy_search"`
+	// How search results are ranked (one of recency, frequency, or frequency_in_cwd). Empty means recency.
+	RankingStrategy string `json:"ranking_strategy"`
+	// Whether search terms only match commands with the same case (e.g. PROD doesn't match prod). Regexes in re: atoms
+	// use their own flags (e.g. (?i)) instead.
+	CaseSensitiveSearch bool `json:"case_sensitive_search"`
+	// Named queries that can be used as the initial query via `--filter <name>`
+	SavedFilters map[string]string `json:"saved_filters"`
+	// Commands that are pinned to the top of the TUI's results whenever they match the query (see Alt+B)
+	PinnedCommands []string `json:"pinned_commands"`
+	// If set, the TUI renders each result as a single line from this template (e.g. `{Timestamp} {CWD}$ {Command}`)
+	// rather than as a table with one column per displayed column
+	LineTemplate string `json:"line_template"`
+	// The maximum number of rows that the TUI loads into memory at once, even when more are requested (e.g. via Alt+M).
+	// Zero means the default of 10000.
+	TuiMaxRows int `json:"tui_max_rows"`
+	// The number of rows that the TUI loads for a query at once, both initially and each time more are loaded as the
+	// cursor nears the bottom of the results. Zero means the default of 40.
+	TuiSearchLimit int `json:"tui_search_limit"`
+	// The maximum number of characters that can be typed into the TUI's search query. Zero means no limit.
+	QueryCharLimit int `json:"query_char_limit"`
+	// Whether the parts of the commands in the TUI that matched the search query are highlighted
+	HighlightMatches bool `json:"highlight_matches"`
+	// The spinner that is shown while the TUI loads entries from other devices (see lib.SpinnerStyles)
+	SpinnerStyle string `json:"spinner_style"`
+	// The message that is shown while the TUI loads entries from other devices. Empty means the default message.
+	LoadingMessage string `json:"loading_message"`
+	// If the terminal is narrower than this, the TUI only displays the Command column rather than all of the displayed
+	// columns. Zero means the default of 60, and a negative value disables this.
+	CompactModeWidth int `json:"compact_mode_width"`
+	// The number of milliseconds that the TUI waits after the query was last edited before running it, so that typing
+	// quickly only runs a single search. Zero means the default of 150, and a negative value runs it on every keystroke.
+	SearchDebounceMs int `json:"search_debounce_ms"`
+	// The number of commands before and after the selected entry that are shown in the TUI's context view (see Alt+A).
+	// Zero means the default of 5.
+	ContextLines int `json:"context_lines"`
+	// Whether the TUI asks for confirmation before selecting a command that spans multiple lines
+	ConfirmMultiLineExec bool `json:"confirm_multi_line_exec"`
+	// Whether selecting an entry via Control+O in the TUI outputs `cd <dir> && <command>` rather than just `cd <dir>`
+	CdAndRunCommand bool `json:"cd_and_run_command"`
+	// Whether the TUI starts in a vim-style normal mode where j/k/g/G/ctrl+d/ctrl+u navigate the results and / starts typing a query
+	EnableVimKeybindings bool `json:"enable_vim_keybindings"`
+	// Whether the TUI starts with the last query that was searched for (stored in LastQuery) when nothing was typed before opening it
+	RememberLastQuery bool `json:"remember_last_query"`
+	// The last query that was searched for in the TUI, only saved if RememberLastQuery is enabled
+	LastQuery string `json:"last_query"`
+	// The colors used by the TUI
+	Theme Theme `json:"theme"`
+	// The key that copies the selected command to the clipboard in the TUI (e.g. ctrl+y, which is used if this is empty)
+	CopyKey string `json:"copy_key"`
+	// Rules for automatically tagging commands so that they can be searched for via the tag: atom
+	AutoTags []AutoTagRule `json:"auto_tags"`
+	// For each one-time migration of existing entries (see `hishtory migrate`), the end time of the last entry that
+	// was migrated so that interrupted migrations can be resumed
+	MigrationCheckpoints map[string]time.Time `json:"migration_checkpoints"`
+}
+
+// The colors used by the TUI, each either an ANSI color number (e.g. 57) or a hex color (e.g. #268bd2). Colors that
+// are empty fall back to the ones from the built-in theme with the given Name (or the default theme if Name is empty).
+type Theme struct {
+	Name               string `json:"name,omitempty"`
+	SelectedForeground string `json:"selected_foreground,omitempty"`
+	SelectedBackground string `json:"selected_background,omitempty"`
+	Border             string `json:"border,omitempty"`
+	Spinner            string `json:"spinner,omitempty"`
+	Highlight          string `json:"highlight,omitempty"`
+}
+
+// A rule that tags every command run within Cwd (or run by Program) with Tag. Exactly one of Cwd and Program is set.
+type AutoTagRule struct {
+	Tag     string `json:"tag"`
+	Cwd     string `json:"cwd,omitempty"`
+	Program string `json:"program,omitempty"`
 }
 
 type CustomColumnDefinition struct {
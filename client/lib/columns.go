@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Formats a history entry for display in a column
+type ColumnFormatter func(ctx *context.Context, entry data.HistoryEntry) string
+
+var columnFormatters = make(map[string]ColumnFormatter)
+
+// The names of all registered columns, in the order that they were registered
+var registeredColumns = make([]string, 0)
+
+// Registers a formatter for the column with the given name so that it can be used in DisplayedColumns. Panics if a
+// column with the same name was already registered.
+func RegisterColumnFormatter(name string, formatter ColumnFormatter) {
+	if _, ok := columnFormatters[name]; ok {
+		panic(fmt.Sprintf("a column formatter named %#v is already registered", name))
+	}
+	columnFormatters[name] = formatter
+	registeredColumns = append(registeredColumns, name)
+}
+
+func init() {
+	RegisterColumnFormatter("Hostname", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return entry.Hostname
+	})
+	RegisterColumnFormatter("CWD", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return entry.CurrentWorkingDirectory
+	})
+	RegisterColumnFormatter("Timestamp", func(ctx *context.Context, entry data.HistoryEntry) string {
+		startTime := entry.StartTime
+		if location := getDisplayLocation(ctx); location != nil {
+			startTime = startTime.In(location)
+		}
+		return startTime.Format(hctx.GetConf(ctx).TimestampFormat)
+	})
+	RegisterColumnFormatter("Runtime", func(ctx *context.Context, entry data.HistoryEntry) string {
+		if entry.StartTime.IsZero() || entry.EndTime.IsZero() || entry.EndTime.Before(entry.StartTime) {
+			// The command hasn't finished (or its runtime wasn't recorded)
+			return ""
+		}
+		return formatRuntime(entry.EndTime.Sub(entry.StartTime))
+	})
+	RegisterColumnFormatter("Exit Code", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return fmt.Sprintf("%d", entry.ExitCode)
+	})
+	RegisterColumnFormatter("Command", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return entry.Command
+	})
+	RegisterColumnFormatter("User", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return entry.LocalUsername
+	})
+	RegisterColumnFormatter("Pane", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return entry.TerminalPane
+	})
+	RegisterColumnFormatter("Expanded Command", func(ctx *context.Context, entry data.HistoryEntry) string {
+		if entry.ExpandedCommand == "" {
+			return entry.Command
+		}
+		return entry.ExpandedCommand
+	})
+	RegisterColumnFormatter("Tags", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return strings.Join(getAutoTags(ctx, entry), ",")
+	})
+	RegisterColumnFormatter("Session", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return entry.SessionId
+	})
+}
+
+// The locations for each configured display_timezone, cached since loading them reads the timezone database
+var (
+	displayLocationsMutex sync.Mutex
+	displayLocations      = make(map[string]*time.Location)
+)
+
+// Returns the location that timestamps are displayed in based on the display_timezone config option, or nil if it
+// isn't set. Invalid timezones fall back to the local timezone. This is called while rendering, so the problem is
+// reported by validateDisplayTimezone instead.
+func getDisplayLocation(ctx *context.Context) *time.Location {
+	name := hctx.GetConf(ctx).DisplayTimezone
+	if name == "" {
+		return nil
+	}
+	displayLocationsMutex.Lock()
+	defer displayLocationsMutex.Unlock()
+	if location, ok := displayLocations[name]; ok {
+		return location
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		location = time.Local
+	}
+	displayLocations[name] = location
+	return location
+}
+
+// Formats how long a command ran for so that it is easy to skim, e.g. 350ms, 1.2s, or 2m15s
+func formatRuntime(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return "<1ms"
+	case d < time.Second:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	case d.Round(100*time.Millisecond) < time.Minute:
+		return strconv.FormatFloat(d.Round(100*time.Millisecond).Seconds(), 'f', -1, 64) + "s"
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+// Matches the column placeholders (e.g. `{Command}`) in a line template
+var lineTemplatePlaceholderRegex = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Returns the names of the columns that are referenced by the given line template
+func getLineTemplateColumns(template string) []string {
+	columns := make([]string, 0)
+	for _, match := range lineTemplatePlaceholderRegex.FindAllStringSubmatch(template, -1) {
+		columns = append(columns, match[1])
+	}
+	return columns
+}
+
+// Renders the given entry as a single line by replacing each column placeholder in the template with the value of that column
+func renderLineTemplate(ctx *context.Context, template string, entry data.HistoryEntry) (string, error) {
+	var err error
+	line := lineTemplatePlaceholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		row, rowErr := buildTableRow(ctx, []string{strings.Trim(placeholder, "{}")}, entry)
+		if rowErr != nil {
+			err = rowErr
+			return placeholder
+		}
+		return row[0]
+	})
+	return line, err
+}
@@ -1,3 +1,6 @@
+# The ID of this shell session (see config.sh)
+set --global --export HISHTORY_SESSION_ID $fish_pid-(date +%s)
+
 function _hishtory_post_exec --on-event fish_postexec 
     # Runs after <ENTER>, but before the command is executed
     set --global _hishtory_command $argv
@@ -31,4 +34,8 @@ function __hishtory_on_control_r
 	rm -f $tmp
 end
 
-[ (hishtory config-get enable-control-r) = true ] && bind \cr __hishtory_on_control_r
\ No newline at end of file
+[ (hishtory config-get enable-control-r) = true ] && bind \cr __hishtory_on_control_r
+
+# Warm up the DB in the background so that the first control-R is fast
+hishtory prewarm >/dev/null 2>&1 &
+disown
\ No newline at end of file
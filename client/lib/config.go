@@ -0,0 +1,424 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// The name of the file that can be placed in a directory to override the config for searches run within that directory
+const DIRECTORY_CONFIG_FILENAME = ".hishtory.toml"
+
+// Validates the config file on disk without otherwise running hishtory. Returns every problem that was found,
+// each of which is prefixed with the name of the offending field.
+func ValidateConfigFile() []error {
+	contents, err := hctx.GetConfigContents()
+	if err != nil {
+		return []error{err}
+	}
+	errs := make([]error, 0)
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	var strictConfig hctx.ClientConfig
+	if err := decoder.Decode(&strictConfig); err != nil {
+		errs = append(errs, fmt.Errorf("failed to strictly parse the config file (is there a typo in a field name?): %v", err))
+	}
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return append(errs, err)
+	}
+	errs = append(errs, ValidateConfig(config)...)
+	if terminalWidth, _, err := getTerminalSize(); err == nil {
+		if err := validateColumnWidthsFit(config, terminalWidth); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Validates that the fixed column widths leave room for the other displayed columns in a terminal of the given width
+func validateColumnWidthsFit(config hctx.ClientConfig, terminalWidth int) error {
+	// The table's borders and padding take up 20 characters, and every other column needs at least one character
+	totalWidth := 20
+	for _, c := range config.DisplayedColumns {
+		if w, ok := config.ColumnWidths[c]; ok {
+			totalWidth += w
+		} else {
+			totalWidth += 1
+		}
+	}
+	if totalWidth > terminalWidth {
+		return fmt.Errorf("column_widths: the fixed column widths need a terminal that is at least %d characters wide, but the current terminal is only %d characters wide (they will be truncated)", totalWidth, terminalWidth)
+	}
+	return nil
+}
+
+// Validates the given config, returning every problem that was found
+func ValidateConfig(config hctx.ClientConfig) []error {
+	errs := make([]error, 0)
+	if config.UserSecret == "" {
+		errs = append(errs, fmt.Errorf("user_secret: must not be empty (try running `hishtory init`)"))
+	}
+	if config.DeviceId == "" {
+		errs = append(errs, fmt.Errorf("device_id: must not be empty (try running `hishtory init`)"))
+	}
+
+	// Custom columns
+	customColumnNames := make([]string, 0)
+	for _, cc := range config.CustomColumns {
+		if strings.TrimSpace(cc.ColumnName) == "" {
+			errs = append(errs, fmt.Errorf("custom_columns: column names must not be empty (command=%#v)", cc.ColumnCommand))
+			continue
+		}
+		if containsString(registeredColumns, cc.ColumnName) {
+			errs = append(errs, fmt.Errorf("custom_columns: column %#v conflicts with a built-in column", cc.ColumnName))
+		}
+		if containsString(customColumnNames, cc.ColumnName) {
+			errs = append(errs, fmt.Errorf("custom_columns: column %#v is defined multiple times", cc.ColumnName))
+		}
+		if strings.TrimSpace(cc.ColumnCommand) == "" {
+			errs = append(errs, fmt.Errorf("custom_columns: column %#v has an empty command", cc.ColumnName))
+		}
+		customColumnNames = append(customColumnNames, cc.ColumnName)
+	}
+
+	// Displayed columns
+	hasCommandColumn := false
+	for _, c := range config.DisplayedColumns {
+		if c == "Command" {
+			hasCommandColumn = true
+		}
+		if !containsString(registeredColumns, c) && !containsString(customColumnNames, c) {
+			errs = append(errs, fmt.Errorf("displayed_columns: unknown column %#v (must be one of %s, or a custom column)", c, strings.Join(registeredColumns, ", ")))
+		}
+	}
+	if !hasCommandColumn {
+		errs = append(errs, fmt.Errorf("displayed_columns: must contain the Command column so that commands can be selected"))
+	}
+
+	if config.TuiQuitBehavior != "" && !containsString(TuiQuitBehaviors, config.TuiQuitBehavior) {
+		errs = append(errs, fmt.Errorf("tui_quit_behavior: unknown value %#v (must be one of %s)", config.TuiQuitBehavior, strings.Join(TuiQuitBehaviors, ", ")))
+	}
+
+	for _, c := range getLineTemplateColumns(config.LineTemplate) {
+		if !containsString(registeredColumns, c) && !containsString(customColumnNames, c) {
+			errs = append(errs, fmt.Errorf("line_template: unknown column %#v (must be one of %s, or a custom column)", c, strings.Join(registeredColumns, ", ")))
+		}
+	}
+	for name := range config.SavedFilters {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " \t") {
+			errs = append(errs, fmt.Errorf("saved_filters: %#v is not a valid filter name", name))
+		}
+	}
+	for name, width := range config.ColumnWidths {
+		if !containsString(registeredColumns, name) && !containsString(customColumnNames, name) {
+			errs = append(errs, fmt.Errorf("column_widths: unknown column %#v", name))
+		}
+		if width <= 0 {
+			errs = append(errs, fmt.Errorf("column_widths: the width for column %#v must be positive, got %d", name, width))
+		}
+	}
+	if config.TuiMaxRows < 0 {
+		errs = append(errs, fmt.Errorf("tui_max_rows: must not be negative, got %d", config.TuiMaxRows))
+	}
+	if config.TuiSearchLimit < 0 {
+		errs = append(errs, fmt.Errorf("tui_search_limit: must not be negative, got %d", config.TuiSearchLimit))
+	}
+	if config.ContextLines < 0 {
+		errs = append(errs, fmt.Errorf("context_lines: must not be negative, got %d", config.ContextLines))
+	}
+	if config.QueryCharLimit < 0 {
+		errs = append(errs, fmt.Errorf("query_char_limit: must not be negative, got %d", config.QueryCharLimit))
+	}
+	if config.RankingStrategy != "" && !containsString(RankingStrategies, config.RankingStrategy) {
+		errs = append(errs, fmt.Errorf("ranking_strategy: unknown value %#v (must be one of %s)", config.RankingStrategy, strings.Join(RankingStrategies, ", ")))
+	}
+	if config.CwdMatchMode != "" && !containsString(CwdMatchModes, config.CwdMatchMode) {
+		errs = append(errs, fmt.Errorf("cwd_match_mode: unknown value %#v (must be one of %s)", config.CwdMatchMode, strings.Join(CwdMatchModes, ", ")))
+	}
+	if err := validateDisplayTimezone(config); err != nil {
+		errs = append(errs, err)
+	}
+	if config.Theme.Name != "" && !containsString(ThemeNames, config.Theme.Name) {
+		errs = append(errs, fmt.Errorf("theme: unknown theme %#v (must be one of %s)", config.Theme.Name, strings.Join(ThemeNames, ", ")))
+	}
+	for _, color := range []struct{ field, value string }{
+		{"selected_foreground", config.Theme.SelectedForeground},
+		{"selected_background", config.Theme.SelectedBackground},
+		{"border", config.Theme.Border},
+		{"spinner", config.Theme.Spinner},
+		{"highlight", config.Theme.Highlight},
+	} {
+		if color.value != "" && !IsValidThemeColor(color.value) {
+			errs = append(errs, fmt.Errorf("theme: invalid %s color %#v (must be an ANSI color number from 0 to 255 or a hex color like #268bd2)", color.field, color.value))
+		}
+	}
+	if config.SpinnerStyle != "" && !containsString(SpinnerStyles, config.SpinnerStyle) {
+		errs = append(errs, fmt.Errorf("spinner_style: unknown value %#v (must be one of %s)", config.SpinnerStyle, strings.Join(SpinnerStyles, ", ")))
+	}
+	if config.ColumnShrinkMode != "" && !containsString(ColumnShrinkModes, config.ColumnShrinkMode) {
+		errs = append(errs, fmt.Errorf("column_shrink_mode: unknown value %#v (must be one of %s)", config.ColumnShrinkMode, strings.Join(ColumnShrinkModes, ", ")))
+	}
+	if config.DedupMode != "" && !containsString(DedupModes, config.DedupMode) {
+		errs = append(errs, fmt.Errorf("dedup_mode: unknown value %#v (must be one of %s)", config.DedupMode, strings.Join(DedupModes, ", ")))
+	}
+	if config.TuiEmptyEnterBehavior != "" && !containsString(TuiEmptyEnterBehaviors, config.TuiEmptyEnterBehavior) {
+		errs = append(errs, fmt.Errorf("tui_empty_enter_behavior: unknown value %#v (must be one of %s)", config.TuiEmptyEnterBehavior, strings.Join(TuiEmptyEnterBehaviors, ", ")))
+	}
+
+	for _, rule := range config.AutoTags {
+		if _, err := ParseAutoTagRule(rule.Tag, autoTagCondition(rule)); err != nil || (rule.Cwd != "" && rule.Program != "") {
+			errs = append(errs, fmt.Errorf("auto_tags: invalid rule %#v (each rule must have a tag and exactly one of cwd or program)", rule))
+		}
+	}
+
+	// Program filters
+	for _, p := range config.NeverRecordPrograms {
+		if strings.TrimSpace(p) == "" || strings.ContainsAny(p, " \t") {
+			errs = append(errs, fmt.Errorf("never_record_programs: %#v is not a valid program name", p))
+		}
+	}
+	for _, p := range config.HiddenPrograms {
+		if strings.TrimSpace(p) == "" || strings.ContainsAny(p, " \t") {
+			errs = append(errs, fmt.Errorf("hidden_programs: %#v is not a valid program name", p))
+		}
+	}
+	return errs
+}
+
+// Returns the query for the saved filter with the given name
+func GetSavedFilter(ctx *context.Context, name string) (string, error) {
+	savedFilters := hctx.GetConf(ctx).SavedFilters
+	if query, ok := savedFilters[name]; ok {
+		return query, nil
+	}
+	names := make([]string, 0)
+	for n := range savedFilters {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return "", fmt.Errorf("there is no saved filter named %#v (add one via `hishtory config-add saved-filters %s <query>`)", name, name)
+	}
+	return "", fmt.Errorf("there is no saved filter named %#v (must be one of %s)", name, strings.Join(names, ", "))
+}
+
+// Validates the display_timezone config option. Invalid timezones fall back to the local timezone (see
+// getDisplayLocation).
+func validateDisplayTimezone(config hctx.ClientConfig) error {
+	if config.DisplayTimezone == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(config.DisplayTimezone); err != nil {
+		return fmt.Errorf("display_timezone: %v", err)
+	}
+	return nil
+}
+
+// Config fields that are specific to a single device (or to its syncing state) and so are never exported or imported
+var deviceSpecificConfigFields = []string{
+	"user_secret",
+	"is_enabled",
+	"device_id",
+	"last_saved_history_line",
+	"have_missed_uploads",
+	"missed_upload_timestamp",
+	"have_completed_initial_import",
+	"is_offline",
+	"have_synced_with_backend",
+	"remote_only",
+	"migration_checkpoints",
+	"last_query",
+}
+
+// Serializes every setting in the config other than the device-specific ones so that it can be imported on another device
+func ExportConfig(ctx *context.Context) ([]byte, error) {
+	fields, err := configToFields(hctx.GetConf(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range deviceSpecificConfigFields {
+		delete(fields, field)
+	}
+	return json.MarshalIndent(fields, "", "  ")
+}
+
+// Imports settings that were exported via ExportConfig into the current config. Device-specific fields and fields
+// that this version of hishtory doesn't know about (e.g. because they were exported from a newer version) are skipped,
+// and a warning is returned for each of them.
+func ImportConfig(ctx *context.Context, contents []byte) ([]string, error) {
+	var imported map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &imported); err != nil {
+		return nil, fmt.Errorf("failed to parse the exported config: %v", err)
+	}
+	fields, err := configToFields(hctx.GetConf(ctx))
+	if err != nil {
+		return nil, err
+	}
+	warnings := make([]string, 0)
+	names := make([]string, 0)
+	for name := range imported {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := fields[name]; !ok {
+			warnings = append(warnings, fmt.Sprintf("Ignoring unknown config field %#v (was it exported from a newer version of hishtory?)", name))
+			continue
+		}
+		if containsString(deviceSpecificConfigFields, name) {
+			warnings = append(warnings, fmt.Sprintf("Ignoring device-specific config field %#v", name))
+			continue
+		}
+		fields[name] = imported[name]
+	}
+	merged, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize the imported config: %v", err)
+	}
+	var config hctx.ClientConfig
+	if err := json.Unmarshal(merged, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse the imported config: %v", err)
+	}
+	for _, err := range ValidateConfig(config) {
+		// Problems with the device-specific fields weren't caused by the import
+		if containsString(deviceSpecificConfigFields, strings.SplitN(err.Error(), ":", 2)[0]) {
+			continue
+		}
+		return nil, fmt.Errorf("the imported config is invalid: %v", err)
+	}
+	return warnings, hctx.SetConfig(config)
+}
+
+// Converts the config into a map from JSON field name to the serialized value of that field
+func configToFields(config hctx.ClientConfig) (map[string]json.RawMessage, error) {
+	serialized, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize config: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(serialized, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse serialized config: %v", err)
+	}
+	return fields, nil
+}
+
+// The subset of the config that can be overridden by a .hishtory.toml file in a directory. Since these files may come from
+// untrusted repos, this purposefully excludes any fields that could be dangerous (e.g. custom columns, which run commands)
+// or that affect what is recorded. Any other fields in the file are ignored.
+type DirectoryConfig struct {
+	DisplayedColumns        []string `toml:"displayed_columns"`
+	DefaultFilter           string   `toml:"default_filter"`
+	FilterDuplicateCommands *bool    `toml:"filter_duplicate_commands"`
+	TimestampFormat         string   `toml:"timestamp_format"`
+	HiddenPrograms          []string `toml:"hidden_programs"`
+}
+
+// Finds the closest .hishtory.toml file in the given directory or any of its parents. Returns an empty string if there is none.
+func findDirectoryConfig(dir string) string {
+	for {
+		candidate := filepath.Join(dir, DIRECTORY_CONFIG_FILENAME)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Returns a context with the global config overridden by the closest .hishtory.toml file in the current directory
+// or any of its parents. If there is no such file, or if it is in a directory that the user hasn't trusted via
+// `hishtory trust-dir`, the context is returned unchanged.
+func WithDirectoryConfig(ctx *context.Context) (*context.Context, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cwd: %v", err)
+	}
+	configPath := findDirectoryConfig(cwd)
+	if configPath == "" {
+		return ctx, nil
+	}
+	if !containsString(hctx.GetConf(ctx).TrustedDirectories, filepath.Dir(configPath)) {
+		fmt.Fprintf(os.Stderr, "Warning: Ignoring %s since its directory isn't trusted (run `hishtory trust-dir %s` to trust it)\n", configPath, filepath.Dir(configPath))
+		return ctx, nil
+	}
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", configPath, err)
+	}
+	var dirConfig DirectoryConfig
+	if err := toml.Unmarshal(contents, &dirConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+	return hctx.WithConfig(ctx, applyDirectoryConfig(hctx.GetConf(ctx), dirConfig)), nil
+}
+
+// A command that matched a pattern being tested via TestPattern, along with the number of times it was run
+type PatternMatch struct {
+	Command string
+	Count   int
+}
+
+// Returns the commands in the history that were run by the given program, using the same logic as never_record_programs
+// and hidden_programs. This is read-only, so it can be used to check what a program filter would affect before adding it.
+func TestPattern(ctx *context.Context, program string) ([]PatternMatch, error) {
+	db := hctx.GetDb(ctx)
+	var counts []PatternMatch
+	result := db.Model(&data.HistoryEntry{}).Select("command, COUNT(*) AS count").Group("command").Order("count DESC, command").Scan(&counts)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	matches := make([]PatternMatch, 0)
+	for _, c := range counts {
+		if getProgram(c.Command) == program {
+			matches = append(matches, c)
+		}
+	}
+	return matches, nil
+}
+
+// Marks the given directory as trusted so that its .hishtory.toml file will be used
+func TrustDirectory(ctx *context.Context, dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for %#v: %v", dir, err)
+	}
+	config := hctx.GetConf(ctx)
+	if containsString(config.TrustedDirectories, absDir) {
+		return nil
+	}
+	config.TrustedDirectories = append(config.TrustedDirectories, absDir)
+	return hctx.SetConfig(config)
+}
+
+func applyDirectoryConfig(config hctx.ClientConfig, dirConfig DirectoryConfig) hctx.ClientConfig {
+	if len(dirConfig.DisplayedColumns) > 0 {
+		config.DisplayedColumns = dirConfig.DisplayedColumns
+	}
+	if dirConfig.DefaultFilter != "" {
+		config.DefaultFilter = dirConfig.DefaultFilter
+	}
+	if dirConfig.FilterDuplicateCommands != nil {
+		config.FilterDuplicateCommands = *dirConfig.FilterDuplicateCommands
+	}
+	if dirConfig.TimestampFormat != "" {
+		config.TimestampFormat = dirConfig.TimestampFormat
+	}
+	if len(dirConfig.HiddenPrograms) > 0 {
+		config.HiddenPrograms = dirConfig.HiddenPrograms
+	}
+	return config
+}
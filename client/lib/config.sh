@@ -5,6 +5,10 @@
 if [ -n "$__hishtory_bash_config_sourced" ]; then return; fi
 __hishtory_bash_config_sourced=`date`
 
+# An ID for this shell session. This is exported so that hishtory can read it, but is regenerated whenever this file is
+# sourced so that nested shells get their own session.
+export HISHTORY_SESSION_ID="$$-`date +%s`"
+
 # Implementation of running before/after every command based on https://jichu4n.com/posts/debug-trap-and-prompt_command-in-bash/
 function __hishtory_precommand() {
   if [ -z "$HISHTORY_AT_PROMPT" ]; then
@@ -14,6 +18,9 @@ function __hishtory_precommand() {
 
   # Run before every command
   HISHTORY_START_TIME=`date +%s`
+  # BASH_COMMAND has any aliases expanded, but only contains the first simple command (e.g. `ll` for `ll | head`), so
+  # hishtory only stores it if that was the whole command
+  HISHTORY_EXPANDED_COMMAND="$BASH_COMMAND"
 }
 trap "__hishtory_precommand" DEBUG
 
@@ -28,8 +35,8 @@ function __hishtory_postcommand() {
   fi
 
   # Run after every prompt
-  (hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME &) # Background Run
-  # hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME  # Foreground Run
+  (hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME "$HISHTORY_EXPANDED_COMMAND" &) # Background Run
+  # hishtory saveHistoryEntry bash $EXIT_CODE "`history 1`" $HISHTORY_START_TIME "$HISHTORY_EXPANDED_COMMAND"  # Foreground Run
 }
 PROMPT_COMMAND="__hishtory_postcommand; $PROMPT_COMMAND"
 export HISTTIMEFORMAT=$HISTTIMEFORMAT
@@ -44,3 +51,6 @@ __hishtory_bind_control_r() {
 }
 
 [ "$(hishtory config-get enable-control-r)" = true ] && __hishtory_bind_control_r
+
+# Warm up the DB in the background so that the first control-R is fast
+(hishtory prewarm >/dev/null 2>&1 &)
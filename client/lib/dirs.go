@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The maximum number of directories that are considered when ranking recent directories, so that huge histories
+// don't slow down `hishtory dirs`
+const MAX_RECENT_DIRECTORIES = 1000
+
+// A directory that commands were run in, along with how often and how recently it was used
+type RecentDirectory struct {
+	Directory string
+	Count     int
+	LastUsed  time.Time
+}
+
+// Ranks a directory based on both how often and how recently it was used, similar to z and autojump
+func frecencyScore(dir RecentDirectory, now time.Time) float64 {
+	age := now.Sub(dir.LastUsed)
+	switch {
+	case age < time.Hour:
+		return float64(dir.Count) * 4
+	case age < 24*time.Hour:
+		return float64(dir.Count) * 2
+	case age < 7*24*time.Hour:
+		return float64(dir.Count) / 2
+	default:
+		return float64(dir.Count) / 4
+	}
+}
+
+// Returns the directories that commands were recently run in and that still exist on this machine, sorted so that the
+// most frequently and recently used ones are first
+func GetRecentDirectories(ctx *context.Context, now time.Time) ([]RecentDirectory, error) {
+	var rows []struct {
+		Directory     string
+		HomeDirectory string
+		Count         int
+		LastUsedUnix  int64
+	}
+	result := hctx.GetDb(ctx).Table("history_entries").
+		Select("current_working_directory AS directory, home_directory, COUNT(*) AS count, CAST(strftime('%s', MAX(start_time)) AS INTEGER) AS last_used_unix").
+		Group("current_working_directory, home_directory").
+		Order("last_used_unix DESC").
+		Limit(MAX_RECENT_DIRECTORIES).
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	directories := make([]RecentDirectory, 0)
+	indices := make(map[string]int)
+	for _, row := range rows {
+		dir := expandHomeDirectory(row.Directory, row.HomeDirectory)
+		if dir != "/" {
+			dir = strings.TrimSuffix(dir, "/")
+		}
+		// The same directory may have been recorded both with and without a trailing slash (or both with and without ~)
+		if i, ok := indices[dir]; ok {
+			directories[i].Count += row.Count
+			continue
+		}
+		if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+			continue
+		}
+		indices[dir] = len(directories)
+		directories = append(directories, RecentDirectory{Directory: dir, Count: row.Count, LastUsed: time.Unix(row.LastUsedUnix, 0)})
+	}
+	sort.SliceStable(directories, func(i, j int) bool {
+		return frecencyScore(directories[i], now) > frecencyScore(directories[j], now)
+	})
+	return directories, nil
+}
+
+// Returns a cd command for the given directory that is safe to evaluate in the shell
+func makeCdCommand(dir string) string {
+	return "cd '" + strings.ReplaceAll(dir, "'", `'\''`) + "'"
+}
+
+// Returns the directories that contain the given filter, ignoring case
+func filterDirectories(directories []RecentDirectory, filter string) []RecentDirectory {
+	filtered := make([]RecentDirectory, 0)
+	for _, dir := range directories {
+		if strings.Contains(strings.ToLower(dir.Directory), strings.ToLower(filter)) {
+			filtered = append(filtered, dir)
+		}
+	}
+	return filtered
+}
+
+type dirsModel struct {
+	// All of the recent directories, in ranked order
+	directories []RecentDirectory
+	// The directories that match the current filter
+	filtered []RecentDirectory
+	// The index of the selected directory within filtered
+	cursor int
+	// The input box for filtering the directories
+	filterInput textinput.Model
+	// The directory that was selected, or an empty string if none was
+	selected string
+}
+
+func (m dirsModel) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (m dirsModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	keyMsg, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return m, nil
+	}
+	switch keyMsg.String() {
+	case "esc", "ctrl+c":
+		return m, tea.Quit
+	case "up", "ctrl+p":
+		m.cursor = max(m.cursor-1, 0)
+		return m, nil
+	case "down", "ctrl+n":
+		m.cursor = max(min(m.cursor+1, len(m.filtered)-1), 0)
+		return m, nil
+	case "enter":
+		if m.cursor < len(m.filtered) {
+			m.selected = m.filtered[m.cursor].Directory
+		}
+		return m, tea.Quit
+	default:
+		var cmd tea.Cmd
+		m.filterInput, cmd = m.filterInput.Update(msg)
+		m.filtered = filterDirectories(m.directories, m.filterInput.Value())
+		m.cursor = 0
+		return m, cmd
+	}
+}
+
+func (m dirsModel) View() string {
+	if m.selected != "" {
+		return ""
+	}
+	_, terminalHeight := getTerminalSizeOrDefault()
+	height := max(min(TABLE_HEIGHT, terminalHeight-4), 1)
+	start := max(min(m.cursor-height/2, len(m.filtered)-height), 0)
+	end := min(start+height, len(m.filtered))
+	lines := make([]string, 0)
+	for i := start; i < end; i++ {
+		prefix := "  "
+		if i == m.cursor {
+			prefix = "> "
+		}
+		lines = append(lines, prefix+m.filtered[i].Directory)
+	}
+	if len(m.filtered) == 0 {
+		lines = append(lines, "  No directories match the filter")
+	}
+	return fmt.Sprintf("Jump to: %s\n\n%s\n", m.filterInput.View(), strings.Join(lines, "\n"))
+}
+
+// Lets the user pick one of their recent directories (initially filtered by the given filter) and outputs a cd command
+// for it, so that it can be evaluated by the shell
+func DirsQuery(ctx *context.Context, initialFilter string) error {
+	directories, err := GetRecentDirectories(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	filterInput := textinput.New()
+	filterInput.Placeholder = "directory"
+	filterInput.SetValue(initialFilter)
+	filterInput.Focus()
+	m := dirsModel{directories: directories, filtered: filterDirectories(directories, initialFilter), filterInput: filterInput}
+	finalModel, err := tea.NewProgram(m, tea.WithOutput(os.Stderr)).Run()
+	if err != nil {
+		return err
+	}
+	if selected := finalModel.(dirsModel).selected; selected != "" {
+		fmt.Println(makeCdCommand(selected))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// An error from contacting the backend because it couldn't be reached (e.g. because this device is offline or the
+// backend is down). These are generally safe to ignore since the next command will retry.
+type OfflineError struct {
+	Err error
+}
+
+func (e *OfflineError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *OfflineError) Unwrap() error {
+	return e.Err
+}
+
+// An error from contacting the backend because it rejected our credentials (e.g. because this device isn't
+// registered). The fix for these errors is to re-register the device via `hishtory init`.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// An error from searching the local DB, either because the query was invalid or because the DB query failed
+type SearchError struct {
+	Query string
+	Err   error
+}
+
+func (e *SearchError) Error() string {
+	return fmt.Sprintf("failed to search for %#v: %v", e.Query, e.Err)
+}
+
+func (e *SearchError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps the given error from contacting the backend in an OfflineError or AuthError if it is one of those
+func classifyApiError(err error) error {
+	if isOfflineErrorMessage(err.Error()) {
+		return &OfflineError{Err: err}
+	}
+	if isAuthErrorMessage(err.Error()) {
+		return &AuthError{Err: err}
+	}
+	return err
+}
+
+func isOfflineErrorMessage(msg string) bool {
+	return strings.Contains(msg, "dial tcp: lookup api.hishtory.dev") ||
+		strings.Contains(msg, "connect: network is unreachable") ||
+		strings.Contains(msg, "read: connection reset by peer") ||
+		strings.Contains(msg, ": EOF") ||
+		strings.Contains(msg, ": status_code=502") ||
+		strings.Contains(msg, ": status_code=503") ||
+		strings.Contains(msg, ": i/o timeout")
+}
+
+func isAuthErrorMessage(msg string) bool {
+	return strings.Contains(msg, ": status_code=401") ||
+		strings.Contains(msg, ": status_code=403")
+}
+
+// Whether the error is because the backend couldn't be reached. This also matches errors that were converted to
+// strings (e.g. via %v) before being returned.
+func IsOfflineError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var offlineErr *OfflineError
+	return errors.As(err, &offlineErr) || isOfflineErrorMessage(err.Error())
+}
+
+// Whether the error is because the backend rejected our credentials (e.g. because this device isn't registered), as
+// opposed to a connectivity issue. This also matches errors that were converted to strings before being returned.
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var authErr *AuthError
+	return errors.As(err, &authErr) || isAuthErrorMessage(err.Error())
+}
+
+// Whether the error means that hishtory can't keep running, e.g. because the local DB is corrupt. Most other errors
+// (e.g. failing to contact the backend) are transient and can be recovered from.
+func IsUnrecoverableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database disk image is malformed") ||
+		strings.Contains(msg, "file is not a database")
+}
+
+// Whether the error is because a search of the local DB failed
+func IsSearchError(err error) bool {
+	var searchErr *SearchError
+	return errors.As(err, &searchErr)
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+)
+
+// Writes the given rows (with the given column names) to the file at filePath. The format is chosen based on the
+// file extension: .json for a JSON list of objects, .csv for CSV with a header row, .md for a Markdown table, .sh for
+// a runnable shell script, and otherwise one command per line (matching the output of `hishtory export`). Shell
+// scripts are built from the entries for each of the rows rather than from the rows themselves, so that they contain
+// the full commands and their timestamps no matter which columns are displayed.
+func ExportRows(ctx *context.Context, filePath string, columnNames []string, rows [][]string, entries []*data.HistoryEntry) error {
+	if strings.HasPrefix(filePath, "~/") {
+		homedir, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to get homedir: %v", err)
+		}
+		filePath = path.Join(homedir, filePath[2:])
+	}
+	f, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %v", err)
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".json":
+		err = exportRowsAsJson(f, columnNames, rows)
+	case ".csv":
+		err = exportRowsAsCsv(f, columnNames, rows)
+	case ".md":
+		err = exportRowsAsMarkdown(f, columnNames, rows)
+	case ".sh":
+		err = exportEntriesAsShellScript(ctx, f, entries)
+		if err == nil {
+			err = f.Chmod(0o755)
+		}
+	default:
+		err = exportRowsAsText(f, columnNames, rows)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export to %s: %v", filePath, err)
+	}
+	return f.Close()
+}
+
+func exportRowsAsJson(w io.Writer, columnNames []string, rows [][]string) error {
+	objects := make([]map[string]string, 0)
+	for _, row := range rows {
+		obj := make(map[string]string)
+		for i, name := range columnNames {
+			if i < len(row) {
+				obj[name] = row[i]
+			}
+		}
+		objects = append(objects, obj)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(objects)
+}
+
+func exportRowsAsCsv(w io.Writer, columnNames []string, rows [][]string) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columnNames); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func exportRowsAsMarkdown(w io.Writer, columnNames []string, rows [][]string) error {
+	separators := make([]string, len(columnNames))
+	for i := range separators {
+		separators[i] = "---"
+	}
+	lines := []string{formatMarkdownRow(columnNames), formatMarkdownRow(separators)}
+	for _, row := range rows {
+		lines = append(lines, formatMarkdownRow(row))
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// Formats the cells as a row of a Markdown table, escaping anything that would otherwise break the table
+func formatMarkdownRow(cells []string) string {
+	escaped := make([]string, 0, len(cells))
+	for _, cell := range cells {
+		cell = strings.ReplaceAll(cell, "|", `\|`)
+		cell = strings.ReplaceAll(cell, "\n", "<br>")
+		escaped = append(escaped, cell)
+	}
+	return "| " + strings.Join(escaped, " | ") + " |"
+}
+
+// Writes the commands as a shell script that runs them in the order that they were originally run, each preceded by
+// a comment with when it was run
+func exportEntriesAsShellScript(ctx *context.Context, w io.Writer, entries []*data.HistoryEntry) error {
+	sorted := append([]*data.HistoryEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].StartTime.Before(sorted[j].StartTime)
+	})
+	formatTimestamp := columnFormatters["Timestamp"]
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n")
+	for _, entry := range sorted {
+		sb.WriteString(fmt.Sprintf("\n# %s\n%s\n", formatTimestamp(ctx, *entry), entry.Command))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func exportRowsAsText(w io.Writer, columnNames []string, rows [][]string) error {
+	indexOfCommand := -1
+	for i, name := range columnNames {
+		if name == "Command" {
+			indexOfCommand = i
+		}
+	}
+	if indexOfCommand == -1 {
+		return fmt.Errorf("cannot export as text without a Command column")
+	}
+	for _, row := range rows {
+		if indexOfCommand < len(row) {
+			if _, err := fmt.Fprintln(w, row[indexOfCommand]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
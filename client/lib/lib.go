@@ -19,10 +19,12 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
 	_ "embed" // for embedding config.sh
 
@@ -67,6 +69,47 @@ func getCwd(ctx *context.Context) (string, string, error) {
 	return cwd, homedir, nil
 }
 
+// Expands the ~ that getCwd uses for directories within the home directory (e.g. ~/work) into an absolute path
+func expandHomeDirectory(dir, homedir string) string {
+	if dir == "~" || dir == "~/" {
+		return homedir
+	}
+	if strings.HasPrefix(dir, "~/") {
+		return strings.TrimSuffix(homedir, "/") + dir[1:]
+	}
+	return dir
+}
+
+// Replaces the home directory at the start of the given absolute path with ~, i.e. the form that getCwd records
+// directories within the home directory in (e.g. ~/work)
+func collapseHomeDirectory(dir, homedir string) string {
+	homedir = strings.TrimSuffix(homedir, "/")
+	if dir == homedir {
+		return "~/"
+	}
+	if strings.HasPrefix(dir, homedir+"/") {
+		return "~" + strings.TrimPrefix(dir, homedir)
+	}
+	return dir
+}
+
+// Returns whether the given command is (as far as can be told without parsing it) a single simple command, i.e. one
+// without any pipes, lists, subshells, or compound commands
+func isSimpleCommand(cmd string) bool {
+	if strings.ContainsAny(cmd, ";&|()`{}\n") || strings.Contains(cmd, "$(") {
+		return false
+	}
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "if", "for", "while", "until", "case", "select", "function", "[[", "!":
+		return false
+	}
+	return true
+}
+
 func BuildHistoryEntry(ctx *context.Context, args []string) (*data.HistoryEntry, error) {
 	if len(args) < 6 {
 		hctx.GetLogger().Warnf("BuildHistoryEntry called with args=%#v, which has too few entries! This can happen in specific edge cases for newly opened terminals and is likely not a problem.", args)
@@ -142,6 +185,20 @@ func BuildHistoryEntry(ctx *context.Context, args []string) (*data.HistoryEntry,
 		return nil, nil
 	}
 
+	// expanded command (e.g. with aliases expanded), if the shell hook provided it. In bash, this is only the first simple
+	// command that was run, so it is only stored if that was the whole command.
+	if len(args) > 6 && (shell != "bash" || isSimpleCommand(entry.Command)) {
+		expandedCommand := strings.TrimSpace(args[6])
+		if expandedCommand != strings.TrimSpace(entry.Command) {
+			entry.ExpandedCommand = expandedCommand
+		}
+	}
+	config := hctx.GetConf(ctx)
+	if isNeverRecorded(config, entry.Command) {
+		// Skip recording commands run by programs that the user never wants recorded
+		return nil, nil
+	}
+
 	// hostname
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -150,9 +207,23 @@ func BuildHistoryEntry(ctx *context.Context, args []string) (*data.HistoryEntry,
 	entry.Hostname = hostname
 
 	// device ID
-	config := hctx.GetConf(ctx)
 	entry.DeviceId = config.DeviceId
 
+	// terminal multiplexer pane
+	entry.TerminalPane = getTerminalPane()
+
+	// shell session
+	entry.SessionId = getSessionId()
+
+	// normalized paths
+	if config.NormalizePaths {
+		absCwd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build history entry: %v", err)
+		}
+		entry.NormalizedPaths = getNormalizedPaths(entry.Command, absCwd, homedir)
+	}
+
 	// custom columns
 	cc, err := buildCustomColumns(ctx)
 	if err != nil {
@@ -163,6 +234,203 @@ func BuildHistoryEntry(ctx *context.Context, args []string) (*data.HistoryEntry,
 	return &entry, nil
 }
 
+// Returns the ID of the shell session that hishtory is running in, or an empty string if it is unknown (e.g. because
+// the shell was started before hishtory was updated). This is set by the shell config when it is sourced.
+func getSessionId() string {
+	return os.Getenv("HISHTORY_SESSION_ID")
+}
+
+// Resolves the value of a session: atom to a session ID, where "current" refers to the shell session that hishtory is
+// being run from
+func resolveSessionId(val string) (string, error) {
+	if val != "current" {
+		return val, nil
+	}
+	sessionId := getSessionId()
+	if sessionId == "" {
+		return "", fmt.Errorf("the current shell session is unknown (try restarting your shell)")
+	}
+	return sessionId, nil
+}
+
+// Returns an identifier for the tmux pane or screen window that hishtory is running in, or an empty
+// string if it isn't running inside of a terminal multiplexer
+func getTerminalPane() string {
+	if os.Getenv("TMUX") != "" && os.Getenv("TMUX_PANE") != "" {
+		return os.Getenv("TMUX_PANE")
+	}
+	if os.Getenv("STY") != "" {
+		return os.Getenv("STY") + "/" + os.Getenv("WINDOW")
+	}
+	return ""
+}
+
+const (
+	// Don't filter out duplicate commands
+	DEDUP_OFF = "off"
+	// Filter out consecutive commands that are identical (ignoring leading and trailing whitespace)
+	DEDUP_EXACT = "exact"
+	// Filter out consecutive commands that are identical after normalizing them (see normalizeCommandForDedup)
+	DEDUP_NORMALIZED = "normalized"
+)
+
+// The supported values for the dedup_mode config option. The empty string is treated as "exact".
+var DedupModes = []string{DEDUP_EXACT, DEDUP_NORMALIZED}
+
+const (
+	// Rank the most recent results first
+	RANKING_RECENCY = "recency"
+	// Rank the commands that were run the most often first
+	RANKING_FREQUENCY = "frequency"
+	// Rank the commands that were run the most often in the current directory first
+	RANKING_FREQUENCY_IN_CWD = "frequency_in_cwd"
+)
+
+// The supported values for the ranking_strategy config option. The empty string is treated as "recency".
+var RankingStrategies = []string{RANKING_RECENCY, RANKING_FREQUENCY, RANKING_FREQUENCY_IN_CWD}
+
+// Returns the configured ranking strategy, or an error if it isn't one of RankingStrategies
+func getRankingStrategy(ctx *context.Context) (string, error) {
+	if ctx == nil || hctx.GetConf(ctx).RankingStrategy == "" {
+		return RANKING_RECENCY, nil
+	}
+	strategy := hctx.GetConf(ctx).RankingStrategy
+	if !containsString(RankingStrategies, strategy) {
+		return "", fmt.Errorf("unknown ranking_strategy %#v (must be one of %s)", strategy, strings.Join(RankingStrategies, ", "))
+	}
+	return strategy, nil
+}
+
+// Returns the dedup mode to use, preferring the one set in opts (e.g. via the TUI) and otherwise falling back to the config
+func getDedupMode(config hctx.ClientConfig, opts SearchOptions) string {
+	if opts.DedupMode != "" {
+		return opts.DedupMode
+	}
+	if !config.FilterDuplicateCommands {
+		return DEDUP_OFF
+	}
+	if config.DedupMode == DEDUP_NORMALIZED {
+		return DEDUP_NORMALIZED
+	}
+	return DEDUP_EXACT
+}
+
+// Returns the key that is used to compare commands for the given dedup mode, where commands with the same key are duplicates
+func dedupKey(dedupMode, command string) string {
+	if dedupMode == DEDUP_NORMALIZED {
+		return normalizeCommandForDedup(command)
+	}
+	return strings.TrimSpace(command)
+}
+
+// Filters duplicate commands out of a list of results (newest first). By default only consecutive duplicates are
+// filtered, but with FilterAllDuplicateCommands only the first (i.e. most recent) occurrence of each command is kept.
+type duplicateFilter struct {
+	dedupMode string
+	filterAll bool
+	seen      map[string]bool
+	// The dedup key of the last command that was kept, which is what the next command is compared against
+	lastKey    string
+	hasLastKey bool
+}
+
+func newDuplicateFilter(config hctx.ClientConfig, opts SearchOptions) *duplicateFilter {
+	return &duplicateFilter{dedupMode: getDedupMode(config, opts), filterAll: config.FilterAllDuplicateCommands, seen: make(map[string]bool)}
+}
+
+// Returns whether the given command is a duplicate of one that was already passed to isDuplicate
+func (f *duplicateFilter) isDuplicate(command string) bool {
+	if f.dedupMode == DEDUP_OFF {
+		return false
+	}
+	key := dedupKey(f.dedupMode, command)
+	if f.filterAll {
+		if f.seen[key] {
+			return true
+		}
+		f.seen[key] = true
+		return false
+	}
+	if f.hasLastKey && key == f.lastKey {
+		return true
+	}
+	f.lastKey = key
+	f.hasLastKey = true
+	return false
+}
+
+// Normalizes the given command so that near-duplicates compare as equal: All whitespace is collapsed into
+// single spaces and any leading sudo is dropped (e.g. `sudo  apt  update` becomes `apt update`).
+func normalizeCommandForDedup(command string) string {
+	fields := strings.Fields(command)
+	for len(fields) > 0 && fields[0] == "sudo" {
+		fields = fields[1:]
+	}
+	return strings.Join(fields, " ")
+}
+
+// Returns whether the given command is excluded from being recorded by the given config
+func isNeverRecorded(config hctx.ClientConfig, command string) bool {
+	return strings.TrimSpace(command) == "" || isNeverRecordedProgram(config, command)
+}
+
+// Returns whether the given command is run by one of the never-record-programs in the given config
+func isNeverRecordedProgram(config hctx.ClientConfig, command string) bool {
+	return containsString(config.NeverRecordPrograms, getProgram(command))
+}
+
+// Returns whether the given token from a command or a query looks like it refers to a file path
+func looksLikePath(token string) bool {
+	return strings.Contains(token, "/") || token == "." || token == ".." || token == "~"
+}
+
+// Returns the canonical form of the given path: Absolute (relative to cwd), with ~ expanded, and with any symlinks
+// resolved if the path exists.
+func normalizePath(p, cwd, homedir string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = filepath.Join(homedir, p[1:])
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(cwd, p)
+	}
+	p = filepath.Clean(p)
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	return p
+}
+
+// Returns a space separated list of the canonical forms of every path referenced in the given command
+func getNormalizedPaths(command, cwd, homedir string) string {
+	paths := make([]string, 0)
+	for _, token := range strings.Fields(command) {
+		token = strings.Trim(token, "\"'")
+		if !looksLikePath(token) || strings.Contains(token, "://") {
+			continue
+		}
+		paths = append(paths, normalizePath(token, cwd, homedir))
+	}
+	return strings.Join(paths, " ")
+}
+
+// Returns the program that is run by the given command (e.g. `git` for `git status`)
+func getProgram(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func containsString(arr []string, s string) bool {
+	for _, item := range arr {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func buildCustomColumns(ctx *context.Context) (data.CustomColumns, error) {
 	ccs := data.CustomColumns{}
 	config := hctx.GetConf(ctx)
@@ -333,18 +601,28 @@ func shouldSkipHiddenCommand(ctx *context.Context, historyLine string) (bool, er
 	return false, nil
 }
 
+// Parses the arguments to `hishtory install` (or `hishtory init`), which are either a secret key, --offline, or nothing.
+// Returns the secret key (or empty if none was passed) and whether --offline was passed.
+func parseSetupArgs(args []string) (string, bool, error) {
+	if len(args) <= 2 || args[2] == "" {
+		return "", false, nil
+	}
+	if args[2] == "--offline" {
+		return "", true, nil
+	}
+	if args[2][0] == '-' {
+		return "", false, fmt.Errorf("refusing to set user secret to %#v since it looks like a flag", args[2])
+	}
+	return args[2], false, nil
+}
+
 func Setup(args []string) error {
-	userSecret := uuid.Must(uuid.NewRandom()).String()
-	isOffline := false
-	if len(args) > 2 && args[2] != "" {
-		if args[2] == "--offline" {
-			isOffline = true
-		} else {
-			if args[2][0] == '-' {
-				return fmt.Errorf("refusing to set user secret to %#v since it looks like a flag", args[2])
-			}
-			userSecret = args[2]
-		}
+	userSecret, isOffline, err := parseSetupArgs(args)
+	if err != nil {
+		return err
+	}
+	if userSecret == "" {
+		userSecret = uuid.Must(uuid.NewRandom()).String()
 	}
 	fmt.Println("Setting secret hishtory key to " + string(userSecret))
 
@@ -354,8 +632,9 @@ func Setup(args []string) error {
 	config.IsEnabled = true
 	config.DeviceId = uuid.Must(uuid.NewRandom()).String()
 	config.ControlRSearchEnabled = true
+	config.HighlightMatches = true
 	config.IsOffline = isOffline
-	err := hctx.SetConfig(config)
+	err = hctx.SetConfig(config)
 	if err != nil {
 		return fmt.Errorf("failed to persist config to disk: %v", err)
 	}
@@ -393,6 +672,11 @@ func Setup(args []string) error {
 		AddToDbIfNew(db, decEntry)
 	}
 
+	config.HaveSyncedWithBackend = true
+	err = hctx.SetConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to persist config to disk: %v", err)
+	}
 	return nil
 }
 
@@ -430,26 +714,15 @@ func getCustomColumnValue(ctx *context.Context, header string, entry data.Histor
 func buildTableRow(ctx *context.Context, columnNames []string, entry data.HistoryEntry) ([]string, error) {
 	row := make([]string, 0)
 	for _, header := range columnNames {
-		switch header {
-		case "Hostname":
-			row = append(row, entry.Hostname)
-		case "CWD":
-			row = append(row, entry.CurrentWorkingDirectory)
-		case "Timestamp":
-			row = append(row, entry.StartTime.Format(hctx.GetConf(ctx).TimestampFormat))
-		case "Runtime":
-			row = append(row, entry.EndTime.Sub(entry.StartTime).Round(time.Millisecond).String())
-		case "Exit Code":
-			row = append(row, fmt.Sprintf("%d", entry.ExitCode))
-		case "Command":
-			row = append(row, entry.Command)
-		default:
-			customColumnValue, err := getCustomColumnValue(ctx, header, entry)
-			if err != nil {
-				return nil, err
-			}
-			row = append(row, customColumnValue)
+		if formatter, ok := columnFormatters[header]; ok {
+			row = append(row, formatter(ctx, entry))
+			continue
+		}
+		customColumnValue, err := getCustomColumnValue(ctx, header, entry)
+		if err != nil {
+			return nil, err
 		}
+		row = append(row, customColumnValue)
 	}
 	return row, nil
 }
@@ -473,10 +746,10 @@ func DisplayResults(ctx *context.Context, results []*data.HistoryEntry, numResul
 	tbl := table.New(columns...)
 	tbl.WithHeaderFormatter(headerFmt)
 
-	lastCommand := ""
+	duplicates := newDuplicateFilter(config, SearchOptions{})
 	numRows := 0
 	for _, entry := range results {
-		if entry != nil && strings.TrimSpace(entry.Command) == strings.TrimSpace(lastCommand) && config.FilterDuplicateCommands {
+		if entry != nil && duplicates.isDuplicate(entry.Command) {
 			continue
 		}
 		row, err := buildTableRow(ctx, config.DisplayedColumns, *entry)
@@ -485,7 +758,6 @@ func DisplayResults(ctx *context.Context, results []*data.HistoryEntry, numResul
 		}
 		tbl.AddRow(stringArrayToAnyArray(row)...)
 		numRows += 1
-		lastCommand = entry.Command
 		if numRows >= numResults {
 			break
 		}
@@ -571,7 +843,7 @@ func ImportHistory(ctx *context.Context, shouldReadStdin, force bool) (int, erro
 			continue
 		}
 		entry := data.HistoryEntry{
-			LocalUsername:           currentUser.Name,
+			LocalUsername:           currentUser.Username,
 			Hostname:                hostname,
 			Command:                 cmd,
 			CurrentWorkingDirectory: "Unknown",
@@ -659,7 +931,10 @@ func readFileToArray(path string) ([]string, error) {
 	return lines, nil
 }
 
-func Install() error {
+// Installs hishtory. If this is the first install (i.e. there is no config yet), this also sets up a new installation,
+// first running the guided setup unless noSetup is set or there is no interactive terminal. The args are the same as
+// for Setup.
+func Install(args []string, noSetup bool) error {
 	homedir, err := os.UserHomeDir()
 	if err != nil {
 		return fmt.Errorf("failed to get user's home directory: %v", err)
@@ -668,31 +943,82 @@ func Install() error {
 	if err != nil {
 		return err
 	}
+	_, err = hctx.GetConfig()
+	isFirstInstall := err != nil
+	var choices *SetupChoices
+	if isFirstInstall && !noSetup && canRunOnboarding() {
+		c, err := RunOnboarding()
+		if err != nil {
+			return err
+		}
+		choices = &c
+	}
 	path, err := installBinary(homedir)
 	if err != nil {
 		return err
 	}
-	err = configureBashrc(homedir, path)
+	// If the user picked their shell in the guided setup, only that shell is configured
+	shells := supportedShells
+	if choices != nil {
+		shells = []string{choices.Shell}
+	}
+	if containsString(shells, "bash") {
+		err = configureBashrc(homedir, path)
+		if err != nil {
+			return err
+		}
+	}
+	if containsString(shells, "zsh") {
+		err = configureZshrc(homedir, path)
+		if err != nil {
+			return err
+		}
+	}
+	if containsString(shells, "fish") {
+		err = configureFish(homedir, path)
+		if err != nil {
+			return err
+		}
+	}
+	err = handleUpgradedFeatures()
 	if err != nil {
 		return err
 	}
-	err = configureZshrc(homedir, path)
+	if !isFirstInstall {
+		return nil
+	}
+	if choices == nil {
+		return Setup(args)
+	}
+	return setupWithChoices(args, *choices)
+}
+
+// Sets up a new installation based on the choices made in the guided setup
+func setupWithChoices(args []string, choices SetupChoices) error {
+	// A secret key or --offline passed on the command line takes precedence over the choice of whether to sync
+	userSecret, isOffline, err := parseSetupArgs(args)
 	if err != nil {
 		return err
 	}
-	err = configureFish(homedir, path)
+	if !choices.EnableSync && userSecret == "" && !isOffline {
+		args = []string{"hishtory", "install", "--offline"}
+	}
+	err = Setup(args)
 	if err != nil {
 		return err
 	}
-	err = handleUpgradedFeatures()
+	config, err := hctx.GetConfig()
 	if err != nil {
 		return err
 	}
-	_, err = hctx.GetConfig()
+	config.DisplayedColumns = choices.DisplayedColumns
+	config.DisplayTimezone = choices.DisplayTimezone
+	err = hctx.SetConfig(config)
 	if err != nil {
-		// No config, so set up a new installation
-		return Setup(os.Args)
+		return fmt.Errorf("failed to persist config to disk: %v", err)
 	}
+	rcFile := map[string]string{"bash": "~/.bashrc", "zsh": "~/.zshrc", "fish": "~/.config/fish/config.fish"}[choices.Shell]
+	fmt.Printf("Setup complete! Run `source %s` or open a new terminal to start using hishtory.\n", rcFile)
 	return nil
 }
 
@@ -702,16 +1028,24 @@ func handleUpgradedFeatures() error {
 		// No config, so this is a new install and thus there is nothing to do
 		return nil
 	}
-	if strings.Contains(string(configConents), "enable_control_r_search") {
-		// control-r search is already configured, so there is nothing to do
+	hasControlRSearch := strings.Contains(string(configConents), "enable_control_r_search")
+	hasHighlightMatches := strings.Contains(string(configConents), "highlight_matches")
+	if hasControlRSearch && hasHighlightMatches {
+		// Everything is already configured, so there is nothing to do
 		return nil
 	}
-	// Enable control-r search
 	config, err := hctx.GetConfig()
 	if err != nil {
 		return err
 	}
-	config.ControlRSearchEnabled = true
+	if !hasControlRSearch {
+		// Enable control-r search
+		config.ControlRSearchEnabled = true
+	}
+	if !hasHighlightMatches {
+		// Enable highlighting matches, since it is on by default for new installs
+		config.HighlightMatches = true
+	}
 	return hctx.SetConfig(config)
 }
 
@@ -1200,7 +1534,7 @@ func httpClient() *http.Client {
 
 func ApiGet(path string) ([]byte, error) {
 	if os.Getenv("HISHTORY_SIMULATE_NETWORK_ERROR") != "" {
-		return nil, fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev")
+		return nil, classifyApiError(fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev"))
 	}
 	start := time.Now()
 	req, err := http.NewRequest("GET", getServerHostname()+path, nil)
@@ -1210,11 +1544,11 @@ func ApiGet(path string) ([]byte, error) {
 	req.Header.Set("X-Hishtory-Version", "v0."+Version)
 	resp, err := httpClient().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to GET %s%s: %v", getServerHostname(), path, err)
+		return nil, classifyApiError(fmt.Errorf("failed to GET %s%s: %v", getServerHostname(), path, err))
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to GET %s%s: status_code=%d", getServerHostname(), path, resp.StatusCode)
+		return nil, classifyApiError(fmt.Errorf("failed to GET %s%s: status_code=%d", getServerHostname(), path, resp.StatusCode))
 	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -1227,7 +1561,7 @@ func ApiGet(path string) ([]byte, error) {
 
 func ApiPost(path, contentType string, data []byte) ([]byte, error) {
 	if os.Getenv("HISHTORY_SIMULATE_NETWORK_ERROR") != "" {
-		return nil, fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev")
+		return nil, classifyApiError(fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev"))
 	}
 	start := time.Now()
 	req, err := http.NewRequest("POST", getServerHostname()+path, bytes.NewBuffer(data))
@@ -1238,11 +1572,11 @@ func ApiPost(path, contentType string, data []byte) ([]byte, error) {
 	req.Header.Set("X-Hishtory-Version", "v0."+Version)
 	resp, err := httpClient().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to POST %s: %v", path, err)
+		return nil, classifyApiError(fmt.Errorf("failed to POST %s: %v", path, err))
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to POST %s: status_code=%d", path, resp.StatusCode)
+		return nil, classifyApiError(fmt.Errorf("failed to POST %s: status_code=%d", path, resp.StatusCode))
 	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -1253,19 +1587,6 @@ func ApiPost(path, contentType string, data []byte) ([]byte, error) {
 	return respBody, nil
 }
 
-func IsOfflineError(err error) bool {
-	if err == nil {
-		return false
-	}
-	return strings.Contains(err.Error(), "dial tcp: lookup api.hishtory.dev") ||
-		strings.Contains(err.Error(), "connect: network is unreachable") ||
-		strings.Contains(err.Error(), "read: connection reset by peer") ||
-		strings.Contains(err.Error(), ": EOF") ||
-		strings.Contains(err.Error(), ": status_code=502") ||
-		strings.Contains(err.Error(), ": status_code=503") ||
-		strings.Contains(err.Error(), ": i/o timeout")
-}
-
 func ReliableDbCreate(db *gorm.DB, entry interface{}) error {
 	var err error = nil
 	i := 0
@@ -1353,6 +1674,103 @@ func Redact(ctx *context.Context, query string, force bool) error {
 	return nil
 }
 
+// Re-applies the current recording rules (e.g. never_record_programs) to the existing history so that entries
+// that would no longer be recorded are removed, both locally and on any other devices. Returns the entries that
+// matched. If dryRun is set, the matching entries are returned without deleting anything.
+func Reclassify(ctx *context.Context, dryRun bool) ([]*data.HistoryEntry, error) {
+	db := hctx.GetDb(ctx)
+	config := hctx.GetConf(ctx)
+	entries, err := Search(ctx, db, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for entries to reclassify: %v", err)
+	}
+	matches := make([]*data.HistoryEntry, 0)
+	for _, entry := range entries {
+		if isNeverRecordedProgram(config, entry.Command) {
+			matches = append(matches, entry)
+		}
+	}
+	if dryRun || len(matches) == 0 {
+		return matches, nil
+	}
+	for _, entry := range matches {
+		res := db.Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime).Delete(&data.HistoryEntry{})
+		if res.Error != nil {
+			return nil, fmt.Errorf("DB error: %v", res.Error)
+		}
+	}
+	err = deleteOnRemoteInstances(ctx, matches)
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// Deletes the given entry from the local DB and sends a deletion request so that it is also deleted on all other devices
+func DeleteEntry(ctx *context.Context, entry *data.HistoryEntry) error {
+	return DeleteEntries(ctx, []*data.HistoryEntry{entry})
+}
+
+// Deletes the given entries locally and on all remote instances, with a single deletion request for all of them
+func DeleteEntries(ctx *context.Context, entries []*data.HistoryEntry) error {
+	err := deleteEntriesLocally(ctx, entries)
+	if err != nil {
+		return err
+	}
+	return deleteOnRemoteInstances(ctx, entries)
+}
+
+// Deletes the given entries from the local DB only
+func deleteEntriesLocally(ctx *context.Context, entries []*data.HistoryEntry) error {
+	for _, entry := range entries {
+		res := hctx.GetDb(ctx).Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime).Delete(&data.HistoryEntry{})
+		if res.Error != nil {
+			return fmt.Errorf("DB error: %v", res.Error)
+		}
+	}
+	return nil
+}
+
+// Re-inserts entries that were deleted from the local DB (see deleteEntriesLocally)
+func restoreEntriesLocally(ctx *context.Context, entries []*data.HistoryEntry) error {
+	db := hctx.GetDb(ctx)
+	for _, entry := range entries {
+		if err := ReliableDbCreate(db, *entry); err != nil {
+			return fmt.Errorf("failed to restore entry: %v", err)
+		}
+	}
+	return nil
+}
+
+// Re-creates entries that were deleted via DeleteEntries, after the deletion request was already sent to the backend.
+// Since every device keeps applying the deletion request whenever it syncs, the entries are re-created with an end time
+// that is a millisecond later so that they no longer match it, and are then uploaded so that they're also re-created on
+// other devices. Returns the re-created entries.
+func RecreateDeletedEntries(ctx *context.Context, entries []*data.HistoryEntry) ([]*data.HistoryEntry, error) {
+	recreated := make([]*data.HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		e := *entry
+		e.EndTime = e.EndTime.Add(time.Millisecond)
+		recreated = append(recreated, &e)
+	}
+	if err := restoreEntriesLocally(ctx, recreated); err != nil {
+		return nil, err
+	}
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return recreated, nil
+	}
+	jsonValue, err := EncryptAndMarshal(config, recreated)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", jsonValue)
+	if err != nil {
+		return recreated, fmt.Errorf("failed to upload the re-created entries, so they were only re-created on this device: %v", err)
+	}
+	return recreated, nil
+}
+
 func deleteOnRemoteInstances(ctx *context.Context, historyEntries []*data.HistoryEntry) error {
 	config := hctx.GetConf(ctx)
 	if config.IsOffline {
@@ -1382,6 +1800,11 @@ func Reupload(ctx *context.Context) error {
 	if config.IsOffline {
 		return nil
 	}
+	return reuploadWithConfig(ctx, config)
+}
+
+// Reuploads all local entries, encrypted with the secret from the given config
+func reuploadWithConfig(ctx *context.Context, config hctx.ClientConfig) error {
 	entries, err := Search(ctx, hctx.GetDb(ctx), "", 0)
 	if err != nil {
 		return fmt.Errorf("failed to reupload due to failed search: %v", err)
@@ -1399,6 +1822,40 @@ func Reupload(ctx *context.Context) error {
 	return nil
 }
 
+// Rotates the secret key used to encrypt history entries that are synced to the backend. Returns the new secret,
+// which must then be used to run `hishtory init` on all other devices. The local history is preserved and is
+// reuploaded encrypted with the new key. The new key is only persisted once everything else has succeeded, so a
+// failure part-way through leaves the existing key in place.
+func RotateKey(ctx *context.Context) (string, error) {
+	config := hctx.GetConf(ctx)
+	newConfig := config
+	newConfig.UserSecret = uuid.Must(uuid.NewRandom()).String()
+	newConfig.DeviceId = uuid.Must(uuid.NewRandom()).String()
+	if !config.IsOffline {
+		// First, retrieve anything that is pending with the old key so that it isn't lost
+		err := RetrieveAdditionalEntriesFromRemote(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to retrieve pending entries with the old key: %v", err)
+		}
+		// Then register as a new device for the new key and upload everything encrypted with the new key
+		_, err = ApiGet("/api/v1/register?user_id=" + data.UserId(newConfig.UserSecret) + "&device_id=" + newConfig.DeviceId)
+		if err != nil {
+			return "", fmt.Errorf("failed to register device with backend: %v", err)
+		}
+		err = reuploadWithConfig(ctx, newConfig)
+		if err != nil {
+			return "", err
+		}
+	}
+	newConfig.HaveMissedUploads = false
+	newConfig.MissedUploadTimestamp = 0
+	err := hctx.SetConfig(newConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to persist config with the new key: %v", err)
+	}
+	return newConfig.UserSecret, nil
+}
+
 func chunks[k any](slice []k, chunkSize int) [][]k {
 	var chunks [][]k
 	for i := 0; i < len(slice); i += chunkSize {
@@ -1411,13 +1868,65 @@ func chunks[k any](slice []k, chunkSize int) [][]k {
 	return chunks
 }
 
+func getPendingUploadsPath(ctx *context.Context) string {
+	return path.Join(hctx.GetHome(ctx), data.HISHTORY_PATH, data.PENDING_UPLOADS_PATH)
+}
+
+// Queues the given (already encrypted) request body for /api/v1/submit to be uploaded later via UploadPendingEntries.
+// This is used in RemoteOnly mode when the device is offline, since there is no local DB to retry the upload from.
+func QueuePendingUpload(ctx *context.Context, jsonValue []byte) error {
+	f, err := os.OpenFile(getPendingUploadsPath(ctx), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open the pending uploads file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(jsonValue, '\n')); err != nil {
+		return fmt.Errorf("failed to queue a pending upload: %v", err)
+	}
+	return nil
+}
+
+// Uploads the entries that were queued via QueuePendingUpload. Any that still fail to upload because the device is
+// offline stay queued for the next attempt.
+func UploadPendingEntries(ctx *context.Context) error {
+	pendingUploadsPath := getPendingUploadsPath(ctx)
+	contents, err := os.ReadFile(pendingUploadsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the pending uploads file: %v", err)
+	}
+	config := hctx.GetConf(ctx)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		_, err := ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", []byte(line))
+		if IsOfflineError(err) {
+			// Keep the ones that haven't been uploaded yet, and try again later
+			return os.WriteFile(pendingUploadsPath, []byte(strings.Join(lines[i:], "\n")+"\n"), 0o600)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(pendingUploadsPath)
+}
+
 func RetrieveAdditionalEntriesFromRemote(ctx *context.Context) error {
 	db := hctx.GetDb(ctx)
 	config := hctx.GetConf(ctx)
 	if config.IsOffline {
 		return nil
 	}
-	respBody, err := ApiGet("/api/v1/query?device_id=" + config.DeviceId + "&user_id=" + data.UserId(config.UserSecret))
+	url := "/api/v1/query?device_id=" + config.DeviceId + "&user_id=" + data.UserId(config.UserSecret)
+	if config.RemoteOnly {
+		// There is no local DB, so we have to retrieve everything rather than just the entries that are new to this device
+		url = "/api/v1/bootstrap?user_id=" + data.UserId(config.UserSecret) + "&device_id=" + config.DeviceId
+	}
+	respBody, err := ApiGet(url)
 	if IsOfflineError(err) {
 		return nil
 	}
@@ -1439,6 +1948,14 @@ func RetrieveAdditionalEntriesFromRemote(ctx *context.Context) error {
 	return ProcessDeletionRequests(ctx)
 }
 
+// Whether this device has never successfully synced with the backend, e.g. because it was installed while offline or
+// because the backend is unreachable from this network. This is recorded when the device is set up and whenever it
+// successfully uploads an entry.
+func HasNeverSynced(ctx *context.Context) bool {
+	config := hctx.GetConf(ctx)
+	return !config.IsOffline && !config.HaveSyncedWithBackend
+}
+
 func ProcessDeletionRequests(ctx *context.Context) error {
 	config := hctx.GetConf(ctx)
 	if config.IsOffline {
@@ -1501,72 +2018,678 @@ func tweakConfigForTests(configContents string) (string, error) {
 }
 
 func parseTimeGenerously(input string) (time.Time, error) {
+	if t, ok := parseRelativeTime(input, time.Now()); ok {
+		return t, nil
+	}
 	input = strings.ReplaceAll(input, "_", " ")
 	return dateparse.ParseLocal(input)
 }
 
-func MakeWhereQueryFromSearch(ctx *context.Context, db *gorm.DB, query string) (*gorm.DB, error) {
-	tokens, err := tokenize(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to tokenize query: %v", err)
+var relativeTimeRegex = regexp.MustCompile(`^(\d+)([smhdw])$`)
+
+// Parses a time relative to now, either as a duration ago (e.g. 30m, 2h, 7d, or 1w) or as one of today and
+// yesterday (which refer to the start of that day). Returns false if the input isn't a relative time.
+func parseRelativeTime(input string, now time.Time) (time.Time, bool) {
+	switch strings.ToLower(input) {
+	case "today":
+		year, month, day := now.Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, now.Location()), true
+	case "yesterday":
+		year, month, day := now.Date()
+		return time.Date(year, month, day-1, 0, 0, 0, 0, now.Location()), true
 	}
-	tx := db.Model(&data.HistoryEntry{}).Where("true")
+	matches := relativeTimeRegex.FindStringSubmatch(input)
+	if matches == nil {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[matches[2]]
+	return now.Add(-time.Duration(n) * unit), true
+}
+
+func MakeWhereQueryFromSearch(ctx *context.Context, db *gorm.DB, query string) (*gorm.DB, error) {
+	query, countAtoms, err := extractCountAtoms(query)
+	if err != nil {
+		return nil, err
+	}
+	clause, args, err := makeWhereClauseFromSearch(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	tx := db.Model(&data.HistoryEntry{}).Where(clause, args...)
+	return applyCountAtoms(tx, countAtoms, func() (*gorm.DB, error) {
+		return MakeWhereQueryFromSearch(ctx, db, query)
+	})
+}
+
+// Builds the where clause for a search query. Search terms are ANDed together by default (or explicitly via AND), and
+// can be combined via OR. AND binds more tightly than OR, so `a b OR c` matches entries that contain both a and b, or
+// that contain c. A term can be negated by prefixing it with - or by preceding it with NOT.
+func makeWhereClauseFromSearch(ctx *context.Context, query string) (string, []interface{}, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to tokenize query: %v", err)
+	}
+	// Each group is a list of clauses that are ANDed together, and the groups are ORed together
+	groups := [][]string{{}}
+	args := make([]interface{}, 0)
+	negateNext := false
+	pendingOperator := ""
 	for _, token := range tokens {
-		if strings.HasPrefix(token, "-") {
-			if strings.Contains(token, ":") {
-				query, v1, v2, err := parseAtomizedToken(ctx, token[1:])
-				if err != nil {
-					return nil, err
-				}
-				tx = tx.Where("NOT "+query, v1, v2)
-			} else {
-				query, v1, v2, v3, err := parseNonAtomizedToken(token[1:])
-				if err != nil {
-					return nil, err
-				}
-				tx = tx.Where("NOT "+query, v1, v2, v3)
+		group := groups[len(groups)-1]
+		switch token {
+		case "OR", "AND":
+			if len(group) == 0 || negateNext || pendingOperator != "" {
+				return "", nil, fmt.Errorf("%s must be between two search terms", token)
 			}
-		} else if strings.Contains(token, ":") {
-			query, v1, v2, err := parseAtomizedToken(ctx, token)
-			if err != nil {
-				return nil, err
+			if token == "OR" {
+				groups = append(groups, []string{})
 			}
-			tx = tx.Where(query, v1, v2)
-		} else {
-			query, v1, v2, v3, err := parseNonAtomizedToken(token)
-			if err != nil {
-				return nil, err
+			pendingOperator = token
+			continue
+		case "NOT":
+			if negateNext {
+				return "", nil, fmt.Errorf("NOT must be followed by a search term")
 			}
-			tx = tx.Where(query, v1, v2, v3)
+			negateNext = true
+			continue
+		}
+		clause, tokenArgs, err := parseSearchToken(ctx, token)
+		if err != nil {
+			return "", nil, err
 		}
+		if negateNext {
+			clause = "NOT " + clause
+			negateNext = false
+		}
+		pendingOperator = ""
+		groups[len(groups)-1] = append(group, clause)
+		args = append(args, tokenArgs...)
 	}
-	return tx, nil
+	if negateNext {
+		return "", nil, fmt.Errorf("NOT must be followed by a search term")
+	}
+	if pendingOperator != "" {
+		return "", nil, fmt.Errorf("%s must be between two search terms", pendingOperator)
+	}
+	if len(groups) == 1 && len(groups[0]) == 0 {
+		return "true", args, nil
+	}
+	orClauses := make([]string, 0, len(groups))
+	for _, group := range groups {
+		orClauses = append(orClauses, "("+strings.Join(group, " AND ")+")")
+	}
+	return "(" + strings.Join(orClauses, " OR ") + ")", args, nil
+}
+
+// Returns the where clause and its arguments for a single search term, which may be an atom (e.g. cwd:/tmp) and may
+// be negated via a - prefix
+func parseSearchToken(ctx *context.Context, token string) (string, []interface{}, error) {
+	if strings.HasPrefix(token, "-tag:") {
+		query, args, err := parseTagToken(ctx, strings.TrimPrefix(token, "-tag:"))
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT " + query, args, nil
+	} else if strings.HasPrefix(token, "tag:") {
+		return parseTagToken(ctx, strings.TrimPrefix(token, "tag:"))
+	} else if strings.HasPrefix(token, "-") {
+		if strings.Contains(token, ":") {
+			query, v1, v2, err := parseAtomizedToken(ctx, token[1:])
+			if err != nil {
+				return "", nil, err
+			}
+			return "NOT " + query, atomArgs(v1, v2), nil
+		}
+		query, args, err := parseNonAtomizedToken(ctx, token[1:])
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT " + query, args, nil
+	} else if strings.Contains(token, ":") {
+		query, v1, v2, err := parseAtomizedToken(ctx, token)
+		if err != nil {
+			return "", nil, err
+		}
+		return query, atomArgs(v1, v2), nil
+	}
+	return parseNonAtomizedToken(ctx, token)
+}
+
+// Options that control how the results of SearchForDisplay are returned
+type SearchOptions struct {
+	// Whether to return the oldest entries first, rather than the default of the newest entries first
+	Reverse bool
+	// Whether to include entries that were marked as sensitive
+	ShowSensitive bool
+	// Whether to only return entries from the current shell session
+	CurrentSessionOnly bool
+	// Overrides how duplicate commands are filtered out of the displayed results (one of the DEDUP_* constants).
+	// If empty, this is determined by the config.
+	DedupMode string
+	// The number of matching entries to skip, e.g. to load the next page of results
+	Offset int
+	// The column to sort the results by (one of the keys of sortableColumns), rather than the default of by time
+	SortColumn string
+	// Whether to sort by SortColumn in ascending order, rather than the default of descending order
+	SortAscending bool
+	// Whether to only display the first (e.g. most recent) entry in each directory
+	UniqueDirectories bool
+}
+
+// The SQL expressions that the results can be sorted by for each of the columns that support sorting. Commands that
+// haven't finished don't have a runtime, so they're sorted after every other entry.
+var sortableColumns = map[string]string{
+	"Timestamp": "start_time",
+	"Runtime":   "CASE WHEN julianday(end_time) >= julianday(start_time) THEN julianday(end_time) - julianday(start_time) END",
+	"Exit Code": "exit_code",
+	"Command":   "command",
+	"Hostname":  "hostname",
+	"CWD":       "current_working_directory",
+	"User":      "local_username",
+	"Session":   "session_id",
 }
 
 func Search(ctx *context.Context, db *gorm.DB, query string, limit int) ([]*data.HistoryEntry, error) {
+	return search(ctx, db, query, limit, SearchOptions{}, false)
+}
+
+// Search for history entries that will be displayed to the user. Unlike Search, this excludes entries that
+// the user has configured to be hidden by default (e.g. via HiddenPrograms). Search should still be used
+// for internal operations (e.g. reuploading) that need to operate on every entry.
+func SearchForDisplay(ctx *context.Context, db *gorm.DB, query string, limit int, opts SearchOptions) ([]*data.HistoryEntry, error) {
+	return search(ctx, db, query, limit, opts, true)
+}
+
+// Returns the entries matching the given query, exactly as they would be displayed to the user (i.e. with the same
+// default filters as SearchForDisplay and with duplicates filtered out based on the config), newest first. This is the
+// stable API for other tools that want to search the history. A limit of 0 returns all of the matching entries.
+func QueryEntries(ctx *context.Context, query string, limit int) ([]data.HistoryEntry, error) {
+	entries, _, err := queryEntriesForDisplay(ctx, query, limit, SearchOptions{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]data.HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		results = append(results, *entry)
+	}
+	return results, nil
+}
+
+// Searches for the entries to display for the given query and filters out duplicates. Also returns the number of
+// entries that were found before the duplicates were filtered out, which is limit if there may be more results. When
+// loading a later page of results (via opts.Offset), previousEntries are the entries that were already loaded so that
+// the results are deduplicated against them too.
+func queryEntriesForDisplay(ctx *context.Context, query string, limit int, opts SearchOptions, previousEntries []*data.HistoryEntry) ([]*data.HistoryEntry, int, error) {
+	searchResults, err := SearchForDisplay(ctx, hctx.GetDb(ctx), query, limit, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]*data.HistoryEntry, 0, len(searchResults))
+	duplicates := newDuplicateFilter(hctx.GetConf(ctx), opts)
+	seenDirectories := make(map[string]bool)
+	for _, entry := range previousEntries {
+		// Any previous entries that were filtered out were duplicates of ones that were kept, so these are enough to
+		// restore the state of the filter
+		duplicates.isDuplicate(entry.Command)
+		seenDirectories[entry.CurrentWorkingDirectory] = true
+	}
+	for _, entry := range searchResults {
+		if opts.UniqueDirectories {
+			// There is already only one entry per directory, so duplicate commands don't need to be filtered out too
+			if !seenDirectories[entry.CurrentWorkingDirectory] {
+				seenDirectories[entry.CurrentWorkingDirectory] = true
+				entries = append(entries, entry)
+			}
+		} else if !duplicates.isDuplicate(entry.Command) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, len(searchResults), nil
+}
+
+// Returns the most recent entry for each of the pinned commands that matches the given query (with the same filtering
+// as SearchForDisplay), in the order that the commands were pinned
+func getPinnedEntries(ctx *context.Context, query string, opts SearchOptions) ([]*data.HistoryEntry, error) {
+	pinnedCommands := hctx.GetConf(ctx).PinnedCommands
+	if len(pinnedCommands) == 0 {
+		return nil, nil
+	}
+	tx, err := makeSearchQuery(ctx, hctx.GetDb(ctx), query, opts, true)
+	if err != nil {
+		return nil, &SearchError{Query: query, Err: err}
+	}
+	var matches []*data.HistoryEntry
+	result := tx.Where("command IN ?", pinnedCommands).Order("end_time DESC").Find(&matches)
+	if result.Error != nil {
+		return nil, &SearchError{Query: query, Err: fmt.Errorf("DB query error: %v", result.Error)}
+	}
+	latest := make(map[string]*data.HistoryEntry)
+	for _, entry := range matches {
+		if _, ok := latest[entry.Command]; !ok {
+			latest[entry.Command] = entry
+		}
+	}
+	entries := make([]*data.HistoryEntry, 0)
+	for _, command := range pinnedCommands {
+		if entry, ok := latest[command]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Count the total number of history entries that match the given query and that would be displayed by SearchForDisplay
+// if it weren't for the limit.
+func CountForDisplay(ctx *context.Context, db *gorm.DB, query string, opts SearchOptions) (int64, error) {
+	tx, err := makeSearchQuery(ctx, db, query, opts, true)
+	if err != nil {
+		return 0, &SearchError{Query: query, Err: err}
+	}
+	var count int64
+	result := tx.Count(&count)
+	if result.Error != nil {
+		return 0, &SearchError{Query: query, Err: fmt.Errorf("DB query error: %v", result.Error)}
+	}
+	return count, nil
+}
+
+// A directory that commands in a set of results were run in, along with the number of those commands
+type DirectoryCount struct {
+	Directory string
+	Count     int
+}
+
+// Returns the distinct directories that the results for the given query were run in (with the same filtering as
+// SearchForDisplay), sorted so that the directories with the most results are first.
+func DistinctDirectoriesForDisplay(ctx *context.Context, db *gorm.DB, query string, opts SearchOptions) ([]DirectoryCount, error) {
+	tx, err := makeSearchQuery(ctx, db, query, opts, true)
+	if err != nil {
+		return nil, &SearchError{Query: query, Err: err}
+	}
+	var directories []DirectoryCount
+	result := tx.Select("current_working_directory AS directory, COUNT(*) AS count").Group("current_working_directory").Order("count DESC, directory").Scan(&directories)
+	if result.Error != nil {
+		return nil, &SearchError{Query: query, Err: fmt.Errorf("DB query error: %v", result.Error)}
+	}
+	return directories, nil
+}
+
+// Returns the entries that were run just before and after the given entry (up to numLines of each, with the same
+// filtering as SearchForDisplay), oldest first, along with the index of the given entry. If the entry's shell session
+// was recorded, only entries from that session are included, and otherwise only entries from the same host.
+func ContextEntriesForDisplay(ctx *context.Context, db *gorm.DB, entry *data.HistoryEntry, numLines int, opts SearchOptions) ([]*data.HistoryEntry, int, error) {
+	getNeighbors := func(comparison, order string) ([]*data.HistoryEntry, error) {
+		tx, err := makeSearchQuery(ctx, db, "", SearchOptions{ShowSensitive: opts.ShowSensitive}, true)
+		if err != nil {
+			return nil, err
+		}
+		if entry.SessionId != "" {
+			tx = tx.Where("session_id = ?", entry.SessionId)
+		} else {
+			tx = tx.Where("hostname = ?", entry.Hostname)
+		}
+		var neighbors []*data.HistoryEntry
+		result := tx.Where("julianday(start_time) "+comparison+" julianday(?)", entry.StartTime).Order("start_time " + order).Limit(numLines).Find(&neighbors)
+		if result.Error != nil {
+			return nil, fmt.Errorf("DB query error: %v", result.Error)
+		}
+		return neighbors, nil
+	}
+	before, err := getNeighbors("<", "DESC")
+	if err != nil {
+		return nil, 0, err
+	}
+	after, err := getNeighbors(">", "ASC")
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]*data.HistoryEntry, 0, len(before)+len(after)+1)
+	for i := len(before) - 1; i >= 0; i-- {
+		entries = append(entries, before[i])
+	}
+	entries = append(entries, entry)
+	entries = append(entries, after...)
+	return entries, len(before), nil
+}
+
+// Returns the distinct directories that commands were most recently run in, most recent first
+func RecentDirectoriesForDisplay(ctx *context.Context, db *gorm.DB, limit int) ([]string, error) {
+	var directories []string
+	result := db.Model(&data.HistoryEntry{}).
+		Select("current_working_directory").
+		Where("current_working_directory != ''").
+		Group("current_working_directory").
+		Order("MAX(start_time) DESC").
+		Limit(limit).
+		Scan(&directories)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	return directories, nil
+}
+
+func makeSearchQuery(ctx *context.Context, db *gorm.DB, query string, opts SearchOptions, applyDefaultFilters bool) (*gorm.DB, error) {
 	if ctx == nil && query != "" {
 		return nil, fmt.Errorf("lib.Search called with a nil context and a non-empty query (this should never happen)")
 	}
-
+	query, countAtoms, err := extractCountAtoms(query)
+	if err != nil {
+		return nil, err
+	}
+	searchQuery := query
 	tx, err := MakeWhereQueryFromSearch(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
-	tx = tx.Order("end_time DESC")
-	if limit > 0 {
-		tx = tx.Limit(limit)
+	if applyDefaultFilters && hctx.GetConf(ctx).DefaultFilter != "" {
+		// The default filter is applied separately so that any ORs in the query don't apply to it
+		clause, args, err := makeWhereClauseFromSearch(ctx, hctx.GetConf(ctx).DefaultFilter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the default filter: %v", err)
+		}
+		tx = tx.Where(clause, args...)
+		query = hctx.GetConf(ctx).DefaultFilter + " " + query
+	}
+	if applyDefaultFilters {
+		tx, err = addDefaultFilters(ctx, tx, query, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.CurrentSessionOnly {
+		tx = tx.Where("session_id = ?", getSessionId())
+	}
+	// The commands are counted within the rest of the search, so that e.g. `count:>5 host:laptop` only counts the runs
+	// on laptop and hidden entries aren't counted
+	return applyCountAtoms(tx, countAtoms, func() (*gorm.DB, error) {
+		return makeSearchQuery(ctx, db, searchQuery, opts, applyDefaultFilters)
+	})
+}
+
+func search(ctx *context.Context, db *gorm.DB, query string, limit int, opts SearchOptions, applyDefaultFilters bool) ([]*data.HistoryEntry, error) {
+	tx, err := makeSearchQuery(ctx, db, query, opts, applyDefaultFilters)
+	if err != nil {
+		return nil, &SearchError{Query: query, Err: err}
+	}
+	if opts.SortColumn != "" {
+		expression, ok := sortableColumns[opts.SortColumn]
+		if !ok {
+			return nil, &SearchError{Query: query, Err: fmt.Errorf("results can't be sorted by the %#v column", opts.SortColumn)}
+		}
+		direction := "DESC"
+		if opts.SortAscending {
+			direction = "ASC"
+		}
+		// Entries with the same value are kept in the default order, so that sorting is stable
+		tx = tx.Order(expression + " " + direction + " NULLS LAST").Order("end_time DESC")
+	}
+	fuzzyTerms, err := getFuzzySearchTerms(ctx, query)
+	if err != nil {
+		return nil, &SearchError{Query: query, Err: err}
+	}
+	// Internal operations (e.g. reuploading) don't care about the order that is displayed to the user
+	rankingStrategy := RANKING_RECENCY
+	if applyDefaultFilters {
+		rankingStrategy, err = getRankingStrategy(ctx)
+		if err != nil {
+			return nil, &SearchError{Query: query, Err: err}
+		}
+	}
+	if opts.SortColumn != "" {
+		// An explicitly chosen sort order takes precedence over ranking the results
+		fuzzyTerms = nil
+		rankingStrategy = RANKING_RECENCY
+	}
+	if opts.SortColumn == "" {
+		direction := "DESC"
+		if opts.Reverse {
+			direction = "ASC"
+		}
+		if rankingStrategy != RANKING_RECENCY {
+			// The frequencies are counted over the same search, so that the DB can still apply the offset and limit
+			counts, err := makeSearchQuery(ctx, db, query, opts, applyDefaultFilters)
+			if err != nil {
+				return nil, &SearchError{Query: query, Err: err}
+			}
+			tx, err = orderByFrequency(ctx, tx, counts, rankingStrategy == RANKING_FREQUENCY_IN_CWD, direction)
+			if err != nil {
+				return nil, &SearchError{Query: query, Err: err}
+			}
+		}
+		tx = tx.Order("end_time " + direction)
+	}
+	// Fuzzy matches are ranked after they are retrieved, so every match has to be retrieved before the offset and limit
+	// can be applied
+	isRanked := len(fuzzyTerms) > 0
+	if !isRanked {
+		if opts.Offset > 0 {
+			tx = tx.Offset(opts.Offset)
+		}
+		if limit > 0 {
+			tx = tx.Limit(limit)
+		}
 	}
 	var historyEntries []*data.HistoryEntry
 	result := tx.Find(&historyEntries)
 	if result.Error != nil {
-		return nil, fmt.Errorf("DB query error: %v", result.Error)
+		return nil, &SearchError{Query: query, Err: fmt.Errorf("DB query error: %v", result.Error)}
+	}
+	if isRanked {
+		// The fuzzy ranking is stable, so entries that match equally well stay in the order from the ranking strategy
+		historyEntries = rankFuzzyMatches(historyEntries, fuzzyTerms)
+		historyEntries = historyEntries[min(opts.Offset, len(historyEntries)):]
+		if limit > 0 && len(historyEntries) > limit {
+			historyEntries = historyEntries[:limit]
+		}
 	}
 	return historyEntries, nil
 }
 
-func parseNonAtomizedToken(token string) (string, interface{}, interface{}, interface{}, error) {
-	wildcardedToken := "%" + token + "%"
-	return "(command LIKE ? OR hostname LIKE ? OR current_working_directory LIKE ?)", wildcardedToken, wildcardedToken, wildcardedToken, nil
+// Returns the search terms in the given query that are matched fuzzily, i.e. those that aren't atoms, operators, or
+// negated. If fuzzy search is disabled, there are none.
+func getFuzzySearchTerms(ctx *context.Context, query string) ([]string, error) {
+	if ctx == nil || !hctx.GetConf(ctx).FuzzySearch {
+		return nil, nil
+	}
+	return getSearchTerms(query)
+}
+
+// Returns the search terms in the given query that commands are matched against, i.e. the tokens that aren't atoms,
+// operators, or negated
+func getSearchTerms(query string) ([]string, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize query: %v", err)
+	}
+	terms := make([]string, 0)
+	for i, token := range tokens {
+		if token == "OR" || token == "AND" || token == "NOT" || (i > 0 && tokens[i-1] == "NOT") {
+			continue
+		}
+		if token != "" && !strings.HasPrefix(token, "-") && !strings.Contains(token, ":") {
+			terms = append(terms, token)
+		}
+	}
+	return terms, nil
+}
+
+// Scores how closely the given command matches the pattern, where every character of the pattern must appear in the
+// command in order (ignoring case). Characters that are next to each other or at the start of a word score higher, and
+// gaps between them score lower. Returns the score, the indices of the matched runes in the command, and whether it
+// matched at all. Every possible starting position is tried so that e.g. "commit" prefers a later exact match over an
+// earlier scattered one.
+func fuzzyScore(pattern, command string) (int, []int, bool) {
+	patternRunes := []rune(strings.ToLower(pattern))
+	commandRunes := []rune(strings.ToLower(command))
+	if len(patternRunes) == 0 {
+		return 0, nil, true
+	}
+	bestScore := 0
+	var bestPositions []int
+	for start := range commandRunes {
+		if commandRunes[start] != patternRunes[0] {
+			continue
+		}
+		positions := make([]int, 0, len(patternRunes))
+		score := 0
+		p := 0
+		for i := start; i < len(commandRunes) && p < len(patternRunes); i++ {
+			if commandRunes[i] != patternRunes[p] {
+				continue
+			}
+			score += 1
+			if len(positions) > 0 {
+				gap := i - positions[len(positions)-1] - 1
+				if gap == 0 {
+					score += 5
+				} else {
+					score -= min(gap, 5)
+				}
+			}
+			if i == 0 || !unicode.IsLetter(commandRunes[i-1]) && !unicode.IsDigit(commandRunes[i-1]) {
+				score += 3
+			}
+			positions = append(positions, i)
+			p++
+		}
+		if p < len(patternRunes) {
+			// Later starting positions have even fewer characters to match against
+			break
+		}
+		if bestPositions == nil || score > bestScore {
+			bestScore = score
+			bestPositions = positions
+		}
+	}
+	return bestScore, bestPositions, bestPositions != nil
+}
+
+// Sorts the given entries so that those whose commands best match the fuzzy search terms are first. The sort is stable
+// so that entries with the same score stay in their existing (i.e. recency) order. Entries that matched a term via their
+// hostname or directory rather than their command don't score anything for that term.
+func rankFuzzyMatches(entries []*data.HistoryEntry, terms []string) []*data.HistoryEntry {
+	scores := make(map[*data.HistoryEntry]int, len(entries))
+	for _, entry := range entries {
+		for _, term := range terms {
+			if score, _, ok := fuzzyScore(term, entry.Command); ok {
+				scores[entry] += score
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return scores[entries[i]] > scores[entries[j]]
+	})
+	return entries
+}
+
+// Orders the given search so that the commands that were run the most often (or, if inCwd is set, the most often in the
+// current directory) are first, where counts is the same search that the frequencies are computed over. All of the
+// entries for a command are kept together, with ties broken by the most recent entry for each command (or the oldest,
+// if direction is ASC). Commands that were never run in the current directory are left in the order the caller applies.
+func orderByFrequency(ctx *context.Context, tx, counts *gorm.DB, inCwd bool, direction string) (*gorm.DB, error) {
+	frequency := "COUNT(*)"
+	args := make([]interface{}, 0)
+	if inCwd {
+		cwd, _, err := getCwd(ctx)
+		if err != nil {
+			return nil, err
+		}
+		frequency = "SUM(CASE WHEN RTRIM(current_working_directory, '/') = ? THEN 1 ELSE 0 END)"
+		args = append(args, strings.TrimSuffix(cwd, "/"))
+	}
+	lastRun := "MAX(end_time)"
+	if direction == "ASC" {
+		lastRun = "MIN(end_time)"
+	}
+	// The command is renamed so that it doesn't conflict with the command column that the search filters on
+	frequencies := counts.Select("command AS ranked_command, "+frequency+" AS frequency, "+lastRun+" AS last_run", args...).Group("command")
+	return tx.Select("history_entries.*").
+		Joins("JOIN (?) AS frequencies ON frequencies.ranked_command = history_entries.command", frequencies).
+		Order("frequency DESC").
+		Order("CASE WHEN frequency > 0 THEN last_run END " + direction), nil
+}
+
+func addDefaultFilters(ctx *context.Context, tx *gorm.DB, query string, opts SearchOptions) (*gorm.DB, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize query: %v", err)
+	}
+	explicitlySearchedPrograms := make([]string, 0)
+	for _, token := range tokens {
+		if strings.HasPrefix(token, "program:") {
+			explicitlySearchedPrograms = append(explicitlySearchedPrograms, strings.TrimPrefix(token, "program:"))
+		}
+	}
+	for _, program := range hctx.GetConf(ctx).HiddenPrograms {
+		if containsString(explicitlySearchedPrograms, program) {
+			// The user explicitly asked for this program, so don't hide it
+			continue
+		}
+		query, v1, v2, err := parseAtomizedToken(ctx, "program:"+program)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("NOT "+query, v1, v2)
+	}
+	if !opts.ShowSensitive {
+		tx = tx.Where("COALESCE(is_sensitive, 0) = 0")
+	}
+	return tx, nil
+}
+
+// Marks (or unmarks) the given entry as sensitive, so that it is hidden unless sensitive entries are explicitly requested.
+// Synced entries can't be updated in place, so the entry is re-created with the new sensitivity (see
+// RecreateDeletedEntries) and the original is deleted on other devices. The given entry is updated to match.
+func SetSensitive(ctx *context.Context, entry *data.HistoryEntry, isSensitive bool) error {
+	original := *entry
+	updated := *entry
+	updated.IsSensitive = isSensitive
+	if err := deleteEntriesLocally(ctx, []*data.HistoryEntry{&original}); err != nil {
+		return err
+	}
+	recreated, err := RecreateDeletedEntries(ctx, []*data.HistoryEntry{&updated})
+	if len(recreated) > 0 {
+		*entry = *recreated[0]
+	}
+	if err != nil {
+		return err
+	}
+	return deleteOnRemoteInstances(ctx, []*data.HistoryEntry{&original})
+}
+
+func parseNonAtomizedToken(ctx *context.Context, token string) (string, []interface{}, error) {
+	// GLOB is the case-sensitive equivalent of LIKE
+	caseSensitive := ctx != nil && hctx.GetConf(ctx).CaseSensitiveSearch
+	operator := "LIKE"
+	wildcard := func(s string) string { return "%" + s + "%" }
+	if caseSensitive {
+		operator = "GLOB"
+		wildcard = func(s string) string { return "*" + escapeGlob(s) + "*" }
+	}
+	wildcardedToken := wildcard(token)
+	commandClause := "command " + operator + " ?"
+	var commandPattern interface{} = wildcardedToken
+	if ctx != nil && hctx.GetConf(ctx).FuzzySearch {
+		if caseSensitive {
+			commandPattern = makeFuzzyGlobPattern(token)
+		} else {
+			commandClause = "command LIKE ? ESCAPE '\\'"
+			commandPattern = makeFuzzyLikePattern(token)
+		}
+	}
+	if ctx != nil && hctx.GetConf(ctx).NormalizePaths && looksLikePath(token) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get cwd to normalize %#v: %v", token, err)
+		}
+		wildcardedPath := wildcard(normalizePath(token, cwd, hctx.GetHome(ctx)))
+		return "(" + commandClause + " OR hostname " + operator + " ? OR current_working_directory " + operator + " ? OR normalized_paths " + operator + " ?)", []interface{}{commandPattern, wildcardedToken, wildcardedToken, wildcardedPath}, nil
+	}
+	return "(" + commandClause + " OR hostname " + operator + " ? OR current_working_directory " + operator + " ?)", []interface{}{commandPattern, wildcardedToken, wildcardedToken}, nil
 }
 
 func parseAtomizedToken(ctx *context.Context, token string) (string, interface{}, interface{}, error) {
@@ -1579,11 +2702,59 @@ func parseAtomizedToken(ctx *context.Context, token string) (string, interface{}
 	case "host":
 		fallthrough
 	case "hostname":
-		return "(instr(hostname, ?) > 0)", val, nil, nil
+		// Hostnames are case-insensitive, and they're often long so any part of one matches
+		return "(instr(LOWER(hostname), LOWER(?)) > 0)", val, nil, nil
+	case "expanded":
+		// Entries where the expanded command is the same as the command don't store it separately
+		return "(instr(CASE WHEN COALESCE(expanded_command, '') = '' THEN command ELSE expanded_command END, ?) > 0)", val, nil, nil
 	case "cwd":
-		return "(instr(current_working_directory, ?) > 0 OR instr(REPLACE(current_working_directory, '~/', home_directory), ?) > 0)", strings.TrimSuffix(val, "/"), strings.TrimSuffix(val, "/"), nil
+		recordedDir, expandedDir, err := resolveRelativeDirectory(ctx, val)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to resolve cwd:%s: %v", val, err)
+		}
+		return parseCwdAtom(hctx.GetConf(ctx).CwdMatchMode, strings.TrimSuffix(recordedDir, "/"), strings.TrimSuffix(expandedDir, "/"))
 	case "exit_code":
-		return "(exit_code = ?)", val, nil, nil
+		op, n, err := parseNumericComparison(val)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to parse exit_code:%s: %v", val, err)
+		}
+		return "(exit_code " + op + " ?)", n, nil, nil
+	case "failed":
+		switch val {
+		case "true":
+			return "(exit_code != ?)", 0, nil, nil
+		case "false":
+			return "(exit_code = ?)", 0, nil, nil
+		default:
+			return "", nil, nil, fmt.Errorf("failed to parse failed:%s: must be either true or false", val)
+		}
+	case "cmd":
+		return "(instr(command, ?) > 0)", val, nil, nil
+	case "re":
+		// Check the regex here so that invalid ones have a clear error rather than failing in the DB query
+		if _, err := regexp.Compile(val); err != nil {
+			return "", nil, nil, fmt.Errorf("invalid regex %#v: %v", val, err)
+		}
+		return "(command REGEXP ?)", val, nil, nil
+	case "arg":
+		// Only match within the arguments, i.e. everything after the program
+		return "(instr(command, ' ') > 0 AND instr(substr(command, instr(command, ' ') + 1), ?) > 0)", val, nil, nil
+	case "program":
+		return "(command = ? OR instr(command, ?) = 1)", val, val + " ", nil
+	case "pane":
+		if val == "current" {
+			val = getTerminalPane()
+		}
+		return "(terminal_pane = ?)", val, nil, nil
+	case "session":
+		sessionId, err := resolveSessionId(val)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to resolve session:%s: %v", val, err)
+		}
+		return "(session_id = ?)", sessionId, nil, nil
+	case "count":
+		// Search queries have their count: atoms removed before they get here (see extractCountAtoms)
+		return "", nil, nil, fmt.Errorf("count:%s can't be used in the default filter", val)
 	case "before":
 		t, err := parseTimeGenerously(val)
 		if err != nil {
@@ -1624,6 +2795,191 @@ func parseAtomizedToken(ctx *context.Context, token string) (string, interface{}
 	}
 }
 
+// The supported values for the cwd_match_mode config option. The empty string is treated as "substring".
+var CwdMatchModes = []string{"substring", "exact", "prefix", "fuzzy"}
+
+// The SQL equivalent of expandHomeDirectory for the recorded directory of an entry
+const expandedCwdSql = "(CASE WHEN current_working_directory IN ('~', '~/') THEN home_directory " +
+	"WHEN substr(current_working_directory, 1, 2) = '~/' THEN RTRIM(home_directory, '/') || substr(current_working_directory, 2) " +
+	"ELSE current_working_directory END)"
+
+// Builds the where clause for the cwd: atom based on the cwd_match_mode config option. Each mode matches recordedDir
+// against the directory as it was recorded (which may start with ~/) and expandedDir against the directory with ~/
+// expanded.
+func parseCwdAtom(mode, recordedDir, expandedDir string) (string, interface{}, interface{}, error) {
+	expandedCwd := expandedCwdSql
+	switch mode {
+	case "exact":
+		return "(RTRIM(current_working_directory, '/') = ? OR RTRIM(" + expandedCwd + ", '/') = ?)", recordedDir, expandedDir, nil
+	case "prefix":
+		return "(instr(current_working_directory, ?) = 1 OR instr(" + expandedCwd + ", ?) = 1)", recordedDir, expandedDir, nil
+	case "fuzzy":
+		return "(current_working_directory LIKE ? ESCAPE '\\' OR " + expandedCwd + " LIKE ? ESCAPE '\\')", makeFuzzyLikePattern(recordedDir), makeFuzzyLikePattern(expandedDir), nil
+	default:
+		return "(instr(current_working_directory, ?) > 0 OR instr(" + expandedCwd + ", ?) > 0)", recordedDir, expandedDir, nil
+	}
+}
+
+// Whether the directory of the given entry matches the cwd: atom. This must be kept in sync with parseCwdAtom.
+func matchesCwdAtom(mode, recordedDir, expandedDir string, entry data.HistoryEntry) bool {
+	cwd := entry.CurrentWorkingDirectory
+	expandedCwd := expandHomeDirectory(cwd, entry.HomeDirectory)
+	switch mode {
+	case "exact":
+		return strings.TrimRight(cwd, "/") == recordedDir || strings.TrimRight(expandedCwd, "/") == expandedDir
+	case "prefix":
+		return strings.HasPrefix(cwd, recordedDir) || strings.HasPrefix(expandedCwd, expandedDir)
+	case "fuzzy":
+		_, _, recordedMatch := fuzzyScore(recordedDir, cwd)
+		_, _, expandedMatch := fuzzyScore(expandedDir, expandedCwd)
+		return recordedMatch || expandedMatch
+	default:
+		return strings.Contains(cwd, recordedDir) || strings.Contains(expandedCwd, expandedDir)
+	}
+}
+
+// Resolves a directory from the cwd: atom that is relative to the current directory (i.e. `.`, or one starting with
+// `./` or `../`) both into the form that directories are recorded in (i.e. starting with ~/ for directories within
+// the home directory, see getCwd) and into an absolute path. Any other directory is returned as is.
+func resolveRelativeDirectory(ctx *context.Context, dir string) (string, string, error) {
+	if dir != "." && dir != ".." && !strings.HasPrefix(dir, "./") && !strings.HasPrefix(dir, "../") {
+		return dir, dir, nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	return collapseHomeDirectory(abs, hctx.GetHome(ctx)), abs, nil
+}
+
+// Returns a LIKE pattern that matches any string containing the characters of s in order (e.g. "proj" matches
+// "my-project" and "~/work/pr/obj")
+func makeFuzzyLikePattern(s string) string {
+	var sb strings.Builder
+	sb.WriteString("%")
+	for _, c := range s {
+		if c == '%' || c == '_' || c == '\\' {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+		sb.WriteString("%")
+	}
+	return sb.String()
+}
+
+// Escapes the characters that are special in GLOB patterns so that they only match themselves
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if c == '*' || c == '?' || c == '[' {
+			sb.WriteString("[" + string(c) + "]")
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// Returns a GLOB pattern that matches any string containing the characters of s in order, i.e. the case-sensitive
+// equivalent of makeFuzzyLikePattern
+func makeFuzzyGlobPattern(s string) string {
+	var sb strings.Builder
+	sb.WriteString("*")
+	for _, c := range s {
+		sb.WriteString(escapeGlob(string(c)))
+		sb.WriteString("*")
+	}
+	return sb.String()
+}
+
+// Returns the query arguments for an atom. Atoms with only a single argument return nil as their second argument,
+// which must be dropped since GORM would otherwise bind it to the next clause's placeholder.
+func atomArgs(v1, v2 interface{}) []interface{} {
+	if v2 == nil {
+		return []interface{}{v1}
+	}
+	return []interface{}{v1, v2}
+}
+
+// A count: atom, which matches the commands that were run a certain number of times within the rest of the search
+type countAtom struct {
+	op      string
+	n       int
+	negated bool
+}
+
+// Removes the count: atoms from the given query and returns them separately, since they filter on how many times each
+// command matched the rest of the query rather than on individual entries (see applyCountAtoms)
+func extractCountAtoms(query string) (string, []countAtom, error) {
+	terms, err := splitQueryTerms(query)
+	if err != nil {
+		return "", nil, err
+	}
+	remaining := make([]string, 0, len(terms))
+	atoms := make([]countAtom, 0)
+	for i := 0; i < len(terms); i++ {
+		term := terms[i]
+		negated := false
+		if term == "NOT" && i+1 < len(terms) && strings.HasPrefix(strings.TrimPrefix(terms[i+1], "-"), "count:") {
+			negated = true
+			i++
+			term = terms[i]
+		}
+		if strings.HasPrefix(term, "-") {
+			negated = !negated
+			term = term[1:]
+		}
+		if !strings.HasPrefix(term, "count:") {
+			remaining = append(remaining, terms[i])
+			continue
+		}
+		op, n, err := parseNumericComparison(strings.TrimPrefix(term, "count:"))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse %s: %v", term, err)
+		}
+		atoms = append(atoms, countAtom{op: op, n: n, negated: negated})
+	}
+	if len(atoms) > 0 && containsString(remaining, "OR") {
+		return "", nil, fmt.Errorf("count: can't be combined with OR")
+	}
+	return strings.Join(remaining, " "), atoms, nil
+}
+
+// Filters the given search down to the commands that match the count: atoms, where makeCounts returns the search that the
+// commands are counted within
+func applyCountAtoms(tx *gorm.DB, atoms []countAtom, makeCounts func() (*gorm.DB, error)) (*gorm.DB, error) {
+	for _, atom := range atoms {
+		counts, err := makeCounts()
+		if err != nil {
+			return nil, err
+		}
+		counts = counts.Select("command").Group("command").Having("COUNT(*) "+atom.op+" ?", atom.n)
+		if atom.negated {
+			tx = tx.Where("command NOT IN (?)", counts)
+		} else {
+			tx = tx.Where("command IN (?)", counts)
+		}
+	}
+	return tx, nil
+}
+
+// Parses a numeric comparison such as `>5`, `<=3`, or `7` into a SQL comparison operator and an integer
+func parseNumericComparison(val string) (string, int, error) {
+	op := "="
+	for _, candidate := range []string{">=", "<=", "!=", ">", "<", "="} {
+		if strings.HasPrefix(val, candidate) {
+			op = candidate
+			val = strings.TrimPrefix(val, candidate)
+			break
+		}
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return "", 0, fmt.Errorf("%#v is not a number", val)
+	}
+	return op, n, nil
+}
+
 func getAllCustomColumnNames(ctx *context.Context) ([]string, error) {
 	db := hctx.GetDb(ctx)
 	query := `
@@ -1648,11 +3004,61 @@ func getAllCustomColumnNames(ctx *context.Context) ([]string, error) {
 	return ccNames, nil
 }
 
+// The atoms whose values can contain spaces if they're quoted, e.g. re:"git (push|pull)" or cwd:"~/My Projects"
+var quotableAtoms = []string{"re", "cwd"}
+
 func tokenize(query string) ([]string, error) {
+	terms, err := splitQueryTerms(query)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]string, 0, len(terms))
+	for _, term := range terms {
+		for _, atom := range quotableAtoms {
+			if strings.HasPrefix(term, atom+`:"`) || strings.HasPrefix(term, "-"+atom+`:"`) {
+				term = strings.Replace(strings.TrimSuffix(term, `"`), atom+`:"`, atom+":", 1)
+			}
+		}
+		tokens = append(tokens, term)
+	}
+	return tokens, nil
+}
+
+// Splits the given query into its terms like tokenize, but keeps the quotes around the values of quoted atoms so that
+// the terms can be joined back together into the same query
+func splitQueryTerms(query string) ([]string, error) {
 	if query == "" {
 		return []string{}, nil
 	}
-	return strings.Split(query, " "), nil
+	terms := make([]string, 0)
+	parts := strings.Split(query, " ")
+	for i := 0; i < len(parts); i++ {
+		term := parts[i]
+		for _, atom := range quotableAtoms {
+			for _, prefix := range []string{atom + `:"`, "-" + atom + `:"`} {
+				if !strings.HasPrefix(term, prefix) {
+					continue
+				}
+				for (len(term) == len(prefix) || !strings.HasSuffix(term, `"`)) && i+1 < len(parts) {
+					i++
+					term += " " + parts[i]
+				}
+				if len(term) == len(prefix) || !strings.HasSuffix(term, `"`) {
+					return nil, fmt.Errorf("missing closing quote for %#v", term)
+				}
+			}
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// Returns the cwd: atom for the given directory, quoting it if it contains spaces
+func makeCwdAtom(dir string) string {
+	if strings.Contains(dir, " ") {
+		return `cwd:"` + dir + `"`
+	}
+	return "cwd:" + dir
 }
 
 func stripLines(filePath, lines string) error {
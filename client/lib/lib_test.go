@@ -1,17 +1,34 @@
 package lib
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
 	"github.com/ddworken/hishtory/client/data"
 	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
 	"github.com/ddworken/hishtory/shared/testutils"
+	"github.com/muesli/termenv"
 )
 
 func TestSetup(t *testing.T) {
@@ -146,6 +163,29 @@ func TestBuildHistoryEntry(t *testing.T) {
 		t.Fatalf("history entry has incorrect Unix time in the start time: %v", entry.StartTime.Unix())
 	}
 
+	// Test building an entry with an expanded alias
+	entry, err = BuildHistoryEntry(hctx.MakeContext(), []string{"unused", "saveHistoryEntry", "zsh", "0", "ll /foo\n", "1641774958", "ls -la /foo"})
+	testutils.Check(t, err)
+	if entry.Command != "ll /foo" || entry.ExpandedCommand != "ls -la /foo" {
+		t.Fatalf("history entry has unexpected command=%#v or expanded command=%#v", entry.Command, entry.ExpandedCommand)
+	}
+	entry, err = BuildHistoryEntry(hctx.MakeContext(), []string{"unused", "saveHistoryEntry", "zsh", "0", "ls /foo\n", "1641774958", "ls /foo"})
+	testutils.Check(t, err)
+	if entry.ExpandedCommand != "" {
+		t.Fatalf("expanded command should only be stored if it differs from the command: %#v", entry.ExpandedCommand)
+	}
+	entry, err = BuildHistoryEntry(hctx.MakeContext(), []string{"unused", "saveHistoryEntry", "bash", "0", " 123  ll /foo", "1641774958", "ls -la /foo"})
+	testutils.Check(t, err)
+	if entry.Command != "ll /foo" || entry.ExpandedCommand != "ls -la /foo" {
+		t.Fatalf("history entry has unexpected command=%#v or expanded command=%#v", entry.Command, entry.ExpandedCommand)
+	}
+	// In bash, only the first simple command is expanded so it isn't stored for anything else
+	entry, err = BuildHistoryEntry(hctx.MakeContext(), []string{"unused", "saveHistoryEntry", "bash", "0", " 123  ll /foo && ll /bar", "1641774958", "ls -la /foo"})
+	testutils.Check(t, err)
+	if entry.Command != "ll /foo && ll /bar" || entry.ExpandedCommand != "" {
+		t.Fatalf("history entry has unexpected command=%#v or expanded command=%#v", entry.Command, entry.ExpandedCommand)
+	}
+
 	// Test building an entry that is empty, and thus not saved
 	entry, err = BuildHistoryEntry(hctx.MakeContext(), []string{"unused", "saveHistoryEntry", "zsh", "120", " \n", "1641774958"})
 	testutils.Check(t, err)
@@ -229,6 +269,200 @@ func TestSearch(t *testing.T) {
 	}
 }
 
+func TestSearchForDisplayHiddenPrograms(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.HiddenPrograms = []string{"direnv"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	db.Create(testutils.MakeFakeHistoryEntry("ls /foo"))
+	db.Create(testutils.MakeFakeHistoryEntry("direnv export zsh"))
+	db.Create(testutils.MakeFakeHistoryEntry("direnvfoo"))
+
+	// Hidden programs are excluded from displayed searches, but not from regular searches
+	results, err := SearchForDisplay(ctx, db, "", 5, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("SearchForDisplay() returned %d results, expected 2, results=%#v", len(results), results)
+	}
+	results, err = Search(ctx, db, "", 5)
+	testutils.Check(t, err)
+	if len(results) != 3 {
+		t.Fatalf("Search() returned %d results, expected 3, results=%#v", len(results), results)
+	}
+
+	// Unless they're explicitly searched for
+	results, err = SearchForDisplay(ctx, db, "program:direnv", 5, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "direnv export zsh" {
+		t.Fatalf("SearchForDisplay() returned unexpected results=%#v", results)
+	}
+}
+
+func TestSearchReverse(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	entry1 := testutils.MakeFakeHistoryEntry("ls /foo")
+	db.Create(entry1)
+	entry2 := testutils.MakeFakeHistoryEntry("ls /bar")
+	db.Create(entry2)
+	entry3 := testutils.MakeFakeHistoryEntry("ls /baz")
+	db.Create(entry3)
+
+	// Search for data in reverse order
+	results, err := SearchForDisplay(ctx, db, "ls", 2, SearchOptions{Reverse: true})
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("SearchForDisplay() returned %d results, expected 2, results=%#v", len(results), results)
+	}
+	if !data.EntryEquals(*results[0], entry1) {
+		t.Fatalf("SearchForDisplay()[0]=%#v, expected: %#v", results[0], entry1)
+	}
+	if !data.EntryEquals(*results[1], entry2) {
+		t.Fatalf("SearchForDisplay()[1]=%#v, expected: %#v", results[1], entry2)
+	}
+}
+
+func TestSearchByCount(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	for i := 0; i < 3; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry("ls /foo"))
+	}
+	db.Create(testutils.MakeFakeHistoryEntry("ls /bar"))
+
+	testcases := []struct {
+		query           string
+		expectedResults int
+	}{
+		{"count:>2", 3},
+		{"count:>=3", 3},
+		{"count:1", 1},
+		{"count:<3", 1},
+		{"ls count:>1", 3},
+		{"bar count:>1", 0},
+		{"-count:1", 3},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 10)
+		testutils.Check(t, err)
+		if len(results) != tc.expectedResults {
+			t.Fatalf("Search(%#v) returned %d results, expected %d, results=%#v", tc.query, len(results), tc.expectedResults, results)
+		}
+	}
+	_, err := Search(ctx, db, "count:>foo", 10)
+	if err == nil {
+		t.Fatalf("expected an error for a malformed count")
+	}
+	if _, err := Search(ctx, db, "count:>1 OR bar", 10); err == nil {
+		t.Fatalf("expected an error for a count combined with OR")
+	}
+
+	// Commands are only counted within the rest of the search, and sensitive entries aren't counted
+	for i := 0; i < 2; i++ {
+		entry := testutils.MakeFakeHistoryEntry("ls /bar")
+		entry.Hostname = "laptop"
+		db.Create(entry)
+	}
+	sensitive := testutils.MakeFakeHistoryEntry("ls /foo")
+	sensitive.IsSensitive = true
+	db.Create(sensitive)
+	testcases = []struct {
+		query           string
+		expectedResults int
+	}{
+		{"count:3", 6},
+		{"count:4", 0},
+		{"count:2 host:laptop", 2},
+		{"count:3 host:laptop", 0},
+		{"count:1 -host:laptop", 1},
+		{"NOT count:2 host:laptop", 0},
+	}
+	for _, tc := range testcases {
+		results, err := SearchForDisplay(ctx, db, tc.query, 10, SearchOptions{})
+		testutils.Check(t, err)
+		if len(results) != tc.expectedResults {
+			t.Fatalf("SearchForDisplay(%#v) returned %d results, expected %d, results=%#v", tc.query, len(results), tc.expectedResults, results)
+		}
+	}
+}
+
+func TestParseNumericComparison(t *testing.T) {
+	testcases := []struct {
+		input string
+		op    string
+		n     int
+	}{
+		{"5", "=", 5},
+		{">5", ">", 5},
+		{">=5", ">=", 5},
+		{"<5", "<", 5},
+		{"<=5", "<=", 5},
+		{"!=0", "!=", 0},
+	}
+	for _, tc := range testcases {
+		op, n, err := parseNumericComparison(tc.input)
+		testutils.Check(t, err)
+		if op != tc.op || n != tc.n {
+			t.Fatalf("parseNumericComparison(%#v) returned (%#v, %d), expected (%#v, %d)", tc.input, op, n, tc.op, tc.n)
+		}
+	}
+}
+
+func TestGetTerminalPane(t *testing.T) {
+	defer testutils.BackupAndRestoreEnv("TMUX")()
+	defer testutils.BackupAndRestoreEnv("TMUX_PANE")()
+	defer testutils.BackupAndRestoreEnv("STY")()
+	defer testutils.BackupAndRestoreEnv("WINDOW")()
+
+	os.Unsetenv("TMUX")
+	os.Unsetenv("TMUX_PANE")
+	os.Unsetenv("STY")
+	os.Unsetenv("WINDOW")
+	if pane := getTerminalPane(); pane != "" {
+		t.Fatalf("expected no pane outside of a terminal multiplexer, got %#v", pane)
+	}
+	os.Setenv("STY", "1234.pts-0.host")
+	os.Setenv("WINDOW", "2")
+	if pane := getTerminalPane(); pane != "1234.pts-0.host/2" {
+		t.Fatalf("unexpected screen pane: %#v", pane)
+	}
+	os.Setenv("TMUX", "/tmp/tmux-1000/default,1234,0")
+	os.Setenv("TMUX_PANE", "%3")
+	if pane := getTerminalPane(); pane != "%3" {
+		t.Fatalf("unexpected tmux pane: %#v", pane)
+	}
+}
+
+func TestGetProgram(t *testing.T) {
+	testcases := []struct {
+		input, output string
+	}{
+		{"ls", "ls"},
+		{"git status", "git"},
+		{"  git   status ", "git"},
+		{"", ""},
+	}
+	for _, tc := range testcases {
+		if actual := getProgram(tc.input); actual != tc.output {
+			t.Fatalf("getProgram(%#v) returned %#v (expected=%#v)", tc.input, actual, tc.output)
+		}
+	}
+}
+
 func TestAddToDbIfNew(t *testing.T) {
 	// Set up
 	defer testutils.BackupAndRestore(t)()
@@ -433,3 +667,4105 @@ func TestParseTimeGenerously(t *testing.T) {
 		t.Fatalf("parsed time incorrectly: %d", ts.Unix())
 	}
 }
+
+func TestValidateConfig(t *testing.T) {
+	config := hctx.ClientConfig{
+		UserSecret:       "secret",
+		DeviceId:         "device",
+		DisplayedColumns: []string{"Hostname", "Command", "git_remote"},
+		CustomColumns:    []hctx.CustomColumnDefinition{{ColumnName: "git_remote", ColumnCommand: "git remote -v"}},
+	}
+	if errs := ValidateConfig(config); len(errs) != 0 {
+		t.Fatalf("expected config to be valid, got errors: %v", errs)
+	}
+
+	config.DisplayedColumns = []string{"Hostname", "Foo"}
+	config.CustomColumns = append(config.CustomColumns, hctx.CustomColumnDefinition{ColumnName: "CWD", ColumnCommand: "pwd"})
+	config.HiddenPrograms = []string{"git commit"}
+	errs := ValidateConfig(config)
+	expected := []string{
+		"custom_columns: column \"CWD\" conflicts with a built-in column",
+		"displayed_columns: unknown column \"Foo\" (must be one of Hostname, CWD, Timestamp, Runtime, Exit Code, Command, User, Pane, Expanded Command, Tags, Session, or a custom column)",
+		"displayed_columns: must contain the Command column so that commands can be selected",
+		"hidden_programs: \"git commit\" is not a valid program name",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected number of errors: %v", errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Fatalf("errs[%d]=%#v, expected %#v", i, err.Error(), expected[i])
+		}
+	}
+}
+
+func TestBuildTableRowUser(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	entry := testutils.MakeFakeHistoryEntry("sudo ls")
+	entry.LocalUsername = "root"
+	row, err := buildTableRow(ctx, []string{"User", "Command"}, entry)
+	testutils.Check(t, err)
+	if len(row) != 2 || row[0] != "root" || row[1] != "sudo ls" {
+		t.Fatalf("unexpected row: %#v", row)
+	}
+}
+
+func TestCountForDisplay(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.HiddenPrograms = []string{"direnv"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 5; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("ls /foo/%d", i)))
+	}
+	db.Create(testutils.MakeFakeHistoryEntry("direnv export zsh"))
+
+	count, err := CountForDisplay(ctx, db, "", SearchOptions{})
+	testutils.Check(t, err)
+	if count != 5 {
+		t.Fatalf("CountForDisplay() returned %d, expected 5", count)
+	}
+	count, err = CountForDisplay(ctx, db, "/foo/3", SearchOptions{})
+	testutils.Check(t, err)
+	if count != 1 {
+		t.Fatalf("CountForDisplay() returned %d, expected 1", count)
+	}
+}
+
+func TestReclassify(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.IsOffline = true
+	conf.NeverRecordPrograms = []string{"direnv"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("ls /foo"))
+	db.Create(testutils.MakeFakeHistoryEntry("direnv export zsh"))
+	db.Create(testutils.MakeFakeHistoryEntry("direnv allow"))
+	// Commands that are empty are never recorded, but they aren't run by a never-record-program so they're left alone
+	db.Create(testutils.MakeFakeHistoryEntry(" "))
+
+	matches, err := Reclassify(ctx, true)
+	testutils.Check(t, err)
+	if len(matches) != 2 {
+		t.Fatalf("Reclassify(dryRun=true) matched %d entries, expected 2", len(matches))
+	}
+	count, err := CountForDisplay(ctx, db, "", SearchOptions{})
+	testutils.Check(t, err)
+	if count != 4 {
+		t.Fatalf("Reclassify(dryRun=true) deleted entries, count=%d", count)
+	}
+
+	matches, err = Reclassify(ctx, false)
+	testutils.Check(t, err)
+	if len(matches) != 2 {
+		t.Fatalf("Reclassify() matched %d entries, expected 2", len(matches))
+	}
+	results, err := Search(ctx, db, "", 0)
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != " " || results[1].Command != "ls /foo" {
+		t.Fatalf("Reclassify() left unexpected entries: %#v", results)
+	}
+}
+
+func TestNormalizedPaths(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	initialWd, err := os.Getwd()
+	testutils.Check(t, err)
+	defer os.Chdir(initialWd)
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	testutils.Check(t, err)
+	project := path.Join(dir, "project")
+	testutils.Check(t, os.Mkdir(project, 0o755))
+	testutils.Check(t, os.WriteFile(path.Join(project, "main.go"), []byte{}, 0o644))
+	testutils.Check(t, os.Symlink(project, path.Join(dir, "link")))
+
+	normalized := getNormalizedPaths("cat link/main.go ~/foo https://example.com 'project/../x' ls", dir, "/home/david")
+	expected := path.Join(project, "main.go") + " /home/david/foo " + path.Join(dir, "x")
+	if normalized != expected {
+		t.Fatalf("getNormalizedPaths() returned %#v, expected %#v", normalized, expected)
+	}
+
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.NormalizePaths = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	entry := testutils.MakeFakeHistoryEntry("cat link/main.go")
+	entry.NormalizedPaths = getNormalizedPaths(entry.Command, dir, "/home/david")
+	db.Create(entry)
+	db.Create(testutils.MakeFakeHistoryEntry("cat other/main.go"))
+
+	testutils.Check(t, os.Chdir(project))
+	results, err := Search(ctx, db, "./main.go", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "cat link/main.go" {
+		t.Fatalf("search for a relative path returned unexpected results: %#v", results)
+	}
+	results, err = Search(ctx, db, path.Join(project, "main.go"), 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "cat link/main.go" {
+		t.Fatalf("search for an absolute path returned unexpected results: %#v", results)
+	}
+}
+
+func TestDuplicateFilter(t *testing.T) {
+	commands := []string{"ls", "ls ", "cd /tmp", "ls", "sudo  cd /tmp", "pwd"}
+	testcases := []struct {
+		config   hctx.ClientConfig
+		expected []string
+	}{
+		{hctx.ClientConfig{}, commands},
+		{hctx.ClientConfig{FilterDuplicateCommands: true}, []string{"ls", "cd /tmp", "ls", "sudo  cd /tmp", "pwd"}},
+		{hctx.ClientConfig{FilterDuplicateCommands: true, FilterAllDuplicateCommands: true}, []string{"ls", "cd /tmp", "sudo  cd /tmp", "pwd"}},
+		{hctx.ClientConfig{FilterDuplicateCommands: true, FilterAllDuplicateCommands: true, DedupMode: DEDUP_NORMALIZED}, []string{"ls", "cd /tmp", "pwd"}},
+		{hctx.ClientConfig{FilterAllDuplicateCommands: true}, commands},
+	}
+	for _, tc := range testcases {
+		duplicates := newDuplicateFilter(tc.config, SearchOptions{})
+		actual := make([]string, 0)
+		for _, command := range commands {
+			if !duplicates.isDuplicate(command) {
+				actual = append(actual, command)
+			}
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("unexpected filtered commands for config=%#v: got %#v, expected %#v", tc.config, actual, tc.expected)
+		}
+	}
+
+	// The first command is never a duplicate, even if it is empty after trimming whitespace
+	duplicates := newDuplicateFilter(hctx.ClientConfig{FilterDuplicateCommands: true}, SearchOptions{})
+	if duplicates.isDuplicate("  ") || !duplicates.isDuplicate("") || duplicates.isDuplicate("ls") {
+		t.Fatalf("unexpected duplicates for whitespace-only commands")
+	}
+}
+
+func TestSearchExpandedCommand(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	aliased := testutils.MakeFakeHistoryEntry("ll /foo")
+	aliased.ExpandedCommand = "ls -la /foo"
+	db.Create(aliased)
+	db.Create(testutils.MakeFakeHistoryEntry("ls -la /bar"))
+	db.Create(testutils.MakeFakeHistoryEntry("echo ll"))
+
+	results, err := Search(ctx, db, "expanded:ls", 10)
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("expanded:ls returned %d results, expected 2: %#v", len(results), results)
+	}
+	results, err = Search(ctx, db, "ll", 10)
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("searching for the raw command returned %d results, expected 2: %#v", len(results), results)
+	}
+	row, err := buildTableRow(ctx, []string{"Command", "Expanded Command"}, aliased)
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(row, []string{"ll /foo", "ls -la /foo"}) {
+		t.Fatalf("unexpected row: %#v", row)
+	}
+}
+
+func TestExitCodeAtoms(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i, exitCode := range []int{0, 0, 1, 2, 127} {
+		entry := testutils.MakeFakeHistoryEntry(fmt.Sprintf("git command%d", i))
+		entry.ExitCode = exitCode
+		db.Create(entry)
+	}
+	entry := testutils.MakeFakeHistoryEntry("ls")
+	entry.ExitCode = 1
+	db.Create(entry)
+	testcases := []struct {
+		query           string
+		expectedResults int
+	}{
+		{"exit_code:0", 2},
+		{"exit_code:1", 2},
+		{"exit_code:!=0", 4},
+		{"exit_code:>1", 2},
+		{"git exit_code:1", 1},
+		{"-exit_code:0", 4},
+		{"failed:true", 4},
+		{"git failed:true", 3},
+		{"failed:false", 2},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 10)
+		testutils.Check(t, err)
+		if len(results) != tc.expectedResults {
+			t.Fatalf("query %#v returned %d results, expected %d: %#v", tc.query, len(results), tc.expectedResults, results)
+		}
+	}
+	for _, query := range []string{"exit_code:abc", "exit_code:>", "failed:maybe"} {
+		if _, err := Search(ctx, db, query, 10); err == nil {
+			t.Fatalf("expected query %#v to be rejected", query)
+		}
+	}
+}
+
+func TestRegexSearch(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, cmd := range []string{"git push --force", "git pull --force", "git push", "git fetch --force", "echo foo"} {
+		db.Create(testutils.MakeFakeHistoryEntry(cmd))
+	}
+	testcases := []struct {
+		query           string
+		expectedResults int
+	}{
+		{`re:^git`, 4},
+		{`re:"git (push|pull) --force"`, 2},
+		{`re:"(push|pull)" force`, 2},
+		{`-re:"(push|pull)" git`, 1},
+		{`re:^echo re:foo$`, 1},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 10)
+		testutils.Check(t, err)
+		if len(results) != tc.expectedResults {
+			t.Fatalf("query %#v returned %d results, expected %d: %#v", tc.query, len(results), tc.expectedResults, results)
+		}
+	}
+	if _, err := Search(ctx, db, "re:git(", 10); err == nil || !strings.Contains(err.Error(), "invalid regex") {
+		t.Fatalf("expected an invalid regex error, got %v", err)
+	}
+	if _, err := Search(ctx, db, `re:"git (push`, 10); err == nil || !strings.Contains(err.Error(), "missing closing quote") {
+		t.Fatalf("expected an unterminated quote error, got %v", err)
+	}
+}
+
+func TestCwdMatchModes(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	db := hctx.GetDb(hctx.MakeContext())
+	for _, cwd := range []string{"~/work/my-project/", "~/work/my-project/src/", "/tmp/project/", "~/work/"} {
+		entry := testutils.MakeFakeHistoryEntry("make " + cwd)
+		entry.CurrentWorkingDirectory = cwd
+		db.Create(entry)
+	}
+	testcases := []struct {
+		mode            string
+		query           string
+		expectedResults int
+	}{
+		{"", "cwd:project", 3},
+		{"substring", "cwd:my-project", 2},
+		{"exact", "cwd:~/work/my-project", 1},
+		{"exact", "cwd:/home/david/work/my-project/", 1},
+		{"exact", "cwd:my-project", 0},
+		{"prefix", "cwd:~/work/my-project", 2},
+		{"prefix", "cwd:/home/david/work", 3},
+		{"prefix", "cwd:project", 0},
+		{"fuzzy", "cwd:wkmp", 2},
+		{"fuzzy", "cwd:WKMP", 2},
+		{"fuzzy", "cwd:proj make", 3},
+		{"fuzzy", "cwd:pm", 0},
+	}
+	for _, tc := range testcases {
+		conf, err := hctx.GetConfig()
+		testutils.Check(t, err)
+		conf.CwdMatchMode = tc.mode
+		testutils.Check(t, hctx.SetConfig(conf))
+		ctx := hctx.MakeContext()
+		results, err := Search(ctx, db, tc.query, 10)
+		testutils.Check(t, err)
+		if len(results) != tc.expectedResults {
+			t.Fatalf("cwd_match_mode=%#v query=%#v returned %d results, expected %d: %#v", tc.mode, tc.query, len(results), tc.expectedResults, results)
+		}
+	}
+}
+
+func TestCwdAtomRelativeDirectory(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	wd, err := os.Getwd()
+	testutils.Check(t, err)
+	for _, cwd := range []string{wd, filepath.Join(wd, "sub"), filepath.Dir(wd), "/some/other/dir"} {
+		entry := testutils.MakeFakeHistoryEntry("gmake " + cwd)
+		entry.CurrentWorkingDirectory = cwd
+		db.Create(entry)
+	}
+	testcases := []struct {
+		query           string
+		expectedResults int
+	}{
+		{"gmake cwd:.", 2},
+		{"gmake cwd:./sub", 1},
+		{"gmake cwd:..", 3},
+		{"gmake -cwd:.", 2},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 10)
+		testutils.Check(t, err)
+		if len(results) != tc.expectedResults {
+			t.Fatalf("query=%#v returned %d results, expected %d: %#v", tc.query, len(results), tc.expectedResults, results)
+		}
+	}
+}
+
+func TestCwdAtomRelativeDirectoryInHome(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	homedir := hctx.GetHome(ctx)
+	dir, err := os.MkdirTemp(homedir, "hishtory-cwd-test")
+	testutils.Check(t, err)
+	defer os.RemoveAll(dir)
+	testutils.Check(t, os.Mkdir(filepath.Join(dir, "sub"), 0o755))
+	initialWd, err := os.Getwd()
+	testutils.Check(t, err)
+	defer os.Chdir(initialWd)
+	testutils.Check(t, os.Chdir(dir))
+	// Directories within the home directory are recorded relative to it, as getCwd does
+	name := filepath.Base(dir)
+	for _, cwd := range []string{"~/" + name, "~/" + name + "/sub/", "~/", "/some/other/dir"} {
+		entry := testutils.MakeFakeHistoryEntry("gmake " + cwd)
+		entry.HomeDirectory = homedir
+		entry.CurrentWorkingDirectory = cwd
+		db.Create(entry)
+	}
+	for _, mode := range CwdMatchModes {
+		config := hctx.GetConf(ctx)
+		config.CwdMatchMode = mode
+		modeCtx := hctx.WithConfig(ctx, config)
+		testcases := []struct {
+			query           string
+			expectedResults int
+		}{
+			{"gmake cwd:.", 2},
+			{"gmake cwd:./sub", 1},
+			{"gmake cwd:" + filepath.Join(dir, "sub"), 1},
+		}
+		if mode == "exact" {
+			testcases[0].expectedResults = 1
+		}
+		for _, tc := range testcases {
+			results, err := Search(modeCtx, db, tc.query, 10)
+			testutils.Check(t, err)
+			if len(results) != tc.expectedResults {
+				t.Fatalf("query=%#v with cwd_match_mode=%#v returned %d results, expected %d: %#v", tc.query, mode, len(results), tc.expectedResults, results)
+			}
+		}
+	}
+}
+
+func TestSearchArguments(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("git push --force"))
+	db.Create(testutils.MakeFakeHistoryEntry("rm --force foo"))
+	db.Create(testutils.MakeFakeHistoryEntry("--force"))
+	db.Create(testutils.MakeFakeHistoryEntry("git status"))
+	db.Create(testutils.MakeFakeHistoryEntry("echo git"))
+
+	results, err := Search(ctx, db, "arg:--force", 10)
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("arg:--force returned %d results, expected 2: %#v", len(results), results)
+	}
+	results, err = Search(ctx, db, "arg:git", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "echo git" {
+		t.Fatalf("arg:git returned unexpected results: %#v", results)
+	}
+	results, err = Search(ctx, db, "arg:--force cmd:push", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "git push --force" {
+		t.Fatalf("arg:--force cmd:push returned unexpected results: %#v", results)
+	}
+	results, err = Search(ctx, db, "arg:--force -cmd:rm", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "git push --force" {
+		t.Fatalf("arg:--force -cmd:rm returned unexpected results: %#v", results)
+	}
+}
+
+func TestAutoTags(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	for _, args := range [][]string{{"clientA", "cwd:~/work/clientA"}, {"k8s", "program:kubectl"}, {"k8s", "program:helm"}} {
+		rule, err := ParseAutoTagRule(args[0], args[1])
+		testutils.Check(t, err)
+		conf.AutoTags = append(conf.AutoTags, rule)
+	}
+	testutils.Check(t, hctx.SetConfig(conf))
+	if _, err := ParseAutoTagRule("foo", "host:bar"); err == nil {
+		t.Fatalf("expected an unsupported condition to be rejected")
+	}
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	clientEntry := testutils.MakeFakeHistoryEntry("kubectl get pods")
+	clientEntry.CurrentWorkingDirectory = "~/work/clientA/infra"
+	db.Create(clientEntry)
+	db.Create(testutils.MakeFakeHistoryEntry("helm list"))
+	db.Create(testutils.MakeFakeHistoryEntry("kubectlfoo"))
+
+	results, err := Search(ctx, db, "tag:k8s", 10)
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("tag:k8s returned %d results, expected 2: %#v", len(results), results)
+	}
+	results, err = Search(ctx, db, "tag:clientA", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "kubectl get pods" {
+		t.Fatalf("tag:clientA returned unexpected results: %#v", results)
+	}
+	results, err = Search(ctx, db, "-tag:k8s", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "kubectlfoo" {
+		t.Fatalf("-tag:k8s returned unexpected results: %#v", results)
+	}
+	results, err = Search(ctx, db, "tag:unknown", 10)
+	testutils.Check(t, err)
+	if len(results) != 0 {
+		t.Fatalf("tag:unknown returned unexpected results: %#v", results)
+	}
+	if tags := getAutoTags(ctx, clientEntry); !reflect.DeepEqual(tags, []string{"clientA", "k8s"}) {
+		t.Fatalf("getAutoTags() returned %#v", tags)
+	}
+
+	// The displayed tags match the tag: atom for every cwd_match_mode
+	for _, mode := range CwdMatchModes {
+		conf.CwdMatchMode = mode
+		modeCtx := hctx.WithConfig(ctx, conf)
+		results, err := Search(modeCtx, db, "tag:clientA", 10)
+		testutils.Check(t, err)
+		isTagged := containsString(getAutoTags(modeCtx, clientEntry), "clientA")
+		if isTagged != (len(results) == 1) || isTagged != (mode != "exact") {
+			t.Fatalf("cwd_match_mode=%s: getAutoTags() and tag:clientA disagree (%v vs %#v)", mode, isTagged, results)
+		}
+	}
+	for _, err := range ValidateConfig(hctx.GetConf(ctx)) {
+		if strings.HasPrefix(err.Error(), "auto_tags") {
+			t.Fatalf("unexpected validation error: %v", err)
+		}
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("ls"))
+	db.Create(testutils.MakeFakeHistoryEntry("echo " + strings.Repeat("a", 100)))
+	otherHost := testutils.MakeFakeHistoryEntry("pwd")
+	otherHost.Hostname = "otherhost"
+	db.Create(otherHost)
+
+	usage, err := GetUsage(ctx, 1)
+	testutils.Check(t, err)
+	if usage.NumEntries != 3 {
+		t.Fatalf("unexpected number of entries: %d", usage.NumEntries)
+	}
+	if usage.Columns[0].Description != "Commands" || usage.Columns[0].Bytes != int64(len("ls")+len("pwd")+105) {
+		t.Fatalf("unexpected command usage: %#v", usage.Columns[0])
+	}
+	if len(usage.LargestEntries) != 1 || !strings.HasPrefix(usage.LargestEntries[0].Command, "echo aaa") {
+		t.Fatalf("unexpected largest entries: %#v", usage.LargestEntries)
+	}
+	if len(usage.Hosts) != 2 || usage.Hosts[0].Count != 2 || usage.Hosts[1] != (HostUsage{"otherhost", 1}) {
+		t.Fatalf("unexpected hosts: %#v", usage.Hosts)
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	entry := testutils.MakeFakeHistoryEntry("cat ~/foo.txt")
+	entry.HomeDirectory = "/home/david"
+	db.Create(entry)
+	db.Create(testutils.MakeFakeHistoryEntry("ls"))
+
+	// Migrations are only run if they're enabled
+	var out bytes.Buffer
+	testutils.Check(t, RunMigrations(ctx, &out))
+	if out.String() != "" {
+		t.Fatalf("unexpected output for disabled migrations: %#v", out.String())
+	}
+
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.NormalizePaths = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	testutils.Check(t, RunMigrations(ctx, &out))
+	if out.String() != "Computing normalized paths for existing entries: 2/2 entries (100%)\n" {
+		t.Fatalf("unexpected progress output: %#v", out.String())
+	}
+	results, err := Search(ctx, db, "cat", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].NormalizedPaths != "/home/david/foo.txt" {
+		t.Fatalf("normalized paths weren't backfilled: %#v", results)
+	}
+
+	// Re-running resumes from the last checkpoint
+	conf, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if conf.MigrationCheckpoints["normalized_paths"].IsZero() {
+		t.Fatalf("expected a checkpoint to be saved")
+	}
+	out.Reset()
+	testutils.Check(t, RunMigrations(hctx.MakeContext(), &out))
+	if !strings.HasPrefix(out.String(), "Computing normalized paths for existing entries: resuming from ") {
+		t.Fatalf("expected the migration to resume: %#v", out.String())
+	}
+}
+
+func TestCurrentSessionOnly(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SESSION_ID")()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i, sessionId := range []string{"123-1", "456-2", "123-1"} {
+		entry := testutils.MakeFakeHistoryEntry(fmt.Sprintf("echo %d", i))
+		entry.SessionId = sessionId
+		db.Create(entry)
+	}
+
+	os.Setenv("HISHTORY_SESSION_ID", "123-1")
+	results, err := SearchForDisplay(ctx, db, "echo", 10, SearchOptions{CurrentSessionOnly: true})
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != "echo 2" || results[1].Command != "echo 0" {
+		t.Fatalf("unexpected results for the current session: %#v", results)
+	}
+	results, err = SearchForDisplay(ctx, db, "echo", 10, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 3 {
+		t.Fatalf("expected results from all sessions, got %#v", results)
+	}
+}
+
+func TestSessionAtom(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SESSION_ID")()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i, sessionId := range []string{"123-1", "456-2", "123-1"} {
+		entry := testutils.MakeFakeHistoryEntry(fmt.Sprintf("echo %d", i))
+		entry.SessionId = sessionId
+		db.Create(entry)
+	}
+
+	results, err := SearchForDisplay(ctx, db, "echo session:456-2", 10, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "echo 1" {
+		t.Fatalf("unexpected results for session:456-2: %#v", results)
+	}
+	results, err = SearchForDisplay(ctx, db, "echo -session:456-2", 10, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("unexpected results for -session:456-2: %#v", results)
+	}
+
+	// session:current uses the session that hishtory is being run from
+	os.Setenv("HISHTORY_SESSION_ID", "123-1")
+	results, err = SearchForDisplay(ctx, db, "session:current", 10, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != "echo 2" || results[1].Command != "echo 0" {
+		t.Fatalf("unexpected results for session:current: %#v", results)
+	}
+	if sessionIds := getQuerySessionIds("echo session:current -session:456-2"); !reflect.DeepEqual(sessionIds, []string{"123-1"}) {
+		t.Fatalf("unexpected session IDs for the footer: %#v", sessionIds)
+	}
+
+	// Which is an error if it isn't known
+	os.Setenv("HISHTORY_SESSION_ID", "")
+	_, err = SearchForDisplay(ctx, db, "session:current", 10, SearchOptions{})
+	if err == nil || !strings.Contains(err.Error(), "the current shell session is unknown") {
+		t.Fatalf("expected an error for an unknown current session, got %v", err)
+	}
+}
+
+func TestSensitiveEntries(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SERVER")()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	var uploaded []shared.EncHistoryEntry
+	var deletionRequest shared.DeletionRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		testutils.Check(t, err)
+		switch r.URL.Path {
+		case "/api/v1/submit":
+			testutils.Check(t, json.Unmarshal(body, &uploaded))
+		case "/api/v1/add-deletion-request":
+			testutils.Check(t, json.Unmarshal(body, &deletionRequest))
+		}
+	}))
+	defer server.Close()
+	os.Setenv("HISHTORY_SERVER", server.URL)
+	db.Create(testutils.MakeFakeHistoryEntry("ls /foo"))
+	secret := testutils.MakeFakeHistoryEntry("curl -u admin:hunter2 example.com")
+	db.Create(secret)
+	originalEndTime := secret.EndTime
+	testutils.Check(t, SetSensitive(ctx, &secret, true))
+
+	// The change is synced by uploading the updated entry and deleting the original on other devices
+	if len(uploaded) != 1 {
+		t.Fatalf("expected the updated entry to be uploaded, got %#v", uploaded)
+	}
+	decrypted, err := data.DecryptHistoryEntry(hctx.GetConf(ctx).UserSecret, uploaded[0])
+	testutils.Check(t, err)
+	if decrypted.Command != secret.Command || !decrypted.IsSensitive || !decrypted.EndTime.Equal(secret.EndTime) {
+		t.Fatalf("unexpected uploaded entry: %#v", decrypted)
+	}
+	if len(deletionRequest.Messages.Ids) != 1 || !deletionRequest.Messages.Ids[0].Date.Equal(originalEndTime) {
+		t.Fatalf("expected the original entry to be deleted on other devices, got %#v", deletionRequest)
+	}
+
+	results, err := SearchForDisplay(ctx, db, "", 10, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "ls /foo" {
+		t.Fatalf("sensitive entry was not hidden: %#v", results)
+	}
+	results, err = SearchForDisplay(ctx, db, "", 10, SearchOptions{ShowSensitive: true})
+	testutils.Check(t, err)
+	if len(results) != 2 || !results[0].IsSensitive {
+		t.Fatalf("sensitive entry was not shown with ShowSensitive: %#v", results)
+	}
+	results, err = Search(ctx, db, "hunter2", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 {
+		t.Fatalf("Search() should not hide sensitive entries: %#v", results)
+	}
+
+	testutils.Check(t, SetSensitive(ctx, &secret, false))
+	count, err := CountForDisplay(ctx, db, "", SearchOptions{})
+	testutils.Check(t, err)
+	if count != 2 {
+		t.Fatalf("entry was still hidden after being unmarked, count=%d", count)
+	}
+}
+
+func TestDistinctDirectoriesForDisplay(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i, cwd := range []string{"/tmp/", "~/code/", "/tmp/", "/etc/"} {
+		entry := testutils.MakeFakeHistoryEntry(fmt.Sprintf("ls %d", i))
+		entry.CurrentWorkingDirectory = cwd
+		db.Create(entry)
+	}
+	entry := testutils.MakeFakeHistoryEntry("echo foo")
+	entry.CurrentWorkingDirectory = "/var/"
+	db.Create(entry)
+
+	directories, err := DistinctDirectoriesForDisplay(ctx, db, "ls", SearchOptions{})
+	testutils.Check(t, err)
+	expected := []DirectoryCount{{"/tmp/", 2}, {"/etc/", 1}, {"~/code/", 1}}
+	if !reflect.DeepEqual(directories, expected) {
+		t.Fatalf("DistinctDirectoriesForDisplay() returned %#v, expected %#v", directories, expected)
+	}
+}
+
+func TestDirectoryPicker(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, cwd := range []string{"/srv/my project/", "/srv/other/", "/srv/my project/"} {
+		entry := testutils.MakeFakeHistoryEntry("pickdir build")
+		entry.CurrentWorkingDirectory = cwd
+		db.Create(entry)
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "pickdir", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows)), rows, entries, "pickdir", numEntries, TuiOptions{})
+
+	// Selecting a directory that contains spaces filters to it via a quoted cwd: atom
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'d'}, Alt: true})
+	if directories := m.(model).directories; len(directories) != 2 || directories[0].Directory != "/srv/my project/" {
+		t.Fatalf("unexpected directories: %#v", directories)
+	}
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.(model).queryInput.Value() != `pickdir cwd:"/srv/my project/"` || m.(model).numEntries != 2 {
+		t.Fatalf("unexpected query %#v with %d results", m.(model).queryInput.Value(), m.(model).numEntries)
+	}
+}
+
+func TestShrinkColumnWidths(t *testing.T) {
+	testcases := []struct {
+		columnWidths []int
+		excessWidth  int
+		mode         string
+		expected     []int
+	}{
+		// The default mode alternates between the columns that are tied for the widest
+		{[]int{10, 40, 40}, 30, "", []int{10, 24, 26}},
+		{[]int{10, 40, 40}, 30, "widest", []int{10, 24, 26}},
+		// And it squashes a single wide column
+		{[]int{40, 10, 10}, 30, "", []int{10, 10, 10}},
+		// Proportional mode shrinks every column based on its width
+		{[]int{10, 40, 40}, 30, "proportional", []int{7, 26, 27}},
+		{[]int{40, 10, 10}, 30, "proportional", []int{20, 5, 5}},
+		// Columns are never shrunk below a width of 1
+		{[]int{2, 4}, 10, "proportional", []int{1, 1}},
+		{[]int{10, 40, 40}, 0, "proportional", []int{10, 40, 40}},
+	}
+	for _, tc := range testcases {
+		actual := shrinkColumnWidths(tc.columnWidths, tc.excessWidth, tc.mode)
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("shrinkColumnWidths(%v, %d, %#v)=%v, expected %v", tc.columnWidths, tc.excessWidth, tc.mode, actual, tc.expected)
+		}
+	}
+}
+
+func TestFitColumnWidths(t *testing.T) {
+	columnNames := []string{"Timestamp", "CWD", "Command"}
+	columnWidths := []int{19, 10, 20}
+	maximumColumnWidths := []int{19, 30, 60}
+
+	// Without fixed widths, columns are padded up to 5 characters past the maximum widths
+	widths := fitColumnWidths(columnNames, columnWidths, maximumColumnWidths, nil, 200, "")
+	if !reflect.DeepEqual(widths, []int{24, 35, 65}) {
+		t.Fatalf("unexpected widths: %v", widths)
+	}
+	// Fixed widths are never padded
+	widths = fitColumnWidths(columnNames, columnWidths, maximumColumnWidths, map[string]int{"Timestamp": 10}, 200, "")
+	if !reflect.DeepEqual(widths, []int{10, 35, 65}) {
+		t.Fatalf("unexpected widths with a fixed width: %v", widths)
+	}
+	// Or shrunk, as long as the other columns can be shrunk instead
+	widths = fitColumnWidths(columnNames, columnWidths, maximumColumnWidths, map[string]int{"Timestamp": 19}, 60, "proportional")
+	if widths[0] != 19 || 20+widths[0]+widths[1]+widths[2] > 60 {
+		t.Fatalf("unexpected widths in a narrow terminal: %v", widths)
+	}
+	// But they are truncated if nothing else fits
+	widths = fitColumnWidths(columnNames, columnWidths, maximumColumnWidths, map[string]int{"Timestamp": 50}, 60, "proportional")
+	if widths[0] >= 50 || 20+widths[0]+widths[1]+widths[2] > 60 {
+		t.Fatalf("unexpected widths in a terminal that is too narrow: %v", widths)
+	}
+
+	conf := hctx.ClientConfig{DisplayedColumns: columnNames, ColumnWidths: map[string]int{"Timestamp": 50}}
+	if err := validateColumnWidthsFit(conf, 100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := validateColumnWidthsFit(conf, 60); err == nil {
+		t.Fatalf("expected an error for fixed widths that don't fit")
+	}
+}
+
+func TestExportRows(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.TimestampFormat = "2006-01-02 15:04"
+	conf.DisplayTimezone = "UTC"
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	dir := t.TempDir()
+	columnNames := []string{"Hostname", "Command"}
+	rows := [][]string{{"localhost", "ls /foo"}, {"server", "echo \"a,b\""}}
+	newer := testutils.MakeFakeHistoryEntry("ls /foo")
+	newer.StartTime = time.Date(2023, 6, 2, 10, 0, 0, 0, time.UTC)
+	older := testutils.MakeFakeHistoryEntry("echo \"a,b\"")
+	older.StartTime = time.Date(2023, 6, 1, 9, 30, 0, 0, time.UTC)
+	entries := []*data.HistoryEntry{&newer, &older}
+
+	testutils.Check(t, ExportRows(ctx, path.Join(dir, "out.json"), columnNames, rows, entries))
+	expectedJson := "[\n  {\n    \"Command\": \"ls /foo\",\n    \"Hostname\": \"localhost\"\n  },\n  {\n    \"Command\": \"echo \\\"a,b\\\"\",\n    \"Hostname\": \"server\"\n  }\n]\n"
+	if out := readFile(t, path.Join(dir, "out.json")); out != expectedJson {
+		t.Fatalf("unexpected json export: %#v", out)
+	}
+
+	testutils.Check(t, ExportRows(ctx, path.Join(dir, "out.csv"), columnNames, rows, entries))
+	if out := readFile(t, path.Join(dir, "out.csv")); out != "Hostname,Command\nlocalhost,ls /foo\nserver,\"echo \"\"a,b\"\"\"\n" {
+		t.Fatalf("unexpected csv export: %#v", out)
+	}
+
+	testutils.Check(t, ExportRows(ctx, path.Join(dir, "out.txt"), columnNames, rows, entries))
+	if out := readFile(t, path.Join(dir, "out.txt")); out != "ls /foo\necho \"a,b\"\n" {
+		t.Fatalf("unexpected text export: %#v", out)
+	}
+
+	testutils.Check(t, ExportRows(ctx, path.Join(dir, "out.md"), columnNames, [][]string{{"localhost", "ls | wc"}, {"server", "echo a\necho b"}}, entries))
+	if out := readFile(t, path.Join(dir, "out.md")); out != "| Hostname | Command |\n| --- | --- |\n| localhost | ls \\| wc |\n| server | echo a<br>echo b |\n" {
+		t.Fatalf("unexpected markdown export: %#v", out)
+	}
+
+	// Shell scripts run the commands in the order that they were run, no matter which columns are displayed
+	testutils.Check(t, ExportRows(ctx, path.Join(dir, "out.sh"), []string{"Hostname"}, [][]string{{"localhost"}, {"server"}}, entries))
+	if out := readFile(t, path.Join(dir, "out.sh")); out != "#!/bin/sh\n\n# 2023-06-01 09:30\necho \"a,b\"\n\n# 2023-06-02 10:00\nls /foo\n" {
+		t.Fatalf("unexpected shell script export: %#v", out)
+	}
+	if stat, err := os.Stat(path.Join(dir, "out.sh")); err != nil || stat.Mode().Perm()&0o100 == 0 {
+		t.Fatalf("expected the shell script to be executable: %v", err)
+	}
+
+	// Write errors are returned rather than panicking
+	if err := ExportRows(ctx, path.Join(dir, "missing", "out.sh"), columnNames, rows, entries); err == nil {
+		t.Fatalf("expected an error when exporting to a directory that doesn't exist")
+	}
+}
+
+func readFile(t *testing.T, filePath string) string {
+	dat, err := os.ReadFile(filePath)
+	testutils.Check(t, err)
+	return string(dat)
+}
+
+func TestGetOutputOnQuit(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	defer testutils.BackupAndRestoreEnv("HISHTORY_TERM_INTEGRATION")()
+
+	os.Setenv("HISHTORY_TERM_INTEGRATION", "1")
+	if out := getOutputOnQuit(hctx.MakeContext(), "initial", "typed"); out != "initial" {
+		t.Fatalf("unexpected output for the default behavior: %#v", out)
+	}
+	os.Setenv("HISHTORY_TERM_INTEGRATION", "")
+	if out := getOutputOnQuit(hctx.MakeContext(), "initial", "typed"); out != "" {
+		t.Fatalf("unexpected output for the default behavior without term integration: %#v", out)
+	}
+
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.TuiQuitBehavior = "echo"
+	testutils.Check(t, hctx.SetConfig(conf))
+	if out := getOutputOnQuit(hctx.MakeContext(), "initial", "typed"); out != "typed" {
+		t.Fatalf("unexpected output for the echo behavior: %#v", out)
+	}
+
+	conf.TuiQuitBehavior = "leave"
+	testutils.Check(t, hctx.SetConfig(conf))
+	os.Setenv("HISHTORY_TERM_INTEGRATION", "1")
+	if out := getOutputOnQuit(hctx.MakeContext(), "initial", "typed"); out != "" {
+		t.Fatalf("unexpected output for the leave behavior: %#v", out)
+	}
+}
+
+func TestEnterWithNoResults(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+
+	m, cmd := enterWithNoResults(model{ctx: hctx.MakeContext()})
+	if cmd == nil || m.useTypedQuery {
+		t.Fatalf("the default behavior should quit without using the typed query")
+	}
+
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.TuiEmptyEnterBehavior = "ignore"
+	testutils.Check(t, hctx.SetConfig(conf))
+	m, cmd = enterWithNoResults(model{ctx: hctx.MakeContext()})
+	if cmd != nil || m.useTypedQuery {
+		t.Fatalf("the ignore behavior should stay in the TUI")
+	}
+
+	conf.TuiEmptyEnterBehavior = "query"
+	testutils.Check(t, hctx.SetConfig(conf))
+	m, cmd = enterWithNoResults(model{ctx: hctx.MakeContext()})
+	if cmd == nil || !m.useTypedQuery {
+		t.Fatalf("the query behavior should quit and use the typed query")
+	}
+}
+
+func TestGetRecentDirectories(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	now := time.Now()
+	frequentDir := t.TempDir()
+	recentDir := t.TempDir() + "/"
+	// Used often, but a long time ago
+	for i := 0; i < 5; i++ {
+		entry := testutils.MakeFakeHistoryEntry("make")
+		entry.CurrentWorkingDirectory = frequentDir
+		entry.StartTime = now.Add(-30 * 24 * time.Hour)
+		db.Create(entry)
+	}
+	// Used a few times recently
+	for i := 0; i < 2; i++ {
+		entry := testutils.MakeFakeHistoryEntry("ls")
+		entry.CurrentWorkingDirectory = recentDir
+		entry.StartTime = now.Add(-time.Minute)
+		db.Create(entry)
+	}
+	// No longer exists
+	entry := testutils.MakeFakeHistoryEntry("ls")
+	entry.CurrentWorkingDirectory = "/this/does/not/exist/"
+	entry.StartTime = now
+	db.Create(entry)
+
+	directories, err := GetRecentDirectories(ctx, now)
+	testutils.Check(t, err)
+	if len(directories) != 2 || directories[0].Directory != strings.TrimSuffix(recentDir, "/") || directories[1].Directory != frequentDir || directories[1].Count != 5 {
+		t.Fatalf("unexpected directories: %#v", directories)
+	}
+	if filtered := filterDirectories(directories, strings.ToUpper(frequentDir)); len(filtered) != 1 || filtered[0].Directory != frequentDir {
+		t.Fatalf("unexpected filtered directories: %#v", filtered)
+	}
+	if cmd := makeCdCommand("/tmp/it's here"); cmd != `cd '/tmp/it'\''s here'` {
+		t.Fatalf("unexpected cd command: %#v", cmd)
+	}
+}
+
+func TestGetRecentDirectoriesInHome(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	now := time.Now()
+	homedir := t.TempDir()
+	testutils.Check(t, os.Mkdir(path.Join(homedir, "work"), 0o755))
+	// Directories within the home directory are recorded relative to it, as getCwd does
+	for i, cwd := range []string{"~/work", "~/", path.Join(homedir, "work"), "~/missing"} {
+		entry := testutils.MakeFakeHistoryEntry("ls")
+		entry.HomeDirectory = homedir
+		entry.CurrentWorkingDirectory = cwd
+		entry.StartTime = now.Add(-time.Duration(i) * time.Minute)
+		db.Create(entry)
+	}
+
+	directories, err := GetRecentDirectories(ctx, now)
+	testutils.Check(t, err)
+	if len(directories) != 2 || directories[0].Directory != path.Join(homedir, "work") || directories[0].Count != 2 || directories[1].Directory != homedir {
+		t.Fatalf("unexpected directories: %#v", directories)
+	}
+	if expanded := expandHomeDirectory("~/work", "/home/david/"); expanded != "/home/david/work" {
+		t.Fatalf("unexpected expanded directory: %#v", expanded)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i, cmd := range []string{"make build", "make test", "make deploy", "git push"} {
+		entry := testutils.MakeFakeHistoryEntry(cmd)
+		entry.SessionId = "session-a"
+		entry.StartTime = entry.StartTime.Add(time.Duration(i) * time.Minute)
+		db.Create(entry)
+	}
+	other := testutils.MakeFakeHistoryEntry("ls")
+	other.SessionId = "session-b"
+	db.Create(other)
+
+	entries, err := GetSessionEntries(ctx, "session-a")
+	testutils.Check(t, err)
+	if len(entries) != 4 || entries[0].Command != "make build" || entries[3].Command != "git push" {
+		t.Fatalf("unexpected session entries: %#v", entries)
+	}
+	if _, err := GetSessionEntries(ctx, "session-c"); err == nil {
+		t.Fatalf("expected an error for a session without any commands")
+	}
+
+	// Skip the first command, and stop after the second one fails
+	ran := make([]string, 0)
+	run := func(entry *data.HistoryEntry) (int, error) {
+		ran = append(ran, entry.Command)
+		if entry.Command == "make test" {
+			return 2, nil
+		}
+		return 0, nil
+	}
+	var out bytes.Buffer
+	testutils.Check(t, Replay(entries, strings.NewReader("s\ny\ns\n"), &out, run))
+	if !reflect.DeepEqual(ran, []string{"make test"}) {
+		t.Fatalf("unexpected commands were run: %#v", ran)
+	}
+	if !strings.Contains(out.String(), "failed with exit code 2") {
+		t.Fatalf("expected the failure to be reported: %#v", out.String())
+	}
+
+	// Continue past the failure, and quit before the last command
+	ran = make([]string, 0)
+	testutils.Check(t, Replay(entries, strings.NewReader("\n\n\ny\nq\n"), &out, run))
+	if !reflect.DeepEqual(ran, []string{"make build", "make test", "make deploy"}) {
+		t.Fatalf("unexpected commands were run: %#v", ran)
+	}
+
+	// Unrecognized answers are asked again rather than running the command
+	ran = make([]string, 0)
+	testutils.Check(t, Replay(entries[:1], strings.NewReader("no\nskip\ns\n"), &out, run))
+	if len(ran) != 0 {
+		t.Fatalf("unexpected commands were run: %#v", ran)
+	}
+	if !strings.Contains(out.String(), "Please answer y, s, or q") {
+		t.Fatalf("expected to be asked again: %#v", out.String())
+	}
+}
+
+func TestRunReplayedCommandDirectory(t *testing.T) {
+	defer testutils.BackupAndRestoreEnv("SHELL")()
+	os.Setenv("SHELL", "sh")
+	homedir := t.TempDir()
+	testutils.Check(t, os.Mkdir(path.Join(homedir, "project"), 0o755))
+	outputFile := path.Join(t.TempDir(), "pwd")
+
+	entry := testutils.MakeFakeHistoryEntry("pwd > " + outputFile)
+	entry.HomeDirectory = homedir
+	entry.CurrentWorkingDirectory = "~/project"
+	exitCode, err := RunReplayedCommand(&entry)
+	testutils.Check(t, err)
+	if exitCode != 0 {
+		t.Fatalf("unexpected exit code: %d", exitCode)
+	}
+	output, err := os.ReadFile(outputFile)
+	testutils.Check(t, err)
+	if strings.TrimSpace(string(output)) != path.Join(homedir, "project") {
+		t.Fatalf("command ran in the wrong directory: %#v", string(output))
+	}
+}
+
+func TestOnboarding(t *testing.T) {
+	defer testutils.BackupAndRestoreEnv("SHELL")()
+	os.Setenv("SHELL", "/usr/bin/fish")
+	questions := getOnboardingQuestions()
+	if !reflect.DeepEqual(questions[0].options, []string{"fish", "bash", "zsh"}) {
+		t.Fatalf("expected the current shell to be the default, got %#v", questions[0].options)
+	}
+	var m tea.Model = onboardingModel{questions: questions}
+	// bash, no syncing, the default columns, and timestamps in UTC
+	for _, k := range []tea.KeyType{tea.KeyDown, tea.KeyEnter, tea.KeyDown, tea.KeyDown, tea.KeyEnter, tea.KeyEnter, tea.KeyDown, tea.KeyEnter} {
+		m, _ = m.Update(tea.KeyMsg{Type: k})
+	}
+	answers := m.(onboardingModel).answers
+	if !reflect.DeepEqual(answers, []int{1, 1, 0, 1}) {
+		t.Fatalf("unexpected answers: %#v", answers)
+	}
+	choices := getSetupChoices(questions, answers)
+	expected := SetupChoices{
+		Shell:            "bash",
+		EnableSync:       false,
+		DisplayedColumns: []string{"Hostname", "CWD", "Timestamp", "Runtime", "Exit Code", "Command"},
+		DisplayTimezone:  "UTC",
+	}
+	if !reflect.DeepEqual(choices, expected) {
+		t.Fatalf("unexpected choices: %#v", choices)
+	}
+	for _, option := range questions[2].options {
+		conf := hctx.ClientConfig{UserSecret: "foo", DeviceId: "bar", DisplayedColumns: strings.Split(option, ", ")}
+		if errs := ValidateConfig(conf); len(errs) > 0 {
+			t.Fatalf("column option %#v is invalid: %v", option, errs)
+		}
+	}
+
+	// An unsupported shell leaves the default order alone
+	os.Setenv("SHELL", "/bin/sh")
+	if options := getShellOptions(); !reflect.DeepEqual(options, supportedShells) {
+		t.Fatalf("unexpected shell options: %#v", options)
+	}
+}
+
+func TestParseSetupArgs(t *testing.T) {
+	testcases := []struct {
+		args       []string
+		userSecret string
+		isOffline  bool
+	}{
+		{[]string{"hishtory", "install"}, "", false},
+		{[]string{"hishtory", "install", ""}, "", false},
+		{[]string{"hishtory", "install", "--offline"}, "", true},
+		{[]string{"hishtory", "install", "my-secret"}, "my-secret", false},
+	}
+	for _, tc := range testcases {
+		userSecret, isOffline, err := parseSetupArgs(tc.args)
+		testutils.Check(t, err)
+		if userSecret != tc.userSecret || isOffline != tc.isOffline {
+			t.Fatalf("parseSetupArgs(%#v) returned (%#v, %v)", tc.args, userSecret, isOffline)
+		}
+	}
+	if _, _, err := parseSetupArgs([]string{"hishtory", "install", "--bogus"}); err == nil {
+		t.Fatalf("expected an error for a secret that looks like a flag")
+	}
+}
+
+func TestExportImportConfig(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	conf := hctx.GetConf(ctx)
+	conf.DisplayedColumns = []string{"Timestamp", "Command"}
+	conf.SavedFilters = map[string]string{"failed": "exit_code:1"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	exported, err := ExportConfig(hctx.MakeContext())
+	testutils.Check(t, err)
+	if strings.Contains(string(exported), "user_secret") || strings.Contains(string(exported), "device_id") {
+		t.Fatalf("exported config contains device-specific fields: %s", exported)
+	}
+
+	// Import it on a "different" device, along with a field from a newer version
+	testutils.Check(t, hctx.InitConfig())
+	ctx = hctx.MakeContext()
+	originalSecret := hctx.GetConf(ctx).UserSecret
+	exported = []byte(strings.Replace(string(exported), "{", `{"some_future_field": true, "device_id": "foo",`, 1))
+	warnings, err := ImportConfig(ctx, exported)
+	testutils.Check(t, err)
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "device_id") || !strings.Contains(warnings[1], "some_future_field") {
+		t.Fatalf("unexpected warnings: %#v", warnings)
+	}
+	imported, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(imported.DisplayedColumns, []string{"Timestamp", "Command"}) || imported.SavedFilters["failed"] != "exit_code:1" {
+		t.Fatalf("settings weren't imported: %#v", imported)
+	}
+	if imported.UserSecret != originalSecret || imported.DeviceId == "foo" {
+		t.Fatalf("device-specific fields were overwritten: %#v", imported)
+	}
+
+	if _, err := ImportConfig(ctx, []byte(`{"displayed_columns": ["Typo"]}`)); err == nil {
+		t.Fatalf("expected an invalid config to be rejected")
+	}
+}
+
+func TestGetSavedFilter(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	if _, err := GetSavedFilter(ctx, "failed-deploys"); err == nil || !strings.Contains(err.Error(), "config-add saved-filters") {
+		t.Fatalf("expected an error explaining how to add a saved filter, got %v", err)
+	}
+	conf := hctx.GetConf(ctx)
+	conf.SavedFilters = map[string]string{"failed-deploys": "exit_code:1 program:kubectl", "mine": "user:david"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	query, err := GetSavedFilter(ctx, "failed-deploys")
+	testutils.Check(t, err)
+	if query != "exit_code:1 program:kubectl" {
+		t.Fatalf("unexpected query: %#v", query)
+	}
+	if _, err := GetSavedFilter(ctx, "typo"); err == nil || !strings.Contains(err.Error(), "failed-deploys, mine") {
+		t.Fatalf("expected an error listing the saved filters, got %v", err)
+	}
+}
+
+func TestRenderLineTemplate(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	entry := testutils.MakeFakeHistoryEntry("ls ~/")
+	line, err := renderLineTemplate(ctx, "[{Exit Code}] {Hostname}:{CWD}$ {Command}", entry)
+	testutils.Check(t, err)
+	if line != "[2] localhost:/tmp/$ ls ~/" {
+		t.Fatalf("unexpected line: %#v", line)
+	}
+	if _, err := renderLineTemplate(ctx, "{Hostname} {Typo}", entry); err == nil {
+		t.Fatalf("expected an error for a template with an unknown column")
+	}
+	if columns := getLineTemplateColumns("{Timestamp} {CWD}$ {Command}"); !reflect.DeepEqual(columns, []string{"Timestamp", "CWD", "Command"}) {
+		t.Fatalf("unexpected columns: %#v", columns)
+	}
+
+	conf := hctx.GetConf(ctx)
+	conf.LineTemplate = "{Typo}"
+	found := false
+	for _, err := range ValidateConfig(conf) {
+		if strings.HasPrefix(err.Error(), "line_template:") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected ValidateConfig to reject a template with an unknown column")
+	}
+}
+
+func TestTuiMaxRows(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.TuiMaxRows = 3
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 5; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("echo %d", i)))
+	}
+	rows, entries, _, err := getRows(ctx, []string{"Command"}, "", 100, SearchOptions{})
+	testutils.Check(t, err)
+	if len(rows) != 3 || len(entries) != 3 {
+		t.Fatalf("expected getRows to be limited to 3 rows, got %d rows and %d entries", len(rows), len(entries))
+	}
+	m := model{ctx: ctx, numEntriesToLoad: 2, table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}))}
+	m = loadMoreEntries(m)
+	if m.numEntriesToLoad != 3 || len(m.entries) != 3 {
+		t.Fatalf("expected loading more to be limited to 3 rows, got numEntriesToLoad=%d with %d entries", m.numEntriesToLoad, len(m.entries))
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.IsOffline = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	entry1 := testutils.MakeFakeHistoryEntry("echo keep")
+	db.Create(entry1)
+	entry2 := testutils.MakeFakeHistoryEntry("echo secret")
+	db.Create(entry2)
+
+	// Deleting requires confirmation
+	m := model{ctx: ctx, entries: []*data.HistoryEntry{&entry2, &entry1}, table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}), table.WithRows([]table.Row{{"echo secret"}, {"echo keep"}}))}
+	updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyCtrlK})
+	if !updated.(model).isConfirmingDelete {
+		t.Fatalf("expected ctrl+k to ask for confirmation")
+	}
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("n")})
+	if updated.(model).isConfirmingDelete {
+		t.Fatalf("expected any other key to cancel the deletion")
+	}
+	results, err := Search(ctx, db, "", 10)
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("expected a cancelled deletion to not delete anything, got %d results", len(results))
+	}
+
+	testutils.Check(t, DeleteEntry(ctx, &entry2))
+	results, err = Search(ctx, db, "", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "echo keep" {
+		t.Fatalf("unexpected results after deleting: %#v", results)
+	}
+}
+
+func TestPreviewView(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	entry := testutils.MakeFakeHistoryEntry("cat <<EOF\nhello\nworld\nEOF")
+	rows := []table.Row{{"cat <<EOF hello world EOF"}}
+	m := model{ctx: hctx.MakeContext(), entries: []*data.HistoryEntry{&entry}, table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows))}
+	if m.previewView() != "" {
+		t.Fatalf("expected no preview when it is disabled")
+	}
+	m.showPreview = true
+	preview := m.previewView()
+	for _, line := range []string{"cat <<EOF", "hello", "world", "EOF"} {
+		if !strings.Contains(preview, "│"+line+" ") {
+			t.Fatalf("expected the preview to contain the line %#v: %#v", line, preview)
+		}
+	}
+
+	longEntry := testutils.MakeFakeHistoryEntry(strings.Repeat("echo hello\n", 20))
+	m.entries = []*data.HistoryEntry{&longEntry}
+	if lines := strings.Split(strings.TrimSuffix(m.previewView(), "\n"), "\n"); len(lines) != PREVIEW_HEIGHT || !strings.Contains(lines[PREVIEW_HEIGHT-2], "…") {
+		t.Fatalf("expected a long preview to be truncated to %d lines: %#v", PREVIEW_HEIGHT, lines)
+	}
+}
+
+func TestGetManPageProgram(t *testing.T) {
+	testcases := []struct {
+		command, expected string
+	}{
+		{"ls -la", "ls"},
+		{"sudo apt-get install foo", "apt-get"},
+		{"GOOS=linux go build ./...", "go"},
+		{"sudo FOO=bar make", "make"},
+		{"", ""},
+	}
+	for _, tc := range testcases {
+		if actual := getManPageProgram(tc.command); actual != tc.expected {
+			t.Fatalf("getManPageProgram(%#v)=%#v, expected %#v", tc.command, actual, tc.expected)
+		}
+	}
+}
+
+func TestFindDistinctEntry(t *testing.T) {
+	entries := []*data.HistoryEntry{}
+	for _, cmd := range []string{"ls", "ls", "ls", "git status", "git status", "ls"} {
+		entry := testutils.MakeFakeHistoryEntry(cmd)
+		entries = append(entries, &entry)
+	}
+	testcases := []struct {
+		cursor, direction, expected int
+	}{
+		{0, 1, 3},
+		{3, 1, 5},
+		{5, 1, 5},
+		{5, -1, 4},
+		{4, -1, 2},
+		{2, -1, 2},
+		{0, -1, 0},
+	}
+	for _, tc := range testcases {
+		if actual := findDistinctEntry(entries, tc.cursor, tc.direction); actual != tc.expected {
+			t.Fatalf("findDistinctEntry(cursor=%d, direction=%d)=%d, expected %d", tc.cursor, tc.direction, actual, tc.expected)
+		}
+	}
+}
+
+func TestNeedsMultiLineConfirmation(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("echo foo\necho bar"))
+	_, entries, _, err := getRows(ctx, []string{"Command"}, "", 10, SearchOptions{})
+	testutils.Check(t, err)
+	if len(entries) != 1 || entries[0].Command != "echo foo\necho bar" {
+		t.Fatalf("getRows() should return the original multi-line command: %#v", entries)
+	}
+	m := model{ctx: ctx, entries: entries}
+	if needsMultiLineConfirmation(m) {
+		t.Fatalf("confirmation should only be needed when ConfirmMultiLineExec is enabled")
+	}
+
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.ConfirmMultiLineExec = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	m.ctx = hctx.MakeContext()
+	if !needsMultiLineConfirmation(m) {
+		t.Fatalf("expected confirmation to be needed for a multi-line command")
+	}
+	m.entries[0].Command = "echo foo\n"
+	if needsMultiLineConfirmation(m) {
+		t.Fatalf("a trailing newline shouldn't require confirmation")
+	}
+}
+
+func TestWithDirectoryConfig(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	initialWd, err := os.Getwd()
+	testutils.Check(t, err)
+	defer os.Chdir(initialWd)
+
+	// No .hishtory.toml file means no changes
+	dir := t.TempDir()
+	testutils.Check(t, os.Chdir(dir))
+	newCtx, err := WithDirectoryConfig(ctx)
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(hctx.GetConf(newCtx), hctx.GetConf(ctx)) {
+		t.Fatalf("config changed without a .hishtory.toml file")
+	}
+
+	// A .hishtory.toml file in a parent dir overrides the config, but dangerous fields are ignored
+	testutils.Check(t, os.WriteFile(path.Join(dir, ".hishtory.toml"), []byte(`
+displayed_columns = ["CWD", "Command"]
+default_filter = "-exit_code:1"
+filter_duplicate_commands = true
+custom_columns = [{column_name = "evil", column_command = "rm -rf /"}]
+`), 0o644))
+	testutils.Check(t, os.MkdirAll(path.Join(dir, "sub", "dir"), 0o755))
+	testutils.Check(t, os.Chdir(path.Join(dir, "sub", "dir")))
+
+	// Which is ignored until the directory is trusted
+	newCtx, err = WithDirectoryConfig(ctx)
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(hctx.GetConf(newCtx), hctx.GetConf(ctx)) {
+		t.Fatalf("config changed for an untrusted directory")
+	}
+	testutils.Check(t, TrustDirectory(ctx, dir))
+	ctx = hctx.MakeContext()
+	newCtx, err = WithDirectoryConfig(ctx)
+	testutils.Check(t, err)
+	conf := hctx.GetConf(newCtx)
+	if !reflect.DeepEqual(conf.DisplayedColumns, []string{"CWD", "Command"}) {
+		t.Fatalf("unexpected displayed columns: %#v", conf.DisplayedColumns)
+	}
+	if conf.DefaultFilter != "-exit_code:1" || !conf.FilterDuplicateCommands {
+		t.Fatalf("config was not overridden: %#v", conf)
+	}
+	if len(conf.CustomColumns) != 0 {
+		t.Fatalf("custom columns should not be overridable: %#v", conf.CustomColumns)
+	}
+	if hctx.GetConf(ctx).FilterDuplicateCommands {
+		t.Fatalf("the original context should not have been modified")
+	}
+}
+
+func TestDefaultFilter(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DefaultFilter = "-foo"
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("ls /foo"))
+	db.Create(testutils.MakeFakeHistoryEntry("ls /bar"))
+
+	results, err := SearchForDisplay(ctx, db, "ls", 5, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "ls /bar" {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+	results, err = Search(ctx, db, "ls", 5)
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+}
+
+func TestTestPattern(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("direnv export zsh"))
+	db.Create(testutils.MakeFakeHistoryEntry("direnv export zsh"))
+	db.Create(testutils.MakeFakeHistoryEntry("direnv allow"))
+	db.Create(testutils.MakeFakeHistoryEntry("direnvfoo"))
+	db.Create(testutils.MakeFakeHistoryEntry("ls direnv"))
+
+	matches, err := TestPattern(ctx, "direnv")
+	testutils.Check(t, err)
+	expected := []PatternMatch{{Command: "direnv export zsh", Count: 2}, {Command: "direnv allow", Count: 1}}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("unexpected matches: %#v", matches)
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	if IsAuthError(nil) {
+		t.Fatalf("nil is not an auth error")
+	}
+	if !IsAuthError(fmt.Errorf("failed to GET https://api.hishtory.dev/api/v1/query: status_code=401")) {
+		t.Fatalf("expected a 401 to be an auth error")
+	}
+	if IsAuthError(fmt.Errorf("failed to GET https://api.hishtory.dev/api/v1/query: status_code=503")) {
+		t.Fatalf("expected a 503 to not be an auth error")
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SIMULATE_NETWORK_ERROR")()
+	os.Setenv("HISHTORY_SIMULATE_NETWORK_ERROR", "1")
+	_, err := ApiGet("/api/v1/banner")
+	var offlineErr *OfflineError
+	if !errors.As(err, &offlineErr) || !IsOfflineError(fmt.Errorf("wrapped: %w", err)) {
+		t.Fatalf("expected a network error to be an OfflineError: %#v", err)
+	}
+
+	err = classifyApiError(fmt.Errorf("failed to GET https://api.hishtory.dev/api/v1/query: status_code=403"))
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || IsOfflineError(err) {
+		t.Fatalf("expected a 403 to be an AuthError: %#v", err)
+	}
+	err = classifyApiError(fmt.Errorf("failed to GET https://api.hishtory.dev/api/v1/query: status_code=500"))
+	if IsAuthError(err) || IsOfflineError(err) {
+		t.Fatalf("expected a 500 to not be classified: %#v", err)
+	}
+
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	_, err = SearchForDisplay(ctx, hctx.GetDb(ctx), "before:not-a-date", 10, SearchOptions{})
+	if !IsSearchError(err) || IsOfflineError(err) {
+		t.Fatalf("expected an invalid query to be a SearchError: %#v", err)
+	}
+	if IsSearchError(nil) {
+		t.Fatalf("nil is not a search error")
+	}
+}
+
+func TestRotateKeyOffline(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.IsOffline = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("ls /foo"))
+
+	newSecret, err := RotateKey(ctx)
+	testutils.Check(t, err)
+	newConf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	if newSecret == conf.UserSecret || newConf.UserSecret != newSecret || newConf.DeviceId == conf.DeviceId {
+		t.Fatalf("key was not rotated: old=%#v, new=%#v", conf, newConf)
+	}
+	results, err := Search(ctx, db, "", 5)
+	testutils.Check(t, err)
+	if len(results) != 1 {
+		t.Fatalf("local history was not preserved: %#v", results)
+	}
+}
+
+func TestRemoteOnlyDoesNotPersistEntries(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.RemoteOnly = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	testutils.Check(t, db.Create(testutils.MakeFakeHistoryEntry("ls /foo")).Error)
+
+	// The entry is searchable for the lifetime of the context
+	results, err := Search(ctx, db, "", 5)
+	testutils.Check(t, err)
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result from the in-memory DB, got %#v", results)
+	}
+
+	// But it wasn't persisted to the local DB
+	localDb, err := hctx.OpenLocalSqliteDb()
+	testutils.Check(t, err)
+	results, err = Search(ctx, localDb, "", 5)
+	testutils.Check(t, err)
+	if len(results) != 0 {
+		t.Fatalf("expected no results from the local DB, got %#v", results)
+	}
+}
+
+func TestRemoteOnlyQueuesEntriesWhileOffline(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SIMULATE_NETWORK_ERROR")()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SERVER")()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.RemoteOnly = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	uploaded := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		testutils.Check(t, err)
+		uploaded = append(uploaded, r.URL.Path+" "+string(body))
+	}))
+	defer server.Close()
+	os.Setenv("HISHTORY_SERVER", server.URL)
+
+	// While offline, the entries stay queued on disk
+	os.Setenv("HISHTORY_SIMULATE_NETWORK_ERROR", "1")
+	testutils.Check(t, QueuePendingUpload(ctx, []byte(`["first"]`)))
+	testutils.Check(t, QueuePendingUpload(ctx, []byte(`["second"]`)))
+	testutils.Check(t, UploadPendingEntries(ctx))
+	if len(uploaded) != 0 {
+		t.Fatalf("expected nothing to be uploaded while offline, got %#v", uploaded)
+	}
+
+	// And they're uploaded once back online, after which the queue is empty
+	os.Setenv("HISHTORY_SIMULATE_NETWORK_ERROR", "")
+	testutils.Check(t, UploadPendingEntries(ctx))
+	if !reflect.DeepEqual(uploaded, []string{`/api/v1/submit ["first"]`, `/api/v1/submit ["second"]`}) {
+		t.Fatalf("unexpected uploads: %#v", uploaded)
+	}
+	if _, err := os.Stat(getPendingUploadsPath(ctx)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the queue to be removed, got err=%v", err)
+	}
+	testutils.Check(t, UploadPendingEntries(ctx))
+	if len(uploaded) != 2 {
+		t.Fatalf("expected nothing more to be uploaded, got %#v", uploaded)
+	}
+}
+
+func TestColumnFormatterRegistry(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	entry := testutils.MakeFakeHistoryEntry("ls /foo")
+
+	// Registered columns are used to build rows
+	RegisterColumnFormatter("TestHomeDir", func(ctx *context.Context, entry data.HistoryEntry) string {
+		return entry.HomeDirectory
+	})
+	defer func() {
+		delete(columnFormatters, "TestHomeDir")
+		registeredColumns = registeredColumns[:len(registeredColumns)-1]
+	}()
+	row, err := buildTableRow(ctx, []string{"TestHomeDir", "Command", "Exit Code"}, entry)
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(row, []string{"/home/david/", "ls /foo", "2"}) {
+		t.Fatalf("unexpected row: %#v", row)
+	}
+
+	// Unknown columns are a clear error rather than a blank
+	_, err = buildTableRow(ctx, []string{"Command", "NotAColumn"}, entry)
+	if err == nil || !strings.Contains(err.Error(), "NotAColumn") {
+		t.Fatalf("expected an error mentioning the unknown column, got %v", err)
+	}
+}
+
+func TestSchemaVersionCheck(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+
+	// Opening the DB sets the schema version
+	db, err := hctx.OpenLocalSqliteDb()
+	testutils.Check(t, err)
+	var version int
+	testutils.Check(t, db.Raw("PRAGMA user_version").Scan(&version).Error)
+	if version != hctx.SCHEMA_VERSION {
+		t.Fatalf("expected schema version %d, got %d", hctx.SCHEMA_VERSION, version)
+	}
+
+	// And a DB from a newer version is rejected
+	testutils.Check(t, db.Exec(fmt.Sprintf("PRAGMA user_version = %d", hctx.SCHEMA_VERSION+1)).Error)
+	_, err = hctx.OpenLocalSqliteDb()
+	if err == nil || !strings.Contains(err.Error(), "newer version of hishtory") {
+		t.Fatalf("expected an error about the DB being from a newer version, got %v", err)
+	}
+	testutils.Check(t, db.Exec(fmt.Sprintf("PRAGMA user_version = %d", hctx.SCHEMA_VERSION)).Error)
+}
+
+func TestVimKeybindings(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.EnableVimKeybindings = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	rows := []table.Row{{"echo 1"}, {"echo 2"}, {"echo 3"}, {"echo 4"}}
+	m := initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}), table.WithRows(rows), table.WithHeight(10)), rows, nil, "", len(rows), TuiOptions{})
+	if !m.vimNormalMode {
+		t.Fatalf("expected the TUI to start in normal mode")
+	}
+	press := func(m tea.Model, key string) tea.Model {
+		updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)})
+		return updated
+	}
+
+	// In normal mode, keys navigate rather than being typed into the query
+	var updated tea.Model = m
+	for _, tc := range []struct {
+		key            string
+		expectedCursor int
+	}{{"j", 1}, {"j", 2}, {"k", 1}, {"G", 3}, {"j", 3}, {"g", 0}, {"x", 0}} {
+		updated = press(updated, tc.key)
+		if cursor := updated.(model).table.Cursor(); cursor != tc.expectedCursor {
+			t.Fatalf("expected %#v to move the cursor to %d, got %d", tc.key, tc.expectedCursor, cursor)
+		}
+	}
+	if updated.(model).queryInput.Value() != "" {
+		t.Fatalf("expected keys in normal mode to not change the query, got %#v", updated.(model).queryInput.Value())
+	}
+
+	// After pressing /, keys are typed into the query until escape is pressed
+	updated = press(press(press(updated, "/"), "j"), "k")
+	if updated.(model).vimNormalMode || updated.(model).queryInput.Value() != "jk" {
+		t.Fatalf("expected / to start typing a query, got query=%#v", updated.(model).queryInput.Value())
+	}
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if !updated.(model).vimNormalMode || updated.(model).quitting {
+		t.Fatalf("expected escape to go back to normal mode rather than quitting")
+	}
+}
+
+func TestColumnWidthCacheInvalidation(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("echo local"))
+	staleResults := []table.Row{{"echo local"}}
+	m := model{ctx: ctx, bigQueryResults: staleResults, table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}))}
+
+	// Once the download finishes, the cached results should include the newly downloaded entries
+	db.Create(testutils.MakeFakeHistoryEntry("echo a much longer command that was downloaded from another device"))
+	updated, _ := m.Update(doneDownloadingMsg{})
+	if results := updated.(model).bigQueryResults; len(results) < 2 || results[0][0] != "echo a much longer command that was downloaded from another device" {
+		t.Fatalf("expected the column width cache to be recomputed to include the downloaded entry")
+	}
+	if len(m.bigQueryResults) != 1 {
+		t.Fatalf("expected the original model's cache to be unchanged, got %#v", m.bigQueryResults)
+	}
+}
+
+func TestGetJsonResults(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.FilterDuplicateCommands = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	entry1 := testutils.MakeFakeHistoryEntry("git status")
+	db.Create(entry1)
+	entry2 := testutils.MakeFakeHistoryEntry("git push")
+	entry2.ExitCode = 1
+	db.Create(entry2)
+	entry3 := testutils.MakeFakeHistoryEntry("git push")
+	db.Create(entry3)
+
+	results, err := getJsonResults(ctx, "git", 0, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("expected duplicates to be filtered, got %#v", results)
+	}
+	if results[0].Command != "git push" || results[0].ExitCode != entry3.ExitCode || results[0].Hostname != entry3.Hostname || results[0].Directory != entry3.CurrentWorkingDirectory || !results[0].StartTime.Equal(entry3.StartTime) {
+		t.Fatalf("unexpected first result: %#v", results[0])
+	}
+	if results[0].DurationSeconds != entry3.EndTime.Sub(entry3.StartTime).Seconds() {
+		t.Fatalf("unexpected duration: %v", results[0].DurationSeconds)
+	}
+	if results[1].Command != "git status" {
+		t.Fatalf("unexpected second result: %#v", results[1])
+	}
+	serialized, err := json.Marshal(results[1])
+	testutils.Check(t, err)
+	for _, field := range []string{`"command":"git status"`, `"exit_code":`, `"hostname":`, `"directory":`, `"start_time":`, `"duration_seconds":`} {
+		if !strings.Contains(string(serialized), field) {
+			t.Fatalf("expected the JSON to contain %s: %s", field, serialized)
+		}
+	}
+
+	results, err = getJsonResults(ctx, "git", 1, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "git push" {
+		t.Fatalf("expected the limit to be respected, got %#v", results)
+	}
+
+	// The search options apply too
+	results, err = getJsonResults(ctx, "git", 0, SearchOptions{Reverse: true})
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != "git status" {
+		t.Fatalf("expected the results to be reversed, got %#v", results)
+	}
+	db.Model(&data.HistoryEntry{}).Where("command = ?", "git status").Update("is_sensitive", true)
+	results, err = getJsonResults(ctx, "git", 0, SearchOptions{})
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "git push" {
+		t.Fatalf("expected the sensitive entry to be hidden, got %#v", results)
+	}
+	results, err = getJsonResults(ctx, "git", 0, SearchOptions{ShowSensitive: true})
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("expected the sensitive entry to be shown, got %#v", results)
+	}
+}
+
+func TestRelativeTimeAtoms(t *testing.T) {
+	now := time.Date(2023, 3, 15, 12, 30, 0, 0, time.UTC)
+	testcases := []struct {
+		input    string
+		expected time.Time
+		ok       bool
+	}{
+		{"30m", time.Date(2023, 3, 15, 12, 0, 0, 0, time.UTC), true},
+		{"2h", time.Date(2023, 3, 15, 10, 30, 0, 0, time.UTC), true},
+		{"7d", time.Date(2023, 3, 8, 12, 30, 0, 0, time.UTC), true},
+		{"1w", time.Date(2023, 3, 8, 12, 30, 0, 0, time.UTC), true},
+		{"today", time.Date(2023, 3, 15, 0, 0, 0, 0, time.UTC), true},
+		{"yesterday", time.Date(2023, 3, 14, 0, 0, 0, 0, time.UTC), true},
+		{"2023-01-01", time.Time{}, false},
+		{"7y", time.Time{}, false},
+	}
+	for _, tc := range testcases {
+		actual, ok := parseRelativeTime(tc.input, now)
+		if ok != tc.ok || !actual.Equal(tc.expected) {
+			t.Fatalf("parseRelativeTime(%#v)=(%v, %v), expected (%v, %v)", tc.input, actual, ok, tc.expected, tc.ok)
+		}
+	}
+
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	old := testutils.MakeFakeHistoryEntry("docker ps")
+	db.Create(old)
+	recent := testutils.MakeFakeHistoryEntry("docker run")
+	recent.StartTime = time.Now().Add(-time.Hour)
+	recent.EndTime = recent.StartTime.Add(time.Second)
+	db.Create(recent)
+	for _, query := range []string{"docker after:2h", "docker after:" + time.Now().Add(-2*time.Hour).Format(time.RFC3339)} {
+		results, err := Search(ctx, db, query, 10)
+		testutils.Check(t, err)
+		if len(results) != 1 || results[0].Command != "docker run" {
+			t.Fatalf("unexpected results for %#v: %#v", query, results)
+		}
+	}
+	results, err := Search(ctx, db, "docker before:2h", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "docker ps" {
+		t.Fatalf("unexpected results for before:2h: %#v", results)
+	}
+	_, err = Search(ctx, db, "after:7x", 10)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse after:7x") {
+		t.Fatalf("expected an invalid time to be an error: %v", err)
+	}
+}
+
+func TestRememberLastQuery(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+
+	// Disabled by default
+	ctx := hctx.MakeContext()
+	testutils.Check(t, saveLastQuery(ctx, "git"))
+	if query := getStartingQuery(hctx.MakeContext(), ""); query != "" {
+		t.Fatalf("expected no query to be remembered by default, got %#v", query)
+	}
+
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.RememberLastQuery = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	testutils.Check(t, saveLastQuery(hctx.MakeContext(), "git cwd:/tmp"))
+	if query := getStartingQuery(hctx.MakeContext(), ""); query != "git cwd:/tmp" {
+		t.Fatalf("expected the last query to be remembered, got %#v", query)
+	}
+	if query := getStartingQuery(hctx.MakeContext(), "docker"); query != "docker" {
+		t.Fatalf("expected the typed query to take precedence, got %#v", query)
+	}
+}
+
+func TestGetTheme(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	if theme := getTheme(hctx.MakeContext()); theme != Themes["default"] {
+		t.Fatalf("expected the default theme, got %#v", theme)
+	}
+
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.Theme = hctx.Theme{Name: "solarized", Border: "#268bd2"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	expected := Themes["solarized"]
+	expected.Border = "#268bd2"
+	if theme := getTheme(hctx.MakeContext()); theme != expected {
+		t.Fatalf("expected the solarized theme with a custom border, got %#v", theme)
+	}
+
+	for _, color := range []string{"0", "57", "255", "#268bd2", "#FFFFFF"} {
+		if !IsValidThemeColor(color) {
+			t.Fatalf("expected %#v to be a valid color", color)
+		}
+	}
+	for _, color := range []string{"", "256", "red", "#fff", "#gggggg"} {
+		if IsValidThemeColor(color) {
+			t.Fatalf("expected %#v to be an invalid color", color)
+		}
+	}
+	conf.Theme = hctx.Theme{Name: "neon", Spinner: "red"}
+	themeErrs := make([]string, 0)
+	for _, err := range ValidateConfig(conf) {
+		if strings.HasPrefix(err.Error(), "theme:") {
+			themeErrs = append(themeErrs, err.Error())
+		}
+	}
+	if len(themeErrs) != 2 || !strings.Contains(themeErrs[0], `unknown theme "neon"`) || !strings.Contains(themeErrs[1], `invalid spinner color "red"`) {
+		t.Fatalf("unexpected validation errors: %v", themeErrs)
+	}
+}
+
+type fakeEnviron map[string]string
+
+func (e fakeEnviron) Environ() []string {
+	ret := make([]string, 0)
+	for k, v := range e {
+		ret = append(ret, k+"="+v)
+	}
+	return ret
+}
+
+func (e fakeEnviron) Getenv(key string) string {
+	return e[key]
+}
+
+func TestGetColorProfile(t *testing.T) {
+	// Terminals that don't support colors don't get them
+	if profile := getColorProfile(termenv.NewOutput(&bytes.Buffer{}, termenv.WithEnvironment(fakeEnviron{"TERM": "dumb"}))); profile != termenv.Ascii {
+		t.Fatalf("expected no colors for TERM=dumb, got %v", profile)
+	}
+	if profile := getColorProfile(termenv.NewOutput(&bytes.Buffer{}, termenv.WithEnvironment(fakeEnviron{"TERM": "xterm-256color", "NO_COLOR": "1"}))); profile != termenv.Ascii {
+		t.Fatalf("expected NO_COLOR to disable colors, got %v", profile)
+	}
+}
+
+func TestMultiSelect(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.IsOffline = true
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, command := range []string{"echo a", "echo b", "echo c", "ls"} {
+		db.Create(testutils.MakeFakeHistoryEntry(command))
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "", 10, SearchOptions{})
+	testutils.Check(t, err)
+	m := model{ctx: ctx, rows: rows, entries: entries, numEntries: numEntries, numEntriesToLoad: 10, table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}), table.WithRows(rows), table.WithHeight(10), table.WithFocused(true))}
+
+	// Mark "ls" and "echo b"
+	var updated tea.Model = m
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyTab})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyTab})
+	m = updated.(model)
+	if len(m.markedEntries) != 2 || !strings.Contains(m.table.View(), "* ls") || !strings.Contains(m.table.View(), "* echo b") || strings.Contains(m.table.View(), "* echo c") {
+		t.Fatalf("unexpected marked rows: %s", m.table.View())
+	}
+	if command, _ := m.selectedCommand(); command != "echo a" {
+		t.Fatalf("expected the selected command to not include the marker, got %#v", command)
+	}
+
+	// The marks survive changing the query
+	query := "echo"
+	m.runQuery = &query
+	m = runQueryAndUpdateTable(m, false, false)
+	if len(m.markedEntries) != 2 || !strings.Contains(m.table.View(), "* echo b") || strings.Contains(m.table.View(), "ls") {
+		t.Fatalf("unexpected marked rows after changing the query: %s", m.table.View())
+	}
+
+	// Selecting outputs all of the marked commands in the order they were run
+	updated, _ = m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	updated.View()
+	if selectedRow != "echo b\nls" {
+		t.Fatalf("unexpected output for the marked entries: %#v", selectedRow)
+	}
+	selectedRow = ""
+
+	// And deleting deletes all of them
+	updated, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlK})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("y")})
+	if len(updated.(model).markedEntries) != 0 {
+		t.Fatalf("expected the marks to be cleared after deleting")
+	}
+	results, err := Search(ctx, db, "", 10)
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != "echo c" || results[1].Command != "echo a" {
+		t.Fatalf("unexpected results after deleting the marked entries: %#v", results)
+	}
+}
+
+func TestFooterView(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 30; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("echo %d", i)))
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "", 100, SearchOptions{})
+	testutils.Check(t, err)
+	// Like the TUI's table, the header has a border below it
+	styles := table.DefaultStyles()
+	styles.Header = styles.Header.BorderStyle(lipgloss.NormalBorder()).BorderBottom(true)
+	m := model{ctx: ctx, rows: rows, entries: entries, numEntries: numEntries, numEntriesToLoad: 100, totalMatches: int64(numEntries), table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}), table.WithRows(rows), table.WithHeight(10), table.WithFocused(true), table.WithStyles(styles))}
+	// Size the terminal so that the table isn't resized to fit it
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	terminalHeight := strings.Count(m.View(), "\n") + 1
+	getTerminalSize = func() (int, int, error) { return 100, terminalHeight, nil }
+	if footer := m.footerView(); footer != "Showing 1-10 of 30 (cursor 1/30)\n" {
+		t.Fatalf("unexpected footer: %#v", footer)
+	}
+
+	// Moving past the bottom of the table scrolls it, while moving back up within it doesn't
+	var updated tea.Model = m
+	for i := 0; i < 12; i++ {
+		updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+	}
+	if footer := updated.(model).footerView(); footer != "Showing 4-13 of 30 (cursor 13/30)\n" {
+		t.Fatalf("unexpected footer after scrolling down: %#v", footer)
+	}
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyUp})
+	if footer := updated.(model).footerView(); footer != "Showing 4-13 of 30 (cursor 12/30)\n" {
+		t.Fatalf("unexpected footer after moving up: %#v", footer)
+	}
+
+	// Not all of the matches may be loaded
+	m.totalMatches = 137
+	m.numEntries = 30
+	m.numEntriesToLoad = 30
+	if footer := m.footerView(); footer != "Showing 1-10 of 137 (cursor 1/137)\n" {
+		t.Fatalf("unexpected footer with more matches: %#v", footer)
+	}
+
+	m.entries = nil
+	if footer := m.footerView(); footer != "No matches\n" {
+		t.Fatalf("unexpected footer with no matches: %#v", footer)
+	}
+}
+
+func TestCopySelectedCommand(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Hostname", "Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	rows := []table.Row{{"localhost", "echo foo"}}
+	entry := testutils.MakeFakeHistoryEntry("echo foo")
+	m := model{ctx: ctx, rows: rows, entries: []*data.HistoryEntry{&entry}, numEntries: 1, table: table.New(table.WithColumns([]table.Column{{Title: "Hostname", Width: 10}, {Title: "Command", Width: 10}}), table.WithRows(rows))}
+	defer func(original func(string) error) { writeToClipboard = original }(writeToClipboard)
+
+	copied := ""
+	writeToClipboard = func(s string) error {
+		copied = s
+		return nil
+	}
+	updated, cmd := m.Update(tea.KeyMsg{Type: tea.KeyCtrlY})
+	if copied != "echo foo" || cmd == nil || !strings.Contains(updated.(model).footerView(), "Copied!") {
+		t.Fatalf("expected ctrl+y to copy the command, copied=%#v, footer=%#v", copied, updated.(model).footerView())
+	}
+	updated, _ = updated.Update(clearFooterMessageMsg{id: updated.(model).footerMessageId})
+	if strings.Contains(updated.(model).footerView(), "Copied!") {
+		t.Fatalf("expected the message to be cleared")
+	}
+
+	// Failing to copy is a warning rather than an error
+	writeToClipboard = func(s string) error {
+		return fmt.Errorf("no clipboard utilities available")
+	}
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyCtrlY})
+	if updated.(model).searchErr != nil || updated.(model).err != nil || !strings.Contains(updated.(model).footerView(), "Warning: Failed to copy to the clipboard: no clipboard utilities available") {
+		t.Fatalf("unexpected footer after failing to copy: %#v", updated.(model).footerView())
+	}
+
+	// The key can be changed
+	conf.CopyKey = "alt+c"
+	testutils.Check(t, hctx.SetConfig(conf))
+	m.ctx = hctx.MakeContext()
+	copied = ""
+	writeToClipboard = func(s string) error {
+		copied = s
+		return nil
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("c"), Alt: true})
+	if copied != "echo foo" {
+		t.Fatalf("expected alt+c to copy the command after changing the key")
+	}
+}
+
+func TestResizeKeepsQuery(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 5; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("echo %d", i)))
+	}
+	db.Create(testutils.MakeFakeHistoryEntry("ls"))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	var updated tea.Model = initialModel(ctx, tbl, rows, entries, "", numEntries, TuiOptions{})
+	for _, r := range "echo" {
+		updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+	}
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+
+	// Resizing keeps both the query and the cursor position
+	getTerminalSize = func() (int, int, error) { return 60, 30, nil }
+	updated, _ = updated.Update(tea.WindowSizeMsg{Width: 60, Height: 30})
+	m := updated.(model)
+	if m.err != nil || m.lastQuery != "echo" || len(m.entries) != 5 || m.table.Cursor() != 2 {
+		t.Fatalf("unexpected state after resizing: err=%v, lastQuery=%#v, entries=%d, cursor=%d", m.err, m.lastQuery, len(m.entries), m.table.Cursor())
+	}
+
+	// If the typed query wasn't run yet, resizing runs it and the cursor is clamped to the new results
+	m.queryInput.SetValue("ls")
+	updated, _ = m.Update(tea.WindowSizeMsg{Width: 60, Height: 30})
+	m = updated.(model)
+	if m.lastQuery != "ls" || len(m.entries) != 1 || m.table.Cursor() != 0 {
+		t.Fatalf("unexpected state after resizing with a new query: lastQuery=%#v, entries=%d, cursor=%d", m.lastQuery, len(m.entries), m.table.Cursor())
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("xgcm status"))
+	db.Create(testutils.MakeFakeHistoryEntry("xgit commit -m 'fix'"))
+	db.Create(testutils.MakeFakeHistoryEntry("xgrep -c make"))
+	db.Create(testutils.MakeFakeHistoryEntry("xgit status"))
+
+	// When disabled, terms only match exact substrings
+	results, err := Search(ctx, db, "xgcm", 10)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "xgcm status" {
+		t.Fatalf("unexpected results with fuzzy search disabled: %#v", results)
+	}
+
+	// When enabled, the closest match is first even though it is the oldest
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.FuzzySearch = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	results, err = Search(ctx, db, "xgcm", 10)
+	testutils.Check(t, err)
+	if len(results) != 3 || results[0].Command != "xgcm status" {
+		t.Fatalf("unexpected results with fuzzy search enabled: %#v", results)
+	}
+	results, err = Search(ctx, db, "xgcm -cmd:make", 1)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "xgcm status" {
+		t.Fatalf("unexpected results with a limit: %#v", results)
+	}
+
+	// Entries with the same score are sorted by recency
+	results, err = Search(ctx, db, "xgit", 10)
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != "xgit status" || results[1].Command != "xgit commit -m 'fix'" {
+		t.Fatalf("unexpected results for ties: %#v", results)
+	}
+}
+
+func TestFuzzyScore(t *testing.T) {
+	testcases := []struct {
+		pattern           string
+		command           string
+		expectedMatch     bool
+		expectedPositions []int
+	}{
+		{"gcm", "git commit -m", true, []int{0, 4, 6}},
+		{"GCM", "git commit -m", true, []int{0, 4, 6}},
+		{"commit", "cat .git/COMMIT_EDITMSG", true, []int{9, 10, 11, 12, 13, 14}},
+		{"mcg", "git commit -m", false, nil},
+		{"ls", "echo foo", false, nil},
+	}
+	for _, tc := range testcases {
+		_, positions, ok := fuzzyScore(tc.pattern, tc.command)
+		if ok != tc.expectedMatch || !reflect.DeepEqual(positions, tc.expectedPositions) {
+			t.Fatalf("fuzzyScore(%#v, %#v) returned positions=%#v ok=%v, expected %#v %v", tc.pattern, tc.command, positions, ok, tc.expectedPositions, tc.expectedMatch)
+		}
+	}
+	exact, _, _ := fuzzyScore("commit", "git commit")
+	scattered, _, _ := fuzzyScore("commit", "cat options.mk mit")
+	if exact <= scattered {
+		t.Fatalf("expected an exact match to score higher than a scattered one: %d <= %d", exact, scattered)
+	}
+}
+
+func TestQueryEntries(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.FilterDuplicateCommands = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	entry := testutils.MakeFakeHistoryEntry("qe build")
+	entry.ExitCode = 3
+	db.Create(entry)
+	db.Create(testutils.MakeFakeHistoryEntry("qe test"))
+	db.Create(testutils.MakeFakeHistoryEntry("qe test"))
+	sensitive := testutils.MakeFakeHistoryEntry("qe secret")
+	sensitive.IsSensitive = true
+	db.Create(sensitive)
+
+	// Sensitive entries and duplicates are filtered out, just like in the TUI
+	results, err := QueryEntries(ctx, "qe", 0)
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != "qe test" || results[1].Command != "qe build" {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+	// The entries are fully typed
+	if results[1].ExitCode != 3 || !results[1].StartTime.Equal(entry.StartTime) || results[1].EndTime.Sub(results[1].StartTime) != entry.EndTime.Sub(entry.StartTime) {
+		t.Fatalf("unexpected entry: %#v", results[1])
+	}
+
+	results, err = QueryEntries(ctx, "qe", 1)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "qe test" {
+		t.Fatalf("unexpected results with a limit: %#v", results)
+	}
+	_, err = QueryEntries(ctx, "qe unknownatom:foo", 0)
+	if err == nil {
+		t.Fatalf("expected an error for an invalid query")
+	}
+}
+
+// Runs the given command and returns the messages that it (and any commands that it batched) returned
+func runCmd(cmd tea.Cmd) []tea.Msg {
+	if cmd == nil {
+		return nil
+	}
+	msg := cmd()
+	if batch, ok := msg.(tea.BatchMsg); ok {
+		msgs := make([]tea.Msg, 0)
+		for _, c := range batch {
+			msgs = append(msgs, runCmd(c)...)
+		}
+		return msgs
+	}
+	return []tea.Msg{msg}
+}
+
+func TestPagination(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 100; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("paged %d", i)))
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "paged", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	queryInput := textinput.New()
+	queryInput.SetValue("paged")
+	m := model{ctx: ctx, rows: rows, entries: entries, numEntries: numEntries, numEntriesToLoad: PAGE_SIZE, queryInput: queryInput, lastQuery: "paged", table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}), table.WithRows(rows), table.WithHeight(10), table.WithFocused(true))}
+
+	// Nothing more is loaded while the cursor is far from the last loaded entry
+	updated, cmd := m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if updated.(model).isLoadingPage || len(runCmd(cmd)) != 0 {
+		t.Fatalf("expected no page to be loaded at the top of the results")
+	}
+
+	// But once it gets close, the next page is loaded and appended
+	m = updated.(model)
+	m.table.SetCursor(PAGE_SIZE - PAGE_LOAD_THRESHOLD)
+	updated, cmd = m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if !updated.(model).isLoadingPage {
+		t.Fatalf("expected the next page to be loading")
+	}
+	msgs := runCmd(cmd)
+	if len(msgs) != 1 {
+		t.Fatalf("expected a single message, got %#v", msgs)
+	}
+	pageMsg := msgs[0]
+	updated, _ = updated.Update(pageMsg)
+	m = updated.(model)
+	if m.isLoadingPage || len(m.entries) != 2*PAGE_SIZE || len(m.rows) != 2*PAGE_SIZE || m.numEntriesToLoad != 2*PAGE_SIZE {
+		t.Fatalf("unexpected state after loading a page: isLoadingPage=%v, entries=%d, rows=%d, numEntriesToLoad=%d", m.isLoadingPage, len(m.entries), len(m.rows), m.numEntriesToLoad)
+	}
+	if m.entries[PAGE_SIZE].Command != fmt.Sprintf("paged %d", 99-PAGE_SIZE) || m.table.Cursor() != PAGE_SIZE-PAGE_LOAD_THRESHOLD+1 {
+		t.Fatalf("unexpected first entry in the page %#v with cursor=%d", m.entries[PAGE_SIZE].Command, m.table.Cursor())
+	}
+
+	// Pages for an outdated query are ignored
+	stale := m
+	stale.isLoadingPage = true
+	stale.lastQuery = "paged 1"
+	stale.numEntries = PAGE_SIZE
+	updated, _ = stale.update(pageMsg)
+	if updated.(model).isLoadingPage || len(updated.(model).entries) != 2*PAGE_SIZE {
+		t.Fatalf("expected a page for an outdated query to be ignored")
+	}
+
+	// The last page may be partial, after which there is nothing left to load
+	m.table.SetCursor(len(m.entries) - 1)
+	updated, cmd = m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	for _, msg := range runCmd(cmd) {
+		updated, _ = updated.Update(msg)
+	}
+	m = updated.(model)
+	if len(m.entries) != 100 || m.totalMatches != 100 {
+		t.Fatalf("expected all of the entries to be loaded, got %d entries with totalMatches=%d", len(m.entries), m.totalMatches)
+	}
+	updated, cmd = m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if updated.(model).isLoadingPage || len(runCmd(cmd)) != 0 {
+		t.Fatalf("expected nothing more to be loaded")
+	}
+}
+
+func TestHostAtom(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, host := range []string{"ci-server.corp.example.com", "Work-Laptop", "ci-runner"} {
+		for _, command := range []string{"hostmake build", "hostls"} {
+			entry := testutils.MakeFakeHistoryEntry(command)
+			entry.Hostname = host
+			db.Create(entry)
+		}
+	}
+	testcases := []struct {
+		query         string
+		expectedHosts []string
+	}{
+		{"hostmake host:ci-server", []string{"ci-server.corp.example.com"}},
+		{"hostmake host:ci-", []string{"ci-runner", "ci-server.corp.example.com"}},
+		{"hostmake host:work-laptop", []string{"Work-Laptop"}},
+		{"hostmake hostname:LAPTOP", []string{"Work-Laptop"}},
+		{"hostmake -host:ci-", []string{"Work-Laptop"}},
+		{"hostmake host:unknown", []string{}},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 10)
+		testutils.Check(t, err)
+		hosts := make([]string, 0)
+		for _, result := range results {
+			if result.Command != "hostmake build" {
+				t.Fatalf("query=%#v returned an unexpected command: %#v", tc.query, result.Command)
+			}
+			hosts = append(hosts, result.Hostname)
+		}
+		if !reflect.DeepEqual(hosts, tc.expectedHosts) {
+			t.Fatalf("query=%#v returned hosts=%#v, expected %#v", tc.query, hosts, tc.expectedHosts)
+		}
+	}
+}
+
+func TestColumnPicker(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Hostname", "Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("colpick"))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+
+	columns := getAvailableColumns(ctx)
+	if len(columns) != len(registeredColumns) || columns[0] != "Hostname" || columns[1] != "Command" || columns[2] != "CWD" {
+		t.Fatalf("unexpected available columns: %#v", columns)
+	}
+
+	rows, entries, numEntries, err := getRows(ctx, conf.DisplayedColumns, "colpick", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	var updated tea.Model = initialModel(ctx, tbl, rows, entries, "colpick", numEntries, TuiOptions{})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("c"), Alt: true})
+	if view := updated.View(); !strings.Contains(view, "> [x] Hostname") || !strings.Contains(view, "  [ ] CWD") {
+		t.Fatalf("unexpected column picker view: %s", view)
+	}
+
+	// Uncheck Hostname and check Exit Code
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(" ")})
+	for i := 0; i < 5; i++ {
+		updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+	}
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(" ")})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m := updated.(model)
+	if m.err != nil || m.columnPicker != nil || !reflect.DeepEqual(hctx.GetConf(m.ctx).DisplayedColumns, []string{"Command", "Exit Code"}) {
+		t.Fatalf("unexpected state after picking columns: err=%v, columns=%#v", m.err, hctx.GetConf(m.ctx).DisplayedColumns)
+	}
+	if !reflect.DeepEqual(m.rows[0], table.Row{"colpick", "2"}) || !strings.Contains(m.table.View(), "Exit Code") || strings.Contains(m.table.View(), "Hostname") {
+		t.Fatalf("unexpected table after picking columns: %#v\n%s", m.rows[0], m.table.View())
+	}
+	if command, _ := m.selectedCommand(); command != "colpick" {
+		t.Fatalf("unexpected selected command: %#v", command)
+	}
+
+	// The change isn't saved unless requested
+	conf, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(conf.DisplayedColumns, []string{"Hostname", "Command"}) {
+		t.Fatalf("expected the config to be unchanged, got %#v", conf.DisplayedColumns)
+	}
+	updated, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("c"), Alt: true})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyCtrlS})
+	conf, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(conf.DisplayedColumns, []string{"Command", "Exit Code"}) {
+		t.Fatalf("expected the columns to be saved, got %#v", conf.DisplayedColumns)
+	}
+}
+
+func TestCursorStaysOnEntryWhenRefiningQuery(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 10; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("keep zulu %d", i)))
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("keep yankee %d", i)))
+	}
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	// Leaves room for a table with 5 rows
+	getTerminalSize = func() (int, int, error) { return 100, 16, nil }
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "keep", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	var updated tea.Model = initialModel(ctx, tbl, rows, entries, "keep", numEntries, TuiOptions{})
+	for i := 0; i < 11; i++ {
+		updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+	}
+	if entry := updated.(model).selectedEntry(); entry.Command != "keep zulu 4" {
+		t.Fatalf("unexpected selected entry: %#v", entry.Command)
+	}
+
+	// Refining the query keeps the same entry selected, and scrolls to it
+	for _, r := range " zu" {
+		updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+	}
+	updated, _ = updated.Update(debouncedQueryMsg{id: updated.(model).debounceId})
+	m := updated.(model)
+	if entry := m.selectedEntry(); m.lastQuery != "keep zu" || entry.Command != "keep zulu 4" || m.table.Cursor() != 5 || !strings.Contains(m.table.View(), "keep zulu 4") {
+		t.Fatalf("unexpected selected entry after refining the query: lastQuery=%#v, cursor=%d\n%s", m.lastQuery, m.table.Cursor(), m.table.View())
+	}
+	if footer := m.footerView(); footer != "Showing 2-6 of 10 (cursor 6/10)\n" {
+		t.Fatalf("unexpected footer: %#v", footer)
+	}
+
+	// But if it no longer matches, the cursor goes back to the top
+	updated, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("lu 9")})
+	updated, _ = updated.Update(debouncedQueryMsg{id: updated.(model).debounceId})
+	m = updated.(model)
+	if entry := m.selectedEntry(); entry.Command != "keep zulu 9" || m.table.Cursor() != 0 {
+		t.Fatalf("unexpected selected entry after changing the query: %#v", entry.Command)
+	}
+}
+
+func TestTuiSearchLimit(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.TuiSearchLimit = 5
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 12; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("limited %d", i)))
+	}
+
+	// The rows are still padded to fill the table
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "limited", getTuiSearchLimit(ctx), SearchOptions{})
+	testutils.Check(t, err)
+	if len(entries) != 5 || numEntries != 5 || len(rows) != TABLE_HEIGHT || len(rows[4]) != 1 || len(rows[5]) != 0 {
+		t.Fatalf("unexpected results: %d entries, numEntries=%d, %d rows", len(entries), numEntries, len(rows))
+	}
+
+	// And loading more pages replaces the padding
+	queryInput := textinput.New()
+	queryInput.SetValue("limited")
+	var updated tea.Model = model{ctx: ctx, rows: rows, entries: entries, numEntries: numEntries, numEntriesToLoad: getTuiSearchLimit(ctx), queryInput: queryInput, lastQuery: "limited", table: table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}}), table.WithRows(rows), table.WithHeight(10), table.WithFocused(true))}
+	for i := 0; i < 3; i++ {
+		var cmd tea.Cmd
+		updated, cmd = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+		for _, msg := range runCmd(cmd) {
+			updated, _ = updated.Update(msg)
+		}
+	}
+	m := updated.(model)
+	if len(m.entries) != 10 || m.numEntriesToLoad != 10 || len(m.rows) != TABLE_HEIGHT || m.entries[5].Command != "limited 6" || len(m.rows[5]) != 1 || len(m.rows[10]) != 0 {
+		t.Fatalf("unexpected state after loading more: %d entries, numEntriesToLoad=%d, %d rows", len(m.entries), m.numEntriesToLoad, len(m.rows))
+	}
+}
+
+func TestFormatRuntime(t *testing.T) {
+	testcases := []struct {
+		runtime  time.Duration
+		expected string
+	}{
+		{0, "<1ms"},
+		{400 * time.Microsecond, "<1ms"},
+		{time.Millisecond, "1ms"},
+		{350 * time.Millisecond, "350ms"},
+		{time.Second, "1s"},
+		{1234 * time.Millisecond, "1.2s"},
+		{59960 * time.Millisecond, "1m0s"},
+		{2*time.Minute + 15*time.Second + 300*time.Millisecond, "2m15s"},
+		{3*time.Hour + 2*time.Second, "3h0m2s"},
+	}
+	for _, tc := range testcases {
+		if actual := formatRuntime(tc.runtime); actual != tc.expected {
+			t.Fatalf("formatRuntime(%v)=%#v, expected %#v", tc.runtime, actual, tc.expected)
+		}
+	}
+
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	entry := testutils.MakeFakeHistoryEntry("sleep 1")
+	entry.EndTime = time.Time{}
+	row, err := buildTableRow(ctx, []string{"Runtime"}, entry)
+	testutils.Check(t, err)
+	if row[0] != "" {
+		t.Fatalf("expected a missing runtime to be blank, got %#v", row[0])
+	}
+}
+
+func TestNeverSyncedWarning(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.HaveSyncedWithBackend = false
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	testutils.Check(t, db.Where("true").Delete(&data.HistoryEntry{}).Error)
+	entry := testutils.MakeFakeHistoryEntry("ls")
+	entry.DeviceId = conf.DeviceId
+	db.Create(entry)
+	offlineErr := fmt.Errorf("failed to query: %w", &OfflineError{Err: fmt.Errorf("dial tcp: connection refused")})
+
+	// With only entries from this device, it has never synced
+	msg := errorToMsg(ctx, offlineErr)
+	if msg != (offlineMsg{neverSynced: true}) {
+		t.Fatalf("unexpected message: %#v", msg)
+	}
+	updated, _ := model{ctx: ctx, quiet: true}.update(msg)
+	if view := updated.View(); !strings.Contains(view, "has never been able to sync") || !strings.Contains(view, "hishtory init") {
+		t.Fatalf("expected a warning about never having synced, got: %s", view)
+	}
+
+	// Which only depends on the stored flag, not on whether there are entries from other devices
+	entry = testutils.MakeFakeHistoryEntry("ls -l")
+	entry.DeviceId = "other-device"
+	db.Create(entry)
+	if msg := errorToMsg(ctx, offlineErr); msg != (offlineMsg{neverSynced: true}) {
+		t.Fatalf("unexpected message with entries from other devices: %#v", msg)
+	}
+
+	// But not once it has synced
+	conf.HaveSyncedWithBackend = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	msg = errorToMsg(ctx, offlineErr)
+	if msg != (offlineMsg{neverSynced: false}) {
+		t.Fatalf("unexpected message after syncing: %#v", msg)
+	}
+	updated, _ = model{ctx: ctx}.update(msg)
+	if view := updated.View(); !strings.Contains(view, "are you offline?") || strings.Contains(view, "never") {
+		t.Fatalf("expected a warning about being temporarily offline, got: %s", view)
+	}
+}
+
+func TestBooleanOperators(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, command := range []string{"boolop git push", "boolop git pull", "boolop docker run", "boolop make"} {
+		db.Create(testutils.MakeFakeHistoryEntry(command))
+	}
+	testcases := []struct {
+		query            string
+		expectedCommands []string
+	}{
+		{"boolop git OR docker", []string{"boolop docker run", "boolop git pull", "boolop git push"}},
+		{"boolop git AND pull", []string{"boolop git pull"}},
+		{"boolop git -push", []string{"boolop git pull"}},
+		{"boolop git NOT push", []string{"boolop git pull"}},
+		{"boolop NOT cmd:git", []string{"boolop make", "boolop docker run"}},
+		// AND binds more tightly than OR
+		{"boolop git push OR make", []string{"boolop make", "boolop git push"}},
+		{"make OR boolop git NOT push", []string{"boolop make", "boolop git pull"}},
+		{"boolop push OR boolop pull OR boolop run", []string{"boolop docker run", "boolop git pull", "boolop git push"}},
+		// Lowercase operators are just search terms
+		{"boolop git or docker", []string{}},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 10)
+		testutils.Check(t, err)
+		commands := make([]string, 0)
+		for _, result := range results {
+			commands = append(commands, result.Command)
+		}
+		if !reflect.DeepEqual(commands, tc.expectedCommands) {
+			t.Fatalf("query=%#v returned %#v, expected %#v", tc.query, commands, tc.expectedCommands)
+		}
+	}
+
+	// Malformed queries are errors rather than matching everything
+	for _, query := range []string{"OR git", "git OR", "git OR OR docker", "git AND", "git NOT", "NOT NOT git", "git NOT OR docker"} {
+		_, err := Search(ctx, db, query, 10)
+		if err == nil || !IsSearchError(err) {
+			t.Fatalf("expected query=%#v to return a search error, got %v", query, err)
+		}
+	}
+}
+
+func TestFollowMode(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 5; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("tailf old %d", i)))
+	}
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "tailf", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	var updated tea.Model = initialModel(ctx, tbl, rows, entries, "tailf", numEntries, TuiOptions{})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyDown})
+	updated, cmd := updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'t'}, Alt: true})
+	m := updated.(model)
+	if !m.follow || cmd == nil {
+		t.Fatalf("expected alt+t to enable follow mode")
+	}
+	if entry := m.selectedEntry(); entry.Command != "tailf old 3" {
+		t.Fatalf("unexpected selected entry: %#v", entry.Command)
+	}
+
+	// New entries are shown on the next tick, and the cursor stays on the selected entry
+	db.Create(testutils.MakeFakeHistoryEntry("tailf new 0"))
+	db.Create(testutils.MakeFakeHistoryEntry("tailf new 1"))
+	m.lastKeyPress = time.Time{}
+	updated, cmd = m.Update(followTickMsg{id: m.followId})
+	m = updated.(model)
+	if cmd == nil {
+		t.Fatalf("expected follow mode to schedule another tick")
+	}
+	if m.numEntries != 7 || m.entries[0].Command != "tailf new 1" {
+		t.Fatalf("expected the new entries to be shown, got numEntries=%d", m.numEntries)
+	}
+	if entry := m.selectedEntry(); entry.Command != "tailf old 3" || m.table.Cursor() != 3 {
+		t.Fatalf("unexpected selected entry after refreshing: %#v (cursor=%d)", entry.Command, m.table.Cursor())
+	}
+
+	// Refreshing is paused while typing
+	db.Create(testutils.MakeFakeHistoryEntry("tailf new 2"))
+	m.lastKeyPress = time.Now()
+	updated, _ = m.Update(followTickMsg{id: m.followId})
+	m = updated.(model)
+	if m.numEntries != 7 {
+		t.Fatalf("expected refreshing to be paused while typing, got numEntries=%d", m.numEntries)
+	}
+
+	// Ticks from before follow mode was toggled are ignored
+	m.lastKeyPress = time.Time{}
+	staleId := m.followId
+	updated, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'t'}, Alt: true})
+	m = updated.(model)
+	m.lastKeyPress = time.Time{}
+	updated, cmd = m.Update(followTickMsg{id: staleId})
+	m = updated.(model)
+	if m.follow || m.numEntries != 7 || cmd != nil {
+		t.Fatalf("expected follow mode to be disabled, got follow=%v numEntries=%d", m.follow, m.numEntries)
+	}
+}
+
+func TestTerminalSizeFallback(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("termsize fallback"))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 0, 0, fmt.Errorf("inappropriate ioctl for device") }
+
+	// Without $COLUMNS and $LINES, the default size is used
+	t.Setenv("COLUMNS", "")
+	t.Setenv("LINES", "")
+	if width, height := getTerminalSizeOrDefault(); width != DEFAULT_TERMINAL_WIDTH || height != DEFAULT_TERMINAL_HEIGHT {
+		t.Fatalf("unexpected default terminal size: %dx%d", width, height)
+	}
+	rows, _, _, err := getRows(ctx, getDisplayedColumns(ctx), "termsize", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	if !strings.Contains(tbl.View(), "termsize") {
+		t.Fatalf("expected the table to render with the default size:\n%s", tbl.View())
+	}
+
+	// $COLUMNS and $LINES take precedence over the default, unless they are invalid
+	t.Setenv("COLUMNS", "200")
+	t.Setenv("LINES", "50")
+	if width, height := getTerminalSizeOrDefault(); width != 200 || height != 50 {
+		t.Fatalf("unexpected terminal size from the environment: %dx%d", width, height)
+	}
+	t.Setenv("LINES", "-3")
+	if width, height := getTerminalSizeOrDefault(); width != 200 || height != DEFAULT_TERMINAL_HEIGHT {
+		t.Fatalf("unexpected terminal size with an invalid $LINES: %dx%d", width, height)
+	}
+	tbl, _, err = makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	if !strings.Contains(tbl.View(), "termsize") {
+		t.Fatalf("expected the table to render with the size from the environment:\n%s", tbl.View())
+	}
+}
+
+func TestCdToSelectedDirectory(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	entry := testutils.MakeFakeHistoryEntry("cdsel make build")
+	entry.CurrentWorkingDirectory = "~/code/my project"
+	db.Create(entry)
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "cdsel", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	m := initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows)), rows, entries, "cdsel", numEntries, TuiOptions{})
+	updated, cmd := m.Update(tea.KeyMsg{Type: tea.KeyCtrlO})
+	if cmd == nil {
+		t.Fatalf("expected ctrl+o to quit the TUI")
+	}
+	updated.View()
+	if selectedRow != "cd ~/'code/my project'" {
+		t.Fatalf("unexpected selected row: %#v", selectedRow)
+	}
+
+	// Optionally, the command is also run
+	conf.CdAndRunCommand = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	m.ctx = hctx.MakeContext()
+	updated, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlO})
+	updated.View()
+	if selectedRow != "cd ~/'code/my project' && cdsel make build" {
+		t.Fatalf("unexpected selected row: %#v", selectedRow)
+	}
+}
+
+func TestShellQuoteDirectory(t *testing.T) {
+	testcases := []struct {
+		dir      string
+		expected string
+	}{
+		{"/tmp", "/tmp"},
+		{"~", "~"},
+		{"~/", "~/"},
+		{"~/code/hishtory", "~/code/hishtory"},
+		{"/home/me/my dir", "'/home/me/my dir'"},
+		{"~/it's", `~/'it'\''s'`},
+		{"/tmp/$(rm -rf ~)", "'/tmp/$(rm -rf ~)'"},
+	}
+	for _, tc := range testcases {
+		if actual := shellQuoteDirectory(tc.dir); actual != tc.expected {
+			t.Fatalf("shellQuoteDirectory(%#v)=%#v, expected %#v", tc.dir, actual, tc.expected)
+		}
+	}
+}
+
+func TestQueryCharLimit(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	longQuery := strings.Repeat("longquery ", 20) + "end"
+
+	// By default, there is no limit and the input scrolls to keep the end of the query visible
+	var updated tea.Model = initialModel(hctx.MakeContext(), table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}})), nil, nil, "", 0, TuiOptions{})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(longQuery)})
+	m := updated.(model)
+	if m.queryInput.Value() != longQuery {
+		t.Fatalf("expected the full query to be typed, got %#v", m.queryInput.Value())
+	}
+	if view := m.queryInput.View(); !strings.Contains(view, "end") {
+		t.Fatalf("expected the query input to scroll to the cursor: %#v", view)
+	}
+	if strings.Contains(m.View(), "character limit") {
+		t.Fatalf("unexpected character limit warning:\n%s", m.View())
+	}
+
+	// But a limit can be configured, in which case reaching it is shown
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.QueryCharLimit = 15
+	testutils.Check(t, hctx.SetConfig(conf))
+	updated = initialModel(hctx.MakeContext(), table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}})), nil, nil, "", 0, TuiOptions{})
+	updated, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(longQuery)})
+	m = updated.(model)
+	if m.queryInput.Value() != "longquery longq" {
+		t.Fatalf("expected the query to be limited, got %#v", m.queryInput.Value())
+	}
+	if !strings.Contains(m.View(), "the query is at the 15 character limit set by query-char-limit") {
+		t.Fatalf("expected a warning about the character limit:\n%s", m.View())
+	}
+}
+
+var ansiEscapeRegex = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestHighlightMatches(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	defer lipgloss.SetColorProfile(lipgloss.ColorProfile())
+	lipgloss.SetColorProfile(termenv.ANSI256)
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 60, 40, nil }
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Exit Code", "Command"}
+	conf.HighlightMatches = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("hlmatch ls"))
+	db.Create(testutils.MakeFakeHistoryEntry("hlmatch Docker run --rm -it ubuntu:22.04 bash -c 'echo this is a very long command'"))
+	makeModel := func(query string) model {
+		rows, entries, numEntries, err := getRows(ctx, getDisplayedColumns(ctx), query, PAGE_SIZE, SearchOptions{})
+		testutils.Check(t, err)
+		tbl, columns, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+		testutils.Check(t, err)
+		m := initialModel(ctx, tbl, rows, entries, query, numEntries, TuiOptions{})
+		m.columns = columns
+		m.lastQuery = query
+		return m
+	}
+
+	// Matches are highlighted (ignoring case), without changing what is displayed even though the command is truncated
+	m := makeModel("hlmatch docker")
+	highlighted := m.tableView()
+	if ansiEscapeRegex.ReplaceAllString(highlighted, "") != ansiEscapeRegex.ReplaceAllString(m.table.View(), "") {
+		t.Fatalf("highlighting changed the table:\n%s\n\nvs\n\n%s", highlighted, m.table.View())
+	}
+	if !strings.Contains(m.table.View(), "…") {
+		t.Fatalf("expected the command to be truncated:\n%s", m.table.View())
+	}
+	style := lipgloss.NewStyle().Foreground(lipgloss.Color(getTheme(ctx).Highlight)).Bold(true)
+	for _, match := range []string{"hlmatch", "Docker"} {
+		if !strings.Contains(highlighted, style.Render(match)) {
+			t.Fatalf("expected %#v to be highlighted:\n%#v", match, highlighted)
+		}
+	}
+
+	// The selected row's style is restored after each match
+	selectedLine := ""
+	for _, line := range strings.Split(highlighted, "\n") {
+		if strings.Contains(line, "Docker") {
+			selectedLine = line
+		}
+	}
+	selectedPrefix := selectedLine[:strings.Index(selectedLine, "m")+1]
+	if !strings.Contains(selectedLine, style.Render("Docker")+selectedPrefix) {
+		t.Fatalf("expected the selected row's style to be restored after the match:\n%#v", selectedLine)
+	}
+
+	m = makeModel("hlmatch")
+	if highlighted := m.tableView(); strings.Count(highlighted, style.Render("hlmatch")) != 2 {
+		t.Fatalf("expected every row to be highlighted:\n%#v", highlighted)
+	}
+
+	// Atoms, negated terms, and the Exit Code column aren't highlighted
+	m = makeModel("hlmatch -ls cwd:/tmp exit_code:2 2")
+	highlighted = m.tableView()
+	if strings.Contains(highlighted, style.Render("2")+" ") || strings.Contains(highlighted, style.Render("ls")) || strings.Contains(highlighted, style.Render("tmp")) {
+		t.Fatalf("unexpected highlighting:\n%#v", highlighted)
+	}
+
+	// With fuzzy search, the matched characters are highlighted
+	conf.FuzzySearch = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	m = makeModel("dkrrun")
+	if highlighted := m.tableView(); !strings.Contains(highlighted, style.Render("D")) || !strings.Contains(highlighted, style.Render("k")) || !strings.Contains(highlighted, style.Render("run")) || strings.Contains(highlighted, style.Render("o")) {
+		t.Fatalf("expected the fuzzy matches to be highlighted:\n%#v", highlighted)
+	}
+
+	// And it can be disabled
+	conf.HighlightMatches = false
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	m = makeModel("hlmatch docker")
+	if m.tableView() != m.table.View() {
+		t.Fatalf("expected no highlighting when it is disabled")
+	}
+}
+
+func TestFindMatches(t *testing.T) {
+	testcases := []struct {
+		text     string
+		terms    []string
+		fuzzy    bool
+		expected string
+	}{
+		{"git commit -m", []string{"commit"}, false, "    ^^^^^^   "},
+		{"GIT git", []string{"git"}, false, "^^^ ^^^"},
+		{"git commit -m", []string{"git", "-m"}, false, "^^^        ^^"},
+		{"git commit -m", []string{"gcm"}, true, "^   ^ ^      "},
+		{"échos écho", []string{"ÉCHO"}, false, "^^^^  ^^^^"},
+		{"ls", []string{"docker"}, false, "  "},
+	}
+	for _, tc := range testcases {
+		matches := findMatches([]rune(tc.text), tc.terms, tc.fuzzy, false)
+		actual := ""
+		for _, matched := range matches {
+			if matched {
+				actual += "^"
+			} else {
+				actual += " "
+			}
+		}
+		if actual != tc.expected {
+			t.Fatalf("findMatches(%#v, %#v)=%#v, expected %#v", tc.text, tc.terms, actual, tc.expected)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	day := time.Date(2023, 3, 10, 12, 0, 0, 0, time.UTC)
+	for i, e := range []struct {
+		command  string
+		cwd      string
+		daysAgo  int
+		exitCode int
+	}{
+		{"git status", "~/code/", 0, 0},
+		{"git push", "~/code/", 0, 1},
+		{"git pull", "~/code/", 2, 0},
+		{"ls", "~/", 2, 0},
+		{"ls -la", "~/code/", 20, 0},
+		{"make", "~/code/", 20, 2},
+	} {
+		entry := testutils.MakeFakeHistoryEntry(e.command)
+		entry.CurrentWorkingDirectory = e.cwd
+		entry.ExitCode = e.exitCode
+		entry.StartTime = day.AddDate(0, 0, -e.daysAgo).Add(time.Duration(i) * time.Minute)
+		entry.EndTime = entry.StartTime.Add(time.Second)
+		db.Create(entry)
+	}
+
+	stats, err := GetStats(ctx, "")
+	testutils.Check(t, err)
+	if stats.NumEntries != 6 || stats.NumFailed != 2 {
+		t.Fatalf("unexpected counts: %#v", stats)
+	}
+	if !reflect.DeepEqual(stats.TopPrograms, []StatCount{{"git", 3}, {"ls", 2}, {"make", 1}}) {
+		t.Fatalf("unexpected top programs: %#v", stats.TopPrograms)
+	}
+	if !reflect.DeepEqual(stats.TopDirectories, []StatCount{{"~/code/", 5}, {"~/", 1}}) {
+		t.Fatalf("unexpected top directories: %#v", stats.TopDirectories)
+	}
+	if len(stats.CommandsPerDay) != NUM_STATS_DAYS {
+		t.Fatalf("unexpected number of days: %#v", stats.CommandsPerDay)
+	}
+	if last := stats.CommandsPerDay[NUM_STATS_DAYS-1]; last != (StatCount{"2023-03-10", 2}) {
+		t.Fatalf("unexpected last day: %#v", last)
+	}
+	if !reflect.DeepEqual(stats.CommandsPerDay[NUM_STATS_DAYS-3:], []StatCount{{"2023-03-08", 2}, {"2023-03-09", 0}, {"2023-03-10", 2}}) {
+		t.Fatalf("unexpected days: %#v", stats.CommandsPerDay)
+	}
+
+	// Stats respect the query, including time ranges
+	stats, err = GetStats(ctx, "before:2023-03-01")
+	testutils.Check(t, err)
+	if stats.NumEntries != 2 || stats.NumFailed != 1 || stats.CommandsPerDay[NUM_STATS_DAYS-1] != (StatCount{"2023-02-18", 2}) {
+		t.Fatalf("unexpected stats for a time range: %#v", stats)
+	}
+	stats, err = GetStats(ctx, "git")
+	testutils.Check(t, err)
+	if stats.NumEntries != 3 || !reflect.DeepEqual(stats.TopPrograms, []StatCount{{"git", 3}}) {
+		t.Fatalf("unexpected stats for a query: %#v", stats)
+	}
+
+	// And are rendered with a bar chart
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	stats, err = GetStats(ctx, "")
+	testutils.Check(t, err)
+	report := FormatStats(ctx, stats)
+	for _, expected := range []string{
+		"Commands: 6 (2 failed, 33.3%)\n",
+		"  git   " + strings.Repeat("█", MAX_STATS_BAR_WIDTH) + "  3   50.0%\n",
+		"  make  " + strings.Repeat("█", MAX_STATS_BAR_WIDTH/3) + strings.Repeat(" ", MAX_STATS_BAR_WIDTH-MAX_STATS_BAR_WIDTH/3) + "  1   16.7%\n",
+		"  2023-03-09  " + strings.Repeat(" ", MAX_STATS_BAR_WIDTH) + "  0    0.0%\n",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Fatalf("expected the report to contain %#v:\n%s", expected, report)
+		}
+	}
+	stats, err = GetStats(ctx, "nonexistentcommand")
+	testutils.Check(t, err)
+	if report := FormatStats(ctx, stats); report != "No matching commands\n" {
+		t.Fatalf("unexpected report with no matches: %#v", report)
+	}
+}
+
+func TestSpinnerStyle(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	makeModel := func() model {
+		return initialModel(hctx.MakeContext(), table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 10}})), nil, nil, "", 0, TuiOptions{})
+	}
+
+	// By default, the dot spinner is animated along with the default message
+	m := makeModel()
+	if m.Init() == nil || m.spinner.Spinner.Frames[0] != spinner.Dot.Frames[0] {
+		t.Fatalf("expected the dot spinner to be animated by default")
+	}
+	if loading := m.loadingView(); loading != m.spinner.View()+" "+DEFAULT_LOADING_MESSAGE {
+		t.Fatalf("unexpected loading message: %#v", loading)
+	}
+
+	// Other spinners and messages can be configured
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.SpinnerStyle = "line"
+	conf.LoadingMessage = "Syncing..."
+	testutils.Check(t, hctx.SetConfig(conf))
+	m = makeModel()
+	if m.Init() == nil || m.spinner.Spinner.Frames[0] != spinner.Line.Frames[0] {
+		t.Fatalf("expected the line spinner to be animated")
+	}
+	if loading := m.loadingView(); loading != m.spinner.View()+" Syncing..." {
+		t.Fatalf("unexpected loading message: %#v", loading)
+	}
+	if !strings.Contains(m.View(), "Syncing...") {
+		t.Fatalf("expected the view to contain the loading message:\n%s", m.View())
+	}
+
+	// And the spinner can be disabled
+	conf.SpinnerStyle = "none"
+	testutils.Check(t, hctx.SetConfig(conf))
+	m = makeModel()
+	if m.Init() != nil || m.loadingView() != "Syncing..." {
+		t.Fatalf("expected just the loading message, got %#v", m.loadingView())
+	}
+	conf.SpinnerStyle = "hidden"
+	testutils.Check(t, hctx.SetConfig(conf))
+	m = makeModel()
+	if m.Init() != nil || m.loadingView() != "" || strings.Contains(m.View(), "Syncing...") {
+		t.Fatalf("expected nothing to be shown while loading, got %#v", m.loadingView())
+	}
+}
+
+func TestSelectWithoutCommandColumn(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Exit Code", "CWD"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	entry := testutils.MakeFakeHistoryEntry("nocmdcol echo\nhi")
+	db.Create(entry)
+	rows, entries, numEntries, err := getRows(ctx, getDisplayedColumns(ctx), "nocmdcol", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl := table.New(table.WithColumns([]table.Column{{Title: "Exit Code", Width: 10}, {Title: "CWD", Width: 10}}), table.WithRows(rows))
+
+	// The command is still selected even though it isn't displayed
+	m := initialModel(ctx, tbl, rows, entries, "nocmdcol", numEntries, TuiOptions{})
+	m.selected = true
+	m.View()
+	if selectedRow != "nocmdcol echo hi" {
+		t.Fatalf("unexpected selected row: %#v", selectedRow)
+	}
+
+	// And if nothing is selected, nothing is output
+	m = initialModel(ctx, tbl, rows, nil, "nocmdcol", 0, TuiOptions{})
+	m.selected = true
+	m.View()
+	if selectedRow != "" {
+		t.Fatalf("expected nothing to be selected, got %#v", selectedRow)
+	}
+}
+
+func TestUndoDeletion(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.IsOffline = true
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	// The TUI always has at least one entry in practice (e.g. the hishtory command itself)
+	db.Create(testutils.MakeFakeHistoryEntry("undoother"))
+	entry := testutils.MakeFakeHistoryEntry("undodel oops")
+	db.Create(entry)
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "undodel", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 20}}), table.WithRows(rows)), rows, entries, "undodel", numEntries, TuiOptions{})
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	countEntries := func() int64 {
+		var count int64
+		testutils.Check(t, db.Model(&data.HistoryEntry{}).Where("command = ?", "undodel oops").Count(&count).Error)
+		return count
+	}
+
+	// There is nothing to undo yet
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlZ})
+	if m.(model).searchErr == nil {
+		t.Fatalf("expected an error when there is nothing to undo")
+	}
+
+	// Deleting is only done locally at first, and can be undone
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlK})
+	m, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'y'}})
+	if countEntries() != 0 || cmd == nil {
+		t.Fatalf("expected the entry to be deleted and the deletion request to be scheduled")
+	}
+	staleId := m.(model).deletionId
+	if footer := m.(model).footerView(); !strings.Contains(footer, "Deleted the entry on this device (press Control+Z to undo") {
+		t.Fatalf("unexpected footer: %#v", footer)
+	}
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlZ})
+	var restored data.HistoryEntry
+	testutils.Check(t, db.Where("command = ?", "undodel oops").First(&restored).Error)
+	if !restored.EndTime.Equal(entry.EndTime) || m.(model).lastDeleted != nil || m.(model).numEntries != 1 {
+		t.Fatalf("expected the entry to be restored unchanged, got %#v", restored)
+	}
+	// And then the deletion request is never sent
+	m, _ = m.Update(sendDeletionMsg{id: staleId})
+	if m.(model).lastDeletionSent || countEntries() != 1 {
+		t.Fatalf("expected the undone deletion to not be sent")
+	}
+
+	// Once the deletion request was sent, undoing re-creates the entry
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlK})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'y'}})
+	m, _ = m.Update(sendDeletionMsg{id: m.(model).deletionId})
+	if !m.(model).lastDeletionSent || countEntries() != 0 {
+		t.Fatalf("expected the deletion request to be sent")
+	}
+	if footer := m.(model).footerView(); !strings.Contains(footer, "Deleted the entry on all of your devices (press Control+Z to re-create it)") {
+		t.Fatalf("unexpected footer: %#v", footer)
+	}
+
+	// If re-creating the entry fails (e.g. since we're offline), the undo is still available
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SIMULATE_NETWORK_ERROR")()
+	os.Setenv("HISHTORY_SIMULATE_NETWORK_ERROR", "1")
+	onlineModel := m.(model)
+	onlineConf := hctx.GetConf(onlineModel.ctx)
+	onlineConf.IsOffline = false
+	onlineModel.ctx = hctx.WithConfig(onlineModel.ctx, onlineConf)
+	failed, _ := onlineModel.Update(tea.KeyMsg{Type: tea.KeyCtrlZ})
+	if failed.(model).searchErr == nil || failed.(model).lastDeleted == nil || countEntries() != 0 {
+		t.Fatalf("expected the failed undo to be retryable, searchErr=%v", failed.(model).searchErr)
+	}
+	os.Setenv("HISHTORY_SIMULATE_NETWORK_ERROR", "")
+
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlZ})
+	testutils.Check(t, db.Where("command = ?", "undodel oops").First(&restored).Error)
+	if !restored.EndTime.Equal(entry.EndTime.Add(time.Millisecond)) || m.(model).lastDeleted != nil || countEntries() != 1 {
+		t.Fatalf("expected the entry to be re-created with a new end time, got %#v", restored)
+	}
+	if strings.Contains(m.(model).footerView(), "Control+Z") {
+		t.Fatalf("expected the undo to no longer be available: %#v", m.(model).footerView())
+	}
+}
+
+func TestCompactMode(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	terminalWidth := 40
+	getTerminalSize = func() (int, int, error) { return terminalWidth, 30, nil }
+	defaultColumns := []string{"Hostname", "CWD", "Timestamp", "Runtime", "Exit Code", "Command"}
+
+	// Narrow terminals only display the command
+	ctx := hctx.MakeContext()
+	if columns := getTableColumns(ctx); !reflect.DeepEqual(columns, []string{"Command"}) {
+		t.Fatalf("expected only the Command column in a narrow terminal, got %#v", columns)
+	}
+	if idx := getIndexOfCommandColumn(ctx); idx != 0 {
+		t.Fatalf("expected the Command column to be first in compact mode, got %d", idx)
+	}
+	if columns := getDisplayedColumns(ctx); !reflect.DeepEqual(columns, defaultColumns) {
+		t.Fatalf("expected compact mode to leave the displayed columns alone, got %#v", columns)
+	}
+
+	// Exports still contain all of the displayed columns
+	testutils.Check(t, hctx.GetDb(ctx).Create(testutils.MakeFakeHistoryEntry("echo compact")).Error)
+	rows, entries, _, err := getRows(ctx, getTableColumns(ctx), "compact", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	exportPath := filepath.Join(t.TempDir(), "export.csv")
+	exportDisplayedRows(model{ctx: ctx, rows: rows, entries: entries}, exportPath)
+	exported, err := os.ReadFile(exportPath)
+	testutils.Check(t, err)
+	if !strings.HasPrefix(string(exported), "Hostname,CWD,Timestamp,Runtime,Exit Code,Command\n") || !strings.Contains(string(exported), "echo compact") {
+		t.Fatalf("unexpected export in compact mode: %#v", string(exported))
+	}
+	terminalWidth = 100
+	if columns := getTableColumns(ctx); !reflect.DeepEqual(columns, defaultColumns) {
+		t.Fatalf("expected all of the columns in a wide terminal, got %#v", columns)
+	}
+
+	// The threshold is configurable
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.CompactModeWidth = 120
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	if columns := getTableColumns(ctx); !reflect.DeepEqual(columns, []string{"Command"}) {
+		t.Fatalf("expected only the Command column below the configured width, got %#v", columns)
+	}
+
+	// And can be disabled
+	conf.CompactModeWidth = -1
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	terminalWidth = 20
+	if columns := getTableColumns(ctx); !reflect.DeepEqual(columns, defaultColumns) {
+		t.Fatalf("expected all of the columns when compact mode is disabled, got %#v", columns)
+	}
+}
+
+func TestEditSelectedCommand(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("editsel --verbose deploy"))
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "editsel", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows)), rows, entries, "editsel", numEntries, TuiOptions{})
+
+	// The edit input starts with the selected command
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlE})
+	if !m.(model).isEditing || m.(model).editInput.Value() != "editsel --verbose deploy" {
+		t.Fatalf("expected to be editing the selected command, got %#v", m.(model).editInput.Value())
+	}
+	if view := m.View(); !strings.Contains(view, "Edit Command:") {
+		t.Fatalf("expected the edit input to be displayed: %#v", view)
+	}
+
+	// Escape cancels editing without selecting anything
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.(model).isEditing || m.(model).selected || m.(model).quitting {
+		t.Fatalf("expected escape to only cancel editing")
+	}
+
+	// The cursor can be moved to edit anywhere in the command, and the edited command is selected
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlE})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyHome})
+	for range "editsel " {
+		m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRight})
+	}
+	for range "--verbose " {
+		m, _ = m.Update(tea.KeyMsg{Type: tea.KeyDelete})
+	}
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyEnd})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(" --dry-run")})
+	m, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd == nil || !m.(model).selected {
+		t.Fatalf("expected enter to select the edited command")
+	}
+	m.View()
+	if selectedRow != "editsel deploy --dry-run" {
+		t.Fatalf("unexpected selected row: %#v", selectedRow)
+	}
+
+	// The stored entry is unchanged
+	var stored data.HistoryEntry
+	testutils.Check(t, db.Where("command LIKE ?", "editsel%").First(&stored).Error)
+	if stored.Command != "editsel --verbose deploy" {
+		t.Fatalf("expected the stored entry to be unchanged, got %#v", stored.Command)
+	}
+}
+
+func TestDisplayTimezone(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.TimestampFormat = "2006-01-02 15:04 MST"
+	conf.DisplayTimezone = "UTC"
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	entry := testutils.MakeFakeHistoryEntry("tzdisplay")
+	newYork, err := time.LoadLocation("America/New_York")
+	testutils.Check(t, err)
+	entry.StartTime = time.Date(2023, 6, 1, 9, 30, 0, 0, newYork)
+	row, err := buildTableRow(ctx, []string{"Timestamp"}, entry)
+	testutils.Check(t, err)
+	if row[0] != "2023-06-01 13:30 UTC" {
+		t.Fatalf("expected the timestamp to be displayed in UTC, got %#v", row[0])
+	}
+
+	// IANA names are supported too
+	conf.DisplayTimezone = "Asia/Tokyo"
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	row, err = buildTableRow(ctx, []string{"Timestamp"}, entry)
+	testutils.Check(t, err)
+	if row[0] != "2023-06-01 22:30 JST" {
+		t.Fatalf("expected the timestamp to be displayed in Tokyo time, got %#v", row[0])
+	}
+
+	// Invalid timezones fall back to the local timezone and are flagged by validation
+	conf.DisplayTimezone = "Mars/Olympus_Mons"
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	row, err = buildTableRow(ctx, []string{"Timestamp"}, entry)
+	testutils.Check(t, err)
+	if expected := entry.StartTime.In(time.Local).Format(conf.TimestampFormat); row[0] != expected {
+		t.Fatalf("expected the timestamp to be displayed in the local timezone %#v, got %#v", expected, row[0])
+	}
+	foundErr := false
+	for _, err := range ValidateConfig(conf) {
+		foundErr = foundErr || strings.Contains(err.Error(), "display_timezone: unknown time zone Mars/Olympus_Mons")
+	}
+	if !foundErr {
+		t.Fatalf("expected a validation error for the invalid timezone, got %v", ValidateConfig(conf))
+	}
+
+	// And are reported in the TUI once, rather than while rendering
+	m := initialModel(ctx, table.New(), nil, nil, "", 0, TuiOptions{})
+	if view := m.backgroundErrorsView(); !strings.Contains(view, "timestamps are displayed in the local timezone since display_timezone: unknown time zone Mars/Olympus_Mons") {
+		t.Fatalf("expected a warning about the invalid timezone, got %#v", view)
+	}
+}
+
+func TestCycleRecentDirectories(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, dir := range []string{"/srv/alpha/", "/srv/bravo/", "/srv/alpha/", "/srv/charlie/"} {
+		entry := testutils.MakeFakeHistoryEntry("recentdir build")
+		entry.CurrentWorkingDirectory = dir
+		db.Create(entry)
+	}
+	directories, err := RecentDirectoriesForDisplay(ctx, db, 10)
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(directories, []string{"/srv/charlie/", "/srv/alpha/", "/srv/bravo/"}) {
+		t.Fatalf("unexpected recent directories: %#v", directories)
+	}
+	directories, err = RecentDirectoriesForDisplay(ctx, db, 1)
+	testutils.Check(t, err)
+	if !reflect.DeepEqual(directories, []string{"/srv/charlie/"}) {
+		t.Fatalf("expected the recent directories to be limited, got %#v", directories)
+	}
+
+	// Each press filters the query to the next directory, keeping the other search terms
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "recentdir", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows)), rows, entries, "recentdir", numEntries, TuiOptions{})
+	for _, expected := range []struct {
+		query      string
+		numEntries int
+	}{
+		{"recentdir cwd:/srv/charlie/", 1},
+		{"recentdir cwd:/srv/alpha/", 2},
+		{"recentdir cwd:/srv/bravo/", 1},
+		{"recentdir", 4},
+		{"recentdir cwd:/srv/charlie/", 1},
+	} {
+		m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'l'}, Alt: true})
+		if m.(model).queryInput.Value() != expected.query || m.(model).lastQuery != expected.query || m.(model).numEntries != expected.numEntries {
+			t.Fatalf("expected the query %#v with %d results, got %#v with %d results", expected.query, expected.numEntries, m.(model).lastQuery, m.(model).numEntries)
+		}
+	}
+
+	// Directories that contain spaces are quoted, and are replaced like any other cwd: atom
+	entry := testutils.MakeFakeHistoryEntry("recentdir build")
+	entry.CurrentWorkingDirectory = "/srv/my project/"
+	db.Create(entry)
+	updated := m.(model)
+	updated.recentDirectories = nil
+	m = updated
+	for _, expected := range []struct {
+		query      string
+		numEntries int
+	}{
+		{`recentdir cwd:"/srv/my project/"`, 1},
+		{"recentdir cwd:/srv/charlie/", 1},
+	} {
+		m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'l'}, Alt: true})
+		if m.(model).queryInput.Value() != expected.query || m.(model).numEntries != expected.numEntries {
+			t.Fatalf("expected the query %#v with %d results, got %#v with %d results", expected.query, expected.numEntries, m.(model).queryInput.Value(), m.(model).numEntries)
+		}
+	}
+}
+
+func TestFitTableHeight(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for i := 0; i < 100; i++ {
+		db.Create(testutils.MakeFakeHistoryEntry(fmt.Sprintf("fitheight %d", i)))
+	}
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	terminalHeight := 60
+	getTerminalSize = func() (int, int, error) { return 100, terminalHeight, nil }
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "fitheight", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	m := initialModel(ctx, tbl, rows, entries, "fitheight", numEntries, TuiOptions{})
+	m.isLoading = false
+	numLines := func(m model) int {
+		return strings.Count(m.View(), "\n") + 1
+	}
+
+	// Tall terminals show more than TABLE_HEIGHT rows, while filling the terminal exactly
+	m = fitTableHeight(m)
+	if m.table.Height() <= TABLE_HEIGHT || numLines(m) != terminalHeight {
+		t.Fatalf("expected the table to fill the terminal, got a height of %d with %d lines", m.table.Height(), numLines(m))
+	}
+	// And the rows past the first page are loaded to fill it
+	updated, cmd := m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if !updated.(model).isLoadingPage || cmd == nil {
+		t.Fatalf("expected the next page to be loaded to fill the table")
+	}
+
+	// Displaying more lines outside of the table shrinks it
+	height := m.table.Height()
+	m.searchErr = fmt.Errorf("fitheight warning")
+	m = fitTableHeight(m)
+	if m.table.Height() != height-2 || numLines(m) != terminalHeight {
+		t.Fatalf("expected the table to shrink to fit the warning, got a height of %d with %d lines", m.table.Height(), numLines(m))
+	}
+
+	// Short terminals still show a few rows
+	terminalHeight = 5
+	m = fitTableHeight(m)
+	if m.table.Height() != MIN_TABLE_HEIGHT {
+		t.Fatalf("expected the table to have the minimum height, got %d", m.table.Height())
+	}
+}
+
+func TestCaseSensitiveSearch(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	db.Create(testutils.MakeFakeHistoryEntry("deploy --env=PROD"))
+	db.Create(testutils.MakeFakeHistoryEntry("deploy --env=prod"))
+	db.Create(testutils.MakeFakeHistoryEntry("echo glob*star"))
+	search := func(ctx *context.Context, query string) []string {
+		results, err := Search(ctx, db, query, 10)
+		testutils.Check(t, err)
+		commands := make([]string, 0)
+		for _, result := range results {
+			commands = append(commands, result.Command)
+		}
+		return commands
+	}
+
+	// Case is ignored by default
+	if commands := search(ctx, "PROD"); len(commands) != 2 {
+		t.Fatalf("expected a case-insensitive search by default, got %#v", commands)
+	}
+
+	conf.CaseSensitiveSearch = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	if commands := search(ctx, "PROD"); !reflect.DeepEqual(commands, []string{"deploy --env=PROD"}) {
+		t.Fatalf("unexpected results for a case-sensitive search: %#v", commands)
+	}
+	if commands := search(ctx, "-PROD deploy"); !reflect.DeepEqual(commands, []string{"deploy --env=prod"}) {
+		t.Fatalf("unexpected results for a negated case-sensitive search: %#v", commands)
+	}
+	// GLOB's special characters only match themselves
+	if commands := search(ctx, "o*s"); len(commands) != 0 {
+		t.Fatalf("expected * to not be a wildcard, got %#v", commands)
+	}
+	if commands := search(ctx, "b*s"); !reflect.DeepEqual(commands, []string{"echo glob*star"}) {
+		t.Fatalf("expected * to match itself, got %#v", commands)
+	}
+	// Regexes use their own flags
+	if commands := search(ctx, "re:(?i)=prod$"); len(commands) != 2 {
+		t.Fatalf("expected the regex to ignore case, got %#v", commands)
+	}
+	// And so does fuzzy search
+	conf.FuzzySearch = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	if commands := search(ctx, "dPD"); !reflect.DeepEqual(commands, []string{"deploy --env=PROD"}) {
+		t.Fatalf("unexpected results for a case-sensitive fuzzy search: %#v", commands)
+	}
+
+	// The TUI can toggle it for a single search, and shows when it is on
+	conf.FuzzySearch = false
+	conf.CaseSensitiveSearch = false
+	testutils.Check(t, hctx.SetConfig(conf))
+	ctx = hctx.MakeContext()
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "prod", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows)), rows, entries, "prod", numEntries, TuiOptions{})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'i'}, Alt: true})
+	if m.(model).numEntries != 1 || !strings.Contains(m.(model).footerView(), "case-sensitive") {
+		t.Fatalf("expected alt+i to switch to a case-sensitive search, got %d results and the footer %#v", m.(model).numEntries, m.(model).footerView())
+	}
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'i'}, Alt: true})
+	if m.(model).numEntries != 2 || strings.Contains(m.(model).footerView(), "case-sensitive") {
+		t.Fatalf("expected alt+i to switch back to a case-insensitive search")
+	}
+	if persisted, err := hctx.GetConfig(); err != nil || persisted.CaseSensitiveSearch {
+		t.Fatalf("expected the toggle to not change the config file")
+	}
+}
+
+func TestBackgroundErrors(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows)), rows, entries, "", numEntries, TuiOptions{})
+
+	// Transient errors are displayed as warnings rather than ending the TUI
+	transientErr := fmt.Errorf("failed to process deletion requests: %w", fmt.Errorf("bgerr status_code=500"))
+	msg := errorToMsg(ctx, transientErr)
+	m, _ = m.Update(msg)
+	m, _ = m.Update(msg)
+	m, _ = m.Update(errorToMsg(ctx, fmt.Errorf("failed to check for a banner: bgerr other")))
+	if m.(model).err != nil {
+		t.Fatalf("expected a transient error to not be fatal: %v", m.(model).err)
+	}
+	view := m.View()
+	if strings.Count(view, "Warning: failed to process deletion requests: bgerr status_code=500") != 1 || !strings.Contains(view, "Warning: failed to check for a banner: bgerr other") || !strings.Contains(view, "Control+L to dismiss") {
+		t.Fatalf("expected each warning to be displayed once: %s", view)
+	}
+
+	// And they can be dismissed
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlL})
+	if view := m.View(); strings.Contains(view, "bgerr") || strings.Contains(view, "dismiss") {
+		t.Fatalf("expected the warnings to be dismissed: %s", view)
+	}
+
+	// Whereas a corrupt DB is still fatal
+	m, _ = m.Update(errorToMsg(ctx, fmt.Errorf("failed to retrieve entries from other devices: database disk image is malformed")))
+	if view := m.View(); !strings.Contains(view, "An unrecoverable error occured") {
+		t.Fatalf("expected a corrupt DB to be fatal: %s", view)
+	}
+}
+
+func TestPinnedCommands(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, command := range []string{"pinme build", "pinme test", "pinme deploy", "pinme build", "pinme lint"} {
+		db.Create(testutils.MakeFakeHistoryEntry(command))
+	}
+	// Returns the displayed commands, with the markers for pinned commands
+	getCommands := func(m model) []string {
+		commands := make([]string, 0)
+		for _, entry := range m.entries {
+			if strings.Contains(m.table.View(), "★ "+entry.Command) {
+				commands = append(commands, "★ "+entry.Command)
+			} else {
+				commands = append(commands, entry.Command)
+			}
+		}
+		return commands
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "pinme", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns([]table.Column{{Title: "Command", Width: 30}}), table.WithRows(rows)), rows, entries, "pinme", numEntries, TuiOptions{})
+
+	// Pinning the selected command moves it to the top and marks it, and is saved in the config
+	updated := m.(model)
+	updated.table.SetCursor(1)
+	m, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'b'}, Alt: true})
+	if commands := getCommands(m.(model)); !reflect.DeepEqual(commands, []string{"★ pinme build", "pinme lint", "pinme deploy", "pinme test"}) {
+		t.Fatalf("unexpected rows after pinning: %#v", commands)
+	}
+	if entry := m.(model).selectedEntry(); entry.Command != "pinme build" {
+		t.Fatalf("expected the pinned entry to stay selected, got %#v", entry.Command)
+	}
+	if persisted, err := hctx.GetConfig(); err != nil || !reflect.DeepEqual(persisted.PinnedCommands, []string{"pinme build"}) {
+		t.Fatalf("expected the pin to be saved, got %#v", persisted.PinnedCommands)
+	}
+
+	// Pins only apply when they match the query
+	ctx = hctx.MakeContext()
+	_, entries, _, err = getRows(ctx, []string{"Command"}, "pinme -build", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	if len(entries) != 3 || entries[0].Command != "pinme lint" {
+		t.Fatalf("expected the pinned command to not match, got %#v", entries[0].Command)
+	}
+
+	// And pinned commands stay in the order that they were pinned
+	updated = m.(model)
+	updated.table.SetCursor(3)
+	m, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'b'}, Alt: true})
+	if commands := getCommands(m.(model)); !reflect.DeepEqual(commands, []string{"★ pinme build", "★ pinme test", "pinme lint", "pinme deploy"}) {
+		t.Fatalf("unexpected rows after pinning a second command: %#v", commands)
+	}
+
+	// Unpinning restores the usual order
+	updated = m.(model)
+	updated.table.SetCursor(0)
+	m, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'b'}, Alt: true})
+	if commands := getCommands(m.(model)); !reflect.DeepEqual(commands, []string{"★ pinme test", "pinme lint", "pinme build", "pinme deploy", "pinme build"}) {
+		t.Fatalf("unexpected rows after unpinning: %#v", commands)
+	}
+	if persisted, err := hctx.GetConfig(); err != nil || !reflect.DeepEqual(persisted.PinnedCommands, []string{"pinme test"}) {
+		t.Fatalf("expected the unpin to be saved, got %#v", persisted.PinnedCommands)
+	}
+}
+
+func TestSortByColumn(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Runtime", "Exit Code", "Command"}
+	conf.FilterAllDuplicateCommands = true
+	testutils.Check(t, hctx.SetConfig(conf))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, e := range []struct {
+		command  string
+		runtime  time.Duration
+		exitCode int
+	}{
+		{"sortme a", 10 * time.Second, 0},
+		{"sortme b", time.Second, 1},
+		{"sortme c", 5 * time.Second, 0},
+		{"sortme a", 2 * time.Second, 0},
+		{"sortme d", -1, 0},
+	} {
+		entry := testutils.MakeFakeHistoryEntry(e.command)
+		entry.EndTime = entry.StartTime.Add(e.runtime)
+		if e.runtime < 0 {
+			// The command hasn't finished yet
+			entry.EndTime = time.Time{}
+		}
+		entry.ExitCode = e.exitCode
+		db.Create(entry)
+	}
+	// Returns the displayed commands and their runtimes
+	getResults := func(entries []*data.HistoryEntry) []string {
+		results := make([]string, 0)
+		for _, entry := range entries {
+			results = append(results, fmt.Sprintf("%s:%s", entry.Command, columnFormatters["Runtime"](ctx, *entry)))
+		}
+		return results
+	}
+
+	// Sorting applies before duplicates are filtered out, so the slowest run of a duplicated command is kept
+	_, entries, _, err := getRows(ctx, getDisplayedColumns(ctx), "sortme", PAGE_SIZE, SearchOptions{SortColumn: "Runtime", DedupMode: DEDUP_EXACT})
+	testutils.Check(t, err)
+	if results := getResults(entries); !reflect.DeepEqual(results, []string{"sortme a:10s", "sortme c:5s", "sortme b:1s", "sortme d:"}) {
+		t.Fatalf("unexpected results when sorting by runtime: %#v", results)
+	}
+
+	// Alt+O cycles through the displayed columns that can be sorted, showing the sort in the column's header
+	columns := []table.Column{{Title: "Runtime", Width: 10}, {Title: "Exit Code", Width: 10}, {Title: "Command", Width: 30}}
+	rows, entries, numEntries, err := getRows(ctx, getDisplayedColumns(ctx), "sortme", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, table.New(table.WithColumns(columns), table.WithRows(rows)), rows, entries, "sortme", numEntries, TuiOptions{})
+	if results := getResults(m.(model).entries); !reflect.DeepEqual(results, []string{"sortme a:2s", "sortme c:5s", "sortme a:10s", "sortme b:1s", "sortme d:"}) {
+		t.Fatalf("unexpected results in the default order: %#v", results)
+	}
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'o'}, Alt: true})
+	if results := getResults(m.(model).entries); !reflect.DeepEqual(results, []string{"sortme a:10s", "sortme c:5s", "sortme a:2s", "sortme b:1s", "sortme d:"}) {
+		t.Fatalf("unexpected results when sorting by runtime: %#v", results)
+	}
+	if !strings.Contains(m.(model).table.View(), "Runtime ▼") {
+		t.Fatalf("expected the header to show the sort, got %#v", m.(model).table.View())
+	}
+
+	// Alt+Shift+O flips the direction, with unfinished commands still sorted last
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'O'}, Alt: true})
+	if results := getResults(m.(model).entries); !reflect.DeepEqual(results, []string{"sortme b:1s", "sortme a:2s", "sortme c:5s", "sortme a:10s", "sortme d:"}) {
+		t.Fatalf("unexpected results when sorting by runtime in ascending order: %#v", results)
+	}
+	if !strings.Contains(m.(model).table.View(), "Runtime ▲") {
+		t.Fatalf("expected the header to show the sort, got %#v", m.(model).table.View())
+	}
+
+	// Entries with the same exit code stay in the default order
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'o'}, Alt: true})
+	if results := getResults(m.(model).entries); !reflect.DeepEqual(results, []string{"sortme b:1s", "sortme a:2s", "sortme c:5s", "sortme a:10s", "sortme d:"}) {
+		t.Fatalf("unexpected results when sorting by exit code: %#v", results)
+	}
+	if !strings.Contains(m.(model).table.View(), "Exit Code ▼") || strings.Contains(m.(model).table.View(), "Runtime ▲") {
+		t.Fatalf("expected the header to show the sort, got %#v", m.(model).table.View())
+	}
+
+	// And after the last sortable column, the results go back to the default order
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'o'}, Alt: true})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'o'}, Alt: true})
+	if m.(model).searchOptions.SortColumn != "" {
+		t.Fatalf("expected the results to no longer be sorted by a column, got %#v", m.(model).searchOptions.SortColumn)
+	}
+	if results := getResults(m.(model).entries); results[0] != "sortme a:2s" {
+		t.Fatalf("unexpected results in the default order: %#v", results)
+	}
+}
+
+func TestDebouncedSearch(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, command := range []string{"echo foo", "echo bar", "ls"} {
+		db.Create(testutils.MakeFakeHistoryEntry(command))
+	}
+	if debounce := getSearchDebounce(ctx); debounce != DEFAULT_SEARCH_DEBOUNCE {
+		t.Fatalf("unexpected default debounce: %v", debounce)
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, tbl, rows, entries, "", numEntries, TuiOptions{})
+
+	// Typing doesn't run the query until it pauses
+	var cmd tea.Cmd
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("ech")})
+	firstId := m.(model).debounceId
+	m, cmd = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("o b")})
+	if cmd == nil || !m.(model).isQueryPending || m.(model).lastQuery != "" || len(m.(model).entries) != 3 {
+		t.Fatalf("expected the query to not have been run yet, got lastQuery=%#v", m.(model).lastQuery)
+	}
+
+	// Only the latest edit runs the query
+	m, _ = m.Update(debouncedQueryMsg{id: firstId})
+	if m.(model).lastQuery != "" {
+		t.Fatalf("expected a stale debounce to be ignored, got lastQuery=%#v", m.(model).lastQuery)
+	}
+	m, _ = m.Update(debouncedQueryMsg{id: m.(model).debounceId})
+	if m.(model).isQueryPending || m.(model).lastQuery != "echo b" || len(m.(model).entries) != 1 {
+		t.Fatalf("expected the query to have been run, got lastQuery=%#v", m.(model).lastQuery)
+	}
+
+	// Keys that act on the results run the pending query first
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+	if m.(model).lastQuery != "echo b" {
+		t.Fatalf("expected the query to not have been run yet, got lastQuery=%#v", m.(model).lastQuery)
+	}
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if m.(model).isQueryPending || m.(model).lastQuery != "echo" || len(m.(model).entries) != 2 || m.(model).selectedEntry().Command != "echo foo" {
+		t.Fatalf("expected the query to have been run, got lastQuery=%#v", m.(model).lastQuery)
+	}
+
+	// And debouncing can be disabled
+	conf.SearchDebounceMs = -1
+	testutils.Check(t, hctx.SetConfig(conf))
+	updated := m.(model)
+	updated.ctx = hctx.MakeContext()
+	m, _ = updated.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(" f")})
+	if m.(model).isQueryPending || m.(model).lastQuery != "echo f" || len(m.(model).entries) != 1 {
+		t.Fatalf("expected the query to have been run immediately, got lastQuery=%#v", m.(model).lastQuery)
+	}
+}
+
+func TestRankingStrategy(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	cwd, _, err := getCwd(ctx)
+	testutils.Check(t, err)
+	for _, e := range []struct {
+		command string
+		cwd     string
+	}{
+		{"git status", "/tmp/"},
+		{"make", cwd},
+		{"git status", "/tmp/"},
+		{"ls", "/tmp/"},
+		{"make", cwd},
+		{"git status", "/tmp/"},
+		{"echo", "/tmp/"},
+	} {
+		entry := testutils.MakeFakeHistoryEntry(e.command)
+		entry.CurrentWorkingDirectory = e.cwd
+		db.Create(entry)
+	}
+	getCommands := func(strategy string, opts SearchOptions) []string {
+		config := hctx.GetConf(ctx)
+		config.RankingStrategy = strategy
+		_, entries, _, err := getRows(hctx.WithConfig(ctx, config), []string{"Command"}, "", PAGE_SIZE, opts)
+		testutils.Check(t, err)
+		commands := make([]string, 0)
+		for _, entry := range entries {
+			commands = append(commands, entry.Command)
+		}
+		return commands
+	}
+
+	// By default, the most recent results are first
+	if commands := getCommands("", SearchOptions{}); !reflect.DeepEqual(commands, []string{"echo", "git status", "make", "ls", "git status", "make", "git status"}) {
+		t.Fatalf("unexpected results when ranking by recency: %#v", commands)
+	}
+	if commands := getCommands(RANKING_RECENCY, SearchOptions{}); commands[0] != "echo" {
+		t.Fatalf("unexpected results when ranking by recency: %#v", commands)
+	}
+
+	// Ranking by frequency keeps the entries for each command together, with ties broken by recency
+	if commands := getCommands(RANKING_FREQUENCY, SearchOptions{}); !reflect.DeepEqual(commands, []string{"git status", "git status", "git status", "make", "make", "echo", "ls"}) {
+		t.Fatalf("unexpected results when ranking by frequency: %#v", commands)
+	}
+
+	// Ranking by frequency in the current directory leaves the commands that weren't run in it in recency order
+	if commands := getCommands(RANKING_FREQUENCY_IN_CWD, SearchOptions{}); !reflect.DeepEqual(commands, []string{"make", "make", "echo", "git status", "ls", "git status", "git status"}) {
+		t.Fatalf("unexpected results when ranking by frequency in the cwd: %#v", commands)
+	}
+
+	// The offset and limit apply to the ranked results
+	config := hctx.GetConf(ctx)
+	config.RankingStrategy = RANKING_FREQUENCY
+	entries, err := search(hctx.WithConfig(ctx, config), db, "", 2, SearchOptions{Offset: 2}, true)
+	testutils.Check(t, err)
+	if len(entries) != 2 || entries[0].Command != "git status" || entries[1].Command != "make" {
+		t.Fatalf("unexpected page of results when ranking by frequency: %#v", entries)
+	}
+
+	// An explicitly chosen sort takes precedence
+	if commands := getCommands(RANKING_FREQUENCY, SearchOptions{SortColumn: "Timestamp"}); commands[0] != "echo" {
+		t.Fatalf("unexpected results when sorting by timestamp: %#v", commands)
+	}
+
+	// And unknown strategies are errors
+	config.RankingStrategy = "popularity"
+	_, _, _, err = getRows(hctx.WithConfig(ctx, config), []string{"Command"}, "", PAGE_SIZE, SearchOptions{})
+	if err == nil || !strings.Contains(err.Error(), `unknown ranking_strategy "popularity"`) {
+		t.Fatalf("expected an error for an unknown ranking strategy, got %v", err)
+	}
+	found := false
+	for _, err := range ValidateConfig(config) {
+		if strings.HasPrefix(err.Error(), "ranking_strategy:") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected ValidateConfig to reject the unknown ranking strategy")
+	}
+}
+
+func TestUniqueDirectories(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	testutils.Check(t, hctx.SetConfig(conf))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, e := range []struct {
+		command string
+		cwd     string
+	}{
+		{"make", "/src/"},
+		{"ls", "/tmp/"},
+		{"git pull", "/src/"},
+		{"vim notes.txt", "/home/"},
+		{"rm foo", "/tmp/"},
+		{"make test", "/src/"},
+	} {
+		entry := testutils.MakeFakeHistoryEntry(e.command)
+		entry.CurrentWorkingDirectory = e.cwd
+		db.Create(entry)
+	}
+	getCommands := func(m model) []string {
+		commands := make([]string, 0)
+		for _, entry := range m.entries {
+			commands = append(commands, entry.Command)
+		}
+		return commands
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	var m tea.Model = initialModel(ctx, tbl, rows, entries, "", numEntries, TuiOptions{})
+
+	// Alt+U collapses the results to the most recent entry in each directory
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'u'}, Alt: true})
+	if commands := getCommands(m.(model)); !reflect.DeepEqual(commands, []string{"make test", "rm foo", "vim notes.txt"}) {
+		t.Fatalf("unexpected results with one row per directory: %#v", commands)
+	}
+	if footer := m.(model).footerView(); footer != "Showing 1-3 of 3 (cursor 1/3) (one row per directory, 3 distinct directories, press Alt+U to show all)\n" {
+		t.Fatalf("unexpected footer: %#v", footer)
+	}
+
+	// This continues across pages
+	_, entries, _, err = getPageOfRows(ctx, []string{"Command"}, "", 2, SearchOptions{UniqueDirectories: true, Offset: 2}, m.(model).entries[:2])
+	testutils.Check(t, err)
+	if len(entries) != 1 || entries[0].Command != "vim notes.txt" {
+		t.Fatalf("unexpected entries on the next page: %#v", entries)
+	}
+
+	// And pressing it again shows everything
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'u'}, Alt: true})
+	if commands := getCommands(m.(model)); len(commands) != 6 {
+		t.Fatalf("unexpected results after showing every entry: %#v", commands)
+	}
+	if footer := m.(model).footerView(); strings.Contains(footer, "one row per directory") {
+		t.Fatalf("unexpected footer: %#v", footer)
+	}
+}
+
+func TestContextView(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	conf, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	conf.DisplayedColumns = []string{"Command"}
+	conf.ContextLines = 2
+	testutils.Check(t, hctx.SetConfig(conf))
+	defer func(original func() (int, int, error)) { getTerminalSize = original }(getTerminalSize)
+	getTerminalSize = func() (int, int, error) { return 100, 40, nil }
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	for _, e := range []struct {
+		command   string
+		sessionId string
+	}{
+		{"cd /srv", "s1"},
+		{"tail -f app.log", "s1"},
+		{"echo elsewhere", "s2"},
+		{"systemctl restart app", "s1"},
+		{"curl localhost", "s1"},
+		{"git log", "s1"},
+		{"exit", "s1"},
+	} {
+		entry := testutils.MakeFakeHistoryEntry(e.command)
+		entry.SessionId = e.sessionId
+		db.Create(entry)
+	}
+	getCommands := func(entries []*data.HistoryEntry) []string {
+		commands := make([]string, 0)
+		for _, entry := range entries {
+			commands = append(commands, entry.Command)
+		}
+		return commands
+	}
+	rows, entries, numEntries, err := getRows(ctx, []string{"Command"}, "", PAGE_SIZE, SearchOptions{})
+	testutils.Check(t, err)
+	tbl, _, err := makeTable(ctx, rows, new([]table.Row), SearchOptions{})
+	testutils.Check(t, err)
+	updated := initialModel(ctx, tbl, rows, entries, "", numEntries, TuiOptions{})
+	updated.table.SetCursor(3)
+	if entry := updated.selectedEntry(); entry.Command != "systemctl restart app" {
+		t.Fatalf("unexpected selected entry: %#v", entry.Command)
+	}
+
+	// Alt+A shows the commands from the same session around the selected entry, oldest first
+	var m tea.Model = updated
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'a'}, Alt: true})
+	if commands := getCommands(m.(model).contextEntries); !reflect.DeepEqual(commands, []string{"cd /srv", "tail -f app.log", "systemctl restart app", "curl localhost", "git log"}) {
+		t.Fatalf("unexpected context entries: %#v", commands)
+	}
+	view := m.(model).View()
+	if !strings.Contains(view, "in this session around the selected entry") || !strings.Contains(view, "> * ") || strings.Contains(view, "echo elsewhere") {
+		t.Fatalf("unexpected context view: %#v", view)
+	}
+
+	// Esc goes back to the results
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.(model).contextEntries != nil || m.(model).quitting {
+		t.Fatalf("expected the context view to be closed")
+	}
+
+	// And selecting an entry in the context view outputs its command
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'a'}, Alt: true})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	m, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd == nil || !m.(model).selected {
+		t.Fatalf("expected the entry to be selected")
+	}
+	defer func() { selectedRow = "" }()
+	m.View()
+	if selectedRow != "curl localhost" {
+		t.Fatalf("unexpected selected command: %#v", selectedRow)
+	}
+
+	// Multi-line commands are confirmed and flattened, the same as when they're selected in the table
+	conf.ConfirmMultiLineExec = true
+	multiLine := testutils.MakeFakeHistoryEntry("echo a\necho b")
+	updated.ctx = hctx.WithConfig(ctx, conf)
+	updated.contextEntries = []*data.HistoryEntry{&multiLine}
+	m, cmd = updated.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd != nil || m.(model).selected || !m.(model).isConfirmingSelection {
+		t.Fatalf("expected to be asked to confirm selecting a multi-line command")
+	}
+	m, cmd = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'y'}})
+	if cmd == nil || !m.(model).selected {
+		t.Fatalf("expected the entry to be selected")
+	}
+	m.View()
+	if selectedRow != "echo a echo b" {
+		t.Fatalf("unexpected selected command: %#v", selectedRow)
+	}
+
+	// Without a recorded session, the commands from the same host are shown instead
+	entry := *entries[3]
+	entry.SessionId = ""
+	contextEntries, index, err := ContextEntriesForDisplay(ctx, db, &entry, 1, SearchOptions{})
+	testutils.Check(t, err)
+	if commands := getCommands(contextEntries); index != 1 || !reflect.DeepEqual(commands, []string{"echo elsewhere", "systemctl restart app", "curl localhost"}) {
+		t.Fatalf("unexpected context entries without a session: %#v", commands)
+	}
+}
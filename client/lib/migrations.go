@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The number of entries that are migrated at a time. Progress is reported (and saved so that an interrupted
+// migration can be resumed) after each batch.
+const MIGRATION_BATCH_SIZE = 1000
+
+// A one-time migration that is applied to every existing entry in the local DB (e.g. to backfill a new column)
+type migration struct {
+	name        string
+	description string
+	// Whether the migration should be run for the given config
+	isEnabled func(config hctx.ClientConfig) bool
+	// Updates the given entry in the DB
+	apply func(ctx *context.Context, entry *data.HistoryEntry) error
+}
+
+var migrations = []migration{
+	{
+		name:        "normalized_paths",
+		description: "Computing normalized paths for existing entries",
+		isEnabled:   func(config hctx.ClientConfig) bool { return config.NormalizePaths },
+		apply: func(ctx *context.Context, entry *data.HistoryEntry) error {
+			cwd := entry.CurrentWorkingDirectory
+			if strings.HasPrefix(cwd, "~") {
+				cwd = strings.Replace(cwd, "~", entry.HomeDirectory, 1)
+			}
+			normalizedPaths := getNormalizedPaths(entry.Command, cwd, entry.HomeDirectory)
+			return hctx.GetDb(ctx).Model(&data.HistoryEntry{}).Where("device_id = ? AND end_time = ?", entry.DeviceId, entry.EndTime).Update("normalized_paths", normalizedPaths).Error
+		},
+	},
+}
+
+// Runs every enabled migration over the existing entries in the local DB, writing progress to the given writer.
+// Progress is saved after each batch, so if this is interrupted then re-running it will resume where it left off.
+func RunMigrations(ctx *context.Context, progress io.Writer) error {
+	for _, m := range migrations {
+		if !m.isEnabled(hctx.GetConf(ctx)) {
+			continue
+		}
+		err := runMigration(ctx, m, progress)
+		if err != nil {
+			return fmt.Errorf("failed to run migration %s: %v", m.name, err)
+		}
+	}
+	return nil
+}
+
+func runMigration(ctx *context.Context, m migration, progress io.Writer) error {
+	db := hctx.GetDb(ctx)
+	// Entries are migrated in order of their end time, so we resume from the last end time that was checkpointed.
+	// Entries with that exact end time are re-migrated, which is safe since migrations are idempotent.
+	checkpoint := hctx.GetConf(ctx).MigrationCheckpoints[m.name]
+	var total int64
+	result := db.Model(&data.HistoryEntry{}).Where("end_time >= ?", checkpoint).Count(&total)
+	if result.Error != nil {
+		return fmt.Errorf("DB query error: %v", result.Error)
+	}
+	if !checkpoint.IsZero() {
+		fmt.Fprintf(progress, "%s: resuming from %s\n", m.description, checkpoint.Format(time.RFC3339))
+	}
+	numMigrated := 0
+	for {
+		var batch []*data.HistoryEntry
+		result := db.Where("end_time >= ?", checkpoint).Order("end_time ASC").Offset(numMigrated).Limit(MIGRATION_BATCH_SIZE).Find(&batch)
+		if result.Error != nil {
+			return fmt.Errorf("DB query error: %v", result.Error)
+		}
+		for _, entry := range batch {
+			if err := m.apply(ctx, entry); err != nil {
+				return err
+			}
+		}
+		numMigrated += len(batch)
+		if len(batch) > 0 {
+			// Read the config from disk rather than from ctx so that we don't overwrite checkpoints saved by earlier batches
+			config, err := hctx.GetConfig()
+			if err != nil {
+				return err
+			}
+			if config.MigrationCheckpoints == nil {
+				config.MigrationCheckpoints = make(map[string]time.Time)
+			}
+			config.MigrationCheckpoints[m.name] = batch[len(batch)-1].EndTime
+			if err := hctx.SetConfig(config); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(progress, "%s: %d/%d entries (%d%%)\n", m.description, numMigrated, total, percent(int64(numMigrated), total))
+		if len(batch) < MIGRATION_BATCH_SIZE {
+			return nil
+		}
+	}
+}
+
+func percent(n, total int64) int64 {
+	if total == 0 {
+		return 100
+	}
+	return n * 100 / total
+}
@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/term"
+)
+
+// A multiple choice question asked during the guided setup on first install. The first option is the default.
+type onboardingQuestion struct {
+	prompt  string
+	options []string
+}
+
+// The shells that hishtory can be set up for
+var supportedShells = []string{"bash", "zsh", "fish"}
+
+// Returns the supported shells, with the current shell (based on $SHELL) first so that it is the default
+func getShellOptions() []string {
+	currentShell := filepath.Base(os.Getenv("SHELL"))
+	options := make([]string, 0, len(supportedShells))
+	if containsString(supportedShells, currentShell) {
+		options = append(options, currentShell)
+	}
+	for _, shell := range supportedShells {
+		if shell != currentShell {
+			options = append(options, shell)
+		}
+	}
+	return options
+}
+
+func getOnboardingQuestions() []onboardingQuestion {
+	return []onboardingQuestion{
+		{
+			prompt:  "Which shell do you want to set up hiSHtory for?",
+			options: getShellOptions(),
+		},
+		{
+			prompt:  "Do you want to sync your shell history between your computers? It is end-to-end encrypted. Note that syncing can't be enabled later on if you disable it now.",
+			options: []string{"Yes, sync my history", "No, keep my history on this computer only"},
+		},
+		{
+			prompt: "Which columns do you want to see when searching your history?",
+			options: []string{
+				"Hostname, CWD, Timestamp, Runtime, Exit Code, Command",
+				"Timestamp, Command",
+				"Hostname, User, CWD, Timestamp, Runtime, Exit Code, Command",
+			},
+		},
+		{
+			prompt:  "Which timezone do you want timestamps to be displayed in? UTC is useful if you use computers in multiple timezones.",
+			options: []string{"My local timezone", "UTC"},
+		},
+	}
+}
+
+// The choices made during the guided setup
+type SetupChoices struct {
+	// The shell whose rc file is configured
+	Shell            string
+	EnableSync       bool
+	DisplayedColumns []string
+	// The timezone that timestamps are displayed in, where empty means the local timezone
+	DisplayTimezone string
+}
+
+// Converts the index of the selected option for each of the given questions into the corresponding choices
+func getSetupChoices(questions []onboardingQuestion, answers []int) SetupChoices {
+	choices := SetupChoices{
+		Shell:      questions[0].options[answers[0]],
+		EnableSync: answers[1] == 0,
+	}
+	choices.DisplayedColumns = strings.Split(questions[2].options[answers[2]], ", ")
+	if answers[3] == 1 {
+		choices.DisplayTimezone = "UTC"
+	}
+	return choices
+}
+
+type onboardingModel struct {
+	// The questions to ask, in order
+	questions []onboardingQuestion
+	// The index of the question that is currently being asked
+	current int
+	// The index of the selected option for the current question
+	cursor int
+	// The index of the chosen option for each of the questions that were answered
+	answers []int
+	// Whether the user quit the guided setup before answering every question
+	quitting bool
+}
+
+func (m onboardingModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m onboardingModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	keyMsg, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return m, nil
+	}
+	switch keyMsg.String() {
+	case "esc", "ctrl+c":
+		m.quitting = true
+		return m, tea.Quit
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(m.questions[m.current].options)-1 {
+			m.cursor++
+		}
+	case "enter":
+		m.answers = append(m.answers, m.cursor)
+		m.current++
+		m.cursor = 0
+		if m.current == len(m.questions) {
+			return m, tea.Quit
+		}
+	}
+	return m, nil
+}
+
+func (m onboardingModel) View() string {
+	if m.quitting || m.current >= len(m.questions) {
+		return ""
+	}
+	question := m.questions[m.current]
+	selectedStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("229")).Background(lipgloss.Color("57"))
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Welcome to hiSHtory! (question %d of %d, press Esc to skip and use the defaults)\n\n", m.current+1, len(m.questions)))
+	sb.WriteString(lipgloss.NewStyle().Width(80).Render(question.prompt) + "\n\n")
+	for i, option := range question.options {
+		if i == m.cursor {
+			sb.WriteString(selectedStyle.Render("> "+option) + "\n")
+		} else {
+			sb.WriteString("  " + option + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// Whether the guided setup can be run, which requires an interactive terminal
+func canRunOnboarding() bool {
+	return os.Getenv("HISHTORY_TEST") == "" && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// Runs the guided setup and returns the choices that were made. If the user quits early, the defaults are returned.
+func RunOnboarding() (SetupChoices, error) {
+	questions := getOnboardingQuestions()
+	finalModel, err := tea.NewProgram(onboardingModel{questions: questions}).Run()
+	if err != nil {
+		return SetupChoices{}, fmt.Errorf("failed to run the guided setup: %v", err)
+	}
+	m := finalModel.(onboardingModel)
+	answers := m.answers
+	if m.quitting {
+		answers = make([]int, len(questions))
+	}
+	return getSetupChoices(questions, answers), nil
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Returns the entries that were recorded in the given shell session, oldest first. The session ID "current" refers to
+// the shell session that hishtory is being run from.
+func GetSessionEntries(ctx *context.Context, sessionId string) ([]*data.HistoryEntry, error) {
+	sessionId, err := resolveSessionId(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*data.HistoryEntry
+	result := hctx.GetDb(ctx).Where("session_id = ?", sessionId).Order("start_time ASC").Find(&entries)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no commands were recorded in the session %#v", sessionId)
+	}
+	return entries, nil
+}
+
+// Runs a replayed command and returns its exit code
+type ReplayRunner func(entry *data.HistoryEntry) (int, error)
+
+// Steps through the given entries in order, asking whether to run, skip, or stop before each of them and whether to
+// continue after any that fail. Prompts are read from in and written to out.
+func Replay(entries []*data.HistoryEntry, in io.Reader, out io.Writer, run ReplayRunner) error {
+	reader := bufio.NewReader(in)
+	prompt := func(message string) (string, error) {
+		fmt.Fprint(out, message)
+		resp, err := reader.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && resp != "") {
+			return "", fmt.Errorf("failed to read response: %v", err)
+		}
+		return strings.ToLower(strings.TrimSpace(resp)), nil
+	}
+	for i, entry := range entries {
+		fmt.Fprintf(out, "[%d/%d] %s\n", i+1, len(entries), entry.Command)
+		resp, err := prompt("Run this command? [Y]es/[s]kip/[q]uit: ")
+		for err == nil && resp != "" && resp != "y" && resp != "yes" && resp != "s" && resp != "q" {
+			resp, err = prompt("Please answer y, s, or q: ")
+		}
+		if err != nil {
+			return err
+		}
+		if resp == "q" {
+			return nil
+		}
+		if resp == "s" {
+			continue
+		}
+		exitCode, err := run(entry)
+		if err != nil {
+			return fmt.Errorf("failed to run %#v: %v", entry.Command, err)
+		}
+		if exitCode != 0 && i < len(entries)-1 {
+			resp, err := prompt(fmt.Sprintf("The command failed with exit code %d. [C]ontinue or [s]top? ", exitCode))
+			if err != nil {
+				return err
+			}
+			if resp == "s" {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Runs the command from the given entry via the user's shell in the directory it was originally run in (or the
+// current directory if that no longer exists)
+func RunReplayedCommand(entry *data.HistoryEntry) (int, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "sh"
+	}
+	cmd := exec.Command(shell, "-c", entry.Command)
+	cwd := expandHomeDirectory(entry.CurrentWorkingDirectory, entry.HomeDirectory)
+	if stat, err := os.Stat(cwd); err == nil && stat.IsDir() {
+		cmd.Dir = cwd
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
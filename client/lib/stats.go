@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/mattn/go-runewidth"
+)
+
+// The number of rows in each of the top programs and busiest directories sections of `hishtory stats`
+const NUM_STATS_ROWS = 10
+
+// The number of days that are shown in the commands per day chart of `hishtory stats`
+const NUM_STATS_DAYS = 14
+
+// The maximum width of the bars in the charts of `hishtory stats`
+const MAX_STATS_BAR_WIDTH = 40
+
+// The number of entries with a given label (e.g. a program or a directory)
+type StatCount struct {
+	Label string
+	Count int64
+}
+
+// A summary of the commands that matched a query
+type Stats struct {
+	NumEntries     int64
+	NumFailed      int64
+	TopPrograms    []StatCount
+	TopDirectories []StatCount
+	// The number of commands run on each of the NUM_STATS_DAYS days up to (and including) the day of the most recent
+	// command, oldest first. Labelled by the date in the YYYY-MM-DD format.
+	CommandsPerDay []StatCount
+}
+
+// Computes stats for the entries that match the given query (with the same filtering as SearchForDisplay), so that
+// e.g. `after:2023-01-01` shows the stats since then
+func GetStats(ctx *context.Context, query string) (*Stats, error) {
+	db := hctx.GetDb(ctx)
+	var stats Stats
+	// Each aggregate is run on a fresh query since gorm queries can't be reused after they're executed
+	tx, err := makeSearchQuery(ctx, db, query, SearchOptions{}, true)
+	if err != nil {
+		return nil, &SearchError{Query: query, Err: err}
+	}
+	if result := tx.Count(&stats.NumEntries); result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	tx, _ = makeSearchQuery(ctx, db, query, SearchOptions{}, true)
+	if result := tx.Where("exit_code != 0").Count(&stats.NumFailed); result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	tx, _ = makeSearchQuery(ctx, db, query, SearchOptions{}, true)
+	result := tx.Select("CASE WHEN instr(command, ' ') > 0 THEN substr(command, 1, instr(command, ' ') - 1) ELSE command END AS label, COUNT(*) AS count").
+		Group("label").
+		Order("count DESC, label").
+		Limit(NUM_STATS_ROWS).
+		Scan(&stats.TopPrograms)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	tx, _ = makeSearchQuery(ctx, db, query, SearchOptions{}, true)
+	result = tx.Select("current_working_directory AS label, COUNT(*) AS count").
+		Group("current_working_directory").
+		Order("count DESC, label").
+		Limit(NUM_STATS_ROWS).
+		Scan(&stats.TopDirectories)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	var days []StatCount
+	tx, _ = makeSearchQuery(ctx, db, query, SearchOptions{}, true)
+	result = tx.Select("date(start_time, 'localtime') AS label, COUNT(*) AS count").
+		Group("label").
+		Order("label DESC").
+		Limit(NUM_STATS_DAYS).
+		Scan(&days)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	stats.CommandsPerDay, err = fillInDays(days)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Returns the counts for each of the NUM_STATS_DAYS days up to the most recent of the given days, oldest first, with
+// zeros for the days that had no commands
+func fillInDays(days []StatCount) ([]StatCount, error) {
+	if len(days) == 0 {
+		return nil, nil
+	}
+	counts := make(map[string]int64)
+	var last time.Time
+	for _, day := range days {
+		t, err := time.Parse("2006-01-02", day.Label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the date %#v: %v", day.Label, err)
+		}
+		if t.After(last) {
+			last = t
+		}
+		counts[day.Label] = day.Count
+	}
+	filled := make([]StatCount, 0, NUM_STATS_DAYS)
+	for i := NUM_STATS_DAYS - 1; i >= 0; i-- {
+		label := last.AddDate(0, 0, -i).Format("2006-01-02")
+		filled = append(filled, StatCount{Label: label, Count: counts[label]})
+	}
+	return filled, nil
+}
+
+// Renders the given stats as a report with a bar chart for each section
+func FormatStats(ctx *context.Context, stats *Stats) string {
+	if stats.NumEntries == 0 {
+		return "No matching commands\n"
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Commands: %d (%d failed, %s)\n", stats.NumEntries, stats.NumFailed, formatPercent(stats.NumFailed, stats.NumEntries)))
+	barStyle := lipgloss.NewStyle().Foreground(lipgloss.Color(getTheme(ctx).Highlight))
+	sb.WriteString("\nTop programs:\n")
+	sb.WriteString(formatBarChart(stats.TopPrograms, stats.NumEntries, barStyle))
+	sb.WriteString("\nBusiest directories:\n")
+	sb.WriteString(formatBarChart(stats.TopDirectories, stats.NumEntries, barStyle))
+	sb.WriteString("\nCommands per day:\n")
+	sb.WriteString(formatBarChart(stats.CommandsPerDay, stats.NumEntries, barStyle))
+	return sb.String()
+}
+
+// Renders one line per count, with a bar that is sized relative to the largest count and the percentage of the total
+func formatBarChart(counts []StatCount, total int64, barStyle lipgloss.Style) string {
+	labelWidth := 0
+	var maxCount int64 = 0
+	for _, c := range counts {
+		labelWidth = max(labelWidth, runewidth.StringWidth(c.Label))
+		if c.Count > maxCount {
+			maxCount = c.Count
+		}
+	}
+	labelWidth = min(labelWidth, 40)
+	terminalWidth, _ := getTerminalSizeOrDefault()
+	// Leave room for the indentation, the label, the count, and the percentage
+	barWidth := max(min(MAX_STATS_BAR_WIDTH, terminalWidth-labelWidth-22), 1)
+	countWidth := len(fmt.Sprintf("%d", maxCount))
+	var sb strings.Builder
+	for _, c := range counts {
+		label := runewidth.FillRight(runewidth.Truncate(c.Label, labelWidth, "…"), labelWidth)
+		bar := ""
+		if maxCount > 0 {
+			bar = strings.Repeat("█", int(c.Count*int64(barWidth)/maxCount))
+		}
+		if bar == "" && c.Count > 0 {
+			// Always show something for non-zero counts so that they're distinguishable from zeros
+			bar = "▏"
+		}
+		padding := strings.Repeat(" ", barWidth-runewidth.StringWidth(bar))
+		sb.WriteString(fmt.Sprintf("  %s  %s%s  %*d  %6s\n", label, barStyle.Render(bar), padding, countWidth, c.Count, formatPercent(c.Count, total)))
+	}
+	return sb.String()
+}
+
+// Formats count as a percentage of total (e.g. 12.5%)
+func formatPercent(count, total int64) string {
+	if total == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(count)*100/float64(total))
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// Parses an auto-tag rule from the given tag and condition, where the condition is either cwd:<dir> or program:<program>
+func ParseAutoTagRule(tag, condition string) (hctx.AutoTagRule, error) {
+	if strings.TrimSpace(tag) == "" {
+		return hctx.AutoTagRule{}, fmt.Errorf("tags must not be empty")
+	}
+	if strings.ContainsAny(tag, " \t") {
+		return hctx.AutoTagRule{}, fmt.Errorf("tag %#v must not contain whitespace", tag)
+	}
+	if strings.HasPrefix(condition, "cwd:") && len(condition) > len("cwd:") {
+		return hctx.AutoTagRule{Tag: tag, Cwd: strings.TrimPrefix(condition, "cwd:")}, nil
+	}
+	if strings.HasPrefix(condition, "program:") && len(condition) > len("program:") {
+		return hctx.AutoTagRule{Tag: tag, Program: strings.TrimPrefix(condition, "program:")}, nil
+	}
+	return hctx.AutoTagRule{}, fmt.Errorf("unsupported auto-tag condition %#v (must be cwd:<dir> or program:<program>)", condition)
+}
+
+// Formats the given rule for display (e.g. "k8s: program:kubectl")
+func FormatAutoTagRule(rule hctx.AutoTagRule) string {
+	return rule.Tag + ": " + autoTagCondition(rule)
+}
+
+// Returns the condition of the given rule, in the same format as the atom that it is equivalent to
+func autoTagCondition(rule hctx.AutoTagRule) string {
+	if rule.Cwd != "" {
+		return "cwd:" + rule.Cwd
+	}
+	return "program:" + rule.Program
+}
+
+// Returns the tags that apply to the given entry based on the configured auto-tag rules
+func getAutoTags(ctx *context.Context, entry data.HistoryEntry) []string {
+	tags := make([]string, 0)
+	for _, rule := range hctx.GetConf(ctx).AutoTags {
+		if containsString(tags, rule.Tag) {
+			continue
+		}
+		if matchesAutoTagRule(ctx, rule, entry) {
+			tags = append(tags, rule.Tag)
+		}
+	}
+	return tags
+}
+
+// Whether the given rule matches the entry. This must be kept in sync with the SQL generated by parseTagToken.
+func matchesAutoTagRule(ctx *context.Context, rule hctx.AutoTagRule, entry data.HistoryEntry) bool {
+	if rule.Cwd != "" {
+		recordedDir, expandedDir, err := resolveRelativeDirectory(ctx, rule.Cwd)
+		if err != nil {
+			// Searching for the tag reports this error, so the tag just isn't shown here
+			return false
+		}
+		return matchesCwdAtom(hctx.GetConf(ctx).CwdMatchMode, strings.TrimSuffix(recordedDir, "/"), strings.TrimSuffix(expandedDir, "/"), entry)
+	}
+	return entry.Command == rule.Program || strings.HasPrefix(entry.Command, rule.Program+" ")
+}
+
+// Returns the SQL condition (and its arguments) for the tag: atom. Tags are applied lazily at query time, so this
+// matches every entry that matches any of the auto-tag rules for the given tag.
+func parseTagToken(ctx *context.Context, tag string) (string, []interface{}, error) {
+	clauses := make([]string, 0)
+	args := make([]interface{}, 0)
+	for _, rule := range hctx.GetConf(ctx).AutoTags {
+		if rule.Tag != tag {
+			continue
+		}
+		query, v1, v2, err := parseAtomizedToken(ctx, autoTagCondition(rule))
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, query)
+		args = append(args, []interface{}{v1, v2}[:strings.Count(query, "?")]...)
+	}
+	if len(clauses) == 0 {
+		// No rules for this tag, so nothing is tagged with it
+		return "(1 = 0)", args, nil
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args, nil
+}
@@ -2,34 +2,213 @@ package lib
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "embed" // for embedding config.sh
 
+	"github.com/atotto/clipboard"
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/table"
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/ddworken/hishtory/client/data"
 	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/mattn/go-runewidth"
 	"github.com/muesli/termenv"
 	"golang.org/x/term"
 )
 
 const TABLE_HEIGHT = 20
-const PADDED_NUM_ENTRIES = TABLE_HEIGHT * 5
+
+// The minimum number of rows that the table shows, even if the terminal is too short to fit everything else
+const MIN_TABLE_HEIGHT = 3
+
+// The default number of entries that are loaded at a time (see tui_search_limit). The next page is loaded once the
+// cursor is within PAGE_LOAD_THRESHOLD rows of the last loaded entry.
+const PAGE_SIZE = TABLE_HEIGHT * 2
+const PAGE_LOAD_THRESHOLD = TABLE_HEIGHT / 2
+
+// The number of lines that the table takes up other than its rows, i.e. the header, the line below it, and the top and
+// bottom of the border around the table
+const TABLE_CHROME_HEIGHT = 4
+
+const WRAPPED_COMMAND_HEIGHT = 5
+const PREVIEW_HEIGHT = 10
+const LOAD_MORE_MULTIPLIER = 10
+
+// The default maximum number of rows that the TUI loads into memory at once (see tui_max_rows)
+const DEFAULT_TUI_MAX_ROWS = 10000
+
+// The default terminal width below which the TUI only displays the Command column (see compact_mode_width)
+const DEFAULT_COMPACT_MODE_WIDTH = 60
+
+// The maximum number of recent directories that Alt+L cycles through
+const NUM_RECENT_DIRECTORIES_TO_CYCLE = 10
+
+// The default number of commands before and after the selected entry that are shown in the context view (see context_lines)
+const DEFAULT_CONTEXT_LINES = 5
+
+// How often the results are refreshed in follow mode (see followTickMsg)
+const FOLLOW_INTERVAL = time.Second
+
+// The default amount of time that the TUI waits after the query was last edited before running it (see search_debounce_ms)
+const DEFAULT_SEARCH_DEBOUNCE = 150 * time.Millisecond
+
+// Returns how long the TUI waits after the query was last edited before running it, or zero if it runs immediately
+func getSearchDebounce(ctx *context.Context) time.Duration {
+	debounceMs := hctx.GetConf(ctx).SearchDebounceMs
+	if debounceMs == 0 {
+		return DEFAULT_SEARCH_DEBOUNCE
+	}
+	return time.Duration(max(debounceMs, 0)) * time.Millisecond
+}
+
+// Returns the number of rows that the TUI loads at a time
+func getTuiSearchLimit(ctx *context.Context) int {
+	if limit := hctx.GetConf(ctx).TuiSearchLimit; limit > 0 {
+		return limit
+	}
+	return PAGE_SIZE
+}
+
+// Returns the maximum number of rows that the TUI loads into memory at once
+func getTuiMaxRows(ctx *context.Context) int {
+	if maxRows := hctx.GetConf(ctx).TuiMaxRows; maxRows > 0 {
+		return maxRows
+	}
+	return DEFAULT_TUI_MAX_ROWS
+}
+
+// Returns whether the terminal is too narrow to usefully display multiple columns, in which case only the Command
+// column is displayed
+func isCompactMode(ctx *context.Context) bool {
+	compactModeWidth := hctx.GetConf(ctx).CompactModeWidth
+	if compactModeWidth == 0 {
+		compactModeWidth = DEFAULT_COMPACT_MODE_WIDTH
+	}
+	terminalWidth, _ := getTerminalSizeOrDefault()
+	return terminalWidth < compactModeWidth
+}
 
 var selectedRow string = ""
 
-var baseStyle = lipgloss.NewStyle().
-	BorderStyle(lipgloss.NormalBorder()).
-	BorderForeground(lipgloss.Color("240"))
+// The built-in themes that can be selected via `hishtory config-set theme`
+var Themes = map[string]hctx.Theme{
+	"default":    {SelectedForeground: "229", SelectedBackground: "57", Border: "240", Spinner: "205", Highlight: "212"},
+	"solarized":  {SelectedForeground: "230", SelectedBackground: "33", Border: "245", Spinner: "125", Highlight: "166"},
+	"monochrome": {SelectedForeground: "0", SelectedBackground: "7", Border: "7", Spinner: "7", Highlight: "15"},
+}
+
+// The names of the built-in themes, in the order that they're listed in error messages
+var ThemeNames = []string{"default", "solarized", "monochrome"}
+
+var themeColorRegex = regexp.MustCompile(`^(\d{1,3}|#[0-9a-fA-F]{6})$`)
+
+// Returns whether the given color is valid for a theme, i.e. an ANSI color number or a hex color
+func IsValidThemeColor(color string) bool {
+	if !themeColorRegex.MatchString(color) {
+		return false
+	}
+	if n, err := strconv.Atoi(color); err == nil && n > 255 {
+		return false
+	}
+	return true
+}
+
+// Returns the theme to use for the TUI, with any colors from the user's config overriding the built-in theme
+func getTheme(ctx *context.Context) hctx.Theme {
+	configured := hctx.GetConf(ctx).Theme
+	theme, ok := Themes[configured.Name]
+	if !ok {
+		theme = Themes["default"]
+	}
+	if configured.SelectedForeground != "" {
+		theme.SelectedForeground = configured.SelectedForeground
+	}
+	if configured.SelectedBackground != "" {
+		theme.SelectedBackground = configured.SelectedBackground
+	}
+	if configured.Border != "" {
+		theme.Border = configured.Border
+	}
+	if configured.Spinner != "" {
+		theme.Spinner = configured.Spinner
+	}
+	if configured.Highlight != "" {
+		theme.Highlight = configured.Highlight
+	}
+	return theme
+}
+
+// The style for the borders around the table and the preview pane
+func getBaseStyle(ctx *context.Context) lipgloss.Style {
+	return lipgloss.NewStyle().
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color(getTheme(ctx).Border))
+}
+
+// The built-in spinners that can be picked via the spinner_style config option
+var spinners = map[string]spinner.Spinner{
+	"dot":       spinner.Dot,
+	"line":      spinner.Line,
+	"minidot":   spinner.MiniDot,
+	"jump":      spinner.Jump,
+	"pulse":     spinner.Pulse,
+	"points":    spinner.Points,
+	"globe":     spinner.Globe,
+	"moon":      spinner.Moon,
+	"monkey":    spinner.Monkey,
+	"meter":     spinner.Meter,
+	"hamburger": spinner.Hamburger,
+}
+
+// The supported values for the spinner_style config option. The empty string is treated as "dot". In addition to the
+// built-in spinners, "none" shows the loading message without a spinner and "hidden" shows nothing while loading.
+var SpinnerStyles = []string{"dot", "line", "minidot", "jump", "pulse", "points", "globe", "moon", "monkey", "meter", "hamburger", "none", "hidden"}
+
+const DEFAULT_LOADING_MESSAGE = "Loading hishtory entries from other devices..."
 
+// Whether the configured spinner_style is animated, as opposed to being disabled via "none" or "hidden"
+func isSpinnerAnimated(ctx *context.Context) bool {
+	style := hctx.GetConf(ctx).SpinnerStyle
+	return style != "none" && style != "hidden"
+}
+
+// An unrecoverable error, which ends the TUI
 type errMsg error
 
+// A recoverable error from a background operation, which is displayed as a warning until it is dismissed
+type backgroundErrMsg struct {
+	err error
+}
+
+// Converts an error from a background operation into the message that the TUI should handle it with, so that
+// recoverable errors (e.g. being offline) are displayed as warnings rather than ending the TUI.
+func errorToMsg(ctx *context.Context, err error) tea.Msg {
+	if IsOfflineError(err) {
+		return offlineMsg{neverSynced: HasNeverSynced(ctx)}
+	}
+	if IsAuthError(err) {
+		return authErrorMsg{}
+	}
+	if IsUnrecoverableError(err) {
+		return errMsg(err)
+	}
+	return backgroundErrMsg{err: err}
+}
+
 type model struct {
 	// context
 	ctx *context.Context
@@ -44,202 +223,2096 @@ type model struct {
 
 	// The table used for displaying search results.
 	table table.Model
+	// The columns of the table (see makeTable). Used to find the Command column when highlighting matches.
+	columns []table.Column
+	// The rows that are currently in the table, including any empty padding rows.
+	rows []table.Row
+	// The entries for each of the non-empty rows in the table.
+	entries []*data.HistoryEntry
 	// The number of entries in the table.
 	numEntries int
+	// The maximum number of entries to load for the current query. Increased when the next page is loaded or when the
+	// user asks to load more.
+	numEntriesToLoad int
+	// Whether the next page of entries is being loaded in the background (see maybeLoadNextPage)
+	isLoadingPage bool
+	// The total number of entries that match the current query, which may be more than the number that were loaded.
+	totalMatches int64
+	// The number of distinct directories that the current query matches, if only one entry per directory is displayed
+	// (see SearchOptions.UniqueDirectories)
+	numDirectories int
 	// Whether the user has hit enter to select an entry and the TUI is thus about to quit.
 	selected bool
+	// Whether the entry was selected via Control+O, in which case a command to cd into its directory is output instead
+	selectedCd bool
+	// Whether the entry was selected after editing it via Control+E, in which case the edited command is output instead
+	selectedEdit bool
+
+	// The search box for the query
+	queryInput textinput.Model
+	// The query to run. Reset to nil after it was run.
+	runQuery *string
+	// The previous query that was run.
+	lastQuery string
+	// Whether the query was edited but hasn't been run yet, since typing hasn't paused (see search_debounce_ms)
+	isQueryPending bool
+	// Identifies the latest edit to the query, so that the query only runs once typing pauses (see debouncedQueryMsg)
+	debounceId int
+	// Options for how the query is run (e.g. whether results are in reverse order).
+	searchOptions SearchOptions
+
+	// Unrecoverable error.
+	err error
+	// An error while searching. Recoverable and displayed as a warning message.
+	searchErr error
+	// Whether the device is offline. If so, a warning will be displayed.
+	isOffline bool
+	// Whether the device is offline and has never synced with the backend, in which case the warning explains how
+	// to fix it rather than implying that this is temporary
+	neverSynced bool
+	// Whether the backend rejected this device's credentials. If so, a warning will be displayed.
+	isUnauthorized bool
+	// Recoverable errors from background operations (e.g. retrieving entries from other devices), which are displayed
+	// as warnings until they're dismissed via Control+L
+	backgroundErrors []error
+
+	// A banner from the backend to be displayed. Generally an empty string.
+	banner string
+	// Whether the offline warning and the banner should be hidden.
+	quiet bool
+	// Whether the debug overlay (with info on search latency and the terminal size) should be displayed.
+	debug bool
+	// Whether enter was pressed with no results and the typed query should be output as the command to run.
+	useTypedQuery bool
+	// Whether focus mode is enabled, in which case everything other than the query and the result rows is hidden.
+	focus bool
+	// How long the last search took and how many entries it returned. Displayed in the debug overlay.
+	lastSearchDuration   time.Duration
+	lastSearchNumEntries int
+	// Whether a pane below the table should show the full command for the selected entry, flattened onto one line and
+	// wrapped to the width of the terminal. The rows in the table are still truncated.
+	wrapCommand bool
+	// Whether the unmodified command for the selected entry (including any newlines) should be displayed in a preview
+	// pane below the table.
+	showPreview bool
+
+	// Whether the user is being asked to confirm selecting a multi-line command (see ConfirmMultiLineExec)
+	isConfirmingSelection bool
+	// The index of the first row that is visible in the table (see getTableOffset)
+	tableOffset int
+	// A transient message shown in the footer (e.g. after copying a command), and its ID (see clearFooterMessageMsg)
+	footerMessage   string
+	footerMessageId int
+
+	// Whether the user is being asked to confirm deleting the selected entry (or the marked entries, if there are any)
+	isConfirmingDelete bool
+	// The most recently deleted entries, which can be restored via Control+Z. Nil if there is nothing to undo.
+	lastDeleted []*data.HistoryEntry
+	// Whether the deletion request for lastDeleted was sent to the backend (see UNDO_WINDOW)
+	lastDeletionSent bool
+	// The ID of the most recent deletion, so that the deletion request isn't sent for a deletion that was undone
+	deletionId int
+	// The entries that were marked via tab for bulk actions, keyed by getEntryKey so that they stay marked when the
+	// query changes
+	markedEntries map[string]*data.HistoryEntry
+
+	// The results of searching for the empty string, which are used to size the columns. Nil until the table is first
+	// made, and reset when new entries are downloaded.
+	bigQueryResults []table.Row
+
+	// Whether the TUI is in vim-style normal mode (see EnableVimKeybindings), where keys navigate the results rather than
+	// being typed into the query
+	vimNormalMode bool
+
+	// The distinct directories in the current results that the user is picking from. Nil if the directory picker isn't open.
+	directories []DirectoryCount
+	// The index of the selected directory in the directory picker
+	directoryCursor int
+
+	// The entries that were run around the selected entry, oldest first. Nil if the context view isn't open.
+	contextEntries []*data.HistoryEntry
+	// The index of the entry that the context view was opened for
+	contextIndex int
+	// The index of the selected entry in the context view
+	contextCursor int
+	// The directories that commands were most recently run in, which Alt+L cycles through. Nil until Alt+L is first
+	// pressed.
+	recentDirectories []string
+	// The index of the recent directory that the query is currently filtered to, or -1 if it isn't filtered to one
+	recentDirectoryIndex int
+
+	// All of the columns that can be displayed, which the user is picking from. Nil if the column picker isn't open.
+	columnPicker []string
+	// The index of the selected column in the column picker
+	columnPickerCursor int
+	// The columns that are checked in the column picker, in the order that they'll be displayed
+	pickedColumns []string
+
+	// Whether follow mode is enabled, in which case the results are periodically refreshed so that newly recorded
+	// commands are shown (like `tail -f`)
+	follow bool
+	// The ID of the current chain of follow ticks, so that ticks from before follow mode was last toggled are ignored
+	followId int
+	// When the last key was pressed. Follow mode doesn't refresh the results while the user is typing.
+	lastKeyPress time.Time
+
+	// Whether the user is currently being prompted for a path to export the displayed results to.
+	isExporting bool
+	// The input box for the export path
+	exportInput textinput.Model
+	// The result of the last export, displayed as a status message.
+	exportStatus string
+
+	// Whether the user is editing the selected command before selecting it. The stored entry is never modified.
+	isEditing bool
+	// The input box for the edited command
+	editInput textinput.Model
+}
+
+type doneDownloadingMsg struct{}
+type manPageClosedMsg struct {
+	err error
+}
+type clearFooterMessageMsg struct {
+	// The ID of the footer message to clear, so that a newer message isn't cleared early
+	id int
+}
+type pageLoadedMsg struct {
+	// The query, options, and offset that the page was loaded for, so that pages for an outdated query are ignored
+	query         string
+	searchOptions SearchOptions
+	// The rows and entries in the page, and the number of entries that were found (see getRows)
+	rows       []table.Row
+	entries    []*data.HistoryEntry
+	numEntries int
+	// The number of entries that were requested
+	pageSize int
+	err      error
+}
+type sendDeletionMsg struct {
+	// The ID of the deletion to send the deletion request for (see model.deletionId)
+	id int
+}
+type debouncedQueryMsg struct {
+	id int
+}
+type followTickMsg struct {
+	// The ID of the follow mode chain that this tick is for (see model.followId)
+	id int
+}
+type offlineMsg struct {
+	// Whether this device has never been able to sync, rather than just being temporarily offline
+	neverSynced bool
+}
+type authErrorMsg struct{}
+type bannerMsg struct {
+	banner string
+}
+
+// Options for how the TUI is displayed
+type TuiOptions struct {
+	// Whether to hide non-critical warnings
+	Quiet bool
+	// Whether to display the debug overlay
+	Debug bool
+	// Whether to include entries that were marked as sensitive
+	ShowSensitive bool
+	// Overrides the number of rows that are loaded at a time (see tui_search_limit), if non-zero
+	SearchLimit int
+}
+
+func initialModel(ctx *context.Context, t table.Model, rows []table.Row, entries []*data.HistoryEntry, initialQuery string, numEntries int, opts TuiOptions) model {
+	s := spinner.New()
+	s.Spinner = spinner.Dot
+	if configured, ok := spinners[hctx.GetConf(ctx).SpinnerStyle]; ok {
+		s.Spinner = configured
+	}
+	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color(getTheme(ctx).Spinner))
+	queryInput := textinput.New()
+	queryInput.Placeholder = "ls"
+	vimNormalMode := hctx.GetConf(ctx).EnableVimKeybindings
+	if !vimNormalMode {
+		queryInput.Focus()
+	}
+	// Queries that are longer than the width scroll horizontally to keep the cursor visible
+	queryInput.CharLimit = hctx.GetConf(ctx).QueryCharLimit
+	queryInput.Width = 50
+	if initialQuery != "" {
+		queryInput.SetValue(initialQuery)
+	}
+	exportInput := textinput.New()
+	exportInput.Placeholder = "~/hishtory-export.json"
+	exportInput.Width = 50
+	// Commands may be long, so there is no limit and they scroll horizontally
+	editInput := textinput.New()
+	editInput.CharLimit = 0
+	t.SetRows(markRows(rows, entries, nil, hctx.GetConf(ctx).PinnedCommands))
+	var backgroundErrors []error
+	if err := validateDisplayTimezone(hctx.GetConf(ctx)); err != nil {
+		// Reported once here since timestamps are rendered all the time
+		backgroundErrors = append(backgroundErrors, fmt.Errorf("timestamps are displayed in the local timezone since %v", err))
+	}
+	return model{ctx: ctx, backgroundErrors: backgroundErrors, spinner: s, isLoading: true, table: t, rows: rows, entries: entries, searchOptions: SearchOptions{ShowSensitive: opts.ShowSensitive, DedupMode: getDedupMode(hctx.GetConf(ctx), SearchOptions{})}, exportInput: exportInput, editInput: editInput, runQuery: &initialQuery, queryInput: queryInput, numEntries: numEntries, numEntriesToLoad: getTuiSearchLimit(ctx), quiet: opts.Quiet, debug: opts.Debug, vimNormalMode: vimNormalMode}
+}
+
+func (m model) Init() tea.Cmd {
+	if !isSpinnerAnimated(m.ctx) {
+		return nil
+	}
+	return m.spinner.Tick
+}
+
+// Runs the query (if it changed, or if updateTable is set) and updates the table with the results. If updateTable is set,
+// the table itself is also rebuilt (e.g. to resize the columns). If maintainCursor is set, the cursor stays at the same
+// position. Otherwise, it stays on the selected entry if that is still in the results (e.g. when the query was refined
+// after scrolling down to it), or is reset to the top.
+func runQueryAndUpdateTable(m model, updateTable, maintainCursor bool) model {
+	if (m.runQuery != nil && *m.runQuery != m.lastQuery) || updateTable {
+		if m.runQuery == nil {
+			m.runQuery = &m.lastQuery
+		}
+		cursor := m.table.Cursor()
+		previouslySelected := m.selectedEntry()
+		start := time.Now()
+		rows, entries, numEntries, err := getRows(m.ctx, getTableColumns(m.ctx), *m.runQuery, m.numEntriesToLoad, m.searchOptions)
+		m.lastSearchDuration = time.Since(start)
+		m.lastSearchNumEntries = numEntries
+		if err != nil {
+			m.searchErr = err
+			return m
+		} else {
+			m.searchErr = nil
+		}
+		m.numEntries = numEntries
+		m = updateTotalMatches(m, *m.runQuery)
+		if updateTable {
+			t, columns, err := makeTable(m.ctx, rows, &m.bigQueryResults, m.searchOptions)
+			if err != nil {
+				m.err = err
+				return m
+			}
+			m.columns = columns
+			// Keep the height that the table was fitted to (see fitTableHeight)
+			t.SetHeight(m.table.Height())
+			m.table = t
+		}
+		m.rows = rows
+		m.entries = entries
+		m.table.SetRows(markRows(rows, entries, m.markedEntries, hctx.GetConf(m.ctx).PinnedCommands))
+		if maintainCursor {
+			m.table.SetCursor(cursor)
+		} else {
+			// Unlike SetCursor(0), this also scrolls back to the top of the table
+			m.table.GotoTop()
+			m.tableOffset = 0
+			if cursor > 0 && previouslySelected != nil {
+				// Scroll down to the previously selected entry, if it is still there
+				if i := findEntry(entries, getEntryKey(previouslySelected)); i > 0 {
+					m.table.MoveDown(i)
+				}
+			}
+		}
+		m.lastQuery = *m.runQuery
+		m.runQuery = nil
+	}
+	if m.table.Cursor() >= m.numEntries {
+		// Ensure that we can't scroll past the end of the table
+		m.table.SetCursor(m.numEntries - 1)
+	}
+	return m
+}
+
+// How long deletions in the TUI are only applied locally before the deletion request is sent to the backend, so that
+// they can be undone (via Control+Z) without affecting other devices
+const UNDO_WINDOW = 10 * time.Second
+
+// Deletes the marked entries (or the selected entry if none are marked) and refreshes the table, keeping the cursor at
+// the same position. The entries are only deleted locally at first, and are deleted on other devices once the undo
+// window is over (see sendPendingDeletion).
+func deleteSelectedEntry(m model) (model, tea.Cmd) {
+	entries := m.getMarkedEntries()
+	if len(entries) == 0 {
+		entry := m.selectedEntry()
+		if entry == nil {
+			return m, nil
+		}
+		entries = []*data.HistoryEntry{entry}
+	}
+	// Only the most recent deletion can be undone, so any earlier one is sent right away
+	m = sendPendingDeletion(m)
+	err := deleteEntriesLocally(m.ctx, entries)
+	if err != nil {
+		m.searchErr = fmt.Errorf("failed to delete the selected entries: %v", err)
+		return m, nil
+	}
+	m.lastDeleted = entries
+	m.lastDeletionSent = false
+	m.deletionId++
+	id := m.deletionId
+	m.markedEntries = nil
+	m = runQueryAndUpdateTable(m, true, true)
+	return m, tea.Tick(UNDO_WINDOW, func(time.Time) tea.Msg {
+		return sendDeletionMsg{id: id}
+	})
+}
+
+// Sends the deletion request for the most recently deleted entries to the backend, if it wasn't already sent
+func sendPendingDeletion(m model) model {
+	if m.lastDeleted == nil || m.lastDeletionSent {
+		return m
+	}
+	m.lastDeletionSent = true
+	err := deleteOnRemoteInstances(m.ctx, m.lastDeleted)
+	if IsOfflineError(err) {
+		// The entries were still deleted locally
+		m.isOffline = true
+		m.searchErr = fmt.Errorf("the selected entries were deleted on this device, but couldn't be deleted on your other devices since the backend couldn't be reached")
+	} else if err != nil {
+		m.searchErr = fmt.Errorf("failed to delete the selected entries on your other devices: %v", err)
+	}
+	return m
+}
+
+// Restores the most recently deleted entries. If the deletion request wasn't sent yet, they're just re-inserted locally.
+// Otherwise, they're re-created on all devices (see RecreateDeletedEntries).
+func undoDeletion(m model) model {
+	if m.lastDeleted == nil {
+		m.searchErr = fmt.Errorf("there is no deletion to undo")
+		return m
+	}
+	if m.lastDeletionSent {
+		if recreated, err := RecreateDeletedEntries(m.ctx, m.lastDeleted); err != nil {
+			// Keep the undo available so that it can be retried, without leaving behind any entries that were only
+			// re-created on this device since the retry would re-create them again
+			if recreated != nil {
+				if deleteErr := deleteEntriesLocally(m.ctx, recreated); deleteErr != nil {
+					err = deleteErr
+				}
+			}
+			m.searchErr = fmt.Errorf("failed to undo the deletion: %v", err)
+			return m
+		}
+	} else if err := restoreEntriesLocally(m.ctx, m.lastDeleted); err != nil {
+		m.searchErr = fmt.Errorf("failed to undo the deletion: %v", err)
+		return m
+	}
+	m.lastDeleted = nil
+	// Cancel sending the deletion request
+	m.deletionId++
+	return runQueryAndUpdateTable(m, true, true)
+}
+
+// The default key for copying the selected command to the clipboard
+const DEFAULT_COPY_KEY = "ctrl+y"
+
+// Returns the key that copies the selected command to the clipboard
+func getCopyKey(ctx *context.Context) string {
+	if key := hctx.GetConf(ctx).CopyKey; key != "" {
+		return key
+	}
+	return DEFAULT_COPY_KEY
+}
+
+// Copies the given text to the system clipboard. A variable so that it can be replaced in tests.
+var writeToClipboard = clipboard.WriteAll
+
+// Copies the selected command to the clipboard and briefly shows whether that worked in the footer
+func copySelectedCommand(m model) (model, tea.Cmd) {
+	command, ok := m.selectedCommand()
+	if !ok {
+		return m, nil
+	}
+	displayFor := time.Second
+	m.footerMessage = "Copied!"
+	if err := writeToClipboard(command); err != nil {
+		// E.g. on headless machines, where there is no clipboard
+		displayFor = 3 * time.Second
+		m.footerMessage = fmt.Sprintf("Warning: Failed to copy to the clipboard: %v", err)
+	}
+	m.footerMessageId++
+	id := m.footerMessageId
+	return m, tea.Tick(displayFor, func(time.Time) tea.Msg {
+		return clearFooterMessageMsg{id: id}
+	})
+}
+
+// Returns a key that uniquely identifies the given entry, the same way that entries are identified when deleting them
+func getEntryKey(entry *data.HistoryEntry) string {
+	return entry.DeviceId + "/" + entry.EndTime.Format(time.RFC3339Nano)
+}
+
+// Returns the index of the entry with the given key (see getEntryKey), or -1 if it isn't in the entries
+func findEntry(entries []*data.HistoryEntry, key string) int {
+	for i, entry := range entries {
+		if getEntryKey(entry) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Marks or unmarks the selected entry for bulk actions, and moves the cursor to the next entry
+func toggleMarkedEntry(m model) model {
+	entry := m.selectedEntry()
+	if entry == nil {
+		return m
+	}
+	key := getEntryKey(entry)
+	// Copy the map, since the model is passed around by value
+	marked := make(map[string]*data.HistoryEntry)
+	for k, v := range m.markedEntries {
+		marked[k] = v
+	}
+	if _, ok := marked[key]; ok {
+		delete(marked, key)
+	} else {
+		marked[key] = entry
+	}
+	m.markedEntries = marked
+	m.table.SetRows(markRows(m.rows, m.entries, m.markedEntries, hctx.GetConf(m.ctx).PinnedCommands))
+	if m.table.Cursor() < len(m.entries)-1 {
+		m.table.MoveDown(1)
+	}
+	return m
+}
+
+// Returns the marked entries in the order that they were run
+func (m model) getMarkedEntries() []*data.HistoryEntry {
+	entries := make([]*data.HistoryEntry, 0, len(m.markedEntries))
+	for _, entry := range m.markedEntries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].StartTime.Before(entries[j].StartTime)
+	})
+	return entries
+}
+
+// Returns a copy of the given rows where the rows for marked entries start with a * and the rows for pinned commands
+// start with a ★
+func markRows(rows []table.Row, entries []*data.HistoryEntry, marked map[string]*data.HistoryEntry, pinnedCommands []string) []table.Row {
+	if len(marked) == 0 && len(pinnedCommands) == 0 {
+		return rows
+	}
+	markedRows := make([]table.Row, len(rows))
+	for i, row := range rows {
+		markedRows[i] = row
+		if i < len(entries) && len(row) > 0 {
+			prefix := ""
+			if _, ok := marked[getEntryKey(entries[i])]; ok {
+				prefix += "* "
+			}
+			if containsString(pinnedCommands, entries[i].Command) {
+				prefix += "★ "
+			}
+			if prefix != "" {
+				markedRows[i] = append(table.Row{prefix + row[0]}, row[1:]...)
+			}
+		}
+	}
+	return markedRows
+}
+
+// Handles a key press in vim-style normal mode. Returns false if the key isn't specific to normal mode, in which case
+// it should be handled as usual (e.g. enter still selects the current entry).
+func updateVimNormalMode(m model, msg tea.KeyMsg) (model, bool) {
+	halfPage := max(m.table.Height()/2, 1)
+	switch msg.String() {
+	case "j":
+		m.table.MoveDown(1)
+	case "k":
+		m.table.MoveUp(1)
+	case "g":
+		m.table.GotoTop()
+	case "G":
+		m.table.GotoBottom()
+	case "ctrl+d":
+		m.table.MoveDown(halfPage)
+	case "ctrl+u":
+		m.table.MoveUp(halfPage)
+	case "/":
+		m.vimNormalMode = false
+		m.queryInput.Focus()
+		return m, true
+	default:
+		// Other characters would otherwise be typed into the query
+		return m, msg.Type == tea.KeyRunes && !msg.Alt
+	}
+	if m.table.Cursor() >= m.numEntries {
+		// Ensure that we can't scroll past the end of the results
+		m.table.SetCursor(max(m.numEntries-1, 0))
+	}
+	return m, true
+}
+
+// Loads more entries for the current query while keeping the cursor on the same entry
+func loadMoreEntries(m model) model {
+	m.numEntriesToLoad = min(m.numEntriesToLoad*LOAD_MORE_MULTIPLIER, getTuiMaxRows(m.ctx))
+	start := time.Now()
+	rows, entries, numEntries, err := getRows(m.ctx, getTableColumns(m.ctx), m.lastQuery, m.numEntriesToLoad, m.searchOptions)
+	m.lastSearchDuration = time.Since(start)
+	m.lastSearchNumEntries = numEntries
+	if err != nil {
+		m.searchErr = err
+		return m
+	}
+	m.searchErr = nil
+	m.numEntries = numEntries
+	m.rows = rows
+	m.entries = entries
+	m.table.SetRows(markRows(rows, entries, m.markedEntries, hctx.GetConf(m.ctx).PinnedCommands))
+	return updateTotalMatches(m, m.lastQuery)
+}
+
+func updateExportInput(m model, msg tea.KeyMsg) (model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.isExporting = false
+	case "enter":
+		m.isExporting = false
+		m.exportStatus = exportDisplayedRows(m, m.exportInput.Value())
+	default:
+		var cmd tea.Cmd
+		m.exportInput, cmd = m.exportInput.Update(msg)
+		return m, cmd
+	}
+	m.exportInput.Blur()
+	m.queryInput.Focus()
+	return m, nil
+}
+
+// Starts editing the selected command in the edit input, so that it can be tweaked before it is selected
+func startEditing(m model) (model, tea.Cmd) {
+	command, ok := m.selectedCommand()
+	if !ok {
+		return m, nil
+	}
+	m.isEditing = true
+	terminalWidth, _ := getTerminalSizeOrDefault()
+	m.editInput.Width = max(terminalWidth-len("Edit Command: > ")-1, 10)
+	m.editInput.SetValue(command)
+	m.editInput.CursorEnd()
+	m.queryInput.Blur()
+	return m, m.editInput.Focus()
+}
+
+func updateEditInput(m model, msg tea.KeyMsg) (model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c":
+		m.isEditing = false
+	case "enter":
+		m.isEditing = false
+		m.selected = true
+		m.selectedEdit = true
+		return m, tea.Quit
+	default:
+		var cmd tea.Cmd
+		m.editInput, cmd = m.editInput.Update(msg)
+		return m, cmd
+	}
+	m.editInput.Blur()
+	m.queryInput.Focus()
+	return m, nil
+}
+
+// Whether the selected command spans multiple lines and the user has asked to confirm before selecting those
+func needsMultiLineConfirmation(m model) bool {
+	if !hctx.GetConf(m.ctx).ConfirmMultiLineExec {
+		return false
+	}
+	if len(m.markedEntries) > 1 && m.contextEntries == nil {
+		// Multiple marked entries are output on separate lines
+		return true
+	}
+	entry := m.selectedEntry()
+	return entry != nil && strings.Contains(strings.TrimSpace(entry.Command), "\n")
+}
+
+// Handles key presses while the directory picker is open. Selecting a directory adds a cwd: filter for it to the query.
+func updateDirectoryPicker(m model, msg tea.KeyMsg) model {
+	switch msg.String() {
+	case "esc", "ctrl+c", "alt+d":
+		m.directories = nil
+	case "up", "ctrl+p":
+		m.directoryCursor = max(m.directoryCursor-1, 0)
+	case "down", "ctrl+n":
+		m.directoryCursor = min(m.directoryCursor+1, len(m.directories)-1)
+	case "enter":
+		if m.directoryCursor < len(m.directories) {
+			query := strings.TrimSpace(m.queryInput.Value() + " " + makeCwdAtom(m.directories[m.directoryCursor].Directory))
+			m.queryInput.SetValue(query)
+			m.queryInput.CursorEnd()
+			m.numEntriesToLoad = getTuiSearchLimit(m.ctx)
+			m.runQuery = &query
+			m = runQueryAndUpdateTable(m, false, false)
+		}
+		m.directories = nil
+	}
+	return m
+}
+
+// Filters the query to the next of the most recently used directories (replacing any cwd: atoms that were already in
+// the query), or back to all directories after the last one
+func cycleRecentDirectory(m model) model {
+	if m.recentDirectories == nil {
+		directories, err := RecentDirectoriesForDisplay(m.ctx, hctx.GetDb(m.ctx), NUM_RECENT_DIRECTORIES_TO_CYCLE)
+		if err != nil {
+			m.searchErr = err
+			return m
+		}
+		m.recentDirectories = directories
+		m.recentDirectoryIndex = -1
+	}
+	if len(m.recentDirectories) == 0 {
+		m.searchErr = fmt.Errorf("there are no recent directories to filter to")
+		return m
+	}
+	queryTerms, err := splitQueryTerms(m.queryInput.Value())
+	if err != nil {
+		m.searchErr = err
+		return m
+	}
+	terms := make([]string, 0)
+	for _, term := range queryTerms {
+		if term != "" && !strings.HasPrefix(term, "cwd:") {
+			terms = append(terms, term)
+		}
+	}
+	m.recentDirectoryIndex += 1
+	if m.recentDirectoryIndex < len(m.recentDirectories) {
+		terms = append(terms, makeCwdAtom(m.recentDirectories[m.recentDirectoryIndex]))
+	} else {
+		m.recentDirectoryIndex = -1
+	}
+	query := strings.Join(terms, " ")
+	m.queryInput.SetValue(query)
+	m.queryInput.CursorEnd()
+	m.numEntriesToLoad = getTuiSearchLimit(m.ctx)
+	m.runQuery = &query
+	return runQueryAndUpdateTable(m, false, false)
+}
+
+// Renders the directory picker in place of the table
+func (m model) directoryPickerView() string {
+	if len(m.directories) == 0 {
+		return "No directories match the current query (press Esc to go back)\n"
+	}
+	height := max(m.table.Height(), 1)
+	start := max(min(m.directoryCursor-height/2, len(m.directories)-height), 0)
+	end := min(start+height, len(m.directories))
+	lines := make([]string, 0)
+	for i := start; i < end; i++ {
+		prefix := "  "
+		if i == m.directoryCursor {
+			prefix = "> "
+		}
+		lines = append(lines, fmt.Sprintf("%s%6d  %s", prefix, m.directories[i].Count, m.directories[i].Directory))
+	}
+	return "Select a directory to filter to (Enter to select, Esc to cancel):\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// Opens the context view, which shows the commands that were run just before and after the selected entry
+func openContextView(m model) model {
+	entry := m.selectedEntry()
+	if entry == nil {
+		return m
+	}
+	numLines := hctx.GetConf(m.ctx).ContextLines
+	if numLines <= 0 {
+		numLines = DEFAULT_CONTEXT_LINES
+	}
+	entries, index, err := ContextEntriesForDisplay(m.ctx, hctx.GetDb(m.ctx), entry, numLines, m.searchOptions)
+	if err != nil {
+		m.searchErr = fmt.Errorf("failed to load the commands around the selected entry: %v", err)
+		return m
+	}
+	m.contextEntries = entries
+	m.contextIndex = index
+	m.contextCursor = index
+	return m
+}
+
+// Handles key presses while the context view is open. While it is open, the entry under its cursor is the selected entry
+// (see selectedEntry), so selecting it works the same as selecting an entry in the table.
+func updateContextView(m model, msg tea.KeyMsg) (model, tea.Cmd) {
+	switch msg.String() {
+	case "esc", "ctrl+c", "alt+a":
+		m.contextEntries = nil
+	case "up", "ctrl+p":
+		m.contextCursor = max(m.contextCursor-1, 0)
+	case "down", "ctrl+n":
+		m.contextCursor = min(m.contextCursor+1, len(m.contextEntries)-1)
+	case "enter":
+		if needsMultiLineConfirmation(m) {
+			m.isConfirmingSelection = true
+			return m, nil
+		}
+		m.selected = true
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
+// Renders the context view in place of the table, with the entry that it was opened for marked with a *
+func (m model) contextView() string {
+	lines := make([]string, 0, len(m.contextEntries))
+	for i, entry := range m.contextEntries {
+		prefix := "  "
+		if i == m.contextCursor {
+			prefix = "> "
+		}
+		marker := " "
+		if i == m.contextIndex {
+			marker = "*"
+		}
+		command := strings.ReplaceAll(entry.Command, "\n", " ")
+		lines = append(lines, fmt.Sprintf("%s%s %s  %s", prefix, marker, columnFormatters["Timestamp"](m.ctx, *entry), command))
+	}
+	description := "on this host"
+	if m.contextEntries[m.contextIndex].SessionId != "" {
+		description = "in this session"
+	}
+	return fmt.Sprintf("The commands run %s around the selected entry (Enter to select, Esc to go back):\n", description) + strings.Join(lines, "\n") + "\n"
+}
+
+// Returns all of the columns that can be displayed, starting with the currently displayed ones (in the order that they're
+// displayed) followed by the remaining built-in and custom columns
+func getAvailableColumns(ctx *context.Context) []string {
+	config := hctx.GetConf(ctx)
+	columns := append([]string{}, config.DisplayedColumns...)
+	for _, column := range registeredColumns {
+		if !containsString(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	for _, customColumn := range config.CustomColumns {
+		if !containsString(columns, customColumn.ColumnName) {
+			columns = append(columns, customColumn.ColumnName)
+		}
+	}
+	return columns
+}
+
+// Handles key presses while the column picker is open. Checked columns are displayed after the ones that were already
+// displayed, and the table is rebuilt with them once the user is done picking.
+func updateColumnPicker(m model, msg tea.KeyMsg) model {
+	switch msg.String() {
+	case "esc", "ctrl+c", "alt+c":
+		m.columnPicker = nil
+	case "up", "ctrl+p":
+		m.columnPickerCursor = max(m.columnPickerCursor-1, 0)
+	case "down", "ctrl+n":
+		m.columnPickerCursor = min(m.columnPickerCursor+1, len(m.columnPicker)-1)
+	case " ", "x":
+		column := m.columnPicker[m.columnPickerCursor]
+		if !containsString(m.pickedColumns, column) {
+			m.pickedColumns = append(m.pickedColumns, column)
+		} else if len(m.pickedColumns) > 1 {
+			// At least one column has to stay displayed
+			picked := make([]string, 0)
+			for _, c := range m.pickedColumns {
+				if c != column {
+					picked = append(picked, c)
+				}
+			}
+			m.pickedColumns = picked
+		}
+	case "enter", "ctrl+s":
+		config := hctx.GetConf(m.ctx)
+		config.DisplayedColumns = m.pickedColumns
+		m.ctx = hctx.WithConfig(m.ctx, config)
+		if msg.String() == "ctrl+s" {
+			// Re-read the config so that only the displayed columns are saved, rather than any overrides from the
+			// per-directory config
+			persistedConfig, err := hctx.GetConfig()
+			if err == nil {
+				persistedConfig.DisplayedColumns = m.pickedColumns
+				err = hctx.SetConfig(persistedConfig)
+			}
+			if err != nil {
+				m.searchErr = fmt.Errorf("failed to save the displayed columns: %v", err)
+			}
+		}
+		m.columnPicker = nil
+		// The cached column widths are for the previous columns
+		m.bigQueryResults = nil
+		m = runQueryAndUpdateTable(m, true, true)
+	}
+	return m
+}
+
+// Renders the column picker in place of the table
+func (m model) columnPickerView() string {
+	lines := make([]string, 0)
+	for i, column := range m.columnPicker {
+		prefix := "  "
+		if i == m.columnPickerCursor {
+			prefix = "> "
+		}
+		checkbox := "[ ]"
+		if containsString(m.pickedColumns, column) {
+			checkbox = "[x]"
+		}
+		lines = append(lines, prefix+checkbox+" "+column)
+	}
+	note := ""
+	if isCompactMode(m.ctx) {
+		note = "Note: the terminal is too narrow to display more than the Command column (see compact-mode-width)\n"
+	}
+	return "Select the columns to display (Space to toggle, Enter to apply, Control+S to apply and save to your config, Esc to cancel):\n" + note + strings.Join(lines, "\n") + "\n"
+}
+
+// Exports the rows that are currently displayed in the table to the given path, and returns a status message describing the result
+func exportDisplayedRows(m model, path string) string {
+	if path == "" {
+		path = m.exportInput.Placeholder
+	}
+	rows := make([][]string, 0)
+	for _, row := range m.rows {
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	if isCompactMode(m.ctx) && hctx.GetConf(m.ctx).LineTemplate == "" {
+		// The table only has the Command column, but the export should still have all of the displayed columns
+		rows = make([][]string, 0)
+		for _, entry := range m.entries {
+			displayedEntry := *entry
+			displayedEntry.Command = strings.ReplaceAll(entry.Command, "\n", " ")
+			row, err := buildTableRow(m.ctx, getDisplayedColumns(m.ctx), displayedEntry)
+			if err != nil {
+				return fmt.Sprintf("Warning: failed to export: %v", err)
+			}
+			rows = append(rows, row)
+		}
+	}
+	err := ExportRows(m.ctx, path, getDisplayedColumns(m.ctx), rows, m.entries)
+	if err != nil {
+		return fmt.Sprintf("Warning: failed to export: %v", err)
+	}
+	return fmt.Sprintf("Exported %d entries to %s", len(rows), path)
+}
+
+func updateTotalMatches(m model, query string) model {
+	if m.searchOptions.UniqueDirectories {
+		directories, err := DistinctDirectoriesForDisplay(m.ctx, hctx.GetDb(m.ctx), query, m.searchOptions)
+		if err != nil {
+			m.searchErr = err
+			return m
+		}
+		m.numDirectories = len(directories)
+	}
+	if m.numEntries < m.numEntriesToLoad {
+		// We loaded everything, so there is no need to count
+		m.totalMatches = int64(m.numEntries)
+		return m
+	}
+	count, err := CountForDisplay(m.ctx, hctx.GetDb(m.ctx), query, m.searchOptions)
+	if err != nil {
+		m.searchErr = err
+		return m
+	}
+	m.totalMatches = count
+	return m
+}
+
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	updated, cmd := m.update(msg)
+	if updatedModel, ok := updated.(model); ok {
+		updatedModel = fitTableHeight(updatedModel)
+		updatedModel.tableOffset = getTableOffset(updatedModel.tableOffset, updatedModel.table.Cursor(), updatedModel.table.Height(), len(updatedModel.rows))
+		updatedModel, pageCmd := maybeLoadNextPage(updatedModel)
+		return updatedModel, tea.Batch(cmd, pageCmd)
+	}
+	return updated, cmd
+}
+
+// Resizes the table so that the TUI fills the terminal. The height is based on how many lines everything other than the
+// table's rows (e.g. the warnings, the banner, and the footer) currently takes up, so the table shrinks when more of
+// those are displayed.
+func fitTableHeight(m model) model {
+	if m.err != nil || m.selected || m.quitting || m.directories != nil || m.columnPicker != nil || m.contextEntries != nil {
+		// The table isn't displayed, so there is nothing to fit
+		return m
+	}
+	_, terminalHeight := getTerminalSizeOrDefault()
+	// The renderer truncates lines that are wider than the terminal rather than wrapping them, so each line of the view
+	// takes up exactly one line of the terminal. This is run after every update, so rather than rendering the whole view
+	// only the parts around the table are rendered and counted.
+	overhead := 2
+	if !m.focus {
+		// The table is followed by a newline, and the last line of the view ends with one too
+		overhead = strings.Count(m.headerView(), "\n") + TABLE_CHROME_HEIGHT + 1 + strings.Count(m.belowTableView(), "\n")
+	}
+	height := max(terminalHeight-overhead, MIN_TABLE_HEIGHT)
+	if height != m.table.Height() {
+		m.table.SetHeight(height)
+		// Scroll the viewport (if needed) so that the selected entry stays visible
+		m.table.MoveDown(0)
+	}
+	return m
+}
+
+// Starts loading the next page of entries in the background if the cursor is close to the last loaded entry and there
+// may be more entries to load
+func maybeLoadNextPage(m model) (model, tea.Cmd) {
+	if m.isLoadingPage || m.selected || m.quitting || m.numEntries < m.numEntriesToLoad || m.numEntriesToLoad >= getTuiMaxRows(m.ctx) {
+		return m, nil
+	}
+	// Tall tables may have room for more rows than were loaded, in which case those are loaded too
+	if m.table.Cursor() < len(m.entries)-PAGE_LOAD_THRESHOLD && len(m.entries) > m.table.Height() {
+		return m, nil
+	}
+	m.isLoadingPage = true
+	ctx := m.ctx
+	query := m.lastQuery
+	opts := m.searchOptions
+	opts.Offset = m.numEntries
+	pageSize := min(getTuiSearchLimit(m.ctx), getTuiMaxRows(m.ctx)-m.numEntries)
+	previousEntries := m.entries
+	return m, func() tea.Msg {
+		rows, entries, numEntries, err := getPageOfRows(ctx, getTableColumns(ctx), query, pageSize, opts, previousEntries)
+		return pageLoadedMsg{query: query, searchOptions: opts, rows: rows, entries: entries, numEntries: numEntries, pageSize: pageSize, err: err}
+	}
+}
+
+// Appends a page of entries that was loaded in the background to the table, unless the query changed in the meantime
+func appendLoadedPage(m model, msg pageLoadedMsg) model {
+	m.isLoadingPage = false
+	opts := msg.searchOptions
+	opts.Offset = 0
+	if msg.query != m.lastQuery || opts != m.searchOptions || msg.searchOptions.Offset != m.numEntries {
+		return m
+	}
+	if msg.err != nil {
+		m.searchErr = msg.err
+		return m
+	}
+	// The page continues from the last entry, so any padding after it is replaced
+	m.rows = padRows(m.ctx, append(m.rows[:len(m.entries):len(m.entries)], msg.rows...))
+	m.entries = append(m.entries, msg.entries...)
+	m.numEntries += msg.numEntries
+	m.numEntriesToLoad += msg.pageSize
+	m.table.SetRows(markRows(m.rows, m.entries, m.markedEntries, hctx.GetConf(m.ctx).PinnedCommands))
+	return updateTotalMatches(m, m.lastQuery)
+}
+
+// Returns whether the given key press edits the query, in which case it doesn't need the results of the previous edit
+func isQueryEditKey(msg tea.KeyMsg) bool {
+	switch msg.Type {
+	case tea.KeyRunes:
+		return !msg.Alt
+	case tea.KeySpace, tea.KeyBackspace, tea.KeyDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// Runs the query that was typed but hasn't been run yet since typing hadn't paused (see search_debounce_ms)
+func runPendingQuery(m model) model {
+	m.isQueryPending = false
+	query := m.queryInput.Value()
+	m.runQuery = &query
+	return runQueryAndUpdateTable(m, false, false)
+}
+
+// Returns a command that sends the next follow tick for the current follow mode chain
+func followTick(m model) tea.Cmd {
+	id := m.followId
+	return tea.Tick(FOLLOW_INTERVAL, func(time.Time) tea.Msg {
+		return followTickMsg{id: id}
+	})
+}
+
+// Whether follow mode should skip refreshing the results for now, because the user is typing or is in the middle of
+// another interaction that a refresh would disrupt
+func isFollowPaused(m model) bool {
+	return time.Since(m.lastKeyPress) < FOLLOW_INTERVAL || m.isExporting || m.isEditing || m.directories != nil || m.columnPicker != nil || m.contextEntries != nil ||
+		m.isConfirmingDelete || m.isConfirmingSelection || m.isLoadingPage || m.searchErr != nil
+}
+
+// Re-runs the last query so that any newly recorded entries are shown. If the user scrolled down, the cursor stays on
+// the selected entry rather than on the same row, so new entries appearing at the top don't move it to a different one.
+func refreshFollowedResults(m model) model {
+	cursor := m.table.Cursor()
+	previouslySelected := m.selectedEntry()
+	rows, entries, numEntries, err := getRows(m.ctx, getTableColumns(m.ctx), m.lastQuery, m.numEntriesToLoad, m.searchOptions)
+	if err != nil {
+		m.searchErr = err
+		return m
+	}
+	m.numEntries = numEntries
+	m = updateTotalMatches(m, m.lastQuery)
+	m.rows = rows
+	m.entries = entries
+	m.table.SetRows(markRows(rows, entries, m.markedEntries, hctx.GetConf(m.ctx).PinnedCommands))
+	if cursor > 0 && previouslySelected != nil {
+		// Moving relative to the old position (rather than via SetCursor) also scrolls the table along with the entry
+		if i := findEntry(entries, getEntryKey(previouslySelected)); i > cursor {
+			m.table.MoveDown(i - cursor)
+		} else if i >= 0 {
+			m.table.MoveUp(cursor - i)
+		}
+	}
+	if m.table.Cursor() >= m.numEntries {
+		m.table.SetCursor(m.numEntries - 1)
+	}
+	return m
+}
+
+// Returns the index of the first row that is visible in the table after the cursor moved, given the previous one. This
+// scrolls the same way as the table itself, i.e. only as far as is needed to keep the cursor visible.
+func getTableOffset(previousOffset, cursor, height, numRows int) int {
+	offset := previousOffset
+	if cursor < offset {
+		offset = cursor
+	}
+	if cursor > offset+height-1 {
+		offset = cursor - height + 1
+	}
+	return max(min(offset, numRows-height), 0)
+}
+
+// Renders the footer below the table, showing which of the results are visible and which one is selected
+func (m model) footerView() string {
+	if m.footerMessage != "" {
+		return m.footerMessage + "\n"
+	}
+	searchMode := ""
+	if hctx.GetConf(m.ctx).CaseSensitiveSearch {
+		searchMode = " (case-sensitive, press Alt+I to toggle)"
+	}
+	for _, sessionId := range getQuerySessionIds(m.lastQuery) {
+		searchMode += fmt.Sprintf(" (session %s)", sessionId)
+	}
+	if len(m.entries) == 0 {
+		return "No matches" + searchMode + "\n" + m.undoView()
+	}
+	total := len(m.entries)
+	if m.searchOptions.UniqueDirectories {
+		// Each directory is a single row, even if not all of the matches are loaded
+		total = max(m.numDirectories, len(m.entries))
+		searchMode += fmt.Sprintf(" (one row per directory, %d distinct directories, press Alt+U to show all)", m.numDirectories)
+	} else if m.totalMatches > int64(m.numEntries) {
+		// Not all of the matches are loaded
+		total = int(m.totalMatches)
+	}
+	first := m.tableOffset + 1
+	last := min(m.tableOffset+m.table.Height(), len(m.entries))
+	return fmt.Sprintf("Showing %d-%d of %d (cursor %d/%d)%s\n", first, last, total, m.table.Cursor()+1, total, searchMode) + m.undoView()
+}
+
+// Returns the IDs of the sessions that the given query is filtered to via session: atoms
+func getQuerySessionIds(query string) []string {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil
+	}
+	sessionIds := make([]string, 0)
+	for i, token := range tokens {
+		if !strings.HasPrefix(token, "session:") || (i > 0 && tokens[i-1] == "NOT") {
+			continue
+		}
+		if sessionId, err := resolveSessionId(strings.TrimPrefix(token, "session:")); err == nil {
+			sessionIds = append(sessionIds, sessionId)
+		}
+	}
+	return sessionIds
+}
+
+// Renders the recoverable errors from background operations. Returns an empty string if there are none.
+func (m model) backgroundErrorsView() string {
+	if len(m.backgroundErrors) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for _, err := range m.backgroundErrors {
+		sb.WriteString(fmt.Sprintf("Warning: %v\n", err))
+	}
+	sb.WriteString("(press Control+L to dismiss the warnings)\n")
+	return sb.String()
+}
+
+// Renders whether the most recent deletion can still be undone, and whether undoing it only affects this device
+func (m model) undoView() string {
+	if m.lastDeleted == nil {
+		return ""
+	}
+	entries, pronoun := "entry", "it"
+	if len(m.lastDeleted) > 1 {
+		entries, pronoun = fmt.Sprintf("%d entries", len(m.lastDeleted)), "them"
+	}
+	if m.lastDeletionSent {
+		return fmt.Sprintf("Deleted the %s on all of your devices (press Control+Z to re-create %s)\n", entries, pronoun)
+	}
+	return fmt.Sprintf("Deleted the %s on this device (press Control+Z to undo before it is deleted on your other devices)\n", entries)
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		m.lastKeyPress = time.Now()
+		if m.isQueryPending && !isQueryEditKey(msg) {
+			// Anything other than editing the query acts on the results, so they have to be up to date
+			m = runPendingQuery(m)
+		}
+		if m.isExporting {
+			return updateExportInput(m, msg)
+		}
+		if m.isEditing {
+			return updateEditInput(m, msg)
+		}
+		if m.directories != nil {
+			return updateDirectoryPicker(m, msg), nil
+		}
+		if m.columnPicker != nil {
+			return updateColumnPicker(m, msg), nil
+		}
+		if m.isConfirmingSelection {
+			m.isConfirmingSelection = false
+			if msg.String() == "y" {
+				m.selected = true
+				return m, tea.Quit
+			}
+			return m, nil
+		}
+		if m.contextEntries != nil {
+			return updateContextView(m, msg)
+		}
+		if m.isConfirmingDelete {
+			m.isConfirmingDelete = false
+			if msg.String() == "y" {
+				return deleteSelectedEntry(m)
+			}
+			return m, nil
+		}
+		if m.vimNormalMode {
+			if updated, handled := updateVimNormalMode(m, msg); handled {
+				return updated, nil
+			}
+		}
+		if msg.String() == getCopyKey(m.ctx) {
+			return copySelectedCommand(m)
+		}
+		switch msg.String() {
+		case "esc", "ctrl+c":
+			if msg.String() == "esc" && hctx.GetConf(m.ctx).EnableVimKeybindings && !m.vimNormalMode {
+				// Like in vim, escape stops typing the query and goes back to normal mode
+				m.vimNormalMode = true
+				m.queryInput.Blur()
+				return m, nil
+			}
+			m.quitting = true
+			return m, tea.Quit
+		case "enter":
+			if m.numEntries == 0 && len(m.markedEntries) == 0 {
+				return enterWithNoResults(m)
+			}
+			if needsMultiLineConfirmation(m) {
+				m.isConfirmingSelection = true
+				return m, nil
+			}
+			m.selected = true
+			return m, tea.Quit
+		case "ctrl+o":
+			entry := m.selectedEntry()
+			if entry == nil {
+				return m, nil
+			}
+			if entry.CurrentWorkingDirectory == "" {
+				m.searchErr = fmt.Errorf("the selected entry doesn't have a recorded directory")
+				return m, nil
+			}
+			m.selected = true
+			m.selectedCd = true
+			return m, tea.Quit
+		case "ctrl+e":
+			return startEditing(m)
+		case "alt+r":
+			m.searchOptions.Reverse = !m.searchOptions.Reverse
+			m = runQueryAndUpdateTable(m, true, false)
+			return m, nil
+		case "alt+t":
+			m.follow = !m.follow
+			m.followId += 1
+			if m.follow {
+				return m, followTick(m)
+			}
+			return m, nil
+		case "alt+w":
+			m.wrapCommand = !m.wrapCommand
+			return m, nil
+		case "alt+m":
+			m = loadMoreEntries(m)
+			return m, nil
+		case "ctrl+p":
+			m.showPreview = !m.showPreview
+			return m, nil
+		case "alt+h":
+			entry := m.selectedEntry()
+			if entry != nil {
+				err := SetSensitive(m.ctx, entry, !entry.IsSensitive)
+				if err != nil {
+					m.searchErr = fmt.Errorf("failed to update the selected entry: %v", err)
+					return m, nil
+				}
+				m = runQueryAndUpdateTable(m, true, true)
+			}
+			return m, nil
+		case "alt+D":
+			m.debug = !m.debug
+			return m, nil
+		case "alt+s":
+			if getSessionId() == "" {
+				m.searchErr = fmt.Errorf("the current shell session is unknown (try restarting your shell)")
+				return m, nil
+			}
+			m.searchOptions.CurrentSessionOnly = !m.searchOptions.CurrentSessionOnly
+			m = runQueryAndUpdateTable(m, true, false)
+			return m, nil
+		case "alt+i":
+			// Only for this search, so the config file isn't changed
+			config := hctx.GetConf(m.ctx)
+			config.CaseSensitiveSearch = !config.CaseSensitiveSearch
+			m.ctx = hctx.WithConfig(m.ctx, config)
+			m = runQueryAndUpdateTable(m, true, false)
+			return m, nil
+		case "ctrl+l":
+			m.backgroundErrors = nil
+			return m, nil
+		case "alt+b":
+			return togglePin(m), nil
+		case "alt+o":
+			m.searchOptions.SortColumn = nextSortColumn(getTableColumns(m.ctx), m.searchOptions.SortColumn)
+			m.searchOptions.SortAscending = false
+			m = runQueryAndUpdateTable(m, true, false)
+			return m, nil
+		case "alt+O":
+			if m.searchOptions.SortColumn == "" {
+				return m, nil
+			}
+			m.searchOptions.SortAscending = !m.searchOptions.SortAscending
+			m = runQueryAndUpdateTable(m, true, false)
+			return m, nil
+		case "alt+u":
+			m.searchOptions.UniqueDirectories = !m.searchOptions.UniqueDirectories
+			m = runQueryAndUpdateTable(m, true, false)
+			return m, nil
+		case "alt+x":
+			m.searchOptions.DedupMode = nextDedupMode(m.searchOptions.DedupMode)
+			m = runQueryAndUpdateTable(m, true, false)
+			return m, nil
+		case "alt+f":
+			m.focus = !m.focus
+			return m, nil
+		case "f1":
+			return openManPage(m)
+		case "ctrl+k":
+			if m.selectedEntry() != nil || len(m.markedEntries) > 0 {
+				m.isConfirmingDelete = true
+			}
+			return m, nil
+		case "tab":
+			return toggleMarkedEntry(m), nil
+		case "ctrl+z":
+			return undoDeletion(m), nil
+		case "alt+n":
+			m.table.MoveDown(findDistinctEntry(m.entries, m.table.Cursor(), 1) - m.table.Cursor())
+			return m, nil
+		case "alt+p":
+			m.table.MoveUp(m.table.Cursor() - findDistinctEntry(m.entries, m.table.Cursor(), -1))
+			return m, nil
+		case "alt+d":
+			directories, err := DistinctDirectoriesForDisplay(m.ctx, hctx.GetDb(m.ctx), m.lastQuery, m.searchOptions)
+			if err != nil {
+				m.searchErr = err
+				return m, nil
+			}
+			m.directories = directories
+			m.directoryCursor = 0
+			return m, nil
+		case "alt+l":
+			return cycleRecentDirectory(m), nil
+		case "alt+a":
+			return openContextView(m), nil
+		case "alt+c":
+			if hctx.GetConf(m.ctx).LineTemplate != "" {
+				m.searchErr = fmt.Errorf("the column picker can't be used while a line template is set")
+				return m, nil
+			}
+			m.columnPicker = getAvailableColumns(m.ctx)
+			m.columnPickerCursor = 0
+			m.pickedColumns = append([]string{}, hctx.GetConf(m.ctx).DisplayedColumns...)
+			return m, nil
+		case "alt+e":
+			m.isExporting = true
+			m.exportStatus = ""
+			m.exportInput.SetValue("")
+			m.queryInput.Blur()
+			cmd := m.exportInput.Focus()
+			return m, cmd
+		default:
+			t, cmd1 := m.table.Update(msg)
+			m.table = t
+			if strings.HasPrefix(msg.String(), "alt+") {
+				return m, tea.Batch(cmd1)
+			}
+			i, cmd2 := m.queryInput.Update(msg)
+			m.queryInput = i
+			searchQuery := m.queryInput.Value()
+			if searchQuery != m.lastQuery {
+				m.numEntriesToLoad = getTuiSearchLimit(m.ctx)
+				if debounce := getSearchDebounce(m.ctx); debounce > 0 {
+					// Wait for typing to pause before running the query, rather than running it on every keystroke
+					m.isQueryPending = true
+					m.debounceId += 1
+					id := m.debounceId
+					return m, tea.Batch(cmd1, cmd2, tea.Tick(debounce, func(time.Time) tea.Msg {
+						return debouncedQueryMsg{id: id}
+					}))
+				}
+			}
+			m.isQueryPending = false
+			m.runQuery = &searchQuery
+			m = runQueryAndUpdateTable(m, false, false)
+			return m, tea.Batch(cmd1, cmd2)
+		}
+	case tea.WindowSizeMsg:
+		// Rebuild the table so that the columns fit the new size, using the typed query in case it differs from the last
+		// one that was run (e.g. if it failed to parse). The cursor is kept where it was unless the query changed.
+		query := m.queryInput.Value()
+		maintainCursor := query == m.lastQuery
+		m.runQuery = &query
+		m = runQueryAndUpdateTable(m, true, maintainCursor)
+		return m, nil
+	case manPageClosedMsg:
+		if msg.err != nil {
+			m.searchErr = fmt.Errorf("failed to open the man page: %v", msg.err)
+		}
+		return m, nil
+	case clearFooterMessageMsg:
+		if msg.id == m.footerMessageId {
+			m.footerMessage = ""
+		}
+		return m, nil
+	case errMsg:
+		m.err = msg
+		return m, nil
+	case backgroundErrMsg:
+		// The same error may happen repeatedly, but is only worth displaying once
+		for _, err := range m.backgroundErrors {
+			if err.Error() == msg.err.Error() {
+				return m, nil
+			}
+		}
+		m.backgroundErrors = append(m.backgroundErrors, msg.err)
+		return m, nil
+	case pageLoadedMsg:
+		m = appendLoadedPage(m, msg)
+		return m, nil
+	case sendDeletionMsg:
+		if msg.id == m.deletionId {
+			m = sendPendingDeletion(m)
+		}
+		return m, nil
+	case debouncedQueryMsg:
+		// Only the latest edit to the query is run
+		if m.isQueryPending && msg.id == m.debounceId {
+			m = runPendingQuery(m)
+		}
+		return m, nil
+	case followTickMsg:
+		if !m.follow || msg.id != m.followId {
+			return m, nil
+		}
+		if !isFollowPaused(m) {
+			m = refreshFollowedResults(m)
+		}
+		return m, followTick(m)
+	case offlineMsg:
+		m.isOffline = true
+		m.neverSynced = msg.neverSynced
+		return m, nil
+	case authErrorMsg:
+		m.isUnauthorized = true
+		return m, nil
+	case bannerMsg:
+		m.banner = msg.banner
+		return m, nil
+	case doneDownloadingMsg:
+		m.isLoading = false
+		// The column widths were based on the entries from before the download, so recompute them (and re-run the query
+		// so that any new entries are shown). With RemoteOnly, all of the results were just downloaded so we also go back
+		// to the top of the results.
+		m.bigQueryResults = nil
+		m = runQueryAndUpdateTable(m, true, !hctx.GetConf(m.ctx).RemoteOnly)
+		return m, nil
+	default:
+		var cmd tea.Cmd
+		if m.isLoading {
+			m.spinner, cmd = m.spinner.Update(msg)
+			return m, cmd
+		} else {
+			m.table, cmd = m.table.Update(msg)
+			return m, cmd
+		}
+	}
+}
+
+func (m model) View() string {
+	if m.err != nil {
+		return fmt.Sprintf("An unrecoverable error occured: %v\n", m.err)
+	}
+	if m.selected && m.selectedCd {
+		selectedRow = m.cdCommand()
+		return ""
+	}
+	if m.selected && m.selectedEdit {
+		selectedRow = m.editInput.Value()
+		return ""
+	}
+	if m.selected && len(m.markedEntries) > 0 && m.contextEntries == nil {
+		commands := make([]string, 0)
+		for _, entry := range m.getMarkedEntries() {
+			commands = append(commands, entry.Command)
+		}
+		selectedRow = strings.Join(commands, "\n")
+		return ""
+	}
+	if m.selected {
+		// If nothing is selected, nothing is output (rather than something that the shell would try to run)
+		selectedRow, _ = m.selectedCommand()
+		return ""
+	}
+	if m.quitting {
+		return ""
+	}
+	if m.focus {
+		return m.focusView()
+	}
+	header := m.headerView()
+	if m.directories != nil {
+		return header + m.directoryPickerView() + m.debugView()
+	}
+	if m.columnPicker != nil {
+		return header + m.columnPickerView() + m.debugView()
+	}
+	if m.contextEntries != nil {
+		return header + m.contextView() + m.debugView()
+	}
+	return header + getBaseStyle(m.ctx).Render(m.tableView()) + "\n" + m.belowTableView()
+}
+
+// Renders everything above the table: the loading message, any warnings, the banner, and the query
+func (m model) headerView() string {
+	loadingMessage := ""
+	if m.isLoading {
+		loadingMessage = m.loadingView()
+	}
+	warning := ""
+	if m.isOffline && m.neverSynced {
+		// Shown even in quiet mode since, unlike a temporary network issue, this won't fix itself
+		warning += fmt.Sprintf("Warning: this device has never been able to sync with the hishtory backend (%s), so results from your other devices are missing. Check that it can reach the backend, or run `hishtory init` to set up syncing again.\n\n", getServerHostname())
+	} else if m.isOffline && !m.quiet {
+		warning += "Warning: failed to contact the hishtory backend (are you offline?), so some results may be stale\n\n"
+	}
+	if m.isUnauthorized {
+		warning += "Warning: this device isn't registered with the hishtory backend, so results from your other devices may be missing (run `hishtory init` to re-register it)\n\n"
+	}
+	if IsSearchError(m.searchErr) {
+		// SearchErrors already include the query that failed
+		warning += fmt.Sprintf("Warning: %v\n\n", m.searchErr)
+	} else if m.searchErr != nil {
+		warning += fmt.Sprintf("Warning: failed to search: %v\n\n", m.searchErr)
+	}
+	queryStatus := ""
+	if m.searchOptions.Reverse {
+		queryStatus = " (oldest first)"
+	}
+	if m.vimNormalMode {
+		queryStatus += " (press / to search)"
+	}
+	if m.searchOptions.ShowSensitive {
+		queryStatus += " (including sensitive entries)"
+	}
+	if m.searchOptions.CurrentSessionOnly {
+		queryStatus += " (this session only)"
+	}
+	if m.follow {
+		queryStatus += " (following new entries)"
+	}
+	if m.recentDirectoryIndex >= 0 && m.recentDirectoryIndex < len(m.recentDirectories) {
+		queryStatus += fmt.Sprintf(" (recent directory %d of %d, press Alt+L for the next one)", m.recentDirectoryIndex+1, len(m.recentDirectories))
+	}
+	if m.queryInput.CharLimit > 0 && len([]rune(m.queryInput.Value())) >= m.queryInput.CharLimit {
+		queryStatus += fmt.Sprintf(" (the query is at the %d character limit set by query-char-limit)", m.queryInput.CharLimit)
+	}
+	if m.searchOptions.DedupMode != DEDUP_OFF {
+		if hctx.GetConf(m.ctx).FilterAllDuplicateCommands {
+			queryStatus += fmt.Sprintf(" (dedup: %s, non-adjacent)", m.searchOptions.DedupMode)
+		} else {
+			queryStatus += fmt.Sprintf(" (dedup: %s)", m.searchOptions.DedupMode)
+		}
+	}
+	if m.exportStatus != "" {
+		warning += m.exportStatus + "\n\n"
+	}
+	if m.totalMatches > int64(m.numEntries) && m.numEntriesToLoad >= getTuiMaxRows(m.ctx) {
+		queryStatus += fmt.Sprintf(" (loaded %d of %d matches, the maximum set by tui-max-rows)", m.numEntries, m.totalMatches)
+	} else if m.totalMatches > int64(m.numEntries) {
+		queryStatus += fmt.Sprintf(" (loaded %d of %d matches, press Alt+M to load more)", m.numEntries, m.totalMatches)
+	}
+	banner := m.banner
+	if m.quiet {
+		banner = ""
+	}
+	if m.isConfirmingDelete && len(m.markedEntries) > 0 {
+		warning += fmt.Sprintf("Warning: This will permanently delete the %d marked entries from your history on all of your devices. Press y to delete them, or any other key to cancel.\n\n", len(m.markedEntries))
+	} else if m.isConfirmingDelete {
+		warning += "Warning: This will permanently delete the selected entry from your history on all of your devices. Press y to delete it, or any other key to cancel.\n\n"
+	}
+	if len(m.markedEntries) > 0 {
+		queryStatus += fmt.Sprintf(" (%d marked, press Enter to select them all or Control+K to delete them)", len(m.markedEntries))
+	}
+	if m.isConfirmingSelection && len(m.markedEntries) > 1 && m.contextEntries == nil {
+		warning += "Warning: The marked commands are output on separate lines, so they may all run at once. Press y to select them anyway, or any other key to cancel.\n\n"
+	} else if m.isConfirmingSelection {
+		warning += "Warning: The selected command spans multiple lines, so it may run multiple commands at once. Press y to select it anyway, or any other key to cancel.\n\n"
+	}
+	if m.isExporting {
+		queryStatus += "\nExport To: " + m.exportInput.View() + " (format is based on the extension: .json, .csv, .md, .sh, or plain text)"
+	}
+	if m.isEditing {
+		queryStatus += "\nEdit Command: " + m.editInput.View() + "\n(press Enter to select the edited command, or Escape to cancel)"
+	}
+	return fmt.Sprintf("\n%s\n%s%s\nSearch Query: %s%s\n\n", loadingMessage, warning, banner, m.queryInput.View(), queryStatus)
+}
+
+// Renders everything below the table
+func (m model) belowTableView() string {
+	return m.footerView() + m.backgroundErrorsView() + m.wrappedCommandView() + m.previewView() + m.debugView()
+}
+
+// Renders the message that is shown while entries are loaded from other devices, based on the spinner_style and
+// loading_message config options
+func (m model) loadingView() string {
+	message := hctx.GetConf(m.ctx).LoadingMessage
+	if message == "" {
+		message = DEFAULT_LOADING_MESSAGE
+	}
+	switch hctx.GetConf(m.ctx).SpinnerStyle {
+	case "hidden":
+		return ""
+	case "none":
+		return message
+	default:
+		return fmt.Sprintf("%s %s", m.spinner.View(), message)
+	}
+}
+
+// Returns the dedup mode that follows the given one when cycling through them in the TUI
+func nextDedupMode(dedupMode string) string {
+	switch dedupMode {
+	case DEDUP_OFF:
+		return DEDUP_EXACT
+	case DEDUP_EXACT:
+		return DEDUP_NORMALIZED
+	default:
+		return DEDUP_OFF
+	}
+}
+
+// Returns the displayed column that follows the given sort column when cycling through the ones that the results can
+// be sorted by in the TUI, or the empty string (i.e. the default sort order) after the last one
+func nextSortColumn(columnNames []string, sortColumn string) string {
+	sortable := make([]string, 0)
+	for _, name := range columnNames {
+		if _, ok := sortableColumns[name]; ok {
+			sortable = append(sortable, name)
+		}
+	}
+	if sortColumn == "" {
+		if len(sortable) == 0 {
+			return ""
+		}
+		return sortable[0]
+	}
+	for i, name := range sortable {
+		if name == sortColumn && i+1 < len(sortable) {
+			return sortable[i+1]
+		}
+	}
+	return ""
+}
+
+// Renders the table, with the parts of the commands that matched the query highlighted (see HighlightMatches)
+func (m model) tableView() string {
+	view := m.table.View()
+	if !hctx.GetConf(m.ctx).HighlightMatches || lipgloss.ColorProfile() == termenv.Ascii {
+		// Without colors, the highlighting wouldn't be visible (and the selected row is offset by its marker)
+		return view
+	}
+	commandColumn := getIndexOfCommandColumn(m.ctx)
+	if hctx.GetConf(m.ctx).LineTemplate != "" {
+		// The command is somewhere within the single column of rendered lines
+		commandColumn = 0
+	}
+	if commandColumn < 0 || commandColumn >= len(m.columns) {
+		return view
+	}
+	terms, err := getSearchTerms(m.lastQuery)
+	if err != nil || len(terms) == 0 {
+		return view
+	}
+	// Each cell is padded by one space on either side
+	start := 1
+	for _, column := range m.columns[:commandColumn] {
+		start += column.Width + 2
+	}
+	fuzzy := hctx.GetConf(m.ctx).FuzzySearch
+	caseSensitive := hctx.GetConf(m.ctx).CaseSensitiveSearch
+	style := lipgloss.NewStyle().Foreground(lipgloss.Color(getTheme(m.ctx).Highlight)).Bold(true)
+	lines := strings.Split(view, "\n")
+	// The rows are always rendered as the last m.table.Height() lines, after the header
+	for i := max(len(lines)-m.table.Height(), 0); i < len(lines); i++ {
+		lines[i] = highlightCell(lines[i], start, m.columns[commandColumn].Width, style, func(cell []rune) []bool {
+			return findMatches(cell, terms, fuzzy, caseSensitive)
+		})
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Highlights the runes that matched in the cell that is width columns wide and starts at the given column of the
+// rendered line. This is done on the rendered table rather than on the rows since the table truncates cells without
+// accounting for escape codes, so highlighting the rows themselves would cut off the commands (or the escape codes).
+func highlightCell(line string, start, width int, style lipgloss.Style, findMatches func(cell []rune) []bool) string {
+	type segment struct {
+		text     string
+		isEscape bool
+		column   int
+	}
+	segments := make([]segment, 0, len(line))
+	column := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\x1b' && i+1 < len(line) && line[i+1] == '[' {
+			// A CSI escape sequence, which ends with a byte between @ and ~
+			end := i + 2
+			for end < len(line) && (line[end] < 0x40 || line[end] > 0x7e) {
+				end++
+			}
+			end = min(end+1, len(line))
+			segments = append(segments, segment{text: line[i:end], isEscape: true, column: column})
+			i = end
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		segments = append(segments, segment{text: line[i : i+size], column: column})
+		column += runewidth.RuneWidth(r)
+		i += size
+	}
+	cell := make([]rune, 0, width)
+	cellSegments := make([]int, 0, width)
+	for i, s := range segments {
+		if !s.isEscape && s.column >= start && s.column < start+width {
+			cell = append(cell, []rune(s.text)...)
+			cellSegments = append(cellSegments, i)
+		}
+	}
+	highlighted := make(map[int]bool)
+	for i, matched := range findMatches(cell) {
+		if matched {
+			highlighted[cellSegments[i]] = true
+		}
+	}
+	if len(highlighted) == 0 {
+		return line
+	}
+	var sb strings.Builder
+	// The escape codes that are in effect (e.g. for the selected row), which are restored after each highlighted run
+	activeEscapes := ""
+	for i := 0; i < len(segments); i++ {
+		if segments[i].isEscape {
+			if segments[i].text == "\x1b[0m" || segments[i].text == "\x1b[m" {
+				activeEscapes = ""
+			} else {
+				activeEscapes += segments[i].text
+			}
+			sb.WriteString(segments[i].text)
+			continue
+		}
+		if !highlighted[i] {
+			sb.WriteString(segments[i].text)
+			continue
+		}
+		run := ""
+		for ; i < len(segments) && highlighted[i]; i++ {
+			run += segments[i].text
+		}
+		i--
+		sb.WriteString(style.Render(run))
+		sb.WriteString(activeEscapes)
+	}
+	return sb.String()
+}
+
+// Returns which of the runes in the given text matched one of the search terms, ignoring case. With fuzzy search, this
+// is the characters of each term that matched (see fuzzyScore), and otherwise it is every occurrence of each term.
+func findMatches(text []rune, terms []string, fuzzy, caseSensitive bool) []bool {
+	matches := make([]bool, len(text))
+	lowered := make([]rune, len(text))
+	for i, r := range text {
+		lowered[i] = r
+		if !caseSensitive {
+			lowered[i] = unicode.ToLower(r)
+		}
+	}
+	for _, term := range terms {
+		termRunes := []rune(term)
+		if !caseSensitive {
+			termRunes = []rune(strings.ToLower(term))
+		}
+		if fuzzy {
+			if _, positions, ok := fuzzyScore(term, string(text)); ok {
+				for _, position := range positions {
+					if position < len(matches) {
+						matches[position] = true
+					}
+				}
+			}
+			continue
+		}
+		for i := 0; i+len(termRunes) <= len(lowered); i++ {
+			if string(lowered[i:i+len(termRunes)]) == string(termRunes) {
+				for j := i; j < i+len(termRunes); j++ {
+					matches[j] = true
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// Renders the view for focus mode, which is just the query input followed by the bare result rows (without the
+// banner, warnings, table header, or borders).
+func (m model) focusView() string {
+	tableLines := strings.Split(m.tableView(), "\n")
+	// The rows are always rendered as the last m.table.Height() lines, after the header
+	rowLines := tableLines[max(len(tableLines)-m.table.Height(), 0):]
+	return fmt.Sprintf("%s\n%s\n", m.queryInput.View(), strings.Join(rowLines, "\n"))
+}
+
+// Renders the debug overlay. Returns an empty string if debugging isn't enabled.
+func (m model) debugView() string {
+	if !m.debug {
+		return ""
+	}
+	terminalWidth, terminalHeight, err := getTerminalSize()
+	terminalSize := fmt.Sprintf("%dx%d", terminalWidth, terminalHeight)
+	if err != nil {
+		terminalWidth, terminalHeight = getTerminalSizeOrDefault()
+		terminalSize = fmt.Sprintf("%dx%d (assumed, since the size couldn't be determined: %v)", terminalWidth, terminalHeight, err)
+	}
+	columnWidthCache := "cold"
+	if m.bigQueryResults != nil {
+		columnWidthCache = "warm"
+	}
+	return fmt.Sprintf("Debug: last search took %s and returned %d entries (limit=%d, total matches=%d), column width cache=%s, terminal size=%s, table height=%d\n",
+		m.lastSearchDuration.Round(time.Microsecond), m.lastSearchNumEntries, m.numEntriesToLoad, m.totalMatches, columnWidthCache, terminalSize, m.table.Height())
+}
+
+// Renders the pane below the table that shows the full command for the currently selected entry, wrapped to fit in the
+// terminal (up to WRAPPED_COMMAND_HEIGHT lines). Returns an empty string if the pane isn't enabled.
+func (m model) wrappedCommandView() string {
+	if !m.wrapCommand || m.numEntries == 0 {
+		return ""
+	}
+	command, ok := m.selectedCommand()
+	if !ok {
+		return ""
+	}
+	terminalWidth, _ := getTerminalSizeOrDefault()
+	wrapped := strings.Split(lipgloss.NewStyle().Width(terminalWidth-2).Render(command), "\n")
+	if len(wrapped) > WRAPPED_COMMAND_HEIGHT {
+		wrapped = wrapped[:WRAPPED_COMMAND_HEIGHT]
+		wrapped[WRAPPED_COMMAND_HEIGHT-1] = strings.TrimRight(wrapped[WRAPPED_COMMAND_HEIGHT-1], " ") + "…"
+	}
+	return strings.Join(wrapped, "\n") + "\n"
+}
+
+// Renders the unmodified command for the selected entry in a bordered box, with newlines preserved and long lines
+// wrapped to the width of the terminal
+func (m model) previewView() string {
+	if !m.showPreview {
+		return ""
+	}
+	entry := m.selectedEntry()
+	if entry == nil {
+		return ""
+	}
+	terminalWidth, _ := getTerminalSizeOrDefault()
+	// Leave room for the border
+	contentHeight := PREVIEW_HEIGHT - 2
+	lines := strings.Split(lipgloss.NewStyle().Width(max(terminalWidth-4, 1)).Render(entry.Command), "\n")
+	if len(lines) > contentHeight {
+		lines = lines[:contentHeight]
+		lines[contentHeight-1] = strings.TrimRight(lines[contentHeight-1], " ") + "…"
+	}
+	return getBaseStyle(m.ctx).Render(strings.Join(lines, "\n")) + "\n"
+}
+
+// Returns the program whose man page should be shown for the given command, skipping over any leading sudo and
+// environment variable assignments (e.g. `sudo FOO=bar make` returns `make`)
+func getManPageProgram(command string) string {
+	for _, field := range strings.Fields(command) {
+		if field == "sudo" || strings.Contains(field, "=") {
+			continue
+		}
+		return field
+	}
+	return ""
+}
+
+// Opens the man page for the program in the selected command, returning to the TUI once it is closed
+func openManPage(m model) (model, tea.Cmd) {
+	entry := m.selectedEntry()
+	if entry == nil {
+		return m, nil
+	}
+	program := getManPageProgram(entry.Command)
+	if program == "" {
+		return m, nil
+	}
+	if _, err := exec.LookPath("man"); err != nil {
+		m.searchErr = fmt.Errorf("failed to open the man page for %#v since man isn't installed", program)
+		return m, nil
+	}
+	// Check that there is a man page before switching away from the TUI so that a missing one doesn't flash an error
+	if err := exec.Command("man", "-w", program).Run(); err != nil {
+		m.searchErr = fmt.Errorf("there is no man page for %#v", program)
+		return m, nil
+	}
+	m.searchErr = nil
+	return m, tea.ExecProcess(exec.Command("man", program), func(err error) tea.Msg {
+		return manPageClosedMsg{err: err}
+	})
+}
+
+// Returns the command to cd into the directory that the selected entry was run in, followed by the entry's command if
+// CdAndRunCommand is set
+func (m model) cdCommand() string {
+	entry := m.selectedEntry()
+	if entry == nil {
+		return ""
+	}
+	cd := "cd " + shellQuoteDirectory(entry.CurrentWorkingDirectory)
+	if !hctx.GetConf(m.ctx).CdAndRunCommand {
+		return cd
+	}
+	command, _ := m.selectedCommand()
+	return cd + " && " + command
+}
 
-	// The search box for the query
-	queryInput textinput.Model
-	// The query to run. Reset to nil after it was run.
-	runQuery *string
-	// The previous query that was run.
-	lastQuery string
+var shellSafeRegex = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
 
-	// Unrecoverable error.
-	err error
-	// An error while searching. Recoverable and displayed as a warning message.
-	searchErr error
-	// Whether the device is offline. If so, a warning will be displayed.
-	isOffline bool
+// Quotes the given directory so that it can be used as an argument in a shell command. A leading ~ is left unquoted
+// so that it is still expanded to the home directory.
+func shellQuoteDirectory(dir string) string {
+	prefix := ""
+	if strings.HasPrefix(dir, "~/") {
+		prefix = "~/"
+		dir = strings.TrimPrefix(dir, "~/")
+	}
+	if dir == "~" || dir == "" || shellSafeRegex.MatchString(dir) {
+		return prefix + dir
+	}
+	return prefix + "'" + strings.ReplaceAll(dir, "'", `'\''`) + "'"
+}
 
-	// A banner from the backend to be displayed. Generally an empty string.
-	banner string
+// Returns the index of the closest entry in the given direction (1 for down, -1 for up) whose command differs from the
+// command at the cursor, skipping over any repeats. Returns the cursor if there is no such entry.
+func findDistinctEntry(entries []*data.HistoryEntry, cursor, direction int) int {
+	if cursor < 0 || cursor >= len(entries) {
+		return cursor
+	}
+	for i := cursor + direction; i >= 0 && i < len(entries); i += direction {
+		if entries[i].Command != entries[cursor].Command {
+			return i
+		}
+	}
+	return cursor
 }
 
-type doneDownloadingMsg struct{}
-type offlineMsg struct{}
-type bannerMsg struct {
-	banner string
+// Returns the entry that is currently selected in the table (or in the context view, if it is open), or nil if there
+// isn't one
+func (m model) selectedEntry() *data.HistoryEntry {
+	if m.contextEntries != nil {
+		return m.contextEntries[m.contextCursor]
+	}
+	cursor := m.table.Cursor()
+	if cursor < 0 || cursor >= len(m.entries) {
+		return nil
+	}
+	return m.entries[cursor]
 }
 
-func initialModel(ctx *context.Context, t table.Model, initialQuery string, numEntries int) model {
-	s := spinner.New()
-	s.Spinner = spinner.Dot
-	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
-	queryInput := textinput.New()
-	queryInput.Placeholder = "ls"
-	queryInput.Focus()
-	queryInput.CharLimit = 156
-	queryInput.Width = 50
-	if initialQuery != "" {
-		queryInput.SetValue(initialQuery)
+// Returns the command in the selected row as it is displayed (i.e. on a single line), or false if there isn't one
+func (m model) selectedCommand() (string, bool) {
+	// This is read from the entry rather than from the Command column so that it works regardless of which columns are
+	// displayed (and so that a misconfiguration can never cause something other than a command to be selected)
+	entry := m.selectedEntry()
+	if entry == nil {
+		return "", false
 	}
-	return model{ctx: ctx, spinner: s, isLoading: true, table: t, runQuery: &initialQuery, queryInput: queryInput, numEntries: numEntries}
+	return strings.ReplaceAll(entry.Command, "\n", " "), true
 }
 
-func (m model) Init() tea.Cmd {
-	return m.spinner.Tick
+// The name of the single column that the TUI displays when the line_template config option is set
+const LINE_TEMPLATE_COLUMN = "Result"
+
+// Returns the names of the columns to display in the TUI
+func getDisplayedColumns(ctx *context.Context) []string {
+	if hctx.GetConf(ctx).LineTemplate != "" {
+		return []string{LINE_TEMPLATE_COLUMN}
+	}
+	return hctx.GetConf(ctx).DisplayedColumns
 }
 
-func runQueryAndUpdateTable(m model, updateTable bool) model {
-	if (m.runQuery != nil && *m.runQuery != m.lastQuery) || updateTable {
-		if m.runQuery == nil {
-			m.runQuery = &m.lastQuery
-		}
-		rows, numEntries, err := getRows(m.ctx, hctx.GetConf(m.ctx).DisplayedColumns, *m.runQuery, PADDED_NUM_ENTRIES)
-		if err != nil {
-			m.searchErr = err
-			return m
-		} else {
-			m.searchErr = nil
-		}
-		m.numEntries = numEntries
-		if updateTable {
-			t, err := makeTable(m.ctx, rows)
-			if err != nil {
-				m.err = err
-				return m
-			}
-			m.table = t
+// Returns the names of the columns in the TUI's table. These are the displayed columns, unless the terminal is too narrow
+// for them (see isCompactMode).
+func getTableColumns(ctx *context.Context) []string {
+	if hctx.GetConf(ctx).LineTemplate == "" && isCompactMode(ctx) {
+		return []string{"Command"}
+	}
+	return getDisplayedColumns(ctx)
+}
+
+// Returns the index of the Command column in the table, or -1 if it isn't displayed
+func getIndexOfCommandColumn(ctx *context.Context) int {
+	for i, columnName := range getTableColumns(ctx) {
+		if columnName == "Command" {
+			return i
 		}
-		m.table.SetRows(rows)
-		m.table.SetCursor(0)
-		m.lastQuery = *m.runQuery
-		m.runQuery = nil
 	}
-	if m.table.Cursor() >= m.numEntries {
-		// Ensure that we can't scroll past the end of the table
-		m.table.SetCursor(m.numEntries - 1)
+	return -1
+}
+
+// Returns the rows to display for the given query, padded with empty rows up to numEntries. Also returns the entries
+// for each of the non-empty rows (in the same order) and the number of entries that matched the query.
+func getRows(ctx *context.Context, columnNames []string, query string, numEntries int, opts SearchOptions) ([]table.Row, []*data.HistoryEntry, int, error) {
+	rows, entries, numSearchResults, err := getPageOfRows(ctx, columnNames, query, numEntries, opts, nil)
+	if err != nil {
+		return nil, nil, 0, err
 	}
-	return m
+	return padRows(ctx, rows), entries, numSearchResults, nil
 }
 
-func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	switch msg := msg.(type) {
-	case tea.KeyMsg:
-		switch msg.String() {
-		case "esc", "ctrl+c":
-			m.quitting = true
-			return m, tea.Quit
-		case "enter":
-			if m.numEntries != 0 {
-				m.selected = true
-			}
-			return m, tea.Quit
-		default:
-			t, cmd1 := m.table.Update(msg)
-			m.table = t
-			if strings.HasPrefix(msg.String(), "alt+") {
-				return m, tea.Batch(cmd1)
-			}
-			i, cmd2 := m.queryInput.Update(msg)
-			m.queryInput = i
-			searchQuery := m.queryInput.Value()
-			m.runQuery = &searchQuery
-			m = runQueryAndUpdateTable(m, false)
-			return m, tea.Batch(cmd1, cmd2)
+// Moves the entries for pinned commands to the top of the results. Pinned commands are only shown once, at the top of
+// the first page, so any other entries for them are removed from every page.
+func pinEntries(ctx *context.Context, query string, opts SearchOptions, entries []*data.HistoryEntry) ([]*data.HistoryEntry, error) {
+	pinnedCommands := hctx.GetConf(ctx).PinnedCommands
+	if len(pinnedCommands) == 0 || opts.UniqueDirectories {
+		// Pinned entries would break up the one entry per directory
+		return entries, nil
+	}
+	pinned := make([]*data.HistoryEntry, 0)
+	if opts.Offset == 0 {
+		var err error
+		pinned, err = getPinnedEntries(ctx, query, opts)
+		if err != nil {
+			return nil, err
 		}
-	case tea.WindowSizeMsg:
-		m = runQueryAndUpdateTable(m, true)
-		return m, nil
-	case errMsg:
-		m.err = msg
-		return m, nil
-	case offlineMsg:
-		m.isOffline = true
-		return m, nil
-	case bannerMsg:
-		m.banner = msg.banner
-		return m, nil
-	case doneDownloadingMsg:
-		m.isLoading = false
-		return m, nil
-	default:
-		var cmd tea.Cmd
-		if m.isLoading {
-			m.spinner, cmd = m.spinner.Update(msg)
-			return m, cmd
-		} else {
-			m.table, cmd = m.table.Update(msg)
-			return m, cmd
+	}
+	for _, entry := range entries {
+		if !containsString(pinnedCommands, entry.Command) {
+			pinned = append(pinned, entry)
 		}
 	}
+	return pinned, nil
 }
 
-func (m model) View() string {
-	if m.err != nil {
-		return fmt.Sprintf("An unrecoverable error occured: %v\n", m.err)
+// Pins the selected command to the top of the results, or unpins it if it is already pinned. This is saved in the
+// config so that it is pinned in future searches too.
+func togglePin(m model) model {
+	entry := m.selectedEntry()
+	if entry == nil {
+		return m
 	}
-	if m.selected {
-		indexOfCommand := -1
-		for i, columnName := range hctx.GetConf(m.ctx).DisplayedColumns {
-			if columnName == "Command" {
-				indexOfCommand = i
-				break
+	config, err := hctx.GetConfig()
+	if err != nil {
+		m.searchErr = fmt.Errorf("failed to update the pinned commands: %v", err)
+		return m
+	}
+	if containsString(config.PinnedCommands, entry.Command) {
+		pinnedCommands := make([]string, 0)
+		for _, command := range config.PinnedCommands {
+			if command != entry.Command {
+				pinnedCommands = append(pinnedCommands, command)
 			}
 		}
-		if indexOfCommand == -1 {
-			selectedRow = "Error: Table doesn't have a column named `Command`?"
-			return ""
-		}
-		selectedRow = m.table.SelectedRow()[indexOfCommand]
-		return ""
-	}
-	if m.quitting {
-		return ""
-	}
-	loadingMessage := ""
-	if m.isLoading {
-		loadingMessage = fmt.Sprintf("%s Loading hishtory entries from other devices...", m.spinner.View())
+		config.PinnedCommands = pinnedCommands
+	} else {
+		config.PinnedCommands = append(config.PinnedCommands, entry.Command)
 	}
-	warning := ""
-	if m.isOffline {
-		warning += "Warning: failed to contact the hishtory backend (are you offline?), so some results may be stale\n\n"
+	if err := hctx.SetConfig(config); err != nil {
+		m.searchErr = fmt.Errorf("failed to update the pinned commands: %v", err)
+		return m
 	}
-	if m.searchErr != nil {
-		warning += fmt.Sprintf("Warning: failed to search: %v\n\n", m.searchErr)
+	// Only the pins are updated in the current config, so that any per-directory overrides still apply
+	currentConfig := hctx.GetConf(m.ctx)
+	currentConfig.PinnedCommands = config.PinnedCommands
+	m.ctx = hctx.WithConfig(m.ctx, currentConfig)
+	return runQueryAndUpdateTable(m, true, false)
+}
+
+// Pads the rows with empty rows so that they fill the table even when only a few rows were loaded (e.g. if
+// tui_search_limit is small), without going over the maximum number of rows
+func padRows(ctx *context.Context, rows []table.Row) []table.Row {
+	for len(rows) < min(TABLE_HEIGHT, getTuiMaxRows(ctx)) {
+		rows = append(rows, table.Row{})
 	}
-	return fmt.Sprintf("\n%s\n%s%s\nSearch Query: %s\n\n%s\n", loadingMessage, warning, m.banner, m.queryInput.View(), baseStyle.Render(m.table.View()))
+	return rows
 }
 
-func getRows(ctx *context.Context, columnNames []string, query string, numEntries int) ([]table.Row, int, error) {
-	db := hctx.GetDb(ctx)
+// Returns the rows for up to numEntries entries matching the query, starting at opts.Offset. previousEntries are the
+// entries that were already loaded for earlier pages (see queryEntriesForDisplay). Like getRows, this also returns the
+// number of entries that were found, including any duplicates that were filtered out.
+func getPageOfRows(ctx *context.Context, columnNames []string, query string, numEntries int, opts SearchOptions, previousEntries []*data.HistoryEntry) ([]table.Row, []*data.HistoryEntry, int, error) {
+	// Never load more than the maximum number of rows, so that huge histories can't use an unbounded amount of memory
+	numEntries = min(numEntries, getTuiMaxRows(ctx)-opts.Offset)
 	config := hctx.GetConf(ctx)
-	data, err := Search(ctx, db, query, numEntries)
+	entries, numSearchResults, err := queryEntriesForDisplay(ctx, query, numEntries, opts, previousEntries)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	entries, err = pinEntries(ctx, query, opts, entries)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 	var rows []table.Row
-	lastCommand := ""
-	for i := 0; i < numEntries; i++ {
-		if i < len(data) {
-			entry := data[i]
-			if strings.TrimSpace(entry.Command) == strings.TrimSpace(lastCommand) && config.FilterDuplicateCommands {
-				continue
-			}
-			entry.Command = strings.ReplaceAll(entry.Command, "\n", " ") // TODO: handle multi-line commands better here
-			row, err := buildTableRow(ctx, columnNames, *entry)
-			if err != nil {
-				return nil, 0, fmt.Errorf("failed to build row for entry=%#v: %v", entry, err)
-			}
-			rows = append(rows, row)
-			lastCommand = entry.Command
+	for _, entry := range entries {
+		// Copy the entry so that the entry we return still has the original multi-line command
+		displayedEntry := *entry
+		// Multi-line commands are flattened into a single line in the table, the full command is shown in the preview pane
+		displayedEntry.Command = strings.ReplaceAll(entry.Command, "\n", " ")
+		var row table.Row
+		if config.LineTemplate != "" {
+			var line string
+			line, err = renderLineTemplate(ctx, config.LineTemplate, displayedEntry)
+			row = table.Row{line}
 		} else {
-			rows = append(rows, table.Row{})
+			row, err = buildTableRow(ctx, columnNames, displayedEntry)
 		}
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to build row for entry=%#v: %v", entry, err)
+		}
+		rows = append(rows, row)
 	}
-	return rows, len(data), nil
+	// Pad the table with empty rows for the results that weren't found
+	for i := numSearchResults; i < numEntries; i++ {
+		rows = append(rows, table.Row{})
+	}
+	return rows, entries, numSearchResults, nil
 }
 
 func calculateColumnWidths(rows []table.Row) []int {
@@ -253,50 +2326,98 @@ func calculateColumnWidths(rows []table.Row) []int {
 	return neededColumnWidth
 }
 
-func getTerminalSize() (int, int, error) {
+// Returns the width and height of the terminal that the TUI is rendered on. A variable so that it can be replaced in tests.
+var getTerminalSize = func() (int, int, error) {
 	return term.GetSize(2)
 }
 
-var bigQueryResults []table.Row
+// The terminal size that is assumed if it can't be determined (e.g. because stderr isn't a tty) and isn't set via
+// $COLUMNS and $LINES
+const DEFAULT_TERMINAL_WIDTH = 80
+const DEFAULT_TERMINAL_HEIGHT = 24
+
+// Returns the width and height of the terminal, falling back to $COLUMNS and $LINES (or to a default size) if it can't be
+// determined so that the TUI can still be rendered in e.g. tmux popups and some SSH setups
+func getTerminalSizeOrDefault() (int, int) {
+	width, height, err := getTerminalSize()
+	if err == nil && width > 0 && height > 0 {
+		return width, height
+	}
+	return getEnvInt("COLUMNS", DEFAULT_TERMINAL_WIDTH), getEnvInt("LINES", DEFAULT_TERMINAL_HEIGHT)
+}
+
+// Returns the value of the given environment variable if it is set to a positive integer, or otherwise the default
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
 
-func makeTableColumns(ctx *context.Context, columnNames []string, rows []table.Row) ([]table.Column, error) {
+// Makes the columns for the given rows. bigQueryResults caches the results of searching for the empty string, which
+// are used to decide how much padding is useful for each column. It is populated if it is nil.
+func makeTableColumns(ctx *context.Context, columnNames []string, rows []table.Row, bigQueryResults *[]table.Row) ([]table.Column, error) {
 	// Handle an initial query with no results
 	if len(rows) == 0 || len(rows[0]) == 0 {
-		allRows, _, err := getRows(ctx, columnNames, "", 25)
+		allRows, _, _, err := getRows(ctx, columnNames, "", 25, SearchOptions{})
 		if err != nil {
 			return nil, err
 		}
-		return makeTableColumns(ctx, columnNames, allRows)
+		return makeTableColumns(ctx, columnNames, allRows, bigQueryResults)
 	}
 
 	// Calculate the minimum amount of space that we need for each column for the current actual search
 	columnWidths := calculateColumnWidths(rows)
-	totalWidth := 20
-	for i, name := range columnNames {
-		columnWidths[i] = max(columnWidths[i], len(name))
-		totalWidth += columnWidths[i]
-	}
 
 	// Calculate the maximum column width that is useful for each column if we search for the empty string
-	if bigQueryResults == nil {
-		bigRows, _, err := getRows(ctx, columnNames, "", 1000)
+	if *bigQueryResults == nil {
+		bigRows, _, _, err := getRows(ctx, columnNames, "", 1000, SearchOptions{})
 		if err != nil {
 			return nil, err
 		}
-		bigQueryResults = bigRows
+		*bigQueryResults = bigRows
 	}
-	maximumColumnWidths := calculateColumnWidths(bigQueryResults)
+	maximumColumnWidths := calculateColumnWidths(*bigQueryResults)
 
-	// Get the actual terminal width. If we're below this, opportunistically add some padding aiming for the maximum column widths
-	terminalWidth, _, err := getTerminalSize()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get terminal size: %v", err)
+	terminalWidth, _ := getTerminalSizeOrDefault()
+	config := hctx.GetConf(ctx)
+	if config.LineTemplate != "" {
+		// Lines always take up the full width (minus the table's border and the cell's padding) and are truncated past that
+		return []table.Column{{Title: LINE_TEMPLATE_COLUMN, Width: max(terminalWidth-4, 1)}}, nil
+	}
+	columnWidths = fitColumnWidths(columnNames, columnWidths, maximumColumnWidths, config.ColumnWidths, terminalWidth, config.ColumnShrinkMode)
+
+	// And finally, create some actual columns!
+	columns := make([]table.Column, 0)
+	for i, name := range columnNames {
+		columns = append(columns, table.Column{Title: name, Width: columnWidths[i]})
 	}
+	return columns, nil
+}
+
+// Returns the width of each column given the width needed for the current results (columnWidths), the width that
+// would be useful for any results (maximumColumnWidths), and the user's fixed column widths (if any)
+func fitColumnWidths(columnNames []string, columnWidths, maximumColumnWidths []int, fixedWidths map[string]int, terminalWidth int, shrinkMode string) []int {
+	widths := make([]int, len(columnNames))
+	isFixed := make([]bool, len(columnNames))
+	totalWidth := 20
+	for i, name := range columnNames {
+		if fixedWidth, ok := fixedWidths[name]; ok {
+			widths[i] = fixedWidth
+			isFixed[i] = true
+		} else {
+			widths[i] = max(columnWidths[i], len(name))
+		}
+		totalWidth += widths[i]
+	}
+
+	// If we're below the terminal width, opportunistically add some padding aiming for the maximum column widths
 	for totalWidth < (terminalWidth - len(columnNames)) {
 		prevTotalWidth := totalWidth
 		for i := range columnNames {
-			if columnWidths[i] < maximumColumnWidths[i]+5 {
-				columnWidths[i] += 1
+			if !isFixed[i] && widths[i] < maximumColumnWidths[i]+5 {
+				widths[i] += 1
 				totalWidth += 1
 			}
 		}
@@ -305,26 +2426,83 @@ func makeTableColumns(ctx *context.Context, columnNames []string, rows []table.R
 		}
 	}
 
-	// And if we are too large from the initial query, let's shrink things to make the table fit. We'll use the heuristic of always shrinking the widest column.
-	for totalWidth > terminalWidth {
-		largestColumnIdx := -1
-		largestColumnSize := -1
+	// And if we are too large, let's shrink things to make the table fit. We first shrink the columns that don't have a
+	// fixed width, and only shrink the fixed width columns (which will truncate them) if that isn't enough.
+	if totalWidth > terminalWidth {
+		autoIndices := make([]int, 0)
+		autoWidths := make([]int, 0)
+		shrinkableWidth := 0
 		for i := range columnNames {
-			if columnWidths[i] > largestColumnSize {
-				largestColumnIdx = i
-				largestColumnSize = columnWidths[i]
+			if !isFixed[i] {
+				autoIndices = append(autoIndices, i)
+				autoWidths = append(autoWidths, widths[i])
+				shrinkableWidth += max(widths[i]-1, 0)
+			}
+		}
+		excessWidth := totalWidth - terminalWidth
+		autoExcessWidth := min(excessWidth, shrinkableWidth)
+		if autoExcessWidth > 0 {
+			for j, w := range shrinkColumnWidths(autoWidths, autoExcessWidth, shrinkMode) {
+				totalWidth -= widths[autoIndices[j]] - w
+				widths[autoIndices[j]] = w
 			}
 		}
-		columnWidths[largestColumnIdx] -= 2
-		totalWidth -= 2
+		if totalWidth > terminalWidth {
+			widths = shrinkColumnWidths(widths, totalWidth-terminalWidth, shrinkMode)
+		}
 	}
+	return widths
+}
 
-	// And finally, create some actual columns!
-	columns := make([]table.Column, 0)
-	for i, name := range columnNames {
-		columns = append(columns, table.Column{Title: name, Width: columnWidths[i]})
+// The supported values for the column_shrink_mode config option. The empty string is treated as "widest".
+var ColumnShrinkModes = []string{"widest", "proportional"}
+
+// Shrinks the given column widths so that they take up at least excessWidth fewer characters. In the default widest
+// mode, this repeatedly shrinks the widest column. In proportional mode, each column is shrunk in proportion to its
+// width so that no single column collapses.
+func shrinkColumnWidths(columnWidths []int, excessWidth int, mode string) []int {
+	widths := make([]int, len(columnWidths))
+	copy(widths, columnWidths)
+	if len(widths) == 0 {
+		return widths
 	}
-	return columns, nil
+	if mode == "proportional" {
+		totalWidth := 0
+		for _, w := range widths {
+			totalWidth += w
+		}
+		removed := 0
+		for i, w := range widths {
+			cut := min(excessWidth*w/max(totalWidth, 1), w-1)
+			widths[i] -= cut
+			removed += cut
+		}
+		// Rounding down means we may still be a few characters too wide, so remove those one at a time from the widest columns
+		for removed < excessWidth {
+			widestIdx := getIndexOfWidestColumn(widths)
+			if widths[widestIdx] <= 1 {
+				break
+			}
+			widths[widestIdx] -= 1
+			removed += 1
+		}
+		return widths
+	}
+	for removed := 0; removed < excessWidth; removed += 2 {
+		widths[getIndexOfWidestColumn(widths)] -= 2
+	}
+	return widths
+}
+
+// Returns the index of the widest column, preferring the first one if there is a tie
+func getIndexOfWidestColumn(columnWidths []int) int {
+	widestIdx := 0
+	for i, w := range columnWidths {
+		if w > columnWidths[widestIdx] {
+			widestIdx = i
+		}
+	}
+	return widestIdx
 }
 
 func max(a, b int) int {
@@ -340,11 +2518,22 @@ func min(a, b int) int {
 	return b
 }
 
-func makeTable(ctx *context.Context, rows []table.Row) (table.Model, error) {
-	config := hctx.GetConf(ctx)
-	columns, err := makeTableColumns(ctx, config.DisplayedColumns, rows)
+// Makes the table for the given rows. The columns are also returned, since the table doesn't expose them.
+func makeTable(ctx *context.Context, rows []table.Row, bigQueryResults *[]table.Row, opts SearchOptions) (table.Model, []table.Column, error) {
+	columns, err := makeTableColumns(ctx, getTableColumns(ctx), rows, bigQueryResults)
 	if err != nil {
-		return table.Model{}, err
+		return table.Model{}, nil, err
+	}
+	for i := range columns {
+		// Show which column the results are sorted by, and in which direction
+		if columns[i].Title == opts.SortColumn {
+			if opts.SortAscending {
+				columns[i].Title += " ▲"
+			} else {
+				columns[i].Title += " ▼"
+			}
+			columns[i].Width = max(columns[i].Width, runewidth.StringWidth(columns[i].Title))
+		}
 	}
 	km := table.KeyMap{
 		LineUp: key.NewBinding(
@@ -372,49 +2561,88 @@ func makeTable(ctx *context.Context, rows []table.Row) (table.Model, error) {
 			key.WithHelp("end", "go to end"),
 		),
 	}
-	_, terminalHeight, err := getTerminalSize()
-	if err != nil {
-		return table.Model{}, err
-	}
-	tableHeight := min(TABLE_HEIGHT, terminalHeight-12)
+	// This is only the initial height, since the TUI resizes the table to fit the terminal (see fitTableHeight)
 	t := table.New(
 		table.WithColumns(columns),
 		table.WithRows(rows),
 		table.WithFocused(true),
-		table.WithHeight(tableHeight),
+		table.WithHeight(TABLE_HEIGHT),
 		table.WithKeyMap(km),
 	)
 
+	theme := getTheme(ctx)
 	s := table.DefaultStyles()
 	s.Header = s.Header.
 		BorderStyle(lipgloss.NormalBorder()).
-		BorderForeground(lipgloss.Color("240")).
+		BorderForeground(lipgloss.Color(theme.Border)).
 		BorderBottom(true).
 		Bold(false)
 	s.Selected = s.Selected.
-		Foreground(lipgloss.Color("229")).
-		Background(lipgloss.Color("57")).
+		Foreground(lipgloss.Color(theme.SelectedForeground)).
+		Background(lipgloss.Color(theme.SelectedBackground)).
 		Bold(false)
+	if lipgloss.ColorProfile() == termenv.Ascii {
+		// Without colors the selected row would look the same as every other row, so mark it instead
+		s.Selected = s.Selected.Border(lipgloss.Border{Left: ">"}, false, false, false, true)
+	}
 	t.SetStyles(s)
 	t.Focus()
-	return t, nil
+	return t, columns, nil
+}
+
+// Warms up the DB (and the OS's page cache for it) by running the same queries that the TUI runs on startup, so that the
+// first control-R in a new shell session isn't slowed down by cold caches. Run in the background by the shell config.
+func Prewarm(ctx *context.Context) error {
+	columnNames := getTableColumns(ctx)
+	_, _, _, err := getRows(ctx, columnNames, "", getTuiSearchLimit(ctx), SearchOptions{})
+	if err != nil {
+		return err
+	}
+	_, _, _, err = getRows(ctx, columnNames, "", 1000, SearchOptions{})
+	return err
+}
+
+// Returns the color profile to render the TUI with. Colors are disabled if NO_COLOR is set (see https://no-color.org/),
+// and otherwise the profile is detected based on the terminal that the TUI is rendered on (i.e. stderr, since stdout
+// is captured by the shell integration). Without colors, the selected row is marked instead (see makeTable).
+func getColorProfile(stderr *termenv.Output) termenv.Profile {
+	if stderr.EnvNoColor() {
+		return termenv.Ascii
+	}
+	return stderr.ColorProfile()
 }
 
-func TuiQuery(ctx *context.Context, gitCommit, initialQuery string) error {
-	lipgloss.SetColorProfile(termenv.ANSI)
-	rows, numEntries, err := getRows(ctx, hctx.GetConf(ctx).DisplayedColumns, initialQuery, PADDED_NUM_ENTRIES)
+func TuiQuery(ctx *context.Context, gitCommit, initialQuery string, opts TuiOptions) error {
+	lipgloss.SetColorProfile(getColorProfile(termenv.NewOutput(os.Stderr)))
+	if opts.SearchLimit > 0 {
+		config := hctx.GetConf(ctx)
+		config.TuiSearchLimit = opts.SearchLimit
+		ctx = hctx.WithConfig(ctx, config)
+	}
+	if _, err := getRankingStrategy(ctx); err != nil {
+		return err
+	}
+	searchOptions := SearchOptions{ShowSensitive: opts.ShowSensitive}
+	startingQuery := getStartingQuery(ctx, initialQuery)
+	rows, entries, numEntries, err := getRows(ctx, getTableColumns(ctx), startingQuery, getTuiSearchLimit(ctx), searchOptions)
 	if err != nil {
 		return err
 	}
-	t, err := makeTable(ctx, rows)
+	var bigQueryResults []table.Row
+	t, columns, err := makeTable(ctx, rows, &bigQueryResults, searchOptions)
 	if err != nil {
 		return err
 	}
-	p := tea.NewProgram(initialModel(ctx, t, initialQuery, numEntries), tea.WithOutput(os.Stderr))
+	opts.Quiet = opts.Quiet || hctx.GetConf(ctx).Quiet
+	m := initialModel(ctx, t, rows, entries, startingQuery, numEntries, opts)
+	m.bigQueryResults = bigQueryResults
+	m.columns = columns
+	m = fitTableHeight(m)
+	p := tea.NewProgram(m, tea.WithOutput(os.Stderr))
 	go func() {
 		err := RetrieveAdditionalEntriesFromRemote(ctx)
 		if err != nil {
-			p.Send(err)
+			p.Send(errorToMsg(ctx, fmt.Errorf("failed to retrieve entries from other devices: %w", err)))
 		}
 		p.Send(doneDownloadingMsg{})
 	}()
@@ -422,30 +2650,153 @@ func TuiQuery(ctx *context.Context, gitCommit, initialQuery string) error {
 	go func() {
 		err := ProcessDeletionRequests(ctx)
 		if err != nil {
-			p.Send(err)
+			p.Send(errorToMsg(ctx, fmt.Errorf("failed to process deletion requests: %w", err)))
 		}
 	}()
 	// Async: Check for any banner from the server
 	go func() {
 		banner, err := GetBanner(ctx, gitCommit)
 		if err != nil {
-			if IsOfflineError(err) {
-				p.Send(offlineMsg{})
-			} else {
-				p.Send(err)
-			}
+			p.Send(errorToMsg(ctx, fmt.Errorf("failed to check for a banner: %w", err)))
 		}
 		p.Send(bannerMsg{banner: string(banner)})
 	}()
 	// Blocking: Start the TUI
-	err = p.Start()
+	finalModel, err := p.Run()
 	if err != nil {
 		return err
 	}
-	if selectedRow == "" && os.Getenv("HISHTORY_TERM_INTEGRATION") != "" {
-		// Print out the initialQuery instead so that we don't clear the terminal
-		selectedRow = initialQuery
+	// Any deletion that can no longer be undone still needs to be sent to the backend
+	if final := finalModel.(model); final.lastDeleted != nil && !final.lastDeletionSent {
+		final.searchErr = nil
+		if final = sendPendingDeletion(final); final.searchErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", final.searchErr)
+		}
+	}
+	if err := saveLastQuery(ctx, finalModel.(model).lastQuery); err != nil {
+		return err
+	}
+	if finalModel.(model).useTypedQuery {
+		selectedRow = finalModel.(model).queryInput.Value()
+	}
+	if selectedRow == "" {
+		selectedRow = getOutputOnQuit(ctx, initialQuery, finalModel.(model).queryInput.Value())
 	}
 	fmt.Printf("%s\n", selectedRow)
 	return nil
 }
+
+// A history entry as output by JsonQuery
+type jsonResult struct {
+	Command         string    `json:"command"`
+	ExitCode        int       `json:"exit_code"`
+	Hostname        string    `json:"hostname"`
+	Directory       string    `json:"directory"`
+	StartTime       time.Time `json:"start_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// Returns the entries matching the given query (with duplicates filtered the same way as in the TUI) in the format that
+// is output by JsonQuery
+func getJsonResults(ctx *context.Context, query string, limit int, opts SearchOptions) ([]jsonResult, error) {
+	entries, _, err := queryEntriesForDisplay(ctx, query, limit, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]jsonResult, 0)
+	for _, entry := range entries {
+		results = append(results, jsonResult{
+			Command:         entry.Command,
+			ExitCode:        entry.ExitCode,
+			Hostname:        entry.Hostname,
+			Directory:       entry.CurrentWorkingDirectory,
+			StartTime:       entry.StartTime,
+			DurationSeconds: entry.EndTime.Sub(entry.StartTime).Seconds(),
+		})
+	}
+	return results, nil
+}
+
+// Outputs the entries matching the given query as JSON (one object per line) so that they can be processed by other
+// tools, e.g. jq. A limit of 0 outputs all of the matching entries.
+func JsonQuery(ctx *context.Context, query string, limit int, opts SearchOptions) error {
+	results, err := getJsonResults(ctx, query, limit, opts)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, result := range results {
+		if err := encoder.Encode(result); err != nil {
+			return fmt.Errorf("failed to output entry as JSON: %v", err)
+		}
+	}
+	return nil
+}
+
+// The supported values for the tui_empty_enter_behavior config option. The empty string is treated as "quit".
+var TuiEmptyEnterBehaviors = []string{"quit", "ignore", "query"}
+
+// Handles enter being pressed when there are no results, based on the tui_empty_enter_behavior config option:
+//   - quit (the default): Exit the TUI, the same as if it were exited without selecting an entry
+//   - ignore: Do nothing and stay in the TUI
+//   - query: Exit the TUI and output the typed query, so that it becomes the command to run
+func enterWithNoResults(m model) (model, tea.Cmd) {
+	switch hctx.GetConf(m.ctx).TuiEmptyEnterBehavior {
+	case "ignore":
+		return m, nil
+	case "query":
+		m.useTypedQuery = true
+		return m, tea.Quit
+	default:
+		return m, tea.Quit
+	}
+}
+
+// Returns the query that the TUI starts with. This is the given initial query (i.e. what was already typed on the
+// command line), or the last query that was searched for if there isn't one and RememberLastQuery is enabled.
+func getStartingQuery(ctx *context.Context, initialQuery string) string {
+	config := hctx.GetConf(ctx)
+	if initialQuery == "" && config.RememberLastQuery {
+		return config.LastQuery
+	}
+	return initialQuery
+}
+
+// Saves the last query that was searched for in the TUI so that it can be restored the next time, if RememberLastQuery
+// is enabled
+func saveLastQuery(ctx *context.Context, lastQuery string) error {
+	if !hctx.GetConf(ctx).RememberLastQuery {
+		return nil
+	}
+	// Re-read the config rather than using the one from ctx, since that may include settings from a per-directory config
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return err
+	}
+	config.LastQuery = lastQuery
+	return hctx.SetConfig(config)
+}
+
+// The supported values for the tui_quit_behavior config option. The empty string is treated as "restore".
+var TuiQuitBehaviors = []string{"restore", "leave", "clear", "echo"}
+
+// Returns what should be output when the TUI is exited without selecting an entry. With the term integration,
+// this output replaces the contents of the shell's command line.
+func getOutputOnQuit(ctx *context.Context, initialQuery, finalQuery string) string {
+	switch hctx.GetConf(ctx).TuiQuitBehavior {
+	case "leave":
+		return ""
+	case "clear":
+		// Clear the screen via the same stream that the TUI is rendered on, so that this works with the term integration
+		fmt.Fprint(os.Stderr, "\033[H\033[2J")
+		return ""
+	case "echo":
+		return finalQuery
+	default:
+		if os.Getenv("HISHTORY_TERM_INTEGRATION") != "" {
+			// Print out the initialQuery instead so that we don't clear the terminal
+			return initialQuery
+		}
+		return ""
+	}
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The columns of the history entries table that are included in the usage breakdown, along with a description of each
+var usageColumns = [][]string{
+	{"command", "Commands"},
+	{"expanded_command", "Expanded commands"},
+	{"current_working_directory", "Working directories"},
+	{"home_directory", "Home directories"},
+	{"hostname", "Hostnames"},
+	{"local_username", "Usernames"},
+	{"device_id", "Device IDs"},
+	{"custom_columns", "Custom columns"},
+	{"normalized_paths", "Normalized paths"},
+	{"terminal_pane", "Terminal panes"},
+}
+
+// The number of bytes used by one column of the history entries table
+type ColumnUsage struct {
+	Description string
+	Bytes       int64
+}
+
+// The number of entries recorded on a single host
+type HostUsage struct {
+	Hostname string
+	Count    int64
+}
+
+// A summary of how the space in the local DB is used
+type Usage struct {
+	NumEntries     int64
+	DbFileBytes    int64
+	Columns        []ColumnUsage
+	LargestEntries []*data.HistoryEntry
+	Hosts          []HostUsage
+}
+
+// Computes how the space in the local DB is used, including the numLargest entries with the longest commands. This
+// is read-only, so it is safe to run at any time.
+func GetUsage(ctx *context.Context, numLargest int) (*Usage, error) {
+	db := hctx.GetDb(ctx)
+	var usage Usage
+	result := db.Model(&data.HistoryEntry{}).Count(&usage.NumEntries)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	for _, column := range usageColumns {
+		var bytes int64
+		result = db.Model(&data.HistoryEntry{}).Select("COALESCE(SUM(LENGTH(CAST(" + column[0] + " AS BLOB))), 0)").Scan(&bytes)
+		if result.Error != nil {
+			return nil, fmt.Errorf("DB query error: %v", result.Error)
+		}
+		usage.Columns = append(usage.Columns, ColumnUsage{Description: column[1], Bytes: bytes})
+	}
+	result = db.Model(&data.HistoryEntry{}).Order("LENGTH(command) DESC").Limit(numLargest).Find(&usage.LargestEntries)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	result = db.Model(&data.HistoryEntry{}).Select("hostname, COUNT(*) AS count").Group("hostname").Order("count DESC, hostname").Scan(&usage.Hosts)
+	if result.Error != nil {
+		return nil, fmt.Errorf("DB query error: %v", result.Error)
+	}
+	homedir := hctx.GetHome(ctx)
+	if stat, err := os.Stat(path.Join(homedir, data.HISHTORY_PATH, data.DB_PATH)); err == nil {
+		usage.DbFileBytes = stat.Size()
+	}
+	return &usage, nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/client/lib"
 	"github.com/ddworken/hishtory/shared"
+	"github.com/mattn/go-runewidth"
 )
 
 var GitCommit string = "Unknown"
@@ -29,16 +31,47 @@ func main() {
 		lib.CheckFatalError(maybeUploadSkippedHistoryEntries(ctx))
 		saveHistoryEntry(ctx)
 	case "query":
-		ctx := hctx.MakeContext()
+		ctx, err := lib.WithDirectoryConfig(hctx.MakeContext())
+		lib.CheckFatalError(err)
 		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
-		query(ctx, strings.Join(os.Args[2:], " "))
+		args, reverse := extractFlag(os.Args[2:], "--reverse")
+		args, showSensitive := extractFlag(args, "--show-sensitive")
+		args, jsonOutput := extractFlag(args, "--json")
+		args, limit := extractFlagValue(args, "--limit")
+		args = applySavedFilter(ctx, args)
+		if limit != "" && !jsonOutput {
+			log.Fatalf("--limit is only supported along with --json")
+		}
+		opts := lib.SearchOptions{Reverse: reverse, ShowSensitive: showSensitive}
+		if jsonOutput {
+			jsonQuery(ctx, strings.Join(args, " "), limit, opts)
+		} else {
+			query(ctx, strings.Join(args, " "), opts)
+		}
 	case "tquery":
-		ctx := hctx.MakeContext()
-		lib.CheckFatalError(lib.TuiQuery(ctx, GitCommit, strings.Join(os.Args[2:], " ")))
+		ctx, err := lib.WithDirectoryConfig(hctx.MakeContext())
+		lib.CheckFatalError(err)
+		args, quiet := extractFlag(os.Args[2:], "--quiet")
+		args, debug := extractFlag(args, "--debug")
+		args, showSensitive := extractFlag(args, "--show-sensitive")
+		args, limit := extractFlagValue(args, "--limit")
+		args = applySavedFilter(ctx, args)
+		searchLimit := 0
+		if limit != "" {
+			searchLimit, err = strconv.Atoi(limit)
+			if err != nil || searchLimit <= 0 {
+				log.Fatalf("--limit must be a positive integer, got %#v", limit)
+			}
+		}
+		lib.CheckFatalError(lib.TuiQuery(ctx, GitCommit, strings.Join(args, " "), lib.TuiOptions{Quiet: quiet, Debug: debug, ShowSensitive: showSensitive, SearchLimit: searchLimit}))
+	case "prewarm":
+		// Purposefully undocumented since this is run automatically in the background by the shell config
+		lib.CheckFatalError(lib.Prewarm(hctx.MakeContext()))
 	case "export":
 		ctx := hctx.MakeContext()
 		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
-		export(ctx, strings.Join(os.Args[2:], " "))
+		args, showSensitive := extractFlag(os.Args[2:], "--show-sensitive")
+		export(ctx, strings.Join(args, " "), lib.SearchOptions{ShowSensitive: showSensitive})
 	case "redact":
 		fallthrough
 	case "delete":
@@ -78,7 +111,8 @@ func main() {
 			}
 		}
 	case "install":
-		lib.CheckFatalError(lib.Install())
+		args, noSetup := extractFlag(os.Args, "--no-setup")
+		lib.CheckFatalError(lib.Install(args, noSetup))
 		if os.Getenv("HISHTORY_SKIP_INIT_IMPORT") == "" {
 			db, err := hctx.OpenLocalSqliteDb()
 			lib.CheckFatalError(err)
@@ -104,6 +138,18 @@ func main() {
 			return
 		}
 		lib.CheckFatalError(lib.Uninstall(hctx.MakeContext()))
+	case "key-rotate":
+		fmt.Printf("This will generate a new secret key and reupload your history encrypted with it. Your other devices will stop syncing until you run `hishtory init $NEW_KEY` on them. Entries encrypted with the old key are not deleted from the backend. Are you sure you want to rotate your key? [y/N]")
+		reader := bufio.NewReader(os.Stdin)
+		resp, err := reader.ReadString('\n')
+		lib.CheckFatalError(err)
+		if strings.TrimSpace(resp) != "y" {
+			fmt.Printf("Aborting key rotation per user response of %#v\n", strings.TrimSpace(resp))
+			return
+		}
+		newSecret, err := lib.RotateKey(hctx.MakeContext())
+		lib.CheckFatalError(err)
+		fmt.Printf("Rotated the secret hishtory key to %s\nRun `hishtory init %s` on your other devices to keep syncing with them\n", newSecret, newSecret)
 	case "import":
 		ctx := hctx.MakeContext()
 		numImported, err := lib.ImportHistory(ctx, true, true)
@@ -144,6 +190,84 @@ func main() {
 			fmt.Printf("%v", config.ControlRSearchEnabled)
 		case "filter-duplicate-commands":
 			fmt.Printf("%v", config.FilterDuplicateCommands)
+		case "dedup-mode":
+			fmt.Println(config.DedupMode)
+		case "filter-all-duplicate-commands":
+			fmt.Printf("%v", config.FilterAllDuplicateCommands)
+		case "quiet":
+			fmt.Printf("%v", config.Quiet)
+		case "column-shrink-mode":
+			fmt.Println(config.ColumnShrinkMode)
+		case "spinner-style":
+			fmt.Println(config.SpinnerStyle)
+		case "loading-message":
+			fmt.Println(config.LoadingMessage)
+		case "theme":
+			fmt.Println(config.Theme.Name)
+		case "copy-key":
+			fmt.Println(config.CopyKey)
+		case "theme-selected-foreground":
+			fmt.Println(config.Theme.SelectedForeground)
+		case "theme-selected-background":
+			fmt.Println(config.Theme.SelectedBackground)
+		case "theme-border":
+			fmt.Println(config.Theme.Border)
+		case "theme-spinner":
+			fmt.Println(config.Theme.Spinner)
+		case "theme-highlight":
+			fmt.Println(config.Theme.Highlight)
+		case "column-widths":
+			for name, width := range config.ColumnWidths {
+				fmt.Printf("%s: %d\n", name, width)
+			}
+		case "line-template":
+			fmt.Println(config.LineTemplate)
+		case "cwd-match-mode":
+			fmt.Println(config.CwdMatchMode)
+		case "ranking-strategy":
+			fmt.Println(config.RankingStrategy)
+		case "fuzzy-search":
+			fmt.Printf("%v", config.FuzzySearch)
+		case "case-sensitive-search":
+			fmt.Printf("%v", config.CaseSensitiveSearch)
+		case "tui-max-rows":
+			fmt.Println(config.TuiMaxRows)
+		case "tui-search-limit":
+			fmt.Println(config.TuiSearchLimit)
+		case "query-char-limit":
+			fmt.Println(config.QueryCharLimit)
+		case "compact-mode-width":
+			fmt.Println(config.CompactModeWidth)
+		case "search-debounce-ms":
+			fmt.Println(config.SearchDebounceMs)
+		case "context-lines":
+			fmt.Println(config.ContextLines)
+		case "display-timezone":
+			fmt.Println(config.DisplayTimezone)
+		case "highlight-matches":
+			fmt.Printf("%v", config.HighlightMatches)
+		case "confirm-multi-line-exec":
+			fmt.Printf("%v", config.ConfirmMultiLineExec)
+		case "cd-and-run-command":
+			fmt.Printf("%v", config.CdAndRunCommand)
+		case "enable-vim-keybindings":
+			fmt.Printf("%v", config.EnableVimKeybindings)
+		case "remember-last-query":
+			fmt.Printf("%v", config.RememberLastQuery)
+		case "tui-quit-behavior":
+			fmt.Println(config.TuiQuitBehavior)
+		case "tui-empty-enter-behavior":
+			fmt.Println(config.TuiEmptyEnterBehavior)
+		case "remote-only":
+			fmt.Printf("%v", config.RemoteOnly)
+		case "normalize-paths":
+			fmt.Printf("%v", config.NormalizePaths)
+		case "default-filter":
+			fmt.Println(config.DefaultFilter)
+		case "trusted-directories":
+			for _, dir := range config.TrustedDirectories {
+				fmt.Println(dir)
+			}
 		case "displayed-columns":
 			for _, col := range config.DisplayedColumns {
 				if strings.Contains(col, " ") {
@@ -157,6 +281,22 @@ func main() {
 			for _, cc := range config.CustomColumns {
 				fmt.Println(cc.ColumnName + ":   " + cc.ColumnCommand)
 			}
+		case "never-record-programs":
+			fmt.Println(strings.Join(config.NeverRecordPrograms, " "))
+		case "hidden-programs":
+			fmt.Println(strings.Join(config.HiddenPrograms, " "))
+		case "pinned-commands":
+			for _, command := range config.PinnedCommands {
+				fmt.Println(command)
+			}
+		case "auto-tags":
+			for _, rule := range config.AutoTags {
+				fmt.Println(lib.FormatAutoTagRule(rule))
+			}
+		case "saved-filters":
+			for name, query := range config.SavedFilters {
+				fmt.Printf("%s: %s\n", name, query)
+			}
 		default:
 			log.Fatalf("Unrecognized config key: %s", key)
 		}
@@ -179,6 +319,221 @@ func main() {
 			}
 			config.FilterDuplicateCommands = (val == "true")
 			lib.CheckFatalError(hctx.SetConfig(config))
+		case "dedup-mode":
+			val := os.Args[3]
+			if !containsString(lib.DedupModes, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.DedupModes, ", "))
+			}
+			config.DedupMode = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "filter-all-duplicate-commands":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.FilterAllDuplicateCommands = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "quiet":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.Quiet = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "confirm-multi-line-exec":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.ConfirmMultiLineExec = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "enable-vim-keybindings":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.EnableVimKeybindings = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "remember-last-query":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.RememberLastQuery = (val == "true")
+			if !config.RememberLastQuery {
+				config.LastQuery = ""
+			}
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "normalize-paths":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.NormalizePaths = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "fuzzy-search":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.FuzzySearch = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "case-sensitive-search":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.CaseSensitiveSearch = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "cd-and-run-command":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.CdAndRunCommand = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "highlight-matches":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			config.HighlightMatches = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "remote-only":
+			val := os.Args[3]
+			if val != "true" && val != "false" {
+				log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+			}
+			if val == "true" && config.IsOffline {
+				log.Fatalf("Cannot enable remote-only mode for an offline install")
+			}
+			config.RemoteOnly = (val == "true")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "tui-quit-behavior":
+			val := os.Args[3]
+			if !containsString(lib.TuiQuitBehaviors, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.TuiQuitBehaviors, ", "))
+			}
+			config.TuiQuitBehavior = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "tui-max-rows":
+			val, err := strconv.Atoi(os.Args[3])
+			if err != nil || val <= 0 {
+				log.Fatalf("Unexpected config value %s, must be a positive integer", os.Args[3])
+			}
+			config.TuiMaxRows = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "tui-search-limit":
+			val, err := strconv.Atoi(os.Args[3])
+			if err != nil || val <= 0 {
+				log.Fatalf("Unexpected config value %s, must be a positive integer", os.Args[3])
+			}
+			config.TuiSearchLimit = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "query-char-limit":
+			val, err := strconv.Atoi(os.Args[3])
+			if err != nil || val < 0 {
+				log.Fatalf("Unexpected config value %s, must be a non-negative integer (or 0 for no limit)", os.Args[3])
+			}
+			config.QueryCharLimit = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "compact-mode-width":
+			val, err := strconv.Atoi(os.Args[3])
+			if err != nil {
+				log.Fatalf("Unexpected config value %s, must be an integer (or a negative number to disable compact mode)", os.Args[3])
+			}
+			config.CompactModeWidth = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "search-debounce-ms":
+			val, err := strconv.Atoi(os.Args[3])
+			if err != nil {
+				log.Fatalf("Unexpected config value %s, must be an integer (or a negative number to run the query on every keystroke)", os.Args[3])
+			}
+			config.SearchDebounceMs = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "context-lines":
+			val, err := strconv.Atoi(os.Args[3])
+			if err != nil || val < 0 {
+				log.Fatalf("Unexpected config value %s, must be a non-negative integer (or 0 for the default)", os.Args[3])
+			}
+			config.ContextLines = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "cwd-match-mode":
+			val := os.Args[3]
+			if !containsString(lib.CwdMatchModes, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.CwdMatchModes, ", "))
+			}
+			config.CwdMatchMode = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "ranking-strategy":
+			val := os.Args[3]
+			if !containsString(lib.RankingStrategies, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.RankingStrategies, ", "))
+			}
+			config.RankingStrategy = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "column-shrink-mode":
+			val := os.Args[3]
+			if !containsString(lib.ColumnShrinkModes, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.ColumnShrinkModes, ", "))
+			}
+			config.ColumnShrinkMode = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "spinner-style":
+			val := os.Args[3]
+			if !containsString(lib.SpinnerStyles, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.SpinnerStyles, ", "))
+			}
+			config.SpinnerStyle = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "loading-message":
+			// An empty message goes back to the default
+			config.LoadingMessage = os.Args[3]
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "theme":
+			val := os.Args[3]
+			if !containsString(lib.ThemeNames, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.ThemeNames, ", "))
+			}
+			config.Theme.Name = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "copy-key":
+			// An empty key goes back to the default of ctrl+y
+			config.CopyKey = os.Args[3]
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "theme-selected-foreground", "theme-selected-background", "theme-border", "theme-spinner", "theme-highlight":
+			// An empty color goes back to using the color from the selected theme
+			val := os.Args[3]
+			if val != "" && !lib.IsValidThemeColor(val) {
+				log.Fatalf("Unexpected config value %s, must be an ANSI color number from 0 to 255 or a hex color like #268bd2", val)
+			}
+			switch os.Args[2] {
+			case "theme-selected-foreground":
+				config.Theme.SelectedForeground = val
+			case "theme-selected-background":
+				config.Theme.SelectedBackground = val
+			case "theme-border":
+				config.Theme.Border = val
+			case "theme-spinner":
+				config.Theme.Spinner = val
+			case "theme-highlight":
+				config.Theme.Highlight = val
+			}
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "line-template":
+			// An empty template switches back to the table of columns
+			config.LineTemplate = os.Args[3]
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "tui-empty-enter-behavior":
+			val := os.Args[3]
+			if !containsString(lib.TuiEmptyEnterBehaviors, val) {
+				log.Fatalf("Unexpected config value %s, must be one of: %s", val, strings.Join(lib.TuiEmptyEnterBehaviors, ", "))
+			}
+			config.TuiEmptyEnterBehavior = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "default-filter":
+			config.DefaultFilter = strings.Join(os.Args[3:], " ")
+			lib.CheckFatalError(hctx.SetConfig(config))
 		case "displayed-columns":
 			vals := os.Args[3:]
 			config.DisplayedColumns = vals
@@ -187,6 +542,19 @@ func main() {
 			val := os.Args[3]
 			config.TimestampFormat = val
 			lib.CheckFatalError(hctx.SetConfig(config))
+		case "display-timezone":
+			val := os.Args[3]
+			if _, err := time.LoadLocation(val); err != nil {
+				log.Fatalf("Unexpected config value %s, must be a timezone name like UTC or America/New_York: %v", val, err)
+			}
+			config.DisplayTimezone = val
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "never-record-programs":
+			config.NeverRecordPrograms = os.Args[3:]
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "hidden-programs":
+			config.HiddenPrograms = os.Args[3:]
+			lib.CheckFatalError(hctx.SetConfig(config))
 		case "custom-columns":
 			log.Fatalf("Please use config-add and config-delete to interact with custom-columns")
 		default:
@@ -213,6 +581,51 @@ func main() {
 			vals := os.Args[3:]
 			config.DisplayedColumns = append(config.DisplayedColumns, vals...)
 			lib.CheckFatalError(hctx.SetConfig(config))
+		case "never-record-programs":
+			config.NeverRecordPrograms = append(config.NeverRecordPrograms, os.Args[3:]...)
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "hidden-programs":
+			config.HiddenPrograms = append(config.HiddenPrograms, os.Args[3:]...)
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "column-widths":
+			if len(os.Args) != 5 {
+				log.Fatalf("Usage: hishtory config-add column-widths <column> <width>")
+			}
+			width, err := strconv.Atoi(os.Args[4])
+			if err != nil || width <= 0 {
+				log.Fatalf("Unexpected width %#v, must be a positive integer", os.Args[4])
+			}
+			if config.ColumnWidths == nil {
+				config.ColumnWidths = make(map[string]int)
+			}
+			config.ColumnWidths[os.Args[3]] = width
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "auto-tags":
+			if len(os.Args) != 5 {
+				log.Fatalf("Usage: hishtory config-add auto-tags <tag> cwd:<dir>|program:<program>")
+			}
+			rule, err := lib.ParseAutoTagRule(os.Args[3], os.Args[4])
+			lib.CheckFatalError(err)
+			config.AutoTags = append(config.AutoTags, rule)
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "saved-filters":
+			if len(os.Args) < 5 {
+				log.Fatalf("Usage: hishtory config-add saved-filters <name> <query>")
+			}
+			if config.SavedFilters == nil {
+				config.SavedFilters = make(map[string]string)
+			}
+			config.SavedFilters[os.Args[3]] = strings.Join(os.Args[4:], " ")
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "pinned-commands":
+			if len(os.Args) < 4 {
+				log.Fatalf("Usage: hishtory config-add pinned-commands <command>")
+			}
+			command := strings.Join(os.Args[3:], " ")
+			if !containsString(config.PinnedCommands, command) {
+				config.PinnedCommands = append(config.PinnedCommands, command)
+			}
+			lib.CheckFatalError(hctx.SetConfig(config))
 		default:
 			log.Fatalf("Unrecognized config key: %s", key)
 		}
@@ -257,9 +670,131 @@ func main() {
 			}
 			config.DisplayedColumns = newColumns
 			lib.CheckFatalError(hctx.SetConfig(config))
+		case "never-record-programs":
+			config.NeverRecordPrograms = removeAll(config.NeverRecordPrograms, os.Args[3:])
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "hidden-programs":
+			config.HiddenPrograms = removeAll(config.HiddenPrograms, os.Args[3:])
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "column-widths":
+			for _, name := range os.Args[3:] {
+				delete(config.ColumnWidths, name)
+			}
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "auto-tags":
+			// Deletes every rule for the given tags
+			newRules := make([]hctx.AutoTagRule, 0)
+			for _, rule := range config.AutoTags {
+				if !containsString(os.Args[3:], rule.Tag) {
+					newRules = append(newRules, rule)
+				}
+			}
+			config.AutoTags = newRules
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "saved-filters":
+			for _, name := range os.Args[3:] {
+				delete(config.SavedFilters, name)
+			}
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "trusted-directories":
+			config.TrustedDirectories = removeAll(config.TrustedDirectories, os.Args[3:])
+			lib.CheckFatalError(hctx.SetConfig(config))
+		case "pinned-commands":
+			config.PinnedCommands = removeAll(config.PinnedCommands, []string{strings.Join(os.Args[3:], " ")})
+			lib.CheckFatalError(hctx.SetConfig(config))
 		default:
 			log.Fatalf("Unrecognized config key: %s", key)
 		}
+	case "config-validate":
+		errs := lib.ValidateConfigFile()
+		if len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Println(err)
+			}
+			os.Exit(1)
+		}
+		fmt.Println("Config is valid")
+	case "dirs":
+		lib.CheckFatalError(lib.DirsQuery(hctx.MakeContext(), strings.Join(os.Args[2:], " ")))
+	case "replay":
+		args, sessionId := extractFlagValue(os.Args[2:], "--session")
+		args, printOnly := extractFlag(args, "--print")
+		if sessionId == "" || len(args) > 0 {
+			log.Fatalf("Usage: hishtory replay --session <id|current> [--print]")
+		}
+		entries, err := lib.GetSessionEntries(hctx.MakeContext(), sessionId)
+		lib.CheckFatalError(err)
+		if printOnly {
+			for _, entry := range entries {
+				fmt.Println(entry.Command)
+			}
+			return
+		}
+		lib.CheckFatalError(lib.Replay(entries, os.Stdin, os.Stdout, lib.RunReplayedCommand))
+	case "config-export":
+		exported, err := lib.ExportConfig(hctx.MakeContext())
+		lib.CheckFatalError(err)
+		if len(os.Args) > 2 {
+			lib.CheckFatalError(os.WriteFile(os.Args[2], exported, 0o600))
+		} else {
+			fmt.Println(string(exported))
+		}
+	case "config-import":
+		if len(os.Args) != 3 {
+			log.Fatalf("Usage: hishtory config-import <path>")
+		}
+		contents, err := os.ReadFile(os.Args[2])
+		lib.CheckFatalError(err)
+		warnings, err := lib.ImportConfig(hctx.MakeContext(), contents)
+		lib.CheckFatalError(err)
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+		fmt.Println("Imported config from " + os.Args[2])
+	case "test-pattern":
+		if len(os.Args) != 3 {
+			log.Fatalf("Usage: hishtory test-pattern <program>")
+		}
+		matches, err := lib.TestPattern(hctx.MakeContext(), os.Args[2])
+		lib.CheckFatalError(err)
+		total := 0
+		for _, match := range matches {
+			fmt.Printf("%6d  %s\n", match.Count, match.Command)
+			total += match.Count
+		}
+		fmt.Printf("%d entries (%d distinct commands) match %#v\n", total, len(matches), os.Args[2])
+	case "reclassify":
+		ctx := hctx.MakeContext()
+		lib.CheckFatalError(lib.RetrieveAdditionalEntriesFromRemote(ctx))
+		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
+		_, dryRun := extractFlag(os.Args[2:], "--dry-run")
+		matches, err := lib.Reclassify(ctx, dryRun)
+		lib.CheckFatalError(err)
+		for _, entry := range matches {
+			fmt.Println(entry.Command)
+		}
+		if dryRun {
+			fmt.Printf("Would delete %d entries that match the current never-record-programs (re-run without --dry-run to delete them)\n", len(matches))
+		} else {
+			fmt.Printf("Deleted %d entries that match the current never-record-programs\n", len(matches))
+		}
+	case "migrate":
+		lib.CheckFatalError(lib.RunMigrations(hctx.MakeContext(), os.Stdout))
+	case "usage":
+		usage, err := lib.GetUsage(hctx.MakeContext(), 5)
+		lib.CheckFatalError(err)
+		printUsage(usage)
+	case "stats":
+		ctx := hctx.MakeContext()
+		stats, err := lib.GetStats(ctx, strings.Join(os.Args[2:], " "))
+		lib.CheckFatalError(err)
+		fmt.Print(lib.FormatStats(ctx, stats))
+	case "trust-dir":
+		dir := "."
+		if len(os.Args) > 2 {
+			dir = os.Args[2]
+		}
+		lib.CheckFatalError(lib.TrustDirectory(hctx.MakeContext(), dir))
 	case "reupload":
 		// Purposefully undocumented since this command is generally not necessary to run
 		lib.CheckFatalError(lib.Reupload(hctx.MakeContext()))
@@ -272,11 +807,26 @@ Supported commands:
     'hishtory query': Query for matching commands and display them in a table. Examples:
 		'hishtory query apt-get'  			# Find shell commands containing 'apt-get'
 		'hishtory query apt-get install'  	# Find shell commands containing 'apt-get' and 'install'
+		'hishtory query git OR docker'		# Find shell commands containing 'git' or 'docker'
+		'hishtory query git NOT push'		# Find shell commands containing 'git' but not 'push' (equivalent to 'git -push')
 		'hishtory query curl cwd:/tmp/'  	# Find shell commands containing 'curl' run in '/tmp/'
+		'hishtory query make cwd:.'		# Find shell commands containing 'make' run in the current directory
 		'hishtory query curl user:david'	# Find shell commands containing 'curl' run by 'david'
 		'hishtory query curl host:x1'		# Find shell commands containing 'curl' run on 'x1'
 		'hishtory query exit_code:1'		# Find shell commands that exited with status code 1
+		'hishtory query git failed:true'	# Find shell commands containing 'git' that exited with a non-zero status code
+		'hishtory query program:git'		# Find shell commands that ran 'git'
+		'hishtory query re:"git (push|pull)"'	# Find shell commands matching the regex 'git (push|pull)'
+		'hishtory query count:>5'		# Find shell commands that have been run more than 5 times
+		'hishtory query pane:current'		# Find shell commands run in the current tmux pane or screen window
+		'hishtory query expanded:ls'		# Find shell commands that ran 'ls' after expanding aliases
+		'hishtory query tag:k8s'		# Find shell commands tagged with 'k8s' by an auto-tag rule
 		'hishtory query before:2022-02-01'	# Find shell commands run before 2022-02-01
+		'hishtory query docker after:2h'	# Find shell commands containing 'docker' run in the last 2 hours
+		'hishtory query --reverse ls'		# Find shell commands containing 'ls', sorted oldest-first
+		'hishtory query --show-sensitive ls'	# Find shell commands containing 'ls', including ones marked as sensitive
+		'hishtory query --filter deploys'	# Find shell commands matching the saved filter named 'deploys' (also supported by 'hishtory tquery')
+		'hishtory query --json --limit 10 git'	# Output the 10 most recent shell commands containing 'git' as JSON, one object per line
 	'hishtory export': Query for matching commands and display them in list without any other 
 		metadata. Supports the same query format as 'hishtory query'. 
 	'hishtory redact': Query for matching commands and remove them from your shell history (on the
@@ -288,7 +838,27 @@ Supported commands:
 		history from another machine. 
 	'hishtory init': Set the secret key to enable syncing shell commands from another 
 		machine with a matching secret key. 
+	'hishtory key-rotate': Generate a new secret key (e.g. if your existing key was compromised) and reupload your
+		history encrypted with it.
 	'hishtory config-get', 'hishtory config-set', 'hishtory config-add', 'hishtory config-delete': Edit the config. See the README for details on each of the config options.
+	'hishtory test-pattern': Show the existing history entries that would be affected by adding the given program to
+		never-record-programs or hidden-programs.
+	'hishtory reclassify': Delete existing history entries (on all of your devices) that match the current
+		never-record-programs. Pass --dry-run to just list the entries that would be deleted.
+	'hishtory trust-dir': Trust the .hishtory.toml file in the given directory (defaults to the current directory).
+	'hishtory migrate': Apply one-time migrations to your existing history (e.g. computing normalized paths after enabling
+		normalize-paths). Progress is saved as it runs, so it can be safely interrupted and re-run.
+	'hishtory usage': Show how the space in the local DB is used (e.g. by commands vs metadata, and by host).
+	'hishtory stats': Show your most used programs, your busiest directories, how many commands you ran per day, and
+		how many of them failed. Accepts the same search format as 'hishtory query' (e.g. 'hishtory stats after:2023-01-01').
+	'hishtory dirs': Pick one of the directories you recently ran commands in (ranked by how often and how recently you
+		used them) and output a cd command for it. Use it via e.g. alias j='eval "$(hishtory dirs)"'.
+	'hishtory replay': Step through the commands from a past shell session in order (via --session <id>, where the ID
+		is shown in the Session column, or --session current), confirming each one before it is run. Pass --print to
+		just print the commands instead.
+	'hishtory config-export', 'hishtory config-import': Export your settings (to stdout, or to the given path) so that they
+		can be imported on another machine. Device-specific settings like the secret key aren't included.
+	'hishtory config-validate': Check the config for errors (e.g. unknown columns) without running anything else.
 	'hishtory uninstall': Permanently uninstall hishtory
 	'hishtory help': View this help page
 		`)
@@ -297,6 +867,107 @@ Supported commands:
 	}
 }
 
+// Removes the given flag from args (if present) and returns whether it was present
+func extractFlag(args []string, flag string) ([]string, bool) {
+	ret := make([]string, 0)
+	found := false
+	for _, arg := range args {
+		if arg == flag {
+			found = true
+		} else {
+			ret = append(ret, arg)
+		}
+	}
+	return ret, found
+}
+
+// Removes the given flag and its value from the args, returning the value (or an empty string if the flag wasn't passed)
+func extractFlagValue(args []string, flag string) ([]string, string) {
+	ret := make([]string, 0)
+	val := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == flag {
+			if i+1 >= len(args) {
+				log.Fatalf("%s requires a value", flag)
+			}
+			val = args[i+1]
+			i++
+		} else {
+			ret = append(ret, args[i])
+		}
+	}
+	return ret, val
+}
+
+// Handles the --filter flag by prepending the named saved filter's query to the rest of the query
+func applySavedFilter(ctx *context.Context, args []string) []string {
+	args, filterName := extractFlagValue(args, "--filter")
+	if filterName == "" {
+		return args
+	}
+	filterQuery, err := lib.GetSavedFilter(ctx, filterName)
+	lib.CheckFatalError(err)
+	return append([]string{filterQuery}, args...)
+}
+
+func removeAll(vals, toRemove []string) []string {
+	ret := make([]string, 0)
+	for _, v := range vals {
+		isRemoved := false
+		for _, r := range toRemove {
+			if v == r {
+				isRemoved = true
+			}
+		}
+		if !isRemoved {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func containsString(arr []string, s string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func printUsage(usage *lib.Usage) {
+	fmt.Printf("Total entries: %d\n", usage.NumEntries)
+	fmt.Printf("DB file size: %s\n", formatBytes(usage.DbFileBytes))
+	fmt.Println("\nBytes by column:")
+	for _, column := range usage.Columns {
+		fmt.Printf("  %-20s %10s\n", column.Description+":", formatBytes(column.Bytes))
+	}
+	fmt.Println("\nLargest entries:")
+	for _, entry := range usage.LargestEntries {
+		command := runewidth.Truncate(strings.ReplaceAll(entry.Command, "\n", " "), 80, "...")
+		fmt.Printf("  %10s  %s\n", formatBytes(int64(len(entry.Command))), command)
+	}
+	fmt.Println("\nEntries by host:")
+	for _, host := range usage.Hosts {
+		fmt.Printf("  %8d  %s\n", host.Count, host.Hostname)
+	}
+	fmt.Println("\nTo free up space, you can delete entries via `hishtory redact` or `hishtory reclassify`.")
+}
+
+// Formats a number of bytes in a human readable form (e.g. 1.5 MB)
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
 func printDumpStatus(config hctx.ClientConfig) {
 	dumpRequests, err := getDumpRequests(config)
 	lib.CheckFatalError(err)
@@ -323,23 +994,48 @@ func getDumpRequests(config hctx.ClientConfig) ([]*shared.DumpRequest, error) {
 	return dumpRequests, err
 }
 
-func query(ctx *context.Context, query string) {
+func query(ctx *context.Context, query string, opts lib.SearchOptions) {
 	db := hctx.GetDb(ctx)
 	err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
 	if err != nil {
 		if lib.IsOfflineError(err) {
 			fmt.Println("Warning: hishtory is offline so this may be missing recent results from your other machines!")
+		} else if lib.IsAuthError(err) {
+			fmt.Println("Warning: this device isn't registered with the hishtory backend so this may be missing recent results from your other machines (run `hishtory init` to re-register it)!")
 		} else {
 			lib.CheckFatalError(err)
 		}
 	}
 	lib.CheckFatalError(displayBannerIfSet(ctx))
 	numResults := 25
-	data, err := lib.Search(ctx, db, query, numResults*5)
+	data, err := lib.SearchForDisplay(ctx, db, query, numResults*5, opts)
 	lib.CheckFatalError(err)
 	lib.CheckFatalError(lib.DisplayResults(ctx, data, numResults))
 }
 
+func jsonQuery(ctx *context.Context, query, limit string, opts lib.SearchOptions) {
+	numResults := 0
+	if limit != "" {
+		var err error
+		numResults, err = strconv.Atoi(limit)
+		if err != nil || numResults <= 0 {
+			log.Fatalf("--limit must be a positive integer, got %#v", limit)
+		}
+	}
+	err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
+	if err != nil {
+		// Warnings go to stderr so that they don't break parsing the JSON
+		if lib.IsOfflineError(err) {
+			fmt.Fprintln(os.Stderr, "Warning: hishtory is offline so this may be missing recent results from your other machines!")
+		} else if lib.IsAuthError(err) {
+			fmt.Fprintln(os.Stderr, "Warning: this device isn't registered with the hishtory backend so this may be missing recent results from your other machines (run `hishtory init` to re-register it)!")
+		} else {
+			lib.CheckFatalError(err)
+		}
+	}
+	lib.CheckFatalError(lib.JsonQuery(ctx, query, numResults, opts))
+}
+
 func displayBannerIfSet(ctx *context.Context) error {
 	respBody, err := lib.GetBanner(ctx, GitCommit)
 	if lib.IsOfflineError(err) {
@@ -356,6 +1052,10 @@ func displayBannerIfSet(ctx *context.Context) error {
 
 func maybeUploadSkippedHistoryEntries(ctx *context.Context) error {
 	config := hctx.GetConf(ctx)
+	if config.RemoteOnly && !config.IsOffline {
+		// There is no local DB to find the missed entries in, so they were queued on disk instead
+		return lib.UploadPendingEntries(ctx)
+	}
 	if !config.HaveMissedUploads {
 		return nil
 	}
@@ -384,6 +1084,7 @@ func maybeUploadSkippedHistoryEntries(ctx *context.Context) error {
 	// Mark down that we persisted it
 	config.HaveMissedUploads = false
 	config.MissedUploadTimestamp = 0
+	config.HaveSyncedWithBackend = true
 	err = hctx.SetConfig(config)
 	if err != nil {
 		return fmt.Errorf("failed to mark a history entry as uploaded: %v", err)
@@ -417,7 +1118,10 @@ func saveHistoryEntry(ctx *context.Context) {
 		if err != nil {
 			if lib.IsOfflineError(err) {
 				hctx.GetLogger().Infof("Failed to remotely persist hishtory entry because we failed to connect to the remote server! This is likely because the device is offline, but also could be because the remote server is having reliability issues. Original error: %v", err)
-				if !config.HaveMissedUploads {
+				if config.RemoteOnly {
+					// The entry is only in the in-memory DB, so it would be lost if it wasn't queued for later
+					lib.CheckFatalError(lib.QueuePendingUpload(ctx, jsonValue))
+				} else if !config.HaveMissedUploads {
 					config.HaveMissedUploads = true
 					config.MissedUploadTimestamp = time.Now().Unix()
 					lib.CheckFatalError(hctx.SetConfig(config))
@@ -425,6 +1129,10 @@ func saveHistoryEntry(ctx *context.Context) {
 			} else {
 				lib.CheckFatalError(err)
 			}
+		} else if !config.HaveSyncedWithBackend {
+			// Record that this device can sync (see lib.HasNeverSynced)
+			config.HaveSyncedWithBackend = true
+			lib.CheckFatalError(hctx.SetConfig(config))
 		}
 	}
 
@@ -463,21 +1171,21 @@ func saveHistoryEntry(ctx *context.Context) {
 	lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
 }
 
-func export(ctx *context.Context, query string) {
+func export(ctx *context.Context, query string, opts lib.SearchOptions) {
 	db := hctx.GetDb(ctx)
 	err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
 	if err != nil {
 		if lib.IsOfflineError(err) {
 			fmt.Println("Warning: hishtory is offline so this may be missing recent results from your other machines!")
+		} else if lib.IsAuthError(err) {
+			fmt.Println("Warning: this device isn't registered with the hishtory backend so this may be missing recent results from your other machines (run `hishtory init` to re-register it)!")
 		} else {
 			lib.CheckFatalError(err)
 		}
 	}
-	data, err := lib.Search(ctx, db, query, 0)
+	data, err := lib.SearchForDisplay(ctx, db, query, 0, opts)
 	lib.CheckFatalError(err)
 	for i := len(data) - 1; i >= 0; i-- {
 		fmt.Println(data[i].Command)
 	}
 }
-
-// TODO(feature): Add a session_id column that corresponds to the shell session the command was run in
@@ -57,6 +57,7 @@ func BackupAndRestoreWithId(t *testing.T, id string) func() {
 		path.Join(homedir, data.HISHTORY_PATH, DB_WAL_PATH),
 		path.Join(homedir, data.HISHTORY_PATH, DB_SHM_PATH),
 		path.Join(homedir, data.HISHTORY_PATH, data.CONFIG_PATH),
+		path.Join(homedir, data.HISHTORY_PATH, data.PENDING_UPLOADS_PATH),
 		path.Join(homedir, data.HISHTORY_PATH, "hishtory"),
 		path.Join(homedir, data.HISHTORY_PATH, "config.sh"),
 		path.Join(homedir, data.HISHTORY_PATH, "config.zsh"),